@@ -4,6 +4,8 @@ import (
 	"log"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/costinm/dmesh-l2/pkg/l2"
 	"github.com/costinm/ugate/pkg/uds"
@@ -32,6 +34,13 @@ func main() {
 
 	l2main := l2.NewL2(mux)
 
+	// Record all frames sent and received to pcapng files in the dir.
+	if dir := os.Getenv("DM_PCAP"); dir != "" {
+		if err := l2main.StartRecording(dir); err != nil {
+			log.Println("PCAP: ", err)
+		}
+	}
+
 	// Used to communicate with wpa_supplicant, if any
 	wpaDir := os.Getenv("WPA_DIR")
 	if wpaDir == "" {
@@ -51,12 +60,26 @@ func main() {
 		log.Println("BLE: ", err)
 	}
 
+	// Decode a capture instead of using the radio - for debugging interop
+	// with a pcap from a monitor interface.
+	if f := os.Getenv("NAN_REPLAY"); f != "" {
+		if err := l2main.ReplayMon(f, nil); err != nil {
+			log.Fatal(err)
+		}
+		select {}
+	}
+
 	// Low level Wifi - NAN
 	err = l2main.InitWifi()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Without wpa_supplicant, scan with nl80211.
+	if wpa == nil {
+		mux.AddHandler("wifi", l2main.ScanHandler())
+	}
+
 	// TODO: reset the iptables capture on exit
 	// TODO: setup iptables capture
 
@@ -71,6 +94,12 @@ func main() {
 	//	// Insecure - debug only
 	//	http.ListenAndServe(os.Getenv("MSG_ADDR"), msgs.DefaultMux.Gate.Mux.ServeMux)
 	//} else {
-	select {}
+	// Remove the monitor and other interfaces created by dmesh.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	if err := l2main.Close(); err != nil {
+		log.Println("Close: ", err)
+	}
 	//}
 }
@@ -20,6 +20,7 @@ require (
 	github.com/mdlayher/genetlink v1.0.0
 	github.com/mdlayher/netlink v1.1.0
 	golang.org/x/net v0.0.0-20211014172544-2b766c08f1c0
+	golang.org/x/sys v0.0.0-20210423082822-04245dca01da
 )
 
 require (
@@ -30,5 +31,4 @@ require (
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
 	github.com/mgutz/logxi v0.0.0-20161027140823-aebf8a7d67ab // indirect
 	github.com/pkg/errors v0.8.1 // indirect
-	golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
 )
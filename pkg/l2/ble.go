@@ -23,7 +23,7 @@ import (
 // When running on Android, the BLE is implemented by the Android process using the core libraries -
 // this is used on linux hosts.
 type BLE struct {
-	device *linux.Device
+	device ble.Device
 	nodes  map[string]*BLENode
 	mutex  sync.Mutex
 	l2     *L2
@@ -75,7 +75,7 @@ func (b *BLE) maybeConnect(n *BLENode) error {
 	}
 
 	tc := time.Now()
-	cl, err := ble.Dial(context.Background(), n.Addr)
+	cl, err := b.device.Dial(context.Background(), n.Addr)
 	if err != nil {
 		return err
 	}
@@ -198,15 +198,21 @@ func (l2 *L2) InitBLE() (*BLE, error) {
 	if err != nil {
 		return nil, err
 	}
+	ble.SetDefaultDevice(d)
+
+	return NewBLE(l2, d), nil
+}
+
+// NewBLE uses the device for scanning and connecting to the peers - a
+// simulated device in tests.
+func NewBLE(l2 *L2, d ble.Device) *BLE {
 	b := &BLE{
 		device: d,
+		l2:     l2,
 		mux:    l2.mux,
 	}
 	b.nodes = map[string]*BLENode{}
-
-	ble.SetDefaultDevice(d)
-
-	return b, nil
+	return b
 }
 
 func (b *BLE) CleanOlder(d time.Duration) {
@@ -235,8 +241,11 @@ func (b *BLE) Scan(d time.Duration) error {
 
 	fnd := 0
 	c, _ := context.WithTimeout(context.Background(), d)
-	err := ble.Scan(c, false, /*dup*/
+	err := b.device.Scan(c, false, /*dup*/
 		func(a ble.Advertisement) {
+			if !dmeshAdv(a) {
+				return
+			}
 			b.mutex.Lock()
 			fnd++
 			// TODO: cleanup old
@@ -257,20 +266,6 @@ func (b *BLE) Scan(d time.Duration) error {
 			}
 			b.mutex.Unlock()
 			n.Last = time.Now()
-		}, func(a ble.Advertisement) bool {
-			svcs := a.Services()
-			if len(svcs) != 1 || !svcs[0].Equal(EDDYSTONE16) {
-				return false
-			}
-
-			if !a.Connectable() {
-				return false
-			}
-			sd := a.ServiceData()
-			if len(sd) != 1 {
-				return false
-			}
-			return true
 		})
 
 	if err != nil && err != context.DeadlineExceeded {
@@ -283,3 +278,21 @@ func (b *BLE) Scan(d time.Duration) error {
 
 	return nil
 }
+
+// dmeshAdv returns true for the connectable Eddystone advertisements of the
+// DMesh nodes.
+func dmeshAdv(a ble.Advertisement) bool {
+	svcs := a.Services()
+	if len(svcs) != 1 || !svcs[0].Equal(EDDYSTONE16) {
+		return false
+	}
+
+	if !a.Connectable() {
+		return false
+	}
+	sd := a.ServiceData()
+	if len(sd) != 1 {
+		return false
+	}
+	return true
+}
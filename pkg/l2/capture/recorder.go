@@ -0,0 +1,310 @@
+// Package capture records frames sent and received by dmesh to pcapng
+// files, for debugging interop with wireshark.
+//
+// Each interface and direction is a separate pcapng interface, and frames
+// have the direction flag and an optional comment - for example the TX
+// status. All frames have radiotap headers - one is added for frames sent
+// or received with nl80211, which have no radiotap.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Direction of a recorded frame.
+type Direction int
+
+const (
+	In  Direction = 1
+	Out Direction = 2
+)
+
+func (d Direction) String() string {
+	if d == Out {
+		return "tx"
+	}
+	return "rx"
+}
+
+const (
+	blockSHB = 0x0A0D0D0A
+	blockIDB = 1
+	blockEPB = 6
+
+	optEnd     = 0
+	optComment = 1
+	optIfName  = 2
+	optFlags   = 2
+
+	linkTypeRadiotap = 127
+)
+
+// Recorder writes frames to pcapng files in Dir, rotating when the file
+// reaches MaxSize or MaxAge. Methods can be called on a nil or stopped
+// Recorder - frames are ignored.
+type Recorder struct {
+	// Dir is the directory for the capture files.
+	Dir string
+
+	// Prefix of the file names, followed by the start time.
+	Prefix string
+
+	MaxSize int64
+	MaxAge  time.Duration
+
+	// MaxFiles is the number of files to keep - older files are removed.
+	MaxFiles int
+
+	m      sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	name   string
+	size   int64
+	opened time.Time
+	ifaces map[string]uint32
+
+	// Frames written since Start.
+	frames int
+
+	// seq is added to the file names - rotation may happen in the same ms.
+	seq int
+}
+
+// NewRecorder returns a stopped recorder with the default limits - 16M
+// and 10 minutes per file, 10 files.
+func NewRecorder(dir string) *Recorder {
+	return &Recorder{
+		Dir:      dir,
+		Prefix:   "dmesh",
+		MaxSize:  16 << 20,
+		MaxAge:   10 * time.Minute,
+		MaxFiles: 10,
+	}
+}
+
+// Start opens a new capture file.
+func (r *Recorder) Start() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.f != nil {
+		return nil
+	}
+	r.frames = 0
+	return r.open(time.Now())
+}
+
+// Stop closes the current file.
+func (r *Recorder) Stop() error {
+	if r == nil {
+		return nil
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.close()
+}
+
+// Enabled returns true if frames are recorded.
+func (r *Recorder) Enabled() bool {
+	if r == nil {
+		return false
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.f != nil
+}
+
+// Status returns the current file and number of frames, for the mux.
+func (r *Recorder) Status() map[string]string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return map[string]string{
+		"file":   r.name,
+		"frames": fmt.Sprint(r.frames),
+		"size":   fmt.Sprint(r.size),
+	}
+}
+
+func (r *Recorder) close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f = nil
+	r.w = nil
+	return err
+}
+
+func (r *Recorder) open(now time.Time) error {
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return err
+	}
+	r.seq++
+	name := filepath.Join(r.Dir, fmt.Sprintf("%s-%s-%04d.pcapng", r.Prefix,
+		now.Format("20060102-150405.000"), r.seq%10000))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	r.w = bufio.NewWriter(f)
+	r.name = name
+	r.size = 0
+	r.opened = now
+	r.ifaces = map[string]uint32{}
+
+	r.writeSHB()
+	r.removeOld()
+	return nil
+}
+
+// removeOld keeps the newest MaxFiles captures.
+func (r *Recorder) removeOld() {
+	if r.MaxFiles <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(r.Dir, r.Prefix+"-*.pcapng"))
+	if err != nil {
+		return
+	}
+	// Names sort by start time
+	sort.Strings(files)
+	for len(files) > r.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			log.Println("PCAP: remove", files[0], err)
+		}
+		files = files[1:]
+	}
+}
+
+// Record writes a 802.11 frame without radiotap header - a header with
+// the frequency and signal is added. signal is ignored if 0.
+func (r *Recorder) Record(iface string, dir Direction, freq, signal int, frame []byte,
+	ts time.Time, comment string) {
+	if !r.Enabled() {
+		return
+	}
+	b := make([]byte, 0, 13+len(frame))
+	b = append(b, 0, 0, 0, 0)
+	present := uint32(1 << 3) // channel
+	if signal != 0 {
+		present |= 1 << 5 // dBm antenna signal
+	}
+	b = binary.LittleEndian.AppendUint32(b, present)
+	b = binary.LittleEndian.AppendUint16(b, uint16(freq))
+	flags := uint16(0x0080) // 2GHz
+	if freq > 3000 {
+		flags = 0x0100 // 5GHz
+	}
+	b = binary.LittleEndian.AppendUint16(b, flags)
+	if signal != 0 {
+		b = append(b, byte(int8(signal)))
+	}
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(b)))
+	b = append(b, frame...)
+	r.RecordRadiotap(iface, dir, b, ts, comment)
+}
+
+// RecordRadiotap writes a frame starting with a radiotap header.
+func (r *Recorder) RecordRadiotap(iface string, dir Direction, data []byte,
+	ts time.Time, comment string) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.f == nil {
+		return
+	}
+	// Frame timestamps may be from a replayed capture, rotation uses the
+	// local time.
+	now := time.Now()
+	if (r.MaxSize > 0 && r.size >= r.MaxSize) ||
+		(r.MaxAge > 0 && now.Sub(r.opened) >= r.MaxAge) {
+		r.close()
+		if err := r.open(now); err != nil {
+			log.Println("PCAP: rotate", err)
+			return
+		}
+	}
+
+	key := iface + " " + dir.String()
+	id, ok := r.ifaces[key]
+	if !ok {
+		id = uint32(len(r.ifaces))
+		r.ifaces[key] = id
+		r.writeIDB(key)
+	}
+	r.writeEPB(id, dir, data, ts, comment)
+	r.frames++
+}
+
+// block writes a pcapng block with the body.
+func (r *Recorder) block(t uint32, body []byte) {
+	l := uint32(12 + len(body))
+	var h [8]byte
+	binary.LittleEndian.PutUint32(h[0:], t)
+	binary.LittleEndian.PutUint32(h[4:], l)
+	r.w.Write(h[:])
+	r.w.Write(body)
+	r.w.Write(h[4:])
+	r.size += int64(l)
+}
+
+func appendOption(b []byte, code uint16, v []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(v)))
+	b = append(b, v...)
+	for len(v)%4 != 0 {
+		b = append(b, 0)
+		v = append(v, 0)
+	}
+	return b
+}
+
+func (r *Recorder) writeSHB() {
+	b := binary.LittleEndian.AppendUint32(nil, 0x1A2B3C4D)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, 0xFFFFFFFFFFFFFFFF) // unknown length
+	r.block(blockSHB, b)
+}
+
+func (r *Recorder) writeIDB(name string) {
+	b := binary.LittleEndian.AppendUint16(nil, linkTypeRadiotap)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0) // no snap length
+	b = appendOption(b, optIfName, []byte(name))
+	b = appendOption(b, optEnd, nil)
+	r.block(blockIDB, b)
+}
+
+func (r *Recorder) writeEPB(id uint32, dir Direction, data []byte, ts time.Time, comment string) {
+	us := uint64(ts.UnixNano() / 1000)
+	b := make([]byte, 0, 20+len(data)+len(comment)+24)
+	b = binary.LittleEndian.AppendUint32(b, id)
+	b = binary.LittleEndian.AppendUint32(b, uint32(us>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(us))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	b = appendOption(b, optFlags, binary.LittleEndian.AppendUint32(nil, uint32(dir)))
+	if comment != "" {
+		b = appendOption(b, optComment, []byte(comment))
+	}
+	b = appendOption(b, optEnd, nil)
+	r.block(blockEPB, b)
+}
@@ -0,0 +1,112 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// readFile returns the frames and interface names in a capture.
+func readFile(t *testing.T, name string) ([][]byte, []string) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeIEEE80211Radio {
+		t.Fatal("Expecting radiotap", r.LinkType())
+	}
+	var frames [][]byte
+	for {
+		d, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, d)
+	}
+	var names []string
+	for i := 0; i < r.NInterfaces(); i++ {
+		ifi, _ := r.Interface(i)
+		names = append(names, ifi.Name)
+	}
+	return frames, names
+}
+
+func TestRecorder(t *testing.T) {
+	var nilr *Recorder
+	nilr.Record("wlan0", In, 2437, 0, []byte{1}, time.Now(), "")
+
+	dir := t.TempDir()
+	r := NewRecorder(dir)
+	r.MaxFiles = 2
+
+	frame := []byte{0xD0, 0, 0, 0, 1, 2, 3, 4, 5, 6}
+	ts := time.Now()
+	// Not started
+	r.Record("wlan0", Out, 2437, 0, frame, ts, "")
+
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.Record("wlan0", Out, 2437, 0, frame, ts, "status=acked")
+	r.Record("wlan0", In, 2437, -50, frame, ts, "")
+	r.RecordRadiotap("mon0", In, append([]byte{0, 0, 8, 0, 0, 0, 0, 0}, frame...), ts, "")
+	first := r.Status()["file"]
+
+	// Rotate by age
+	r.MaxAge = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	r.Record("wlan0", In, 5180, -60, frame, ts, "")
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, names := readFile(t, first)
+	if len(frames) != 3 {
+		t.Fatal("Expecting 3 frames", len(frames))
+	}
+	if len(names) != 3 || names[0] != "wlan0 tx" || names[1] != "wlan0 rx" || names[2] != "mon0 rx" {
+		t.Error("Unexpected interfaces", names)
+	}
+	for _, d := range frames {
+		if !bytes.HasSuffix(d, frame) {
+			t.Error("Frame not recorded", d)
+		}
+	}
+	// Channel and signal radiotap
+	if len(frames[1]) != 13+len(frame) || int8(frames[1][12]) != -50 {
+		t.Error("Unexpected radiotap", frames[1])
+	}
+
+	// Rotate by size, keeping MaxFiles
+	r.MaxSize = 200
+	r.MaxAge = 0
+	r.Start()
+	for i := 0; i < 20; i++ {
+		r.Record("wlan0", In, 2437, 0, frame, ts.Add(time.Duration(i)*time.Millisecond), "")
+	}
+	r.Stop()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(files) != 2 {
+		t.Fatal("Expecting 2 files", files)
+	}
+	for _, f := range files {
+		frames, _ := readFile(t, f)
+		if len(frames) == 0 {
+			t.Error("Empty capture", f)
+		}
+	}
+}
@@ -3,9 +3,12 @@ package l2
 import (
 	"sync"
 
+	"github.com/costinm/dmesh-l2/pkg/l2/capture"
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
 	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
 	"github.com/costinm/dmesh-l2/pkg/l2api"
 	msgs "github.com/costinm/ugate/webpush"
+	"github.com/google/gopacket"
 )
 
 type L2 struct {
@@ -26,6 +29,38 @@ type L2 struct {
 	// Monitor interfaces
 	physMon     map[int]*wifi.Interface
 	netLinkWifi *wifi.Client
+
+	// Capabilities of each phy, by phy index - set by InitWifi.
+	phys map[int]*wifi.Phy
+
+	// NAN state for each active interface.
+	nans []*wifi.Nan
+
+	// Driver NAN, for phys with NAN offload - instead of nans.
+	nanOffloads []*wifi.NanOffload
+
+	// NAN data interfaces, one for each NAN interface with data path support.
+	ndis []*nanNDI
+
+	// Stats of the devices connected to the AP, GO and mesh interfaces.
+	stations *wifi.StationWatcher
+
+	// 802.11s mesh interface, after JoinMesh.
+	mesh *wifi.Interface
+
+	// Connection state events sent as /net/status, after ScanHandler.
+	connStatus *wifi.Subscription
+
+	// NAN services, shared by all interfaces.
+	nanServices *nan.Services
+
+	// Recorder saves sent and received frames to pcapng, when started.
+	Recorder *capture.Recorder
+
+	// MonSource opens the frames of a monitor interface, instead of a
+	// packet socket on the netdev. Used with the simulated radios, which
+	// have no netdev. The NAN BPF filter is applied to the source.
+	MonSource func(mon *wifi.Interface) (gopacket.PacketDataSource, error)
 }
 
 func NewL2(mux *msgs.Mux) *L2 {
@@ -33,6 +68,17 @@ func NewL2(mux *msgs.Mux) *L2 {
 		devByL2Id:   map[uint64]*l2api.MeshDevice{},
 		devByMeshId: map[uint64]*l2api.MeshDevice{},
 		mux:         mux,
+		nanServices: nan.NewServices(),
+		Recorder:    capture.NewRecorder(defaultPcapDir),
+	}
+	if mux != nil {
+		mux.AddHandler("pcap", pcapHandler{l2: l2})
 	}
 	return l2
 }
+
+// NanServices returns the registry of NAN services. Apps can publish and
+// subscribe to services, sharing the NAN radio.
+func (l2 *L2) NanServices() *nan.Services {
+	return l2.nanServices
+}
@@ -0,0 +1,225 @@
+package l2
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/costinm/dmesh-l2/pkg/l2api"
+	msgs "github.com/costinm/ugate/webpush"
+)
+
+// 802.11s mesh, for Linux routers - a multi-hop backbone alongside the P2P
+// and NAN links to phones. The kernel does the peering and the path
+// selection, the mesh interface is a regular netdev - used for mux traffic
+// with the IPv6 link local addresses, like the NAN NDI.
+//
+// MESH_ID joins the mesh at startup, on the first phy that supports mesh
+// point, on MESH_FREQ - default the NAN channel, so a single channel radio
+// can run both. The "wifi" handler also accepts:
+//
+// /wifi/mesh/join/MESHID - optional meta "freq"
+// /wifi/mesh/leave
+//
+// And sends:
+//
+// /wifi/mesh - iface, id, freq, addr when joined. Only iface when left.
+// /wifi/mesh/path - device JSON with Mesh set, dest, via, metric. gone=1
+//   if the path was removed.
+//
+// The mesh peers are sent as /wifi/sta, with the peer link state.
+
+const meshName = "dmmesh0"
+
+var errNoMeshPhy = errors.New("no phy supports mesh point")
+
+// startMesh joins the mesh in MESH_ID, if set.
+func (l2 *L2) startMesh() {
+	id := os.Getenv("MESH_ID")
+	if id == "" {
+		return
+	}
+	freq := wifi.NANFreq
+	if f, err := strconv.Atoi(os.Getenv("MESH_FREQ")); err == nil {
+		freq = f
+	}
+	if err := l2.JoinMesh(id, freq); err != nil {
+		log.Println("MESH: join", id, err)
+	}
+}
+
+// JoinMesh creates the mesh interface if needed, and joins the mesh. A
+// mesh joined before is left.
+func (l2 *L2) JoinMesh(id string, freq int) error {
+	client := l2.netLinkWifi
+	if client == nil {
+		return errNoWifi
+	}
+	l2.m.Lock()
+	ifi := l2.mesh
+	l2.m.Unlock()
+	if ifi == nil {
+		var err error
+		if ifi, err = l2.createMesh(); err != nil {
+			return err
+		}
+	} else if err := l2.LeaveMesh(); err != nil {
+		log.Println("MESH: leave", err)
+	}
+
+	cfg := wifi.MeshConfig{MeshID: id,
+		ChannelConfig: wifi.ChannelConfig{Freq: freq, Width: wifi.Width20}}
+	if err := client.JoinMesh(ifi, cfg); err != nil {
+		return err
+	}
+	l2.m.Lock()
+	stations := l2.stations
+	l2.m.Unlock()
+	if stations != nil {
+		stations.Add(ifi)
+	}
+	if l2.mux != nil {
+		l2.mux.SendMessage(msgs.NewMessage("/wifi/mesh", map[string]string{
+			"iface": ifi.Name,
+			"id":    id,
+			"freq":  strconv.Itoa(freq),
+			"addr":  ifi.HardwareAddr.String(),
+		}))
+	}
+	return nil
+}
+
+// createMesh creates the mesh interface on the first phy that supports
+// it, and brings it up. An interface left from a previous run is used.
+func (l2 *L2) createMesh() (*wifi.Interface, error) {
+	client := l2.netLinkWifi
+	var ifi *wifi.Interface
+	phy := -1
+	l2.m.Lock()
+	for _, a := range l2.actWifi {
+		if a.Name == meshName && a.Type == wifi.InterfaceTypeMeshPoint {
+			ifi = a
+		}
+	}
+	for id, p := range l2.phys {
+		if p.SupportsType(wifi.InterfaceTypeMeshPoint) && (phy < 0 || id < phy) {
+			phy = id
+		}
+	}
+	l2.m.Unlock()
+
+	created := ifi == nil
+	if created {
+		if phy < 0 {
+			return nil, errNoMeshPhy
+		}
+		var err error
+		ifi, err = client.CreateInterface(wifi.InterfaceConfig{Name: meshName, PHY: phy,
+			Type: wifi.InterfaceTypeMeshPoint})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The mesh can only be joined when the interface is up.
+	if err := client.SetLinkUp(ifi, true); err != nil {
+		if created {
+			client.DeleteInterface(ifi)
+		}
+		return nil, err
+	}
+	if nifi, err := net.InterfaceByIndex(ifi.Index); err == nil && ifi.HardwareAddr == nil {
+		ifi.HardwareAddr = nifi.HardwareAddr
+	}
+	l2.m.Lock()
+	l2.mesh = ifi
+	l2.m.Unlock()
+	return ifi, nil
+}
+
+// LeaveMesh leaves the mesh. The interface is kept, for joining again.
+func (l2 *L2) LeaveMesh() error {
+	l2.m.Lock()
+	ifi := l2.mesh
+	stations := l2.stations
+	l2.m.Unlock()
+	if ifi == nil || l2.netLinkWifi == nil {
+		return nil
+	}
+	if stations != nil {
+		stations.Remove(ifi.Index)
+	}
+	if err := l2.netLinkWifi.LeaveMesh(ifi); err != nil {
+		return err
+	}
+	if l2.mux != nil {
+		l2.mux.SendMessage(msgs.NewMessage("/wifi/mesh", map[string]string{
+			"iface": ifi.Name,
+		}))
+	}
+	return nil
+}
+
+func (l2 *L2) handleMesh(parts []string, meta map[string]string) {
+	if len(parts) < 4 {
+		return
+	}
+	switch parts[3] {
+	case "join":
+		if len(parts) < 5 {
+			return
+		}
+		freq := wifi.NANFreq
+		if f, err := strconv.Atoi(meta["freq"]); err == nil {
+			freq = f
+		}
+		go func() {
+			if err := l2.JoinMesh(parts[4], freq); err != nil {
+				log.Println("MESH: join", parts[4], err)
+			}
+		}()
+	case "leave":
+		if err := l2.LeaveMesh(); err != nil {
+			log.Println("MESH: leave", err)
+		}
+	}
+}
+
+// onMeshPath updates the route of the mesh node, and sends it to the mux.
+// Nodes more than one hop away are only known from the path.
+func (l2 *L2) onMeshPath(e *wifi.MeshPathChanged) {
+	l2.m.Lock()
+	key := Uint64(e.Path.Dest)
+	node := l2.devByL2Id[key]
+	if node == nil {
+		if e.Removed {
+			l2.m.Unlock()
+			return
+		}
+		node = &l2api.MeshDevice{MAC: e.Path.Dest.String()}
+		l2.devByL2Id[key] = node
+	}
+	meta := map[string]string{
+		"dest": e.Path.Dest.String(),
+	}
+	if e.Removed {
+		node.Mesh = nil
+		meta["gone"] = "1"
+	} else {
+		node.Mesh = &l2api.MeshRoute{
+			Iface:  ifName(e.Ifindex),
+			Via:    e.Path.NextHop.String(),
+			Metric: e.Path.Metric,
+		}
+		meta["via"] = node.Mesh.Via
+		meta["metric"] = strconv.Itoa(e.Path.Metric)
+	}
+	js := msgs.NewMessage("/wifi/mesh/path", meta).SetDataJSON(node)
+	l2.m.Unlock()
+
+	if l2.mux != nil {
+		l2.mux.SendMessage(js)
+	}
+}
@@ -0,0 +1,36 @@
+package l2
+
+import (
+	"net"
+	"testing"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+)
+
+func TestOnMeshPath(t *testing.T) {
+	l := NewL2(nil)
+	peer := net.HardwareAddr{0x2a, 0, 0, 0, 0, 5}
+	far := net.HardwareAddr{0x2a, 0, 0, 0, 0, 6}
+
+	// Node 2 hops away, only known from the path
+	l.onMeshPath(&wifi.MeshPathChanged{Path: wifi.MeshPath{Dest: far, NextHop: peer, Metric: 400}})
+	node := l.devByL2Id[Uint64(far)]
+	if node == nil || node.Mesh == nil || node.Mesh.Via != peer.String() || node.Mesh.Metric != 400 {
+		t.Fatal("Unexpected device", node)
+	}
+
+	l.onMeshPath(&wifi.MeshPathChanged{Path: wifi.MeshPath{Dest: far, NextHop: peer}, Removed: true})
+	if node.Mesh != nil {
+		t.Error("Path not removed", node.Mesh)
+	}
+
+	l.onMeshPath(&wifi.MeshPathChanged{Path: wifi.MeshPath{Dest: peer, NextHop: peer}, Removed: true})
+	if l.devByL2Id[Uint64(peer)] != nil {
+		t.Error("Unexpected device")
+	}
+
+	l.onStationStats(&wifi.StationStats{MAC: peer, Mesh: true, PeerLink: wifi.PeerLinkEstab})
+	if node := l.devByL2Id[Uint64(peer)]; node == nil || node.Link.PeerLink != "estab" {
+		t.Error("Unexpected peer", node)
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"time"
 
+	"github.com/costinm/dmesh-l2/pkg/l2/capture"
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
 	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
-	"github.com/costinm/dmesh-l2/pkg/l2api"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 
@@ -85,146 +87,209 @@ func (l2 *L2) InitMon(iface *wifi.Interface) error {
 	//	return err
 	//}
 
-	// pcap depends on "C" pcap.h
-	bpfIns := []bpf.RawInstruction{
-		bpf.RawInstruction{Op: 0x30, K: 3}, // 0: ldb [3]
-		bpf.RawInstruction{Op: 0x64, K: 8}, // 1: lsh #8
-		bpf.RawInstruction{Op: 0x07},       // 2: tax
-		bpf.RawInstruction{Op: 0x30, K: 2}, // 3: ldb [2]
-		bpf.RawInstruction{Op: 0x4C, K: 2}, // 4: or x // header len in A
-		bpf.RawInstruction{Op: 0x07},       // 5: tax
-
-		bpf.RawInstruction{Op: 0x40, K: 16},                       // 6: ld [x+4+6+6] // BSSID first word
-		bpf.RawInstruction{Op: 0x15, Jt: 0, Jf: 1, K: 0x506F9A01}, // 7: jeq # jt 8 jf 9
-
-		bpf.RawInstruction{Op: 6, K: 0x00040000}, // ret true
-
-		bpf.RawInstruction{Op: 6, K: 0}, // ret false
+	if l2.MonSource != nil {
+		src, err := l2.MonSource(iface)
+		if err != nil {
+			return err
+		}
+		fsrc, err := newFilterSource(src, nanBPF)
+		if err != nil {
+			return err
+		}
+		return l2.RunMon(fsrc, iface)
 	}
 
-	eh,err  := pcapgo.NewEthernetHandle(iface.Name)
+	eh, err := pcapgo.NewEthernetHandle(iface.Name)
 	if err != nil {
-		log.Println("Failed to set BPF", err)
+		log.Println("Failed to open monitor", err)
 		return err
 	}
-	err = eh.SetBPF(bpfIns)
+	err = eh.SetBPF(nanBPF)
 	if err != nil {
 		log.Println("Failed to set BPF", err)
 		return err
 	}
 
+	return l2.RunMon(eh, iface)
+}
 
-	//if tp.SetBPF(bpfIns); err != nil {
-	//	log.Println("Failed to set BPF")
-	//	//return err
-	//}
+// RunMon reads radiotap frames from the source and decodes them until the
+// source returns an error - io.EOF for files, which returns nil.
+//
+// mon is the interface the frames are received on - its address is used to
+// skip our own frames, and the PHY to find the NAN interfaces.
+func (l2 *L2) RunMon(src gopacket.PacketDataSource, mon *wifi.Interface) error {
+	for {
+		// 12 bytes header + raw 802.11 packet
+
+		// https://www.kernel.org/doc/Documentation/networking/radiotap-headers.txt
+		//    0x00, 0x00, // <-- radiotap version + pad byte
+		//		0x0b, 0x00, // <- radiotap header length
+		//		0x04, 0x0c, 0x00, 0x00, // <-- bitmap
+		//		0x6c, // <-- rate (in 500kHz units)
+		//		0x0c, //<-- tx power
+		//		0x01 //<-- antenna
+		//
+		d, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		now := ci.Timestamp
+		if now.IsZero() {
+			now = time.Now()
+		}
+		l2.Recorder.RecordRadiotap(mon.Name, capture.In, d, now, "")
+		l2.onMonFrame(mon, d, now)
+	}
+}
+
+// onMonFrame decodes a radiotap frame from the monitor interface, updates
+// the device registry and passes NAN frames to the NAN interfaces.
+func (l2 *L2) onMonFrame(iface *wifi.Interface, d []byte, now time.Time) {
+	//{Contents=[..56..] Payload=[..52..] Version=0 Length=56
+	// Present=2688565295 TSFT=1140624841
+	// Flags= Rate=1 Mb/s
+	// ChannelFrequency=2437 MHz
+	// ChannelFlags=CCK,Ghz2
+	// FHSS=0
+	// DBMAntennaSignal=-26
+	// DBMAntennaNoise=0
+	// LockQuality=0
+	// TxAttenuation=0
+	// DBTxAttenuation=0
+	// DBMTxPower=0
+	// Antenna=0
+	// DBAntennaSignal=0 DBAntennaNoise=0
+	// RxFlags= TxFlags= RtsRetries=0 DataRetries=0
+	// MCS= AMPDUStatus=ref#0 VHT=}
+	// It doesn't seem to get the channel if the packet is going out
+
+	p := gopacket.NewPacket(d, layers.LayerTypeRadioTap, gopacket.Default)
+
+	pls := p.Layers()
+
+	// should be len = 3
+	// layer[1] should be Dot11. Captures may have truncated or invalid
+	// frames.
+	if len(pls) < 2 {
+		return
+	}
+	rtap, ok := pls[0].(*layers.RadioTap)
+	if !ok {
+		return
+	}
+	d11, ok := pls[1].(*layers.Dot11)
+	if !ok {
+		return
+	}
+	//ma := pls[2].(*layers.Dot11MgmtAction)
+
+	if bytes.Equal(d11.Address2, iface.HardwareAddr) {
+		return
+	}
 
-	if true {
-		for {
-			// 12 bytes header + raw 802.11 packet
-
-			// https://www.kernel.org/doc/Documentation/networking/radiotap-headers.txt
-			//    0x00, 0x00, // <-- radiotap version + pad byte
-			//		0x0b, 0x00, // <- radiotap header length
-			//		0x04, 0x0c, 0x00, 0x00, // <-- bitmap
-			//		0x6c, // <-- rate (in 500kHz units)
-			//		0x0c, //<-- tx power
-			//		0x01 //<-- antenna
-			//
-			d, ci, err := eh.ReadPacketData()
+	// Note: the decoded type is data[0]>>2,
+	if d11.Type == layers.Dot11TypeMgmtAction && len(pls) > 2 {
+		d := pls[2].LayerContents()
+		if nan.IsSDF(d) {
+			attrs, err := nan.ParseSDF(d)
 			if err != nil {
-				return err
-			}
-			now := time.Now()
-
-			//{Contents=[..56..] Payload=[..52..] Version=0 Length=56
-			// Present=2688565295 TSFT=1140624841
-			// Flags= Rate=1 Mb/s
-			// ChannelFrequency=2437 MHz
-			// ChannelFlags=CCK,Ghz2
-			// FHSS=0
-			// DBMAntennaSignal=-26
-			// DBMAntennaNoise=0
-			// LockQuality=0
-			// TxAttenuation=0
-			// DBTxAttenuation=0
-			// DBMTxPower=0
-			// Antenna=0
-			// DBAntennaSignal=0 DBAntennaNoise=0
-			// RxFlags= TxFlags= RtsRetries=0 DataRetries=0
-			// MCS= AMPDUStatus=ref#0 VHT=}
-			// It doesn't seem to get the channel if the packet is going out
-
-			p := gopacket.NewPacket(d, layers.LayerTypeRadioTap, gopacket.Default)
-
-			pls := p.Layers()
-			rtap := pls[0].(*layers.RadioTap)
-
-			// should be len = 3
-			// layer[1] should be Dot11
-			dot1l := pls[1]
-			d11 := dot1l.(*layers.Dot11)
-			//ma := pls[2].(*layers.Dot11MgmtAction)
-
-			if bytes.Equal(d11.Address2, iface.HardwareAddr) {
-				continue
+				log.Println(err)
+				log.Println(hex.Dump(d))
+				//log.Println(p.Dump())
+				return
 			}
 
-			// Note: the decoded type is data[0]>>2,
-			if d11.Type == layers.Dot11TypeMgmtAction {
-				d := pls[2].LayerContents()
-				if len(d) > 6 &&
-					d[0] == 4 && // Action
-					d[1] == 9 && // vendor
-					d[2] == 0x50 && d[3] == 0x6F && d[4] == 0x9A && // WifiAll
-					d[5] == 0x13 { // NAN
-
-					ies, err := wifi.ParseATTs(d[6:])
-					if err != nil {
-						log.Println(err)
-						log.Println(pls[2].LayerContents())
-						//log.Println(p.Dump())
-						continue
-					}
-
-					for _, ie := range ies {
-						log.Println("IE:", ie.ID, d11.Address2,
-							now.Unix(), ci.InterfaceIndex, "\n", hex.Dump(ie.Data))
-					}
-
-					continue
-				}
-			} else if d11.Type == layers.Dot11TypeMgmtBeacon {
-				b := pls[2].(*layers.Dot11MgmtBeacon)
-
-				l2.m.Lock()
-
-				key := Uint64(d11.Address2)
-				node := l2.devByL2Id[key]
-				if node == nil {
-					node = &l2api.MeshDevice{}
-					l2.devByL2Id[key] = node
-					log.Println("Beacon:", iface.Name,
-						d11.Address2,
-						b.Interval, b.Timestamp,
-						now.Unix())
-				}
-
-				l2.m.Unlock()
-
-				// Has decoded layers for IE, timestamp, etc
-				continue
+			log.Println("NAN:", d11.Address2, now.Unix(), iface.Name,
+				nan.Dump(attrs))
+
+			rssi := int(rtap.DBMAntennaSignal)
+			l2.onNanSDFDevice(d11.Address2, rssi, int(rtap.ChannelFrequency), now, attrs)
+			l2.onNanSDF(iface.PHY, d11.Address2, rssi, attrs)
+
+			return
+		}
+		if nan.IsNAF(d) {
+			t, attrs, err := nan.ParseNAF(d)
+			if err != nil {
+				log.Println("NAF: ", d11.Address2, err)
+				return
 			}
+			log.Println("NAF:", d11.Address2, t, nan.Dump(attrs))
+			l2.onNanNAF(iface.PHY, d11.Address2, t, attrs)
+			return
+		}
+	} else if d11.Type.MainType() == layers.Dot11TypeData {
+		// NAN data frames use the cluster ID as BSSID
+		if nan.IsClusterID(d11.Address3) {
+			l2.onNanData(iface.PHY, d11)
+		}
+		return
+	} else if d11.Type == layers.Dot11TypeMgmtBeacon && len(pls) > 2 {
+		b, ok := pls[2].(*layers.Dot11MgmtBeacon)
+		if !ok || !nan.IsClusterID(d11.Address3) {
+			return
+		}
+		attrs, err := nan.ParseBeaconIEs(b.Payload)
+		if err != nil {
+			log.Println("Beacon: ", d11.Address2, err)
+			return
+		}
 
-			// AncillaryData typically empty
-			// CaptureLength -
-			log.Println("MON Read", ci.AncillaryData, ci.InterfaceIndex,
-				d11.Address2, rtap)
-			log.Println(p.Dump())
+		l2.m.Lock()
+
+		node, isNew := l2.updateNanDevice(d11.Address2,
+			int(rtap.DBMAntennaSignal), int(rtap.ChannelFrequency), now)
+		node.BSSID = d11.Address3.String()
+		if isNew {
+			log.Println("Beacon:", iface.Name,
+				d11.Address2,
+				b.Interval, b.Timestamp,
+				now.Unix(), nan.Dump(attrs))
 		}
+
+		l2.m.Unlock()
+
+		l2.onNanBeacon(iface.PHY, &nan.Beacon{
+			Src:       d11.Address2,
+			ClusterID: d11.Address3,
+			TSF:       b.Timestamp,
+			Interval:  b.Interval,
+			RSSI:      int(rtap.DBMAntennaSignal),
+			Received:  now,
+			Attrs:     attrs,
+		})
+
+		// Has decoded layers for IE, timestamp, etc
+		return
 	}
 
-	return nil
+	// AncillaryData typically empty
+	// CaptureLength -
+	log.Println("MON Read", iface.Name,
+		d11.Address2, rtap)
+	log.Println(p.Dump())
+}
+
+// nanBPF accepts frames where the BSSID - address 3 - starts with the NAN
+// cluster ID prefix, after the radiotap header.
+var nanBPF = []bpf.RawInstruction{
+	bpf.RawInstruction{Op: 0x30, K: 3}, // 0: ldb [3]
+	bpf.RawInstruction{Op: 0x64, K: 8}, // 1: lsh #8
+	bpf.RawInstruction{Op: 0x07},       // 2: tax
+	bpf.RawInstruction{Op: 0x30, K: 2}, // 3: ldb [2]
+	bpf.RawInstruction{Op: 0x4C, K: 2}, // 4: or x // header len in A
+	bpf.RawInstruction{Op: 0x07},       // 5: tax
+
+	bpf.RawInstruction{Op: 0x40, K: 16},                       // 6: ld [x+4+6+6] // BSSID first word
+	bpf.RawInstruction{Op: 0x15, Jt: 0, Jf: 1, K: 0x506F9A01}, // 7: jeq # jt 8 jf 9
+
+	bpf.RawInstruction{Op: 6, K: 0x00040000}, // ret true
+
+	bpf.RawInstruction{Op: 6, K: 0}, // ret false
 }
 
 func Uint64(b net.HardwareAddr) uint64 {
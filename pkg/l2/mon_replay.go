@@ -0,0 +1,113 @@
+package l2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// Captures of radiotap frames - from tcpdump/wireshark on a monitor
+// interface, or recorded by dmesh - can be replayed through the same
+// decoding as the live monitor. Used to reproduce interop problems with
+// Android and ESP32 without a radio.
+//
+// tcpdump -i mon0 -w nan.pcap "wlan addr3 50:6f:9a:01:00:00 mask ff:ff:ff:ff:00:00"
+
+var errNotRadiotap = errors.New("capture is not radiotap")
+
+// pcapngMagic is the block type of the section header block.
+const pcapngMagic = 0x0A0D0D0A
+
+// OpenCapture returns a packet source for a pcap or pcapng stream of
+// radiotap frames.
+func OpenCapture(r io.Reader) (gopacket.PacketDataSource, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	var lt layers.LinkType
+	var src gopacket.PacketDataSource
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		lt, src = ng.LinkType(), ng
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		lt, src = pr.LinkType(), pr
+	}
+	if lt != layers.LinkTypeIEEE80211Radio {
+		return nil, fmt.Errorf("%w: link type %v", errNotRadiotap, lt)
+	}
+	return src, nil
+}
+
+// filterSource applies the monitor BPF filter to frames from a capture,
+// so replay sees the same frames as the live interface.
+type filterSource struct {
+	src gopacket.PacketDataSource
+	vm  *bpf.VM
+}
+
+func newFilterSource(src gopacket.PacketDataSource, raw []bpf.RawInstruction) (*filterSource, error) {
+	ins, _ := bpf.Disassemble(raw)
+	vm, err := bpf.NewVM(ins)
+	if err != nil {
+		return nil, err
+	}
+	return &filterSource{src: src, vm: vm}, nil
+}
+
+func (f *filterSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		d, ci, err := f.src.ReadPacketData()
+		if err != nil {
+			return d, ci, err
+		}
+		if n, err := f.vm.Run(d); err == nil && n > 0 {
+			return d, ci, nil
+		}
+	}
+}
+
+// ReplayMon decodes the frames in a pcap or pcapng file, updating the
+// device registry and sending the mux events as if received live. Frame
+// timestamps from the capture are used as the receive time.
+//
+// mon is the interface the capture is handled as - nil for a virtual
+// interface not matching any NAN interface.
+func (l2 *L2) ReplayMon(path string, mon *wifi.Interface) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src, err := OpenCapture(f)
+	if err != nil {
+		return err
+	}
+	fsrc, err := newFilterSource(src, nanBPF)
+	if err != nil {
+		return err
+	}
+	if mon == nil {
+		mon = &wifi.Interface{Name: path, PHY: -1}
+	}
+	return l2.RunMon(fsrc, mon)
+}
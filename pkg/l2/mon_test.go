@@ -0,0 +1,128 @@
+package l2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var (
+	replayPeer  = net.HardwareAddr{0x2a, 0, 0, 0, 0, 1}
+	replayOther = net.HardwareAddr{0x2a, 0, 0, 0, 0, 2}
+	replayCID   = net.HardwareAddr{0x50, 0x6f, 0x9a, 0x01, 0x12, 0x34}
+)
+
+// radiotap returns a radiotap header with channel and signal.
+func radiotap(freq uint16, signal int8) []byte {
+	b := []byte{0, 0, 13, 0, 0x28, 0, 0, 0}
+	b = binary.LittleEndian.AppendUint16(b, freq)
+	b = binary.LittleEndian.AppendUint16(b, 0x00a0)
+	return append(b, byte(signal))
+}
+
+func mgmtFrame(typ byte, dst, src, bssid net.HardwareAddr) []byte {
+	b := []byte{typ, 0, 0, 0}
+	b = append(b, dst...)
+	b = append(b, src...)
+	b = append(b, bssid...)
+	return append(b, 0, 0)
+}
+
+// replayFrames returns a NAN beacon and dmesh publish from the peer, and
+// an AP beacon that is filtered.
+func replayFrames() [][]byte {
+	bcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	beacon := append(radiotap(2437, -40), mgmtFrame(0x80, bcast, replayPeer, replayCID)...)
+	beacon = binary.LittleEndian.AppendUint64(beacon, 1000)
+	beacon = append(beacon, 0, 2, 0x20, 0x04)
+	beacon, _ = nan.AppendBeaconIE(beacon, &nan.MasterIndication{Preference: 1},
+		&nan.Cluster{AnchorMaster: nan.NewMasterRank(1, 2, replayPeer)})
+
+	txt := []byte("\x08s=DIRECT\x06p=pass\x06i=abcd")
+	sdf := append(radiotap(2437, -45), mgmtFrame(0xD0, nan.NetworkID, replayPeer, replayCID)...)
+	sdf = nan.AppendSDFHeader(sdf)
+	sdf, _ = nan.AppendAttributes(sdf, &nan.ServiceDescriptor{ServiceID: dmeshServiceID,
+		InstanceID: 1, Type: nan.Publish, ServiceInfo: txt})
+
+	ap := append(radiotap(2412, -30), mgmtFrame(0x80, bcast, replayOther, replayOther)...)
+	ap = append(ap, make([]byte, 12)...)
+
+	return [][]byte{beacon, sdf, ap}
+}
+
+func writeCapture(t *testing.T, name string, ng bool) string {
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var write func(gopacket.CaptureInfo, []byte) error
+	if ng {
+		w, err := pcapgo.NewNgWriter(f, layers.LinkTypeIEEE80211Radio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Flush()
+		write = w.WritePacket
+	} else {
+		w := pcapgo.NewWriter(f)
+		w.WriteFileHeader(65536, layers.LinkTypeIEEE80211Radio)
+		write = w.WritePacket
+	}
+	ts := time.Unix(1600000000, 0)
+	for i, d := range replayFrames() {
+		ci := gopacket.CaptureInfo{Timestamp: ts.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(d), Length: len(d)}
+		if err := write(ci, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestReplayMon(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ng   bool
+	}{{"nan.pcap", false}, {"nan.pcapng", true}} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewL2(nil)
+			if err := l.ReplayMon(writeCapture(t, tc.name, tc.ng), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			node := l.devByL2Id[Uint64(replayPeer)]
+			if node == nil {
+				t.Fatal("Peer not found", l.devByL2Id)
+			}
+			if node.BSSID != replayCID.String() || node.Freq != 2437 {
+				t.Error("Beacon not decoded", node)
+			}
+			if node.SSID != "DIRECT" || node.PSK != "pass" || l.devByMeshId[0xabcd] != node {
+				t.Error("Publish not decoded", node)
+			}
+			if !node.LastSeen.Equal(time.Unix(1600000001, 0)) {
+				t.Error("Expecting capture time", node.LastSeen)
+			}
+			if l.devByL2Id[Uint64(replayOther)] != nil {
+				t.Error("AP beacon not filtered")
+			}
+		})
+	}
+
+	if _, err := OpenCapture(bytes.NewReader([]byte("not a capture"))); err == nil {
+		t.Error("Expecting error")
+	}
+}
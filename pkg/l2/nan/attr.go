@@ -0,0 +1,228 @@
+// Package nan encodes and decodes WifiAware (NAN) attributes, as carried in
+// NAN beacons (vendor IE) and service discovery frames (SDF).
+//
+// Only the subset of the spec needed to interoperate with Android and ESP32
+// is typed - other attributes are returned as RawAttribute, and can be sent
+// the same way.
+package nan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// errInvalidAttr is returned when one or more attributes are malformed.
+	errInvalidAttr = errors.New("invalid NAN attribute")
+
+	// errShortAttr is returned when an attribute body is shorter than the
+	// fixed fields of its type.
+	errShortAttr = errors.New("NAN attribute too short")
+
+	// errAttrTooLong is returned when encoding a field or attribute longer
+	// than its length field allows.
+	errAttrTooLong = errors.New("NAN attribute field too long")
+)
+
+// AttrID identifies a NAN attribute. Each attribute is encoded as 1 byte ID,
+// 2 bytes little endian length and the body.
+type AttrID uint8
+
+// NAN attribute IDs, from the WifiAware spec (table 42).
+const (
+	AttrMasterIndication     AttrID = 0x00
+	AttrCluster              AttrID = 0x01
+	AttrServiceIDList        AttrID = 0x02
+	AttrServiceDescriptor    AttrID = 0x03
+	AttrFurtherAvailability  AttrID = 0x0A
+	AttrServiceDescriptorExt AttrID = 0x0E
+	AttrDeviceCapability     AttrID = 0x0F
+	AttrNDP                  AttrID = 0x10
+	AttrAvailability         AttrID = 0x12
+	AttrNDC                  AttrID = 0x13
+	AttrNDL                  AttrID = 0x14
+	AttrVendor               AttrID = 0xDD
+)
+
+// String returns the string representation of an AttrID.
+func (id AttrID) String() string {
+	switch id {
+	case AttrMasterIndication:
+		return "master"
+	case AttrCluster:
+		return "cluster"
+	case AttrServiceIDList:
+		return "svcids"
+	case AttrServiceDescriptor:
+		return "sda"
+	case AttrFurtherAvailability:
+		return "favail"
+	case AttrServiceDescriptorExt:
+		return "sdea"
+	case AttrDeviceCapability:
+		return "devcap"
+	case AttrNDP:
+		return "ndp"
+	case AttrAvailability:
+		return "avail"
+	case AttrNDC:
+		return "ndc"
+	case AttrNDL:
+		return "ndl"
+	case AttrVendor:
+		return "vendor"
+	default:
+		return fmt.Sprintf("attr(%d)", uint8(id))
+	}
+}
+
+// An Attribute is a typed NAN attribute.
+type Attribute interface {
+	// ID returns the attribute ID.
+	ID() AttrID
+
+	// AppendBody appends the encoded body - without ID and length - to b.
+	AppendBody(b []byte) []byte
+
+	// UnmarshalBody decodes the attribute body - without ID and length.
+	// The attribute may keep references to body.
+	UnmarshalBody(body []byte) error
+}
+
+// RawAttribute holds an attribute without a typed decoder.
+type RawAttribute struct {
+	Type AttrID
+	// Length field implied by length of data
+	Data []byte
+}
+
+func (a *RawAttribute) ID() AttrID { return a.Type }
+
+func (a *RawAttribute) AppendBody(b []byte) []byte { return append(b, a.Data...) }
+
+func (a *RawAttribute) UnmarshalBody(body []byte) error {
+	a.Data = body
+	return nil
+}
+
+// newAttribute returns an empty typed attribute for the ID, or nil if the
+// ID has no typed decoder.
+func newAttribute(id AttrID) Attribute {
+	switch id {
+	case AttrMasterIndication:
+		return &MasterIndication{}
+	case AttrCluster:
+		return &Cluster{}
+	case AttrServiceIDList:
+		return &ServiceIDList{}
+	case AttrServiceDescriptor:
+		return &ServiceDescriptor{}
+	case AttrFurtherAvailability:
+		return &FurtherAvailability{}
+	case AttrServiceDescriptorExt:
+		return &ServiceDescriptorExt{}
+	case AttrDeviceCapability:
+		return &DeviceCapability{}
+	case AttrNDP:
+		return &NDP{}
+	case AttrAvailability:
+		return &Availability{}
+	case AttrNDC:
+		return &NDC{}
+	case AttrNDL:
+		return &NDL{}
+	}
+	return nil
+}
+
+// validator is implemented by attributes with fields that may not fit
+// their length field.
+type validator interface {
+	Validate() error
+}
+
+// ValidateAttributes returns an error if one of the attributes can't be
+// encoded - used before queuing frames.
+func ValidateAttributes(attrs ...Attribute) error {
+	for _, a := range attrs {
+		if v, ok := a.(validator); ok {
+			if err := v.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AppendAttributes appends the encoded attributes to b. Returns an error
+// and b unchanged if an attribute or field is too long.
+func AppendAttributes(b []byte, attrs ...Attribute) ([]byte, error) {
+	if err := ValidateAttributes(attrs...); err != nil {
+		return b, err
+	}
+	orig := len(b)
+	for _, a := range attrs {
+		b = append(b, byte(a.ID()), 0, 0)
+		start := len(b)
+		b = a.AppendBody(b)
+		if len(b)-start > 0xffff {
+			return b[:orig], fmt.Errorf("%w: %v %d", errAttrTooLong, a.ID(), len(b)-start)
+		}
+		binary.LittleEndian.PutUint16(b[start-2:], uint16(len(b)-start))
+	}
+	return b, nil
+}
+
+// ParseAttributes parses zero or more attributes from a byte slice.
+// Attributes without a typed decoder are returned as *RawAttribute.
+func ParseAttributes(b []byte) ([]Attribute, error) {
+	var attrs []Attribute
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errInvalidAttr
+		}
+		id := AttrID(b[0])
+		l := int(binary.LittleEndian.Uint16(b[1:3]))
+		b = b[3:]
+		if len(b) < l {
+			return nil, errInvalidAttr
+		}
+
+		a := newAttribute(id)
+		if a == nil {
+			a = &RawAttribute{Type: id}
+		}
+		if err := a.UnmarshalBody(b[:l]); err != nil {
+			return nil, fmt.Errorf("%v: %w", id, err)
+		}
+		attrs = append(attrs, a)
+
+		b = b[l:]
+	}
+
+	return attrs, nil
+}
+
+// Find returns the first attribute with the given ID, or nil.
+func Find(attrs []Attribute, id AttrID) Attribute {
+	for _, a := range attrs {
+		if a.ID() == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// Dump returns a debug representation of the attributes, for logging.
+func Dump(attrs []Attribute) string {
+	var sb strings.Builder
+	for i, a := range attrs {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		fmt.Fprintf(&sb, "%v:%+v", a.ID(), a)
+	}
+	return sb.String()
+}
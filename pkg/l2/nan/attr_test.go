@@ -0,0 +1,206 @@
+package nan
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// Byte arrays previously hand-built in wifi/nan.go, interop tested with
+// Android and ESP32.
+var (
+	beaconIE = []byte{
+		0xdd, 34, 0x50, 0x6F, 0x9A, 0x13,
+		// Master
+		0, 2, 0, 140, 0xFE,
+		// Cluster
+		1, 0x0d, 0,
+		0x38, 0xba, 0xf8, 0x49, 0xd3, 0xbf, 0xFE, 140,
+		0,
+		0, 0, 0, 0,
+		// Service ID list
+		2, 6, 0,
+		0x75, 0x94, 0x31, 0x93, 0xea, 0xc9,
+	}
+
+	devCap = []byte{
+		0x0F, 0x09, 0x00,
+		0, 1, 0, 0x04, 1, 0, 0, 0x14, 0,
+	}
+
+	avail = []byte{
+		0x12, 0x1b, 0x00,
+		0x0b, 0x01, 0x00, 0x16, 0x00, 0x1a, 0x10, 0x18, 0x00, 0x04, 0xfe,
+		0xff, 0xff, 0x3f, 0x31, 0x51, 0xff, 0x07, 0x00, 0x80, 0x20, 0x00, 0x0f, 0x80, 0x01, 0x00, 0x0f,
+	}
+
+	sdea = []byte{
+		0x0e, 0x04, 0x00,
+		1, 0x00, 0x02, 0x02,
+	}
+
+	followup = []byte{
+		0x03, 0x0E, 0x00,
+		0x75, 0x94, 0x31, 0x93, 0xea, 0xc9,
+		0x80, 0x80, 0x12,
+		0x04, 'P', 'I', 'N', 'G',
+	}
+)
+
+var dmeshID = ServiceID{0x75, 0x94, 0x31, 0x93, 0xea, 0xc9}
+
+// appendAttrs encodes the attributes, failing the test on error.
+func appendAttrs(t *testing.T, b []byte, attrs ...Attribute) []byte {
+	t.Helper()
+	b, err := AppendAttributes(b, attrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBeaconIE(t *testing.T) {
+	mac := net.HardwareAddr{0x38, 0xba, 0xf8, 0x49, 0xd3, 0xbf}
+	b, err := AppendBeaconIE(nil,
+		&MasterIndication{Preference: 140, RandomFactor: 0xFE},
+		&Cluster{AnchorMaster: NewMasterRank(140, 0xFE, mac)},
+		&ServiceIDList{dmeshID})
+	if err != nil || !bytes.Equal(b, beaconIE) {
+		t.Fatalf("beacon IE\n%x\n%x", b, beaconIE)
+	}
+
+	// Preceded by an SSID IE
+	attrs, err := ParseBeaconIEs(append([]byte{0, 0}, beaconIE...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 3 {
+		t.Fatal("Expecting 3 attributes", Dump(attrs))
+	}
+	c := Find(attrs, AttrCluster).(*Cluster)
+	if c.AnchorMaster.Preference() != 140 || c.AnchorMaster.RandomFactor() != 0xFE ||
+		!bytes.Equal(c.AnchorMaster.Addr(), mac) {
+		t.Error("Invalid anchor master", c.AnchorMaster)
+	}
+	if l := *Find(attrs, AttrServiceIDList).(*ServiceIDList); len(l) != 1 || l[0] != dmeshID {
+		t.Error("Invalid service IDs", l)
+	}
+}
+
+func TestDiscoveryAttrs(t *testing.T) {
+	a := &Availability{
+		SequenceID: 0x0b,
+		Control:    1,
+		Entries: []AvailabilityEntry{
+			{
+				Control:           AvailPotential | 3<<3,
+				TimeBitmapControl: 0x0018,
+				TimeBitmap:        []byte{0xfe, 0xff, 0xff, 0x3f},
+				Channels: []ChannelEntry{
+					{OperatingClass: 81, ChannelBitmap: 0x07ff},
+					{OperatingClass: 128, ChannelBitmap: 0x0020, PrimaryChannelBitmap: 0x0f},
+					{OperatingClass: 128, ChannelBitmap: 0x0001, PrimaryChannelBitmap: 0x0f},
+				},
+			},
+		},
+	}
+	for _, tc := range []struct {
+		name string
+		a    Attribute
+		b    []byte
+	}{
+		{"devcap", &DeviceCapability{CommittedDW: 1, SupportedBands: 1 << Band24G,
+			OperationMode: 1, MaxChannelSwitchTime: 0x1400}, devCap},
+		{"avail", a, avail},
+		{"sdea", &ServiceDescriptorExt{InstanceID: 1, Control: SDEAServiceUpdate,
+			ServiceUpdateIndicator: 2}, sdea},
+		{"followup", &ServiceDescriptor{ServiceID: dmeshID, InstanceID: 0x80,
+			RequestorInstanceID: 0x80, Type: FollowUp, ServiceInfo: []byte("PING")}, followup},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := appendAttrs(t, nil, tc.a)
+			if !bytes.Equal(b, tc.b) {
+				t.Fatalf("encode\n%x\n%x", b, tc.b)
+			}
+			attrs, err := ParseAttributes(tc.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attrs) != 1 || attrs[0].ID() != tc.a.ID() {
+				t.Fatal("Unexpected decode", Dump(attrs))
+			}
+			// Round trip
+			if b := appendAttrs(t, nil, attrs...); !bytes.Equal(b, tc.b) {
+				t.Fatalf("round trip\n%x\n%x", b, tc.b)
+			}
+		})
+	}
+}
+
+func TestServiceDescriptorOptional(t *testing.T) {
+	sd := &ServiceDescriptor{
+		ServiceID:        dmeshID,
+		InstanceID:       3,
+		Type:             Subscribe,
+		HasBindingBitmap: true,
+		BindingBitmap:    0x0102,
+		MatchingFilter:   [][]byte{[]byte("dm"), {}},
+		ResponseFilter:   []byte{1, 2},
+		ServiceInfo:      []byte{},
+	}
+	attrs, err := ParseAttributes(appendAttrs(t, nil, sd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := attrs[0].(*ServiceDescriptor)
+	if d.Type != Subscribe || d.BindingBitmap != 0x0102 || len(d.MatchingFilter) != 2 ||
+		string(d.MatchingFilter[0]) != "dm" || len(d.MatchingFilter[1]) != 0 ||
+		!bytes.Equal(d.ResponseFilter, sd.ResponseFilter) || d.ServiceInfo == nil {
+		t.Errorf("Unexpected %+v", d)
+	}
+
+	if _, err := ParseAttributes([]byte{3, 4, 0, 1, 2, 3, 4}); err == nil {
+		t.Error("Expecting error for short SDA")
+	}
+	if _, err := ParseAttributes([]byte{3, 20, 0, 1}); err == nil {
+		t.Error("Expecting error for truncated attribute")
+	}
+}
+
+func TestAttrTooLong(t *testing.T) {
+	long := make([]byte, 256)
+	for _, sd := range []*ServiceDescriptor{
+		{ServiceInfo: long},
+		{ResponseFilter: long},
+		{MatchingFilter: [][]byte{long}},
+		{MatchingFilter: [][]byte{long[:200], long[:100]}},
+	} {
+		if b, err := AppendAttributes([]byte{1}, sd); !errors.Is(err, errAttrTooLong) || len(b) != 1 {
+			t.Error("Expecting too long error", err, len(b))
+		}
+	}
+	if _, err := AppendAttributes(nil, &ServiceDescriptor{ServiceInfo: long[:255]}); err != nil {
+		t.Error(err)
+	}
+
+	for _, e := range []AvailabilityEntry{
+		{TimeBitmap: long},
+		{Channels: make([]ChannelEntry, 16)},
+		{Bands: long[:16]},
+	} {
+		av := &Availability{Entries: []AvailabilityEntry{e}}
+		if _, err := AppendAttributes(nil, av); !errors.Is(err, errAttrTooLong) {
+			t.Error("Expecting availability too long", err)
+		}
+	}
+	av := &Availability{Entries: []AvailabilityEntry{{TimeBitmap: long[:255], Channels: make([]ChannelEntry, 15)}}}
+	if _, err := AppendAttributes(nil, av); err != nil {
+		t.Error(err)
+	}
+
+	ids := make(ServiceIDList, 50)
+	if b, err := AppendBeaconIE([]byte{1}, &ids); !errors.Is(err, errAttrTooLong) || len(b) != 1 {
+		t.Error("Expecting beacon IE too long", err, len(b))
+	}
+}
@@ -0,0 +1,297 @@
+package nan
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Band IDs, used in availability entries. The supported bands bitmap in
+// device capability has the bit with the same index set.
+const (
+	BandSub1G = 1
+	Band24G   = 2
+	Band5G    = 4
+)
+
+// DeviceCapability advertises the bands and committed DW wake up intervals.
+type DeviceCapability struct {
+	// MapID the capability applies to, 0 for all maps.
+	MapID uint8
+
+	// CommittedDW has the wake interval for 2.4GHz in bits 0-2 and 5GHz
+	// in bits 3-5. 1 means every 512 TU.
+	CommittedDW uint16
+
+	SupportedBands uint8
+	OperationMode  uint8
+	NumAntennas    uint8
+
+	// MaxChannelSwitchTime in microseconds.
+	MaxChannelSwitchTime uint16
+
+	Capabilities uint8
+}
+
+func (a *DeviceCapability) ID() AttrID { return AttrDeviceCapability }
+
+func (a *DeviceCapability) AppendBody(b []byte) []byte {
+	b = append(b, a.MapID)
+	b = binary.LittleEndian.AppendUint16(b, a.CommittedDW)
+	b = append(b, a.SupportedBands, a.OperationMode, a.NumAntennas)
+	b = binary.LittleEndian.AppendUint16(b, a.MaxChannelSwitchTime)
+	return append(b, a.Capabilities)
+}
+
+func (a *DeviceCapability) UnmarshalBody(body []byte) error {
+	if len(body) < 9 {
+		return errShortAttr
+	}
+	a.MapID = body[0]
+	a.CommittedDW = binary.LittleEndian.Uint16(body[1:])
+	a.SupportedBands = body[3]
+	a.OperationMode = body[4]
+	a.NumAntennas = body[5]
+	a.MaxChannelSwitchTime = binary.LittleEndian.Uint16(body[6:])
+	a.Capabilities = body[8]
+	return nil
+}
+
+// Availability entry types, in the low bits of the entry control.
+const (
+	AvailCommitted   = 1 << 0
+	AvailPotential   = 1 << 1
+	AvailConditional = 1 << 2
+
+	availTimeBitmap = 1 << 12
+)
+
+// Availability (NAN 2) lists the time slots and channels where the device
+// is available, for each map.
+type Availability struct {
+	SequenceID uint8
+
+	// Control has the map ID in the low 4 bits, followed by 'changed' bits.
+	Control uint16
+
+	Entries []AvailabilityEntry
+}
+
+// MapID returns the map ID of the availability.
+func (a *Availability) MapID() uint8 { return uint8(a.Control & 0x0F) }
+
+// AvailabilityEntry is one schedule - time bitmap and the channels or bands
+// it applies to.
+type AvailabilityEntry struct {
+	// Control has the type (committed, potential, conditional), usage
+	// preference, utilization and rx NSS. The time bitmap present bit is
+	// set when encoding if TimeBitmap is not nil.
+	Control uint16
+
+	// TimeBitmapControl has the bit duration, period and start offset.
+	TimeBitmapControl uint16
+	TimeBitmap        []byte
+
+	// Bands is used if Channels is empty.
+	Bands []uint8
+
+	Channels []ChannelEntry
+
+	// NonContiguous is set for 80+80 channels - aux bitmap included.
+	NonContiguous bool
+}
+
+// Type returns the committed, potential, conditional bits.
+func (e *AvailabilityEntry) Type() uint8 { return uint8(e.Control & 7) }
+
+// ChannelEntry identifies one or more channels in an operating class.
+type ChannelEntry struct {
+	OperatingClass       uint8
+	ChannelBitmap        uint16
+	PrimaryChannelBitmap uint8
+	AuxChannelBitmap     uint16
+}
+
+func (a *Availability) ID() AttrID { return AttrAvailability }
+
+// Validate checks the fields with short length fields - each entry has a
+// 4 bit channel or band count and a 1 byte time bitmap length.
+func (a *Availability) Validate() error {
+	for i := range a.Entries {
+		e := &a.Entries[i]
+		if len(e.TimeBitmap) > 255 {
+			return fmt.Errorf("%w: time bitmap %d", errAttrTooLong, len(e.TimeBitmap))
+		}
+		if len(e.Channels) > 15 {
+			return fmt.Errorf("%w: channel entries %d", errAttrTooLong, len(e.Channels))
+		}
+		if len(e.Channels) == 0 && len(e.Bands) > 15 {
+			return fmt.Errorf("%w: bands %d", errAttrTooLong, len(e.Bands))
+		}
+	}
+	return nil
+}
+
+// AppendBody encodes the availability - Validate must pass,
+// AppendAttributes checks it.
+func (a *Availability) AppendBody(b []byte) []byte {
+	b = append(b, a.SequenceID)
+	b = binary.LittleEndian.AppendUint16(b, a.Control)
+	for i := range a.Entries {
+		b = a.Entries[i].append(b)
+	}
+	return b
+}
+
+func (e *AvailabilityEntry) append(b []byte) []byte {
+	b = append(b, 0, 0)
+	start := len(b)
+
+	ctl := e.Control &^ availTimeBitmap
+	if e.TimeBitmap != nil {
+		ctl |= availTimeBitmap
+	}
+	b = binary.LittleEndian.AppendUint16(b, ctl)
+	if e.TimeBitmap != nil {
+		b = binary.LittleEndian.AppendUint16(b, e.TimeBitmapControl)
+		b = append(b, byte(len(e.TimeBitmap)))
+		b = append(b, e.TimeBitmap...)
+	}
+
+	if len(e.Channels) > 0 {
+		lc := byte(1) | byte(len(e.Channels))<<4
+		if e.NonContiguous {
+			lc |= 2
+		}
+		b = append(b, lc)
+		for _, c := range e.Channels {
+			b = append(b, c.OperatingClass)
+			b = binary.LittleEndian.AppendUint16(b, c.ChannelBitmap)
+			b = append(b, c.PrimaryChannelBitmap)
+			if e.NonContiguous {
+				b = binary.LittleEndian.AppendUint16(b, c.AuxChannelBitmap)
+			}
+		}
+	} else if len(e.Bands) > 0 {
+		b = append(b, byte(len(e.Bands))<<4)
+		b = append(b, e.Bands...)
+	}
+
+	binary.LittleEndian.PutUint16(b[start-2:], uint16(len(b)-start))
+	return b
+}
+
+func (a *Availability) UnmarshalBody(body []byte) error {
+	if len(body) < 3 {
+		return errShortAttr
+	}
+	a.SequenceID = body[0]
+	a.Control = binary.LittleEndian.Uint16(body[1:])
+	body = body[3:]
+	a.Entries = nil
+	for len(body) > 0 {
+		if len(body) < 2 {
+			return errShortAttr
+		}
+		l := int(binary.LittleEndian.Uint16(body))
+		if len(body) < 2+l {
+			return errShortAttr
+		}
+		var e AvailabilityEntry
+		if err := e.unmarshal(body[2 : 2+l]); err != nil {
+			return err
+		}
+		a.Entries = append(a.Entries, e)
+		body = body[2+l:]
+	}
+	return nil
+}
+
+func (e *AvailabilityEntry) unmarshal(b []byte) error {
+	if len(b) < 2 {
+		return errShortAttr
+	}
+	e.Control = binary.LittleEndian.Uint16(b)
+	b = b[2:]
+	if e.Control&availTimeBitmap != 0 {
+		if len(b) < 3 {
+			return errShortAttr
+		}
+		e.TimeBitmapControl = binary.LittleEndian.Uint16(b)
+		l := int(b[2])
+		if len(b) < 3+l {
+			return errShortAttr
+		}
+		e.TimeBitmap = b[3 : 3+l]
+		b = b[3+l:]
+	}
+	if len(b) == 0 {
+		return nil
+	}
+
+	lc := b[0]
+	n := int(lc >> 4)
+	b = b[1:]
+	if lc&1 == 0 {
+		if len(b) < n {
+			return errShortAttr
+		}
+		e.Bands = b[:n]
+		return nil
+	}
+
+	e.NonContiguous = lc&2 != 0
+	sz := 4
+	if e.NonContiguous {
+		sz = 6
+	}
+	if len(b) < n*sz {
+		return errShortAttr
+	}
+	for i := 0; i < n; i++ {
+		c := b[i*sz:]
+		ce := ChannelEntry{
+			OperatingClass:       c[0],
+			ChannelBitmap:        binary.LittleEndian.Uint16(c[1:]),
+			PrimaryChannelBitmap: c[3],
+		}
+		if e.NonContiguous {
+			ce.AuxChannelBitmap = binary.LittleEndian.Uint16(c[4:])
+		}
+		e.Channels = append(e.Channels, ce)
+	}
+	return nil
+}
+
+// FurtherAvailability is the NAN 1 further availability map - a single
+// channel and a bitmap of 32 intervals.
+type FurtherAvailability struct {
+	MapID uint8
+
+	// Control has the interval duration in bits 0-1 (16, 32, 64 TU) and
+	// the repeat flag in bit 2.
+	Control uint8
+
+	OperatingClass uint8
+	Channel        uint8
+
+	Bitmap uint32
+}
+
+func (a *FurtherAvailability) ID() AttrID { return AttrFurtherAvailability }
+
+func (a *FurtherAvailability) AppendBody(b []byte) []byte {
+	b = append(b, a.MapID, a.Control, a.OperatingClass, a.Channel)
+	return binary.LittleEndian.AppendUint32(b, a.Bitmap)
+}
+
+func (a *FurtherAvailability) UnmarshalBody(body []byte) error {
+	if len(body) < 8 {
+		return errShortAttr
+	}
+	a.MapID = body[0]
+	a.Control = body[1]
+	a.OperatingClass = body[2]
+	a.Channel = body[3]
+	a.Bitmap = binary.LittleEndian.Uint32(body[4:])
+	return nil
+}
@@ -0,0 +1,208 @@
+package nan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	// errNotNAN is returned when a frame or IE is not a NAN one.
+	errNotNAN = errors.New("not a NAN frame")
+)
+
+// WifiAlliance OUI and the NAN OUI type, used in the vendor IE of beacons
+// and in the vendor specific public action header of SDFs.
+var (
+	OUI = [3]byte{0x50, 0x6F, 0x9A}
+)
+
+const (
+	OUITypeNAN = 0x13
+
+	// ieVendor is the 802.11 vendor specific IE
+	ieVendor = 0xDD
+)
+
+var (
+	// ClusterIDPrefix is the prefix of the NAN cluster ID (used as BSSID).
+	// The last 2 bytes are picked by the node starting the cluster.
+	ClusterIDPrefix = []byte{0x50, 0x6F, 0x9A, 0x01}
+
+	// NetworkID is the destination address of broadcast SDFs.
+	// According to the spec - it seems broadcast works too.
+	NetworkID = net.HardwareAddr{0x51, 0x6F, 0x9A, 0x01, 0x00, 0x00}
+)
+
+// IsClusterID returns true if the address is a NAN cluster ID.
+func IsClusterID(bssid []byte) bool {
+	return len(bssid) == 6 && bssid[0] == 0x50 && bssid[1] == 0x6F &&
+		bssid[2] == 0x9A && bssid[3] == 0x01
+}
+
+// MasterRank is used in master selection. Encoded as a 64 bit little
+// endian value: interface address, random factor, master preference - so
+// the preference is the most significant byte.
+type MasterRank uint64
+
+// NewMasterRank computes the rank of a device.
+func NewMasterRank(pref, random uint8, addr net.HardwareAddr) MasterRank {
+	var b [8]byte
+	copy(b[0:6], addr)
+	b[6] = random
+	b[7] = pref
+	return MasterRank(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (r MasterRank) Preference() uint8 { return uint8(r >> 56) }
+
+func (r MasterRank) RandomFactor() uint8 { return uint8(r >> 48) }
+
+// Addr returns the interface address of the master.
+func (r MasterRank) Addr() net.HardwareAddr {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(r))
+	return net.HardwareAddr(b[0:6])
+}
+
+// MasterIndication is sent in beacons and SDFs with the preference of the
+// device to act as master.
+type MasterIndication struct {
+	// Android uses 1, ESP will use 81 (infra, high) to save android bat life.
+	Preference   uint8
+	RandomFactor uint8
+}
+
+func (a *MasterIndication) ID() AttrID { return AttrMasterIndication }
+
+func (a *MasterIndication) AppendBody(b []byte) []byte {
+	return append(b, a.Preference, a.RandomFactor)
+}
+
+func (a *MasterIndication) UnmarshalBody(body []byte) error {
+	if len(body) < 2 {
+		return errShortAttr
+	}
+	a.Preference = body[0]
+	a.RandomFactor = body[1]
+	return nil
+}
+
+// Cluster attribute, sent in beacons, identifies the anchor master of the
+// cluster.
+type Cluster struct {
+	AnchorMaster MasterRank
+
+	// Hops to the anchor master.
+	HopCount uint8
+
+	// AnchorMasterBTT is the lower 32 bits of the TSF of the last beacon
+	// transmitted by the anchor master.
+	AnchorMasterBTT uint32
+}
+
+func (a *Cluster) ID() AttrID { return AttrCluster }
+
+func (a *Cluster) AppendBody(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, uint64(a.AnchorMaster))
+	b = append(b, a.HopCount)
+	return binary.LittleEndian.AppendUint32(b, a.AnchorMasterBTT)
+}
+
+func (a *Cluster) UnmarshalBody(body []byte) error {
+	if len(body) < 13 {
+		return errShortAttr
+	}
+	a.AnchorMaster = MasterRank(binary.LittleEndian.Uint64(body))
+	a.HopCount = body[8]
+	a.AnchorMasterBTT = binary.LittleEndian.Uint32(body[9:])
+	return nil
+}
+
+// ServiceID identifies a NAN service.
+type ServiceID [6]byte
+
+// ServiceIDList is sent in beacons, listing the published services.
+type ServiceIDList []ServiceID
+
+func (a *ServiceIDList) ID() AttrID { return AttrServiceIDList }
+
+func (a *ServiceIDList) AppendBody(b []byte) []byte {
+	for _, id := range *a {
+		b = append(b, id[:]...)
+	}
+	return b
+}
+
+func (a *ServiceIDList) UnmarshalBody(body []byte) error {
+	if len(body)%6 != 0 {
+		return errInvalidAttr
+	}
+	l := make(ServiceIDList, len(body)/6)
+	for i := range l {
+		copy(l[i][:], body[i*6:])
+	}
+	*a = l
+	return nil
+}
+
+// AppendBeaconIE appends the NAN vendor IE holding attrs - used in beacons.
+// Returns an error and b unchanged if the attributes don't fit in the IE.
+func AppendBeaconIE(b []byte, attrs ...Attribute) ([]byte, error) {
+	orig := len(b)
+	b = append(b, ieVendor, 0, OUI[0], OUI[1], OUI[2], OUITypeNAN)
+	start := len(b) - 4
+	b, err := AppendAttributes(b, attrs...)
+	if err != nil {
+		return b[:orig], err
+	}
+	if len(b)-start > 255 {
+		return b[:orig], fmt.Errorf("%w: beacon IE %d", errAttrTooLong, len(b)-start)
+	}
+	b[start-1] = byte(len(b) - start)
+	return b, nil
+}
+
+// ParseBeaconIEs finds the NAN vendor IE in a list of 802.11 IEs - the
+// beacon body after the fixed fields - and parses its attributes.
+func ParseBeaconIEs(ies []byte) ([]Attribute, error) {
+	for len(ies) >= 2 {
+		id := ies[0]
+		l := int(ies[1])
+		if len(ies) < 2+l {
+			return nil, errInvalidAttr
+		}
+		ie := ies[2 : 2+l]
+		if id == ieVendor && l >= 4 && ie[0] == OUI[0] && ie[1] == OUI[1] &&
+			ie[2] == OUI[2] && ie[3] == OUITypeNAN {
+			return ParseAttributes(ie[4:])
+		}
+		ies = ies[2+l:]
+	}
+	return nil, errNotNAN
+}
+
+// AppendSDFHeader appends the public action header of a service discovery
+// frame: action, vendor, WifiAlliance OUI, NAN.
+func AppendSDFHeader(b []byte) []byte {
+	return append(b, 0x04, 0x09, OUI[0], OUI[1], OUI[2], OUITypeNAN)
+}
+
+// ParseSDF parses the attributes of a service discovery frame. The body
+// starts with the action category, after the 24 byte 802.11 header.
+func ParseSDF(body []byte) ([]Attribute, error) {
+	if !IsSDF(body) {
+		return nil, errNotNAN
+	}
+	return ParseAttributes(body[6:])
+}
+
+// IsSDF returns true if the action frame body is a NAN SDF.
+func IsSDF(body []byte) bool {
+	return len(body) >= 6 &&
+		body[0] == 4 && // Action
+		body[1] == 9 && // vendor
+		body[2] == OUI[0] && body[3] == OUI[1] && body[4] == OUI[2] && // WifiAll
+		body[5] == OUITypeNAN
+}
@@ -0,0 +1,442 @@
+package nan
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// errTooManyNDPs is returned when all NDP IDs for a peer are in use.
+var errTooManyNDPs = errors.New("no free NDP ID")
+
+// errNoNDI is returned when starting a data path without a local NDI.
+var errNoNDI = errors.New("no local NDI")
+
+// NDPState is the negotiation state of a data path.
+type NDPState int
+
+const (
+	// NDPRequested - initiator sent the request.
+	NDPRequested NDPState = iota
+
+	// NDPResponded - responder accepted, waiting for confirm.
+	NDPResponded
+
+	NDPEstablished
+	NDPTerminated
+)
+
+func (s NDPState) String() string {
+	switch s {
+	case NDPRequested:
+		return "requested"
+	case NDPResponded:
+		return "responded"
+	case NDPEstablished:
+		return "established"
+	case NDPTerminated:
+		return "terminated"
+	}
+	return "unknown"
+}
+
+// ndpSetupTimeout is the max time for the request/response/confirm.
+const ndpSetupTimeout = 5 * time.Second
+
+// DataPath is a NAN data path with a peer. Packets are exchanged between
+// LocalNDI and PeerNDI - the data interface addresses.
+type DataPath struct {
+	// Peer is the management address of the peer (NMI).
+	Peer net.HardwareAddr
+
+	PeerNDI  net.HardwareAddr
+	LocalNDI net.HardwareAddr
+
+	ID        uint8
+	PublishID uint8
+
+	// Initiator is true if the local device sent the request.
+	Initiator bool
+
+	State NDPState
+
+	// Info is the NDP specific info received from the peer.
+	Info []byte
+
+	initiatorNDI net.HardwareAddr
+	token        uint8
+	started      time.Time
+}
+
+func (p *DataPath) String() string {
+	return fmt.Sprintf("%s/%d %s->%s %v", p.Peer, p.ID, p.LocalNDI, p.PeerNDI, p.State)
+}
+
+func (p *DataPath) key() string {
+	return fmt.Sprintf("%s/%s/%d", p.Peer, p.initiatorNDI, p.ID)
+}
+
+// DataPaths negotiates data paths with peers, using NAN action frames.
+//
+// The initiator sends a data path request with its availability, NDC and
+// NDL schedule; the responder replies with its NDI and availability, and
+// the initiator confirms. The committed schedule of the initiator is
+// accepted as is - Linux can't follow a negotiated schedule, the emulated
+// data interface listens on a single channel.
+type DataPaths struct {
+	m sync.Mutex
+
+	// NDI is the address of the local data interface - use SetNDI once
+	// frames may be received.
+	NDI net.HardwareAddr
+
+	// Avail is the committed availability sent in requests and responses.
+	Avail *Availability
+
+	// DevCap is sent with the availability, if not nil.
+	DevCap *DeviceCapability
+
+	// Accept is called for received requests - nil accepts all. Called
+	// holding the lock - must not call DataPaths methods.
+	Accept func(*DataPath) bool
+
+	// Called without holding locks when a data path is established or
+	// terminated.
+	OnEstablished func(*DataPath)
+	OnTerminated  func(*DataPath)
+
+	send func(to net.HardwareAddr, t NAFSubtype, attrs ...Attribute) error
+
+	paths map[string]*DataPath
+	token uint8
+	ndcID net.HardwareAddr
+}
+
+// NewDataPaths creates the data path negotiation for a local NDI. The
+// default availability is committed on channel 6, all slots except the DW.
+func NewDataPaths(ndi net.HardwareAddr,
+	send func(to net.HardwareAddr, t NAFSubtype, attrs ...Attribute) error) *DataPaths {
+	var r [3]byte
+	rand.Read(r[:])
+	return &DataPaths{
+		NDI:  ndi,
+		send: send,
+		Avail: &Availability{
+			SequenceID: r[0],
+			Entries: []AvailabilityEntry{
+				{
+					Control:           AvailCommitted,
+					TimeBitmapControl: 0x0018, // 16 TU slots, 512 TU period
+					TimeBitmap:        []byte{0xfe, 0xff, 0xff, 0xff},
+					Channels: []ChannelEntry{
+						{OperatingClass: 81, ChannelBitmap: 1 << 5},
+					},
+				},
+			},
+		},
+		paths: map[string]*DataPath{},
+		token: r[0],
+		ndcID: net.HardwareAddr{ClusterIDPrefix[0], ClusterIDPrefix[1],
+			ClusterIDPrefix[2], ClusterIDPrefix[3], r[1], r[2]},
+	}
+}
+
+// SetNDI sets the address of the local data interface. Requests received
+// before it is set are ignored.
+func (d *DataPaths) SetNDI(ndi net.HardwareAddr) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.NDI = ndi
+}
+
+// SetAvailability changes the availability and capability sent in
+// requests and responses.
+func (d *DataPaths) SetAvailability(avail *Availability, devCap *DeviceCapability) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.Avail = avail
+	d.DevCap = devCap
+}
+
+// ndc returns the NDC attribute - the slot after the DW.
+func (d *DataPaths) ndc() *NDC {
+	return &NDC{
+		NDCID:    d.ndcID,
+		Selected: true,
+		Schedule: []ScheduleEntry{
+			{TimeBitmapControl: 0x0018, TimeBitmap: []byte{0x02, 0, 0, 0}},
+		},
+	}
+}
+
+// availAttrs returns the device capability and availability.
+func (d *DataPaths) availAttrs() []Attribute {
+	if d.DevCap != nil {
+		return []Attribute{d.DevCap, d.Avail}
+	}
+	return []Attribute{d.Avail}
+}
+
+// List returns the current data paths.
+func (d *DataPaths) List() []*DataPath {
+	d.m.Lock()
+	defer d.m.Unlock()
+	res := []*DataPath{}
+	for _, p := range d.paths {
+		res = append(res, p)
+	}
+	return res
+}
+
+// Request starts a data path with the publish instance of the peer.
+func (d *DataPaths) Request(peer net.HardwareAddr, publishID uint8, info []byte) (*DataPath, error) {
+	d.m.Lock()
+	if d.NDI == nil {
+		d.m.Unlock()
+		return nil, errNoNDI
+	}
+	p := &DataPath{
+		Peer:         peer,
+		LocalNDI:     d.NDI,
+		PublishID:    publishID,
+		Initiator:    true,
+		State:        NDPRequested,
+		initiatorNDI: d.NDI,
+		started:      time.Now(),
+	}
+	for id := 1; id < 256; id++ {
+		p.ID = uint8(id)
+		if d.paths[p.key()] == nil {
+			break
+		}
+	}
+	if d.paths[p.key()] != nil {
+		d.m.Unlock()
+		return nil, errTooManyNDPs
+	}
+	d.token++
+	p.token = d.token
+	d.paths[p.key()] = p
+
+	attrs := append(d.availAttrs(), d.ndc(),
+		&NDL{DialogToken: p.token, Type: NegRequest, Control: NDLNDCPresent},
+		&NDP{
+			DialogToken:  p.token,
+			Type:         NegRequest,
+			InitiatorNDI: d.NDI,
+			NDPID:        p.ID,
+			Control:      NDPConfirmRequired,
+			PublishID:    publishID,
+			HasPublishID: true,
+			Info:         info,
+		})
+	d.m.Unlock()
+
+	return p, d.send(peer, NAFDataPathRequest, attrs...)
+}
+
+// Terminate ends a data path, and notifies the peer.
+func (d *DataPaths) Terminate(p *DataPath) error {
+	d.m.Lock()
+	if d.paths[p.key()] != p {
+		d.m.Unlock()
+		return nil
+	}
+	delete(d.paths, p.key())
+	p.State = NDPTerminated
+	d.m.Unlock()
+
+	err := d.send(p.Peer, NAFDataPathTermination, &NDP{
+		DialogToken:  p.token,
+		Type:         NegTermination,
+		InitiatorNDI: p.initiatorNDI,
+		NDPID:        p.ID,
+	})
+	if d.OnTerminated != nil {
+		d.OnTerminated(p)
+	}
+	return err
+}
+
+// Expire terminates the data paths that were not established in time.
+func (d *DataPaths) Expire(now time.Time) {
+	var expired []*DataPath
+	d.m.Lock()
+	for k, p := range d.paths {
+		if p.State != NDPEstablished && now.Sub(p.started) > ndpSetupTimeout {
+			p.State = NDPTerminated
+			delete(d.paths, k)
+			expired = append(expired, p)
+		}
+	}
+	d.m.Unlock()
+	for _, p := range expired {
+		log.Println("NDP: setup timeout", p)
+		if d.OnTerminated != nil {
+			d.OnTerminated(p)
+		}
+	}
+}
+
+// nafOut is a frame to send after releasing the lock.
+type nafOut struct {
+	t     NAFSubtype
+	attrs []Attribute
+}
+
+// OnNAF handles a received NAN action frame.
+func (d *DataPaths) OnNAF(src net.HardwareAddr, t NAFSubtype, attrs []Attribute) {
+	ndp, _ := Find(attrs, AttrNDP).(*NDP)
+	if ndp == nil {
+		return
+	}
+
+	var out []nafOut
+	var established, terminated *DataPath
+
+	d.m.Lock()
+	if d.NDI == nil {
+		d.m.Unlock()
+		return
+	}
+	key := fmt.Sprintf("%s/%s/%d", src, ndp.InitiatorNDI, ndp.NDPID)
+	p := d.paths[key]
+
+	switch t {
+	case NAFDataPathRequest:
+		if ndp.Type != NegRequest || p != nil {
+			break
+		}
+		p = &DataPath{
+			Peer:         append(net.HardwareAddr{}, src...),
+			PeerNDI:      append(net.HardwareAddr{}, ndp.InitiatorNDI...),
+			LocalNDI:     d.NDI,
+			ID:           ndp.NDPID,
+			PublishID:    ndp.PublishID,
+			Info:         append([]byte{}, ndp.Info...),
+			initiatorNDI: append(net.HardwareAddr{}, ndp.InitiatorNDI...),
+			token:        ndp.DialogToken,
+			started:      time.Now(),
+		}
+		status := StatusAccepted
+		if d.Accept != nil && !d.Accept(p) {
+			status = StatusRejected
+		} else if ndp.Control&NDPConfirmRequired != 0 {
+			status = StatusContinued
+		}
+		ndlStatus := StatusAccepted
+		if status == StatusRejected {
+			ndlStatus = StatusRejected
+		}
+
+		ndc, _ := Find(attrs, AttrNDC).(*NDC)
+		if ndc == nil {
+			ndc = d.ndc()
+		}
+		out = append(out, nafOut{NAFDataPathResponse, append(d.availAttrs(), ndc,
+			&NDL{DialogToken: p.token, Type: NegResponse, Status: ndlStatus,
+				Control: NDLNDCPresent},
+			&NDP{
+				DialogToken:  p.token,
+				Type:         NegResponse,
+				Status:       status,
+				InitiatorNDI: p.initiatorNDI,
+				NDPID:        p.ID,
+				ResponderNDI: d.NDI,
+			})})
+
+		switch status {
+		case StatusContinued:
+			p.State = NDPResponded
+			d.paths[key] = p
+		case StatusAccepted:
+			p.State = NDPEstablished
+			d.paths[key] = p
+			established = p
+		}
+
+	case NAFDataPathResponse:
+		if p == nil || !p.Initiator || p.State != NDPRequested ||
+			ndp.Type != NegResponse || ndp.DialogToken != p.token {
+			break
+		}
+		if ndp.Status == StatusRejected {
+			p.State = NDPTerminated
+			delete(d.paths, key)
+			terminated = p
+			break
+		}
+		p.PeerNDI = append(net.HardwareAddr{}, ndp.ResponderNDI...)
+		p.Info = append([]byte{}, ndp.Info...)
+		if ndp.Status == StatusContinued {
+			out = append(out, nafOut{NAFDataPathConfirm, []Attribute{
+				&NDL{DialogToken: p.token, Type: NegConfirm, Status: StatusAccepted},
+				&NDP{
+					DialogToken:  p.token,
+					Type:         NegConfirm,
+					Status:       StatusAccepted,
+					InitiatorNDI: d.NDI,
+					NDPID:        p.ID,
+				}}})
+		}
+		p.State = NDPEstablished
+		established = p
+
+	case NAFDataPathConfirm:
+		if p == nil || p.Initiator || p.State != NDPResponded || ndp.Type != NegConfirm {
+			break
+		}
+		if ndp.Status == StatusAccepted {
+			p.State = NDPEstablished
+			established = p
+		} else {
+			p.State = NDPTerminated
+			delete(d.paths, key)
+			terminated = p
+		}
+
+	case NAFDataPathTermination:
+		if p == nil || ndp.Type != NegTermination {
+			break
+		}
+		p.State = NDPTerminated
+		delete(d.paths, key)
+		terminated = p
+	}
+	d.m.Unlock()
+
+	for _, o := range out {
+		if err := d.send(src, o.t, o.attrs...); err != nil {
+			log.Println("NDP: send error", src, o.t, err)
+		}
+	}
+	if established != nil {
+		log.Println("NDP: established", established)
+		if d.OnEstablished != nil {
+			d.OnEstablished(established)
+		}
+	}
+	if terminated != nil {
+		log.Println("NDP: terminated", terminated)
+		if d.OnTerminated != nil {
+			d.OnTerminated(terminated)
+		}
+	}
+}
+
+// FindByNDI returns the established data path with the peer NDI, or nil.
+func (d *DataPaths) FindByNDI(ndi net.HardwareAddr) *DataPath {
+	d.m.Lock()
+	defer d.m.Unlock()
+	for _, p := range d.paths {
+		if p.State == NDPEstablished && bytes.Equal(p.PeerNDI, ndi) {
+			return p
+		}
+	}
+	return nil
+}
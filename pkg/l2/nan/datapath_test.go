@@ -0,0 +1,115 @@
+package nan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var (
+	ndiA = net.HardwareAddr{2, 0, 0, 0, 1, 0xA}
+	ndiB = net.HardwareAddr{2, 0, 0, 0, 1, 0xB}
+)
+
+// pairDataPaths returns 2 DataPaths sending frames to each other, encoded
+// and parsed.
+func pairDataPaths(t *testing.T) (*DataPaths, *DataPaths, *[]NAFSubtype) {
+	var a, b *DataPaths
+	frames := &[]NAFSubtype{}
+	link := func(src net.HardwareAddr, dst **DataPaths) func(net.HardwareAddr, NAFSubtype, ...Attribute) error {
+		return func(to net.HardwareAddr, st NAFSubtype, attrs ...Attribute) error {
+			*frames = append(*frames, st)
+			rt, ra, err := ParseNAF(appendAttrs(t, AppendNAFHeader(nil, st), attrs...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			(*dst).OnNAF(src, rt, ra)
+			return nil
+		}
+	}
+	a = NewDataPaths(ndiA, link(macA, &b))
+	b = NewDataPaths(ndiB, link(macB, &a))
+	return a, b, frames
+}
+
+func TestDataPath(t *testing.T) {
+	a, b, frames := pairDataPaths(t)
+
+	var est []*DataPath
+	a.OnEstablished = func(p *DataPath) { est = append(est, p) }
+	b.OnEstablished = func(p *DataPath) { est = append(est, p) }
+	b.Accept = func(p *DataPath) bool { return p.PublishID == 3 }
+
+	p, err := a.Request(macB, 3, []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*frames) != 3 || (*frames)[2] != NAFDataPathConfirm {
+		t.Fatal("Expecting request, response, confirm", *frames)
+	}
+	if p.State != NDPEstablished || !bytes.Equal(p.PeerNDI, ndiB) || len(est) != 2 {
+		t.Fatal("Not established", p, est)
+	}
+	bp := b.FindByNDI(ndiA)
+	if bp == nil || string(bp.Info) != "info" || bp.Initiator {
+		t.Fatal("Responder not established", bp)
+	}
+
+	var term []*DataPath
+	b.OnTerminated = func(p *DataPath) { term = append(term, p) }
+	a.Terminate(p)
+	if len(term) != 1 || len(b.List()) != 0 || len(a.List()) != 0 {
+		t.Error("Expecting terminated", term, b.List())
+	}
+
+	// Rejected by Accept
+	a.OnTerminated = func(p *DataPath) { term = append(term, p) }
+	p, _ = a.Request(macB, 4, nil)
+	if p.State != NDPTerminated || len(term) != 2 {
+		t.Error("Expecting reject", p)
+	}
+}
+
+// Without a local NDI, requests fail and received requests are ignored.
+func TestDataPathNoNDI(t *testing.T) {
+	a, b, frames := pairDataPaths(t)
+	b.SetNDI(nil)
+	if _, err := b.Request(macA, 3, nil); err != errNoNDI {
+		t.Error("Expecting no NDI error", err)
+	}
+	a.Request(macB, 3, nil)
+	if len(*frames) != 1 || len(b.List()) != 0 {
+		t.Error("Expecting request ignored", *frames, b.List())
+	}
+	b.SetNDI(ndiB)
+	if _, err := a.Request(macB, 3, nil); err != nil || len(b.List()) != 1 {
+		t.Error("Expecting data path", err, b.List())
+	}
+}
+
+func TestNDPAttrs(t *testing.T) {
+	in := []Attribute{
+		&NDP{DialogToken: 1, Type: NegResponse, Status: StatusContinued,
+			InitiatorNDI: ndiA, NDPID: 2, ResponderNDI: ndiB, Info: []byte{}},
+		&NDL{DialogToken: 1, Type: NegRequest, Control: NDLNDCPresent,
+			HasPeerID: true, PeerID: 5, MaxIdlePeriod: 3, ImmutableSchedule: []byte{1}},
+		&NDC{NDCID: macA, Selected: true, Schedule: []ScheduleEntry{
+			{MapID: 1, TimeBitmapControl: 0x18, TimeBitmap: []byte{2, 0}}}},
+	}
+	b := appendAttrs(t, nil, in...)
+	out, err := ParseAttributes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 3 || !bytes.Equal(appendAttrs(t, nil, out...), b) {
+		t.Fatal("Round trip", Dump(out))
+	}
+	ndp := out[0].(*NDP)
+	if ndp.Status != StatusContinued || ndp.Type != NegResponse || ndp.HasPublishID ||
+		!bytes.Equal(ndp.ResponderNDI, ndiB) {
+		t.Error("Unexpected NDP", ndp)
+	}
+	if ndl := out[1].(*NDL); ndl.PeerID != 5 || ndl.MaxIdlePeriod != 3 {
+		t.Error("Unexpected NDL", ndl)
+	}
+}
@@ -0,0 +1,419 @@
+package nan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reliable datagrams over follow-up frames.
+//
+// Each follow-up service info carries a 4 byte header - message sequence
+// (LE16), fragment index and fragment count - followed by up to
+// MaxFragment bytes of the message. The top bit of the sequence requests
+// an end to end ack: a header with the same sequence and index and a 0
+// count.
+//
+// Fragments are sent one at a time per interface, and retransmitted until
+// the TX status reports the 802.11 ACK from the peer. Injected and offload
+// frames have no ACK status - once one is seen, fragments request the end
+// to end ack and are retransmitted until it is received. The receiver
+// reassembles and drops duplicates - if the ACK is lost the fragment is
+// sent again.
+
+const (
+	fragHeaderLen = 4
+
+	// seqMask is the sequence bits of the first 2 header bytes.
+	seqMask = 0x7fff
+
+	// fragAckReq is set in the second header byte if the receiver must
+	// send an end to end ack.
+	fragAckReq = 0x80
+
+	// MaxFragment is the max message bytes in a follow-up - the SDA
+	// service info is limited to 255 bytes.
+	MaxFragment = 255 - fragHeaderLen
+
+	// MaxMessage is the max size of a message.
+	MaxMessage = 255 * MaxFragment
+
+	// reassemblyTimeout is how long partial messages - and sequence
+	// numbers of completed messages - are kept.
+	reassemblyTimeout = 10 * time.Second
+
+	// linkTimeout is the default fragment timeout. Follow-ups are queued
+	// until the next DW - up to a DW interval - and the TX status can take
+	// up to a second after that.
+	linkTimeout = DWInterval*TU + time.Second
+)
+
+var (
+	errMessageTooLarge = errors.New("NAN message too large")
+	errWindowFull      = errors.New("NAN send window full")
+	errInvalidFragment = errors.New("invalid NAN fragment")
+	errLinkDropped     = errors.New("NAN message not acked")
+)
+
+// txMsg is a message queued for a peer.
+type txMsg struct {
+	to      net.HardwareAddr
+	frags   [][]byte
+	next    int
+	retries int
+	done    func(error)
+}
+
+// rxMsg is a partially received message.
+type rxMsg struct {
+	frags [][]byte
+	got   int
+	start time.Time
+}
+
+type linkPeer struct {
+	// Messages waiting to be sent, the first one is in progress.
+	q []*txMsg
+
+	rx   map[uint16]*rxMsg
+	done map[uint16]time.Time
+}
+
+// Link sends and receives messages of up to MaxMessage bytes using
+// follow-up frames.
+type Link struct {
+	m sync.Mutex
+
+	// Window is the max number of messages queued for a peer.
+	Window int
+
+	// MaxRetries is the number of retransmissions of a fragment before
+	// the message is dropped.
+	MaxRetries int
+
+	// Timeout for the TX status of a fragment, from the send call - it
+	// must include the time the fragment is queued waiting for the DW.
+	// Fragments without a TX status are retransmitted. The end to end ack
+	// is waited for the same time after the fragment is sent.
+	Timeout time.Duration
+
+	// OnMessage is called with complete messages.
+	OnMessage func(from net.HardwareAddr, data []byte)
+
+	send func(to net.HardwareAddr, sdu []byte) error
+
+	peers map[string]*linkPeer
+
+	// Peers with queued messages, for round robin.
+	ready []string
+
+	seq uint16
+
+	// e2e is set once a fragment was sent without ACK status - the
+	// fragments request the end to end ack.
+	e2e bool
+
+	// Message with the fragment waiting for TX status.
+	cur     *txMsg
+	attempt uint32
+	timer   *time.Timer
+
+	// Stats
+	Sent, Retransmits, Dropped, Received int
+}
+
+// NewLink creates a Link using send to transmit a follow-up with the sdu as
+// service info. The sequence starts at a random value, so the messages of
+// a restarted node are not dropped by peers as duplicates.
+func NewLink(send func(to net.HardwareAddr, sdu []byte) error) *Link {
+	return &Link{
+		Window:     4,
+		MaxRetries: 5,
+		Timeout:    linkTimeout,
+		send:       send,
+		peers:      map[string]*linkPeer{},
+		seq:        uint16(rand.Intn(seqMask + 1)),
+	}
+}
+
+func (l *Link) peer(addr net.HardwareAddr) *linkPeer {
+	p := l.peers[addr.String()]
+	if p == nil {
+		p = &linkPeer{
+			rx:   map[uint16]*rxMsg{},
+			done: map[uint16]time.Time{},
+		}
+		l.peers[addr.String()] = p
+	}
+	return p
+}
+
+// Send queues a message for a peer. Returns an error if the peer has Window
+// messages queued. done, if not nil, is called when all fragments are acked,
+// or with an error when the message is dropped after MaxRetries.
+func (l *Link) Send(to net.HardwareAddr, data []byte, done func(error)) error {
+	if len(data) > MaxMessage {
+		return errMessageTooLarge
+	}
+
+	l.m.Lock()
+	p := l.peer(to)
+	if len(p.q) >= l.Window {
+		l.m.Unlock()
+		return errWindowFull
+	}
+
+	l.seq = (l.seq + 1) & seqMask
+	msg := &txMsg{to: append(net.HardwareAddr{}, to...), done: done}
+	cnt := (len(data) + MaxFragment - 1) / MaxFragment
+	if cnt == 0 {
+		cnt = 1
+	}
+	for i := 0; i < cnt; i++ {
+		end := (i + 1) * MaxFragment
+		if end > len(data) {
+			end = len(data)
+		}
+		f := make([]byte, fragHeaderLen, fragHeaderLen+end-i*MaxFragment)
+		binary.LittleEndian.PutUint16(f, l.seq)
+		f[2] = byte(i)
+		f[3] = byte(cnt)
+		msg.frags = append(msg.frags, append(f, data[i*MaxFragment:end]...))
+	}
+
+	if len(p.q) == 0 {
+		l.ready = append(l.ready, to.String())
+	}
+	p.q = append(p.q, msg)
+	l.m.Unlock()
+
+	l.pump()
+	return nil
+}
+
+// pump sends the next fragment, if none is waiting for TX status.
+func (l *Link) pump() {
+	l.m.Lock()
+	if l.cur != nil || len(l.ready) == 0 {
+		l.m.Unlock()
+		return
+	}
+	// Round robin between peers
+	k := l.ready[0]
+	l.ready = append(l.ready[1:], k)
+	msg := l.peers[k].q[0]
+
+	l.cur = msg
+	l.attempt++
+	attempt := l.attempt
+	frag := msg.frags[msg.next]
+	if l.e2e && msg.to[0]&1 == 0 {
+		frag[1] |= fragAckReq
+	}
+	l.timer = time.AfterFunc(l.Timeout, func() {
+		l.m.Lock()
+		if l.attempt != attempt || l.cur == nil {
+			l.m.Unlock()
+			return
+		}
+		done := l.txDone(false)
+		l.m.Unlock()
+		l.next(done)
+	})
+	l.Sent++
+	l.m.Unlock()
+
+	// On error - the timer will retransmit.
+	if err := l.send(msg.to, frag); err != nil {
+		log.Println("NAN: link send", msg.to, err)
+	}
+}
+
+// TxStatus should be called with the destination and service info of each
+// follow-up TX status, and the ACK flag.
+func (l *Link) TxStatus(to net.HardwareAddr, sdu []byte, acked bool) {
+	l.m.Lock()
+	msg := l.cur
+	if msg == nil || !bytes.Equal(to, msg.to) ||
+		!bytes.Equal(sdu, msg.frags[msg.next]) {
+		l.m.Unlock()
+		return
+	}
+	// Multicast frames are not acked.
+	done := l.txDone(acked || to[0]&1 == 1)
+	l.m.Unlock()
+	l.next(done)
+}
+
+// TxSent should be called instead of TxStatus for follow-ups sent without
+// ACK status - injected, or with the offload. The fragment is complete
+// when the end to end ack is received. A fragment sent without the ack
+// request is sent again with it, and so are all the later fragments.
+func (l *Link) TxSent(to net.HardwareAddr, sdu []byte) {
+	l.m.Lock()
+	msg := l.cur
+	if msg == nil || !bytes.Equal(to, msg.to) ||
+		!bytes.Equal(sdu, msg.frags[msg.next]) {
+		l.m.Unlock()
+		return
+	}
+	if to[0]&1 == 1 {
+		done := l.txDone(true)
+		l.m.Unlock()
+		l.next(done)
+		return
+	}
+	if sdu[1]&fragAckReq == 0 {
+		l.e2e = true
+		l.cur = nil
+		l.timer.Stop()
+		l.Retransmits++
+		l.m.Unlock()
+		l.pump()
+		return
+	}
+	// The peer sends the ack in its next DW.
+	l.timer.Reset(l.Timeout)
+	l.m.Unlock()
+}
+
+// next calls the completion of a message, if any, and sends the next
+// fragment.
+func (l *Link) next(done func()) {
+	if done != nil {
+		done()
+	}
+	l.pump()
+}
+
+// txDone completes the current fragment. Must hold the lock. Returns the
+// completion of the message if it is done, to be called without the lock.
+func (l *Link) txDone(acked bool) func() {
+	msg := l.cur
+	l.cur = nil
+	l.timer.Stop()
+
+	var err error
+	if acked {
+		msg.next++
+		msg.retries = 0
+		if msg.next < len(msg.frags) {
+			return nil
+		}
+	} else {
+		msg.retries++
+		l.Retransmits++
+		if msg.retries <= l.MaxRetries {
+			return nil
+		}
+		l.Dropped++
+		log.Println("NAN: link drop", msg.to, msg.next, len(msg.frags))
+		err = errLinkDropped
+	}
+
+	k := msg.to.String()
+	p := l.peers[k]
+	p.q = p.q[1:]
+	if len(p.q) == 0 {
+		for i, r := range l.ready {
+			if r == k {
+				l.ready = append(l.ready[:i], l.ready[i+1:]...)
+				break
+			}
+		}
+	}
+	if msg.done == nil {
+		return nil
+	}
+	return func() { msg.done(err) }
+}
+
+// onAck completes the current fragment if it matches the end to end ack.
+func (l *Link) onAck(from net.HardwareAddr, sdu []byte) {
+	l.m.Lock()
+	msg := l.cur
+	if msg == nil || !bytes.Equal(from, msg.to) {
+		l.m.Unlock()
+		return
+	}
+	f := msg.frags[msg.next]
+	if binary.LittleEndian.Uint16(f)&seqMask != binary.LittleEndian.Uint16(sdu)&seqMask || f[2] != sdu[2] {
+		l.m.Unlock()
+		return
+	}
+	done := l.txDone(true)
+	l.m.Unlock()
+	l.next(done)
+}
+
+// Receive handles the service info of a follow-up from a peer, and calls
+// OnMessage when a message is complete. Fragments requesting it are acked,
+// including duplicates.
+func (l *Link) Receive(from net.HardwareAddr, sdu []byte) error {
+	if len(sdu) >= fragHeaderLen && sdu[3] == 0 {
+		l.onAck(from, sdu)
+		return nil
+	}
+	if len(sdu) < fragHeaderLen || sdu[2] >= sdu[3] {
+		return errInvalidFragment
+	}
+	seq := binary.LittleEndian.Uint16(sdu) & seqMask
+	idx, cnt := int(sdu[2]), int(sdu[3])
+	now := time.Now()
+
+	if sdu[1]&fragAckReq != 0 && l.send != nil {
+		ack := []byte{sdu[0], sdu[1] &^ fragAckReq, sdu[2], 0}
+		if err := l.send(from, ack); err != nil {
+			log.Println("NAN: link ack", from, err)
+		}
+	}
+
+	l.m.Lock()
+	p := l.peer(from)
+	for s, t := range p.done {
+		if now.Sub(t) > reassemblyTimeout {
+			delete(p.done, s)
+		}
+	}
+	for s, m := range p.rx {
+		if now.Sub(m.start) > reassemblyTimeout {
+			delete(p.rx, s)
+		}
+	}
+	if _, f := p.done[seq]; f {
+		l.m.Unlock()
+		return nil
+	}
+
+	m := p.rx[seq]
+	if m == nil {
+		m = &rxMsg{frags: make([][]byte, cnt), start: now}
+		p.rx[seq] = m
+	}
+	if len(m.frags) != cnt {
+		l.m.Unlock()
+		return errInvalidFragment
+	}
+	if m.frags[idx] == nil {
+		m.frags[idx] = append([]byte{}, sdu[fragHeaderLen:]...)
+		m.got++
+	}
+	if m.got < cnt {
+		l.m.Unlock()
+		return nil
+	}
+	delete(p.rx, seq)
+	p.done[seq] = now
+	l.Received++
+	l.m.Unlock()
+
+	if l.OnMessage != nil {
+		l.OnMessage(from, bytes.Join(m.frags, nil))
+	}
+	return nil
+}
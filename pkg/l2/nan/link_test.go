@@ -0,0 +1,174 @@
+package nan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type sentFrag struct {
+	to  net.HardwareAddr
+	sdu []byte
+}
+
+func TestLink(t *testing.T) {
+	sent := make(chan sentFrag, 16)
+	tx := NewLink(func(to net.HardwareAddr, sdu []byte) error {
+		sent <- sentFrag{to, append([]byte{}, sdu...)}
+		return nil
+	})
+	tx.Window = 2
+
+	var got [][]byte
+	rx := NewLink(nil)
+	rx.OnMessage = func(from net.HardwareAddr, data []byte) {
+		if !bytes.Equal(from, macA) {
+			t.Error("Unexpected from", from)
+		}
+		got = append(got, data)
+	}
+
+	results := make(chan error, 4)
+	done := func(err error) { results <- err }
+	msg := bytes.Repeat([]byte("0123456789"), 60)
+	if err := tx.Send(macB, msg, done); err != nil {
+		t.Fatal(err)
+	}
+	tx.Send(macB, []byte("short"), done)
+	if err := tx.Send(macB, []byte("full"), done); err != errWindowFull {
+		t.Error("Expecting window full", err)
+	}
+
+	frags := 0
+	lost := false
+	for len(got) < 2 {
+		var f sentFrag
+		select {
+		case f = <-sent:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout", frags, len(got))
+		}
+		frags++
+		if len(f.sdu) > 255 {
+			t.Fatal("Fragment too large", len(f.sdu))
+		}
+		rx.Receive(macA, f.sdu)
+		// Lose the first ACK - the fragment is sent again, and the
+		// duplicate ignored.
+		tx.TxStatus(f.to, f.sdu, lost)
+		lost = true
+	}
+	if frags != 5 || !bytes.Equal(got[0], msg) || string(got[1]) != "short" {
+		t.Error("Unexpected receive", frags, len(got[0]), got[1])
+	}
+	if tx.Retransmits != 1 || rx.Received != 2 {
+		t.Error("Unexpected stats", tx.Retransmits, rx.Received)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Error("Expecting delivered", err)
+		}
+	}
+
+	// No TX status - dropped after retries.
+	tx.Timeout = time.Millisecond
+	tx.MaxRetries = 1
+	tx.Send(macB, []byte("lost"), done)
+	for i := 0; i < 2; i++ {
+		<-sent
+	}
+	select {
+	case err := <-results:
+		if err != errLinkDropped {
+			t.Error("Expecting dropped", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No drop result")
+	}
+	tx.m.Lock()
+	if tx.Dropped != 1 || tx.cur != nil {
+		t.Error("Expecting drop", tx.Dropped)
+	}
+	tx.m.Unlock()
+
+	if err := rx.Receive(macA, []byte{1, 0, 2, 2}); err != errInvalidFragment {
+		t.Error("Expecting invalid fragment", err)
+	}
+}
+
+// Without ACK status the fragments request an end to end ack, and are
+// retransmitted until it is received.
+func TestLinkEndToEnd(t *testing.T) {
+	sent := make(chan sentFrag, 16)
+	tx := NewLink(func(to net.HardwareAddr, sdu []byte) error {
+		sent <- sentFrag{to, append([]byte{}, sdu...)}
+		return nil
+	})
+	acks := make(chan sentFrag, 16)
+	rx := NewLink(func(to net.HardwareAddr, sdu []byte) error {
+		acks <- sentFrag{to, append([]byte{}, sdu...)}
+		return nil
+	})
+	got := make(chan []byte, 1)
+	rx.OnMessage = func(from net.HardwareAddr, data []byte) { got <- data }
+	results := make(chan error, 1)
+	tx.Send(macB, []byte("hello"), func(err error) { results <- err })
+
+	next := func(c chan sentFrag) sentFrag {
+		select {
+		case f := <-c:
+			return f
+		case <-time.After(time.Second):
+			t.Fatal("Timeout")
+		}
+		return sentFrag{}
+	}
+
+	// Sent without the ack request - sent again with it.
+	f := next(sent)
+	if f.sdu[1]&fragAckReq != 0 {
+		t.Error("Unexpected ack request", f.sdu)
+	}
+	rx.Receive(macA, f.sdu)
+	tx.TxSent(f.to, f.sdu)
+	f = next(sent)
+	if f.sdu[1]&fragAckReq == 0 {
+		t.Fatal("Expecting ack request", f.sdu)
+	}
+	tx.TxSent(f.to, f.sdu)
+	// The duplicate is acked.
+	rx.Receive(macA, f.sdu)
+	ack := next(acks)
+	if !bytes.Equal(ack.to, macA) || ack.sdu[3] != 0 || ack.sdu[1]&fragAckReq != 0 {
+		t.Fatal("Unexpected ack", ack)
+	}
+	tx.Receive(macB, ack.sdu)
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Error("Expecting delivered", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Not acked")
+	}
+	if d := <-got; string(d) != "hello" || rx.Received != 1 {
+		t.Error("Unexpected receive", string(d), rx.Received)
+	}
+
+	// Later messages request the ack in the first transmission, and are
+	// retransmitted until acked.
+	tx.Timeout = 10 * time.Millisecond
+	tx.Send(macB, []byte("again"), func(err error) { results <- err })
+	f = next(sent)
+	tx.TxSent(f.to, f.sdu)
+	f = next(sent)
+	if f.sdu[1]&fragAckReq == 0 || tx.Retransmits != 2 {
+		t.Fatal("Expecting retransmit with ack request", f.sdu, tx.Retransmits)
+	}
+	rx.Receive(macA, f.sdu)
+	tx.Receive(macB, next(acks).sdu)
+	if err := <-results; err != nil {
+		t.Error("Expecting delivered", err)
+	}
+}
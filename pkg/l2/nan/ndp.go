@@ -0,0 +1,346 @@
+package nan
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// NAN action frames (NAF) carry the data path and schedule negotiation.
+// Same public action header as SDF, with OUI type 0x18 and a subtype.
+
+const (
+	OUITypeNAF = 0x18
+)
+
+// NAFSubtype is the type of a NAN action frame.
+type NAFSubtype uint8
+
+const (
+	NAFRangingRequest      NAFSubtype = 1
+	NAFRangingResponse     NAFSubtype = 2
+	NAFRangingTermination  NAFSubtype = 3
+	NAFRangingReport       NAFSubtype = 4
+	NAFDataPathRequest     NAFSubtype = 5
+	NAFDataPathResponse    NAFSubtype = 6
+	NAFDataPathConfirm     NAFSubtype = 7
+	NAFDataPathKeyInstall  NAFSubtype = 8
+	NAFDataPathTermination NAFSubtype = 9
+	NAFScheduleRequest     NAFSubtype = 10
+	NAFScheduleResponse    NAFSubtype = 11
+	NAFScheduleConfirm     NAFSubtype = 12
+	NAFScheduleUpdate      NAFSubtype = 13
+)
+
+func (t NAFSubtype) String() string {
+	switch t {
+	case NAFDataPathRequest:
+		return "dp-req"
+	case NAFDataPathResponse:
+		return "dp-resp"
+	case NAFDataPathConfirm:
+		return "dp-confirm"
+	case NAFDataPathKeyInstall:
+		return "dp-key"
+	case NAFDataPathTermination:
+		return "dp-term"
+	case NAFScheduleRequest:
+		return "sched-req"
+	case NAFScheduleResponse:
+		return "sched-resp"
+	case NAFScheduleConfirm:
+		return "sched-confirm"
+	case NAFScheduleUpdate:
+		return "sched-update"
+	}
+	return "naf"
+}
+
+// AppendNAFHeader appends the public action header of a NAN action frame.
+func AppendNAFHeader(b []byte, t NAFSubtype) []byte {
+	return append(b, 0x04, 0x09, OUI[0], OUI[1], OUI[2], OUITypeNAF, byte(t))
+}
+
+// IsNAF returns true if the action frame body is a NAN action frame.
+func IsNAF(body []byte) bool {
+	return len(body) >= 7 &&
+		body[0] == 4 && body[1] == 9 &&
+		body[2] == OUI[0] && body[3] == OUI[1] && body[4] == OUI[2] &&
+		body[5] == OUITypeNAF
+}
+
+// ParseNAF returns the subtype and attributes of a NAN action frame.
+func ParseNAF(body []byte) (NAFSubtype, []Attribute, error) {
+	if !IsNAF(body) {
+		return 0, nil, errNotNAN
+	}
+	attrs, err := ParseAttributes(body[7:])
+	return NAFSubtype(body[6]), attrs, err
+}
+
+// NegType is the type in the NDP and NDL attributes.
+type NegType uint8
+
+const (
+	NegRequest  NegType = 0
+	NegResponse NegType = 1
+	NegConfirm  NegType = 2
+	// Only for NDP
+	NegSecurityInstall NegType = 3
+	NegTermination     NegType = 4
+)
+
+// NegStatus is the status in the NDP and NDL attributes.
+type NegStatus uint8
+
+const (
+	StatusContinued NegStatus = 0
+	StatusAccepted  NegStatus = 1
+	StatusRejected  NegStatus = 2
+)
+
+// NDP attribute control bits.
+const (
+	NDPConfirmRequired = 1 << 0
+	NDPSecurityPresent = 1 << 2
+	ndpPublishID       = 1 << 3
+	ndpResponderNDI    = 1 << 4
+	ndpInfo            = 1 << 5
+)
+
+// NDP attribute negotiates a data path. The initiator (subscriber) sends the
+// request, the responder (publisher) answers with its NDI.
+type NDP struct {
+	DialogToken uint8
+	Type        NegType
+	Status      NegStatus
+	ReasonCode  uint8
+
+	InitiatorNDI net.HardwareAddr
+	NDPID        uint8
+
+	// Control has the confirm required and security present bits. The
+	// other bits are set when encoding, based on the optional fields.
+	Control uint8
+
+	// PublishID of the responder service - used in requests.
+	PublishID    uint8
+	HasPublishID bool
+
+	ResponderNDI net.HardwareAddr
+
+	// Info is the NDP specific info - passed to the app.
+	Info []byte
+}
+
+func (a *NDP) ID() AttrID { return AttrNDP }
+
+func (a *NDP) AppendBody(b []byte) []byte {
+	ctl := a.Control &^ (ndpPublishID | ndpResponderNDI | ndpInfo)
+	if a.HasPublishID {
+		ctl |= ndpPublishID
+	}
+	if a.ResponderNDI != nil {
+		ctl |= ndpResponderNDI
+	}
+	if a.Info != nil {
+		ctl |= ndpInfo
+	}
+	b = append(b, a.DialogToken, byte(a.Type)&0x0F|byte(a.Status)<<4, a.ReasonCode)
+	b = appendAddr(b, a.InitiatorNDI)
+	b = append(b, a.NDPID, ctl)
+	if a.HasPublishID {
+		b = append(b, a.PublishID)
+	}
+	if a.ResponderNDI != nil {
+		b = appendAddr(b, a.ResponderNDI)
+	}
+	return append(b, a.Info...)
+}
+
+func (a *NDP) UnmarshalBody(body []byte) error {
+	if len(body) < 11 {
+		return errShortAttr
+	}
+	a.DialogToken = body[0]
+	a.Type = NegType(body[1] & 0x0F)
+	a.Status = NegStatus(body[1] >> 4)
+	a.ReasonCode = body[2]
+	a.InitiatorNDI = net.HardwareAddr(body[3:9])
+	a.NDPID = body[9]
+	a.Control = body[10]
+	body = body[11:]
+	if a.Control&ndpPublishID != 0 {
+		if len(body) < 1 {
+			return errShortAttr
+		}
+		a.HasPublishID = true
+		a.PublishID = body[0]
+		body = body[1:]
+	}
+	if a.Control&ndpResponderNDI != 0 {
+		if len(body) < 6 {
+			return errShortAttr
+		}
+		a.ResponderNDI = net.HardwareAddr(body[:6])
+		body = body[6:]
+	}
+	if a.Control&ndpInfo != 0 {
+		a.Info = body
+	}
+	return nil
+}
+
+// NDL attribute control bits.
+const (
+	ndlPeerID        = 1 << 0
+	ndlImmutable     = 1 << 1
+	NDLNDCPresent    = 1 << 2
+	NDLQoSPresent    = 1 << 3
+	ndlMaxIdle       = 1 << 4
+	NDLTypeMulticast = 1 << 5
+)
+
+// NDL attribute negotiates the schedule of the data link with a peer. A
+// link may carry multiple NDPs.
+type NDL struct {
+	DialogToken uint8
+	Type        NegType
+	Status      NegStatus
+	ReasonCode  uint8
+
+	// Control has the NDC, QoS and type bits. Peer ID, immutable schedule
+	// and max idle bits are set when encoding.
+	Control uint8
+
+	PeerID    uint8
+	HasPeerID bool
+
+	// MaxIdlePeriod in units of 1000 TU, 0 if not present.
+	MaxIdlePeriod uint16
+
+	// ImmutableSchedule is the raw list of schedule entries.
+	ImmutableSchedule []byte
+}
+
+func (a *NDL) ID() AttrID { return AttrNDL }
+
+func (a *NDL) AppendBody(b []byte) []byte {
+	ctl := a.Control &^ (ndlPeerID | ndlImmutable | ndlMaxIdle)
+	if a.HasPeerID {
+		ctl |= ndlPeerID
+	}
+	if a.MaxIdlePeriod != 0 {
+		ctl |= ndlMaxIdle
+	}
+	if a.ImmutableSchedule != nil {
+		ctl |= ndlImmutable
+	}
+	b = append(b, a.DialogToken, byte(a.Type)&0x0F|byte(a.Status)<<4, a.ReasonCode, ctl)
+	if a.HasPeerID {
+		b = append(b, a.PeerID)
+	}
+	if a.MaxIdlePeriod != 0 {
+		b = binary.LittleEndian.AppendUint16(b, a.MaxIdlePeriod)
+	}
+	return append(b, a.ImmutableSchedule...)
+}
+
+func (a *NDL) UnmarshalBody(body []byte) error {
+	if len(body) < 4 {
+		return errShortAttr
+	}
+	a.DialogToken = body[0]
+	a.Type = NegType(body[1] & 0x0F)
+	a.Status = NegStatus(body[1] >> 4)
+	a.ReasonCode = body[2]
+	a.Control = body[3]
+	body = body[4:]
+	if a.Control&ndlPeerID != 0 {
+		if len(body) < 1 {
+			return errShortAttr
+		}
+		a.HasPeerID = true
+		a.PeerID = body[0]
+		body = body[1:]
+	}
+	if a.Control&ndlMaxIdle != 0 {
+		if len(body) < 2 {
+			return errShortAttr
+		}
+		a.MaxIdlePeriod = binary.LittleEndian.Uint16(body)
+		body = body[2:]
+	}
+	if a.Control&ndlImmutable != 0 {
+		a.ImmutableSchedule = body
+	}
+	return nil
+}
+
+// ScheduleEntry is a time bitmap for a map, used in NDC and immutable
+// schedules.
+type ScheduleEntry struct {
+	MapID             uint8
+	TimeBitmapControl uint16
+	TimeBitmap        []byte
+}
+
+// NDC attribute is the NAN data cluster schedule - the slots where all
+// devices in the data cluster are awake.
+type NDC struct {
+	// NDCID has the same format as the cluster ID.
+	NDCID net.HardwareAddr
+
+	// Selected is set for the NDC chosen by the device.
+	Selected bool
+
+	Schedule []ScheduleEntry
+}
+
+func (a *NDC) ID() AttrID { return AttrNDC }
+
+func (a *NDC) AppendBody(b []byte) []byte {
+	b = appendAddr(b, a.NDCID)
+	ctl := byte(0)
+	if a.Selected {
+		ctl = 1
+	}
+	b = append(b, ctl)
+	for _, e := range a.Schedule {
+		b = append(b, e.MapID)
+		b = binary.LittleEndian.AppendUint16(b, e.TimeBitmapControl)
+		b = append(b, byte(len(e.TimeBitmap)))
+		b = append(b, e.TimeBitmap...)
+	}
+	return b
+}
+
+func (a *NDC) UnmarshalBody(body []byte) error {
+	if len(body) < 7 {
+		return errShortAttr
+	}
+	a.NDCID = net.HardwareAddr(body[:6])
+	a.Selected = body[6]&1 != 0
+	body = body[7:]
+	a.Schedule = nil
+	for len(body) > 0 {
+		if len(body) < 4 || len(body) < 4+int(body[3]) {
+			return errShortAttr
+		}
+		l := int(body[3])
+		a.Schedule = append(a.Schedule, ScheduleEntry{
+			MapID:             body[0],
+			TimeBitmapControl: binary.LittleEndian.Uint16(body[1:]),
+			TimeBitmap:        body[4 : 4+l],
+		})
+		body = body[4+l:]
+	}
+	return nil
+}
+
+// appendAddr appends a 6 byte address, zero if nil.
+func appendAddr(b []byte, addr net.HardwareAddr) []byte {
+	if len(addr) != 6 {
+		return append(b, 0, 0, 0, 0, 0, 0)
+	}
+	return append(b, addr...)
+}
@@ -0,0 +1,368 @@
+package nan
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Schedule model - the channels and 16 TU time slots where a device is
+// available, generating the Availability and Device Capability attributes.
+//
+// Each device picks its own receive channel - committed slots - and may
+// advertise potential channels where it can switch. Peers' Availability
+// attributes are parsed into the same model, and used to find the channel
+// and time for sending to them.
+
+var errBadChannel = errors.New("unknown NAN channel")
+
+const (
+	// SlotDuration is the duration of a slot, in TU.
+	SlotDuration = 16
+
+	// SlotsPerDW is the number of slots in a 512 TU DW interval. Slot 0 is
+	// the 2.4GHz DW.
+	SlotsPerDW = DWInterval / SlotDuration
+
+	// Time bitmap control for 16 TU slots and 512 TU period, no offset.
+	slotsBitmapControl = 0x0018
+)
+
+// Channel is a 20MHz channel, identified by the operating class and the
+// channel number. For 80MHz classes the number is the primary channel.
+type Channel struct {
+	OperatingClass uint8
+	Number         uint8
+}
+
+// Channels in the operating classes used by NAN (global table E-4). Class
+// 128 is 80MHz and uses the center channel.
+var opClassChannels = map[uint8][]uint8{
+	81:  {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13},
+	115: {36, 40, 44, 48},
+	118: {52, 56, 60, 64},
+	121: {100, 104, 108, 112, 116, 120, 124, 128, 132, 136, 140, 144},
+	124: {149, 153, 157, 161},
+	125: {149, 153, 157, 161, 165, 169},
+	128: {42, 58, 106, 122, 138, 155},
+}
+
+// ChannelNumber returns the 20MHz channel with the number.
+func ChannelNumber(n int) (Channel, error) {
+	if n >= 1 && n <= 13 {
+		return Channel{OperatingClass: 81, Number: uint8(n)}, nil
+	}
+	for _, oc := range []uint8{115, 118, 121, 125} {
+		for _, c := range opClassChannels[oc] {
+			if int(c) == n {
+				return Channel{OperatingClass: oc, Number: c}, nil
+			}
+		}
+	}
+	return Channel{}, errBadChannel
+}
+
+// FreqChannel returns the 20MHz channel with the center frequency.
+func FreqChannel(freq int) (Channel, error) {
+	switch {
+	case freq >= 2412 && freq <= 2472 && (freq-2407)%5 == 0:
+		return ChannelNumber((freq - 2407) / 5)
+	case freq > 5000 && freq < 5900 && freq%5 == 0:
+		return ChannelNumber((freq - 5000) / 5)
+	}
+	return Channel{}, errBadChannel
+}
+
+// ParseChannels parses a comma separated list of channel numbers.
+func ParseChannels(s string) ([]Channel, error) {
+	var res []Channel
+	for _, p := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		c, err := ChannelNumber(n)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// Freq returns the center frequency of the 20MHz channel, in MHz.
+func (c Channel) Freq() int {
+	if c.Number <= 14 {
+		return 2407 + 5*int(c.Number)
+	}
+	return 5000 + 5*int(c.Number)
+}
+
+// Band returns the band ID - Band24G or Band5G.
+func (c Channel) Band() uint8 {
+	if c.OperatingClass == 81 || c.OperatingClass == 82 {
+		return Band24G
+	}
+	return Band5G
+}
+
+func (c Channel) String() string {
+	return fmt.Sprintf("%d/%d", c.OperatingClass, c.Number)
+}
+
+// channelEntry returns the availability channel entry.
+func (c Channel) channelEntry() ChannelEntry {
+	if c.OperatingClass == 128 {
+		for i, center := range opClassChannels[128] {
+			if c.Number >= center-6 && c.Number <= center+6 {
+				return ChannelEntry{
+					OperatingClass:       128,
+					ChannelBitmap:        1 << i,
+					PrimaryChannelBitmap: 1 << ((c.Number - center + 6) / 4),
+				}
+			}
+		}
+	}
+	for i, n := range opClassChannels[c.OperatingClass] {
+		if n == c.Number {
+			return ChannelEntry{OperatingClass: c.OperatingClass, ChannelBitmap: 1 << i}
+		}
+	}
+	return ChannelEntry{OperatingClass: c.OperatingClass}
+}
+
+// channels returns the channels in the entry. For 80MHz the primary
+// channels are returned, or the lowest if not set.
+func (e ChannelEntry) channels() []Channel {
+	var res []Channel
+	for i, n := range opClassChannels[e.OperatingClass] {
+		if e.ChannelBitmap&(1<<i) == 0 {
+			continue
+		}
+		if e.OperatingClass != 128 {
+			res = append(res, Channel{OperatingClass: e.OperatingClass, Number: n})
+			continue
+		}
+		p := e.PrimaryChannelBitmap
+		if p == 0 {
+			p = 1
+		}
+		for j := 0; j < 4; j++ {
+			if p&(1<<j) != 0 {
+				res = append(res, Channel{OperatingClass: 128, Number: n - 6 + uint8(4*j)})
+			}
+		}
+	}
+	return res
+}
+
+// Slots is a bitmap of the 16 TU slots in the 512 TU DW interval.
+type Slots uint32
+
+// AllSlots has all slots except the DW.
+const AllSlots Slots = 0xfffffffe
+
+// SlotRange returns the slots from..to, inclusive.
+func SlotRange(from, to int) Slots {
+	var s Slots
+	for i := from; i <= to && i < SlotsPerDW; i++ {
+		s |= 1 << i
+	}
+	return s
+}
+
+// Has returns true if slot i is set.
+func (s Slots) Has(i int) bool {
+	return s&(1<<(i%SlotsPerDW)) != 0
+}
+
+// slotsFromBitmap converts a time bitmap to slots. Bitmaps with a period
+// longer than 512 TU are folded - a slot is set only if it is available in
+// all the repetitions.
+func slotsFromBitmap(ctl uint16, bm []byte) Slots {
+	dur := 1 << (ctl & 7) // in 16 TU slots
+	period := SlotsPerDW
+	if p := (ctl >> 3) & 7; p != 0 {
+		period = (128 << (p - 1)) / SlotDuration
+	}
+	start := int(ctl>>6) & 0x1FF
+
+	avail := func(k int) bool {
+		k = ((k-start)%period + period) % period
+		bit := k / dur
+		return bit/8 < len(bm) && bm[bit/8]&(1<<(bit%8)) != 0
+	}
+
+	var s Slots
+	for i := 0; i < SlotsPerDW; i++ {
+		set := true
+		for k := i; k < period || k == i; k += SlotsPerDW {
+			if !avail(k) {
+				set = false
+				break
+			}
+		}
+		if set {
+			s |= 1 << i
+		}
+	}
+	return s
+}
+
+// bitmap returns the time bitmap for the slots, using slotsBitmapControl.
+func (s Slots) bitmap() []byte {
+	return []byte{byte(s), byte(s >> 8), byte(s >> 16), byte(s >> 24)}
+}
+
+// Slot is the availability on one channel, or a band for potential
+// availability.
+type Slot struct {
+	// Type is AvailCommitted, AvailPotential or AvailConditional.
+	Type uint8
+
+	// Channel is used if set, otherwise Band.
+	Channel Channel
+	Band    uint8
+
+	Slots Slots
+
+	// Preference is the usage preference, 0-3.
+	Preference uint8
+}
+
+// Schedule is the availability of a device.
+type Schedule struct {
+	m sync.Mutex
+
+	MapID uint8
+
+	// CommittedDW is the 2.4GHz and 5GHz DW wake intervals, as in the
+	// device capability.
+	CommittedDW uint16
+
+	Slots []Slot
+
+	seq uint8
+}
+
+// NewSchedule returns a schedule committed on the first channel in all
+// slots except the DW, and potential on the other channels.
+func NewSchedule(chans ...Channel) *Schedule {
+	s := &Schedule{CommittedDW: 1}
+	for i, c := range chans {
+		t := uint8(AvailPotential)
+		if i == 0 {
+			t = AvailCommitted
+		}
+		s.Slots = append(s.Slots, Slot{Type: t, Channel: c, Slots: AllSlots, Preference: 3})
+	}
+	return s
+}
+
+// Set replaces the slots, and increments the sequence ID advertised in
+// the Availability.
+func (s *Schedule) Set(slots []Slot) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Slots = slots
+	s.seq++
+}
+
+// Availability returns the Availability attribute for the schedule.
+func (s *Schedule) Availability() *Availability {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a := &Availability{SequenceID: s.seq, Control: uint16(s.MapID & 0x0F)}
+	for _, sl := range s.Slots {
+		e := AvailabilityEntry{
+			Control:           uint16(sl.Type&7) | uint16(sl.Preference&3)<<3,
+			TimeBitmapControl: slotsBitmapControl,
+			TimeBitmap:        sl.Slots.bitmap(),
+		}
+		if sl.Channel.OperatingClass != 0 {
+			e.Channels = []ChannelEntry{sl.Channel.channelEntry()}
+		} else {
+			e.Bands = []uint8{sl.Band}
+		}
+		a.Entries = append(a.Entries, e)
+	}
+	return a
+}
+
+// DeviceCapability returns the capability for the schedule - the
+// supported bands are the bands of the channels.
+func (s *Schedule) DeviceCapability() *DeviceCapability {
+	s.m.Lock()
+	defer s.m.Unlock()
+	dc := &DeviceCapability{
+		MapID:                s.MapID,
+		CommittedDW:          s.CommittedDW,
+		SupportedBands:       1 << Band24G,
+		OperationMode:        1,
+		MaxChannelSwitchTime: 0x1400,
+	}
+	for _, sl := range s.Slots {
+		if sl.Channel.OperatingClass != 0 {
+			dc.SupportedBands |= 1 << sl.Channel.Band()
+		} else {
+			dc.SupportedBands |= 1 << sl.Band
+		}
+	}
+	return dc
+}
+
+// PeerSchedule returns the schedule of a peer, from the Availability
+// attributes of all maps. Returns nil if the attributes have no
+// Availability.
+func PeerSchedule(attrs []Attribute) *Schedule {
+	var s *Schedule
+	for _, a := range attrs {
+		av, ok := a.(*Availability)
+		if !ok {
+			continue
+		}
+		if s == nil {
+			s = &Schedule{MapID: av.MapID(), seq: av.SequenceID}
+		}
+		for _, e := range av.Entries {
+			slots := AllSlots | 1
+			if e.TimeBitmap != nil {
+				slots = slotsFromBitmap(e.TimeBitmapControl, e.TimeBitmap)
+			}
+			t := e.Type()
+			pref := uint8(e.Control>>3) & 3
+			for _, ce := range e.Channels {
+				for _, c := range ce.channels() {
+					s.Slots = append(s.Slots, Slot{Type: t, Channel: c, Slots: slots, Preference: pref})
+				}
+			}
+			for _, b := range e.Bands {
+				s.Slots = append(s.Slots, Slot{Type: t, Band: b, Slots: slots, Preference: pref})
+			}
+		}
+	}
+	return s
+}
+
+// Next returns the channel and the TSF of the start of the next slot with
+// one of the types, after tsf. DW slots and band-only entries are skipped.
+func (s *Schedule) Next(tsf uint64, types uint8) (Channel, uint64, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	slotUs := uint64(SlotDuration * TU.Microseconds())
+	n := tsf/slotUs + 1
+	for i := uint64(0); i < SlotsPerDW; i++ {
+		idx := int((n + i) % SlotsPerDW)
+		if idx == 0 {
+			continue
+		}
+		for _, sl := range s.Slots {
+			if sl.Type&types != 0 && sl.Channel.Number != 0 && sl.Slots.Has(idx) {
+				return sl.Channel, (n + i) * slotUs, true
+			}
+		}
+	}
+	return Channel{}, 0, false
+}
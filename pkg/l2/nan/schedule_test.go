@@ -0,0 +1,102 @@
+package nan
+
+import (
+	"testing"
+)
+
+func TestSchedule(t *testing.T) {
+	chans, err := ParseChannels("6, 149")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSchedule(chans...)
+
+	dc := s.DeviceCapability()
+	if dc.SupportedBands != 1<<Band24G|1<<Band5G {
+		t.Error("Expecting 2.4 and 5GHz", dc.SupportedBands)
+	}
+
+	attrs, err := ParseAttributes(appendAttrs(t, nil, s.Availability()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := PeerSchedule(attrs)
+	if ps == nil || len(ps.Slots) != 2 {
+		t.Fatal("Unexpected peer schedule", ps)
+	}
+	if ps.Slots[0].Type != AvailCommitted || ps.Slots[0].Channel.Freq() != 2437 ||
+		ps.Slots[0].Slots != AllSlots {
+		t.Error("Unexpected committed slots", ps.Slots[0])
+	}
+	if ps.Slots[1].Type != AvailPotential || ps.Slots[1].Channel.Freq() != 5745 {
+		t.Error("Unexpected potential slots", ps.Slots[1])
+	}
+
+	// Next committed slot - after the DW
+	slotUs := uint64(SlotDuration * 1024)
+	ch, start, ok := ps.Next(31*slotUs+5, AvailCommitted)
+	if !ok || ch != chans[0] || start != 33*slotUs {
+		t.Error("Unexpected next slot", ch, start/slotUs)
+	}
+
+	// Only slots 4-7 on 149
+	s.Set([]Slot{{Type: AvailCommitted, Channel: chans[1], Slots: SlotRange(4, 7)}})
+	ps = PeerSchedule([]Attribute{s.Availability()})
+	ch, start, ok = ps.Next(10*slotUs, AvailCommitted)
+	if !ok || ch != chans[1] || start != 36*slotUs {
+		t.Error("Unexpected next slot", ch, start/slotUs)
+	}
+}
+
+func TestSlotsFromBitmap(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ctl  uint16
+		bm   []byte
+		want Slots
+	}{
+		{"512TU", 0x0018, []byte{0xfe, 0xff, 0xff, 0x3f}, 0x3ffffffe},
+		// 32 TU bits, offset 2 slots
+		{"32TU offset", 1 | 3<<3 | 2<<6, []byte{0x03}, SlotRange(2, 5)},
+		// 128 TU period repeats 4 times
+		{"128TU", 1 << 3, []byte{0x02}, 0x02020202},
+		// 1024 TU period - only slots available in both halves
+		{"1024TU", 4 << 3, []byte{0x0f, 0, 0, 0, 0x03, 0, 0, 0}, 0x03},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := slotsFromBitmap(tc.ctl, tc.bm); got != tc.want {
+				t.Errorf("got %08x want %08x", uint32(got), uint32(tc.want))
+			}
+		})
+	}
+}
+
+func TestChannelEntry(t *testing.T) {
+	c := Channel{OperatingClass: 128, Number: 153}
+	e := c.channelEntry()
+	if e.ChannelBitmap != 1<<5 || e.PrimaryChannelBitmap != 1<<1 {
+		t.Fatal("Unexpected 80MHz entry", e)
+	}
+	if cs := e.channels(); len(cs) != 1 || cs[0] != c {
+		t.Error("Unexpected channels", cs)
+	}
+	// Android potential entry: channels 1-11
+	if cs := (ChannelEntry{OperatingClass: 81, ChannelBitmap: 0x07ff}).channels(); len(cs) != 11 {
+		t.Error("Expecting 11 channels", cs)
+	}
+}
+
+func TestFreqChannel(t *testing.T) {
+	for freq, want := range map[int]Channel{
+		2437: {OperatingClass: 81, Number: 6},
+		5180: {OperatingClass: 115, Number: 36},
+		5745: {OperatingClass: 125, Number: 149},
+	} {
+		if c, err := FreqChannel(freq); err != nil || c != want || c.Freq() != freq {
+			t.Error("Unexpected channel", freq, c, err)
+		}
+	}
+	if _, err := FreqChannel(2484); err == nil {
+		t.Error("Expecting error for channel 14")
+	}
+}
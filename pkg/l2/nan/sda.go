@@ -0,0 +1,283 @@
+package nan
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ServiceControlType is the type of a service descriptor.
+type ServiceControlType uint8
+
+const (
+	Publish   ServiceControlType = 0
+	Subscribe ServiceControlType = 1
+	FollowUp  ServiceControlType = 2
+)
+
+func (t ServiceControlType) String() string {
+	switch t {
+	case Publish:
+		return "publish"
+	case Subscribe:
+		return "subscribe"
+	case FollowUp:
+		return "followup"
+	}
+	return "reserved"
+}
+
+// Service control bits, after the 2 type bits.
+const (
+	sdaMatchingFilter = 1 << 2
+	sdaResponseFilter = 1 << 3
+	sdaServiceInfo    = 1 << 4
+	sdaRangeLimited   = 1 << 5
+	sdaBindingBitmap  = 1 << 6
+)
+
+// ServiceDescriptor (SDA) is the main attribute of publish, subscribe and
+// follow-up SDFs.
+//
+// Optional fields are encoded only if set.
+type ServiceDescriptor struct {
+	ServiceID ServiceID
+
+	// InstanceID of the publish or subscribe on the sending device.
+	InstanceID uint8
+
+	// RequestorInstanceID is the instance of the peer - extracted from the
+	// subscribe or publish being answered.
+	RequestorInstanceID uint8
+
+	Type ServiceControlType
+
+	RangeLimited bool
+
+	HasBindingBitmap bool
+	BindingBitmap    uint16
+
+	// MatchingFilter is a list of LV encoded filters. An empty entry
+	// matches anything.
+	MatchingFilter [][]byte
+
+	// ResponseFilter is the raw service response filter - control and
+	// bloom filter or address list.
+	ResponseFilter []byte
+
+	// ServiceInfo is the application payload, max 255 bytes.
+	// The SDEA can carry longer info.
+	ServiceInfo []byte
+}
+
+func (a *ServiceDescriptor) ID() AttrID { return AttrServiceDescriptor }
+
+// Validate checks the fields with 1 byte lengths - filters and service
+// info.
+func (a *ServiceDescriptor) Validate() error {
+	if len(a.ServiceInfo) > 255 {
+		return fmt.Errorf("%w: service info %d", errAttrTooLong, len(a.ServiceInfo))
+	}
+	if len(a.ResponseFilter) > 255 {
+		return fmt.Errorf("%w: response filter %d", errAttrTooLong, len(a.ResponseFilter))
+	}
+	n := 0
+	for _, f := range a.MatchingFilter {
+		if len(f) > 255 {
+			return fmt.Errorf("%w: matching filter %d", errAttrTooLong, len(f))
+		}
+		n += 1 + len(f)
+	}
+	if n > 255 {
+		return fmt.Errorf("%w: matching filters %d", errAttrTooLong, n)
+	}
+	return nil
+}
+
+// AppendBody encodes the descriptor - Validate must pass, AppendAttributes
+// checks it.
+func (a *ServiceDescriptor) AppendBody(b []byte) []byte {
+	ctl := byte(a.Type) & 3
+	if a.MatchingFilter != nil {
+		ctl |= sdaMatchingFilter
+	}
+	if a.ResponseFilter != nil {
+		ctl |= sdaResponseFilter
+	}
+	if a.ServiceInfo != nil {
+		ctl |= sdaServiceInfo
+	}
+	if a.RangeLimited {
+		ctl |= sdaRangeLimited
+	}
+	if a.HasBindingBitmap {
+		ctl |= sdaBindingBitmap
+	}
+
+	b = append(b, a.ServiceID[:]...)
+	b = append(b, a.InstanceID, a.RequestorInstanceID, ctl)
+
+	if a.HasBindingBitmap {
+		b = binary.LittleEndian.AppendUint16(b, a.BindingBitmap)
+	}
+	if a.MatchingFilter != nil {
+		b = append(b, 0)
+		start := len(b)
+		for _, f := range a.MatchingFilter {
+			b = append(b, byte(len(f)))
+			b = append(b, f...)
+		}
+		b[start-1] = byte(len(b) - start)
+	}
+	if a.ResponseFilter != nil {
+		b = append(b, byte(len(a.ResponseFilter)))
+		b = append(b, a.ResponseFilter...)
+	}
+	if a.ServiceInfo != nil {
+		b = append(b, byte(len(a.ServiceInfo)))
+		b = append(b, a.ServiceInfo...)
+	}
+	return b
+}
+
+func (a *ServiceDescriptor) UnmarshalBody(body []byte) error {
+	if len(body) < 9 {
+		return errShortAttr
+	}
+	copy(a.ServiceID[:], body[0:6])
+	a.InstanceID = body[6]
+	a.RequestorInstanceID = body[7]
+	ctl := body[8]
+	a.Type = ServiceControlType(ctl & 3)
+	a.RangeLimited = ctl&sdaRangeLimited != 0
+	a.HasBindingBitmap = ctl&sdaBindingBitmap != 0
+	body = body[9:]
+
+	if a.HasBindingBitmap {
+		if len(body) < 2 {
+			return errShortAttr
+		}
+		a.BindingBitmap = binary.LittleEndian.Uint16(body)
+		body = body[2:]
+	}
+
+	var err error
+	if ctl&sdaMatchingFilter != 0 {
+		var mf []byte
+		if mf, body, err = lv(body); err != nil {
+			return err
+		}
+		a.MatchingFilter = [][]byte{}
+		for len(mf) > 0 {
+			var f []byte
+			if f, mf, err = lv(mf); err != nil {
+				return err
+			}
+			a.MatchingFilter = append(a.MatchingFilter, f)
+		}
+	}
+	if ctl&sdaResponseFilter != 0 {
+		if a.ResponseFilter, body, err = lv(body); err != nil {
+			return err
+		}
+	}
+	if ctl&sdaServiceInfo != 0 {
+		if a.ServiceInfo, body, err = lv(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lv splits a 1-byte length prefixed value from b.
+func lv(b []byte) ([]byte, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, nil, errShortAttr
+	}
+	l := int(b[0])
+	return b[1 : 1+l], b[1+l:], nil
+}
+
+// Service descriptor extension control bits.
+const (
+	SDEAFSDRequired      = 1 << 0
+	SDEAFSDWithGAS       = 1 << 1
+	SDEADataPathRequired = 1 << 2
+	SDEADataPathMcast    = 1 << 3
+	SDEAQoSRequired      = 1 << 5
+	SDEASecurityRequired = 1 << 6
+	SDEARangingRequired  = 1 << 7
+	SDEARangeLimit       = 1 << 8
+	SDEAServiceUpdate    = 1 << 9
+)
+
+// ServiceDescriptorExt (SDEA) extends the SDA with the same instance ID.
+//
+// Range limit and service update indicator are encoded if the matching
+// bit is set in Control.
+type ServiceDescriptorExt struct {
+	InstanceID uint8
+
+	Control uint16
+
+	// Ingress and egress range limits, in cm.
+	IngressRange uint16
+	EgressRange  uint16
+
+	// ServiceUpdateIndicator is incremented when the service info changes.
+	ServiceUpdateIndicator uint8
+
+	// ServiceInfo is the extended service info - starting with OUI and
+	// service protocol type. Encoded if not nil.
+	ServiceInfo []byte
+}
+
+func (a *ServiceDescriptorExt) ID() AttrID { return AttrServiceDescriptorExt }
+
+func (a *ServiceDescriptorExt) AppendBody(b []byte) []byte {
+	b = append(b, a.InstanceID)
+	b = binary.LittleEndian.AppendUint16(b, a.Control)
+	if a.Control&SDEARangeLimit != 0 {
+		b = binary.LittleEndian.AppendUint16(b, a.IngressRange)
+		b = binary.LittleEndian.AppendUint16(b, a.EgressRange)
+	}
+	if a.Control&SDEAServiceUpdate != 0 {
+		b = append(b, a.ServiceUpdateIndicator)
+	}
+	if a.ServiceInfo != nil {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(a.ServiceInfo)))
+		b = append(b, a.ServiceInfo...)
+	}
+	return b
+}
+
+func (a *ServiceDescriptorExt) UnmarshalBody(body []byte) error {
+	if len(body) < 3 {
+		return errShortAttr
+	}
+	a.InstanceID = body[0]
+	a.Control = binary.LittleEndian.Uint16(body[1:])
+	body = body[3:]
+	if a.Control&SDEARangeLimit != 0 {
+		if len(body) < 4 {
+			return errShortAttr
+		}
+		a.IngressRange = binary.LittleEndian.Uint16(body)
+		a.EgressRange = binary.LittleEndian.Uint16(body[2:])
+		body = body[4:]
+	}
+	if a.Control&SDEAServiceUpdate != 0 {
+		if len(body) < 1 {
+			return errShortAttr
+		}
+		a.ServiceUpdateIndicator = body[0]
+		body = body[1:]
+	}
+	if len(body) >= 2 {
+		l := int(binary.LittleEndian.Uint16(body))
+		if len(body) < 2+l {
+			return errShortAttr
+		}
+		a.ServiceInfo = body[2 : 2+l]
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package nan
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoInstanceID is returned when all 255 instance IDs are in use.
+var errNoInstanceID = errors.New("no free NAN instance ID")
+
+// NewServiceID returns the service ID for a service name - the first 6
+// bytes of the SHA-256 of the lower case name.
+func NewServiceID(name string) ServiceID {
+	var id ServiceID
+	h := sha256.Sum256([]byte(strings.ToLower(name)))
+	copy(id[:], h[:])
+	return id
+}
+
+// Service is a local publish or subscribe.
+type Service struct {
+	Name string
+
+	// ID is derived from Name when the service is added.
+	ID ServiceID
+
+	// Type is Publish or Subscribe.
+	Type ServiceControlType
+
+	// Unsolicited publish is sent in each DW. Solicited publish is sent
+	// in reply to active subscribes.
+	Unsolicited bool
+	Solicited   bool
+
+	// Active subscribe is sent in each DW. A passive subscribe only
+	// matches unsolicited publishes.
+	Active bool
+
+	// MatchFilter is sent in the SDA, and must match the filter of the
+	// peer. Empty entries match anything.
+	MatchFilter [][]byte
+
+	ServiceInfo []byte
+
+	// TTL of the service, 0 if it doesn't expire.
+	TTL time.Duration
+
+	// OnMatch is called for publishes matching a subscribe, and for
+	// follow-ups sent to this service instance.
+	// Called without holding locks - may send follow-ups.
+	OnMatch func(*Match)
+
+	instanceID uint8
+	expires    time.Time
+	updates    uint8
+}
+
+// NewPublish returns a solicited and unsolicited publish for the service.
+func NewPublish(name string, info []byte) *Service {
+	return &Service{
+		Name:        name,
+		Type:        Publish,
+		Unsolicited: true,
+		Solicited:   true,
+		ServiceInfo: info,
+	}
+}
+
+// NewSubscribe returns a subscribe for the service.
+func NewSubscribe(name string, active bool, onMatch func(*Match)) *Service {
+	return &Service{
+		Name:    name,
+		Type:    Subscribe,
+		Active:  active,
+		OnMatch: onMatch,
+	}
+}
+
+// InstanceID returns the ID assigned when the service was added, 0 if not
+// added.
+func (s *Service) InstanceID() uint8 {
+	return s.instanceID
+}
+
+// Match is a discovery result or a follow-up from a peer.
+type Match struct {
+	// Service is the local service.
+	Service *Service
+
+	// Type of the received SDA - Publish or FollowUp.
+	Type ServiceControlType
+
+	Peer           net.HardwareAddr
+	PeerInstanceID uint8
+
+	ServiceInfo []byte
+	MatchFilter [][]byte
+
+	RSSI int
+}
+
+// Services is the registry of local services, shared by all apps using the
+// NAN interface.
+type Services struct {
+	m sync.Mutex
+
+	byInstance map[uint8]*Service
+	last       uint8
+}
+
+// NewServices returns an empty registry.
+func NewServices() *Services {
+	return &Services{byInstance: map[uint8]*Service{}}
+}
+
+// Add registers a service and returns the assigned instance ID.
+// The service ID is computed from the name.
+func (r *Services) Add(s *Service) (uint8, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	id := r.last
+	for i := 0; i < 255; i++ {
+		id++
+		if id == 0 {
+			id = 1
+		}
+		if r.byInstance[id] == nil {
+			s.ID = NewServiceID(s.Name)
+			s.instanceID = id
+			if s.TTL > 0 {
+				s.expires = time.Now().Add(s.TTL)
+			}
+			r.byInstance[id] = s
+			r.last = id
+			return id, nil
+		}
+	}
+	return 0, errNoInstanceID
+}
+
+// Remove cancels a publish or subscribe.
+func (r *Services) Remove(instanceID uint8) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.byInstance, instanceID)
+}
+
+// Get returns the service with the instance ID, or nil.
+func (r *Services) Get(instanceID uint8) *Service {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.byInstance[instanceID]
+}
+
+// SetServiceInfo updates the service info of a service, and increments the
+// service update indicator sent in the SDEA.
+func (r *Services) SetServiceInfo(instanceID uint8, info []byte) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if s := r.byInstance[instanceID]; s != nil {
+		s.ServiceInfo = info
+		s.updates++
+	}
+}
+
+// active returns the non-expired services, removing expired ones.
+func (r *Services) active(now time.Time) []*Service {
+	res := []*Service{}
+	for id, s := range r.byInstance {
+		if !s.expires.IsZero() && now.After(s.expires) {
+			delete(r.byInstance, id)
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// List returns the active services, by instance ID.
+func (r *Services) List() []*Service {
+	r.m.Lock()
+	defer r.m.Unlock()
+	l := r.active(time.Now())
+	sort.Slice(l, func(i, j int) bool { return l[i].instanceID < l[j].instanceID })
+	return l
+}
+
+// IDs returns the IDs of the published services, for the beacon service
+// ID list.
+func (r *Services) IDs(now time.Time) ServiceIDList {
+	r.m.Lock()
+	defer r.m.Unlock()
+	l := ServiceIDList{}
+	for _, s := range r.active(now) {
+		if s.Type == Publish {
+			l = append(l, s.ID)
+		}
+	}
+	return l
+}
+
+// sda returns the service descriptor for a local service.
+func (s *Service) sda(t ServiceControlType, requestor uint8) *ServiceDescriptor {
+	return &ServiceDescriptor{
+		ServiceID:           s.ID,
+		InstanceID:          s.instanceID,
+		RequestorInstanceID: requestor,
+		Type:                t,
+		MatchingFilter:      s.MatchFilter,
+		ServiceInfo:         s.ServiceInfo,
+	}
+}
+
+// Attrs returns the SDA and SDEA attributes to send in the DW - for
+// unsolicited publishes and active subscribes. Expired services are
+// removed.
+func (r *Services) Attrs(now time.Time) []Attribute {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	attrs := []Attribute{}
+	for _, s := range r.active(now) {
+		if (s.Type == Publish && !s.Unsolicited) ||
+			(s.Type == Subscribe && !s.Active) {
+			continue
+		}
+		attrs = append(attrs, s.sda(s.Type, 0), &ServiceDescriptorExt{
+			InstanceID:             s.instanceID,
+			Control:                SDEAServiceUpdate,
+			ServiceUpdateIndicator: s.updates,
+		})
+	}
+	return attrs
+}
+
+// OnSDF matches the SDAs of a received SDF against the local services.
+// OnMatch is called for matching publishes and follow-ups. The returned
+// attributes are the solicited publishes to send to src, in reply to
+// matching subscribes - nil if none.
+func (r *Services) OnSDF(src net.HardwareAddr, rssi int, attrs []Attribute) []Attribute {
+	var replies []Attribute
+	var matches []*Match
+
+	r.m.Lock()
+	local := r.active(time.Now())
+	for _, a := range attrs {
+		sda, ok := a.(*ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		for _, s := range local {
+			if s.ID != sda.ServiceID {
+				continue
+			}
+			m := &Match{
+				Service:        s,
+				Type:           sda.Type,
+				Peer:           src,
+				PeerInstanceID: sda.InstanceID,
+				ServiceInfo:    sda.ServiceInfo,
+				MatchFilter:    sda.MatchingFilter,
+				RSSI:           rssi,
+			}
+			switch sda.Type {
+			case Publish:
+				// Solicited publishes are sent to a specific subscribe.
+				if s.Type != Subscribe ||
+					(sda.RequestorInstanceID != 0 && sda.RequestorInstanceID != s.instanceID) ||
+					!MatchFilters(s.MatchFilter, sda.MatchingFilter) {
+					continue
+				}
+				matches = append(matches, m)
+			case Subscribe:
+				if s.Type != Publish || !s.Solicited ||
+					!MatchFilters(s.MatchFilter, sda.MatchingFilter) {
+					continue
+				}
+				replies = append(replies, s.sda(Publish, sda.InstanceID))
+			case FollowUp:
+				if sda.RequestorInstanceID != s.instanceID {
+					continue
+				}
+				matches = append(matches, m)
+			}
+		}
+	}
+	r.m.Unlock()
+
+	for _, m := range matches {
+		if m.Service.OnMatch != nil {
+			m.Service.OnMatch(m)
+		}
+	}
+	return replies
+}
+
+// MatchFilters compares the local and peer matching filters. Entries are
+// compared in order - an empty or missing entry on either side matches
+// anything.
+func MatchFilters(local, peer [][]byte) bool {
+	for i := 0; i < len(local) && i < len(peer); i++ {
+		if len(local[i]) == 0 || len(peer[i]) == 0 {
+			continue
+		}
+		if !bytes.Equal(local[i], peer[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package nan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceID(t *testing.T) {
+	if NewServiceID("DMesh") != dmeshID {
+		t.Error("Unexpected service ID", NewServiceID("dmesh"))
+	}
+}
+
+func TestServices(t *testing.T) {
+	pubs := NewServices()
+	subs := NewServices()
+
+	pub := NewPublish("dmesh", []byte("info"))
+	pub.Unsolicited = false
+	pub.MatchFilter = [][]byte{[]byte("v1"), {}}
+	if _, err := pubs.Add(pub); err != nil {
+		t.Fatal(err)
+	}
+	pubs.Add(NewPublish("other", nil))
+
+	var matches []*Match
+	sub := NewSubscribe("DMESH", true, func(m *Match) {
+		matches = append(matches, m)
+	})
+	sub.MatchFilter = [][]byte{{}, []byte("x")}
+	subs.Add(sub)
+
+	// Only the unsolicited publish and active subscribe are sent in DW
+	now := time.Now()
+	if l := len(pubs.Attrs(now)); l != 2 {
+		t.Fatal("Expecting 1 SDA and SDEA", l)
+	}
+	if l := pubs.IDs(now); len(l) != 2 {
+		t.Error("Expecting 2 published IDs", l)
+	}
+
+	// Subscribe from the peer gets a solicited reply
+	replies := pubs.OnSDF(macB, -50, subs.Attrs(now))
+	if len(replies) != 1 {
+		t.Fatal("Expecting reply", Dump(replies))
+	}
+	if sda := replies[0].(*ServiceDescriptor); sda.Type != Publish ||
+		sda.RequestorInstanceID != sub.InstanceID() {
+		t.Error("Invalid reply", sda)
+	}
+
+	subs.OnSDF(macA, -50, replies)
+	if len(matches) != 1 || string(matches[0].ServiceInfo) != "info" ||
+		matches[0].PeerInstanceID != pub.InstanceID() {
+		t.Fatal("Expecting match", matches)
+	}
+
+	// Follow-up to the subscribe instance
+	subs.OnSDF(macA, -50, []Attribute{&ServiceDescriptor{ServiceID: pub.ID,
+		InstanceID: pub.InstanceID(), RequestorInstanceID: sub.InstanceID(),
+		Type: FollowUp, ServiceInfo: []byte("hi")}})
+	if len(matches) != 2 || matches[1].Type != FollowUp {
+		t.Error("Expecting follow-up", matches)
+	}
+
+	// Filter mismatch
+	sub.MatchFilter = [][]byte{[]byte("v2")}
+	if r := pubs.OnSDF(macB, -50, subs.Attrs(now)); len(r) != 0 {
+		t.Error("Unexpected reply", Dump(r))
+	}
+
+	// TTL
+	sub.TTL = time.Second
+	subs.Remove(sub.InstanceID())
+	subs.Add(sub)
+	if l := len(subs.Attrs(now.Add(2 * time.Second))); l != 0 || subs.Get(sub.InstanceID()) != nil {
+		t.Error("Expecting expired subscribe", l)
+	}
+}
@@ -0,0 +1,386 @@
+package nan
+
+import (
+	"bytes"
+	"crypto/rand"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timing constants, in TU (1024 microseconds).
+const (
+	// TU is the 802.11 time unit.
+	TU = 1024 * time.Microsecond
+
+	// DWInterval is the period of the 2.4GHz discovery windows, 512 TU.
+	DWInterval = 512
+
+	// DW0Interval is the period of DW0 - where TSF lower 23 bits are 0.
+	DW0Interval = 8192
+
+	// DWDuration is the length of a discovery window.
+	DWDuration = 16
+
+	// SyncBeaconInterval is the beacon interval field of sync beacons.
+	// Discovery beacons use 100 TU.
+	SyncBeaconInterval = 512
+)
+
+// RSSI thresholds used in master election, dBm.
+const (
+	RSSIClose  = -60
+	RSSIMiddle = -75
+)
+
+// Role of the device in the cluster.
+type Role int
+
+const (
+	// RoleMaster sends sync and discovery beacons.
+	RoleMaster Role = iota
+
+	// RoleNonMasterSync sends sync beacons, to extend the cluster.
+	RoleNonMasterSync
+
+	// RoleNonMasterNonSync doesn't send beacons.
+	RoleNonMasterNonSync
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleMaster:
+		return "master"
+	case RoleNonMasterSync:
+		return "nms"
+	case RoleNonMasterNonSync:
+		return "nmns"
+	}
+	return "unknown"
+}
+
+// Beacon holds the fields of a received NAN beacon used for sync.
+type Beacon struct {
+	Src       net.HardwareAddr
+	ClusterID net.HardwareAddr
+
+	// TSF is the beacon timestamp, in microseconds.
+	TSF uint64
+
+	// Interval is 512 for sync beacons, 100 for discovery beacons.
+	Interval uint16
+
+	RSSI int
+
+	// Received is the local time when the beacon was received.
+	Received time.Time
+
+	Attrs []Attribute
+}
+
+// syncPeer tracks the last sync beacon from a device in the cluster.
+type syncPeer struct {
+	rank MasterRank
+	am   MasterRank
+	hop  uint8
+	rssi int
+	last time.Time
+}
+
+// Sync implements NAN cluster synchronization: master election, anchor
+// master selection, cluster TSF and cluster merging.
+//
+// The state is updated from received beacons (OnBeacon) and on each DW
+// (Update) - the caller sends beacons based on the returned role.
+type Sync struct {
+	m sync.Mutex
+
+	addr net.HardwareAddr
+
+	// Preference and random factor of this device.
+	preference uint8
+	random     uint8
+
+	clusterID net.HardwareAddr
+	role      Role
+
+	anchorMaster MasterRank
+	hopCount     uint8
+	ambtt        uint32
+	amUpdated    time.Time
+
+	// Cluster TSF is the local monotonic time plus the offset, in
+	// microseconds.
+	base      time.Time
+	tsfOffset int64
+
+	peers map[string]*syncPeer
+}
+
+// NewSync creates the sync state for an interface. The device starts as
+// master of a new cluster, with a random cluster ID, until it hears a
+// cluster with a higher grade.
+func NewSync(addr net.HardwareAddr, preference uint8) *Sync {
+	var r [3]byte
+	rand.Read(r[:])
+
+	s := &Sync{
+		addr:       addr,
+		preference: preference,
+		random:     r[0],
+		clusterID: net.HardwareAddr{ClusterIDPrefix[0], ClusterIDPrefix[1],
+			ClusterIDPrefix[2], ClusterIDPrefix[3], r[1], r[2]},
+		base:  time.Now(),
+		peers: map[string]*syncPeer{},
+	}
+	s.becomeAnchorMaster(s.base)
+	return s
+}
+
+// Rank returns the master rank of this device.
+func (s *Sync) Rank() MasterRank {
+	return NewMasterRank(s.preference, s.random, s.addr)
+}
+
+func (s *Sync) becomeAnchorMaster(now time.Time) {
+	s.role = RoleMaster
+	s.anchorMaster = s.Rank()
+	s.hopCount = 0
+	s.ambtt = 0
+	s.amUpdated = now
+}
+
+func (s *Sync) isAnchorMaster() bool {
+	return s.anchorMaster == s.Rank()
+}
+
+func (s *Sync) localMicros(t time.Time) int64 {
+	return t.Sub(s.base).Microseconds()
+}
+
+// TSF returns the cluster TSF at the given local time, in microseconds.
+func (s *Sync) TSF(t time.Time) uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return uint64(s.localMicros(t) + s.tsfOffset)
+}
+
+// NextDW returns the local time of the start of the next DW.
+func (s *Sync) NextDW(now time.Time) time.Time {
+	tsf := s.TSF(now)
+	p := uint64(DWInterval * TU / time.Microsecond)
+	return now.Add(time.Duration(p-tsf%p) * time.Microsecond)
+}
+
+// NextDW0 returns the local time of the start of the next DW0.
+func (s *Sync) NextDW0(now time.Time) time.Time {
+	tsf := s.TSF(now)
+	p := uint64(DW0Interval * TU / time.Microsecond)
+	return now.Add(time.Duration(p-tsf%p) * time.Microsecond)
+}
+
+// DWIndex returns the index of the DW nearest to now, in the DW0 period -
+// 0 for DW0, up to 15. Devices with an awake interval of N DWs are awake
+// in the DWs with index multiple of N.
+func (s *Sync) DWIndex(now time.Time) int {
+	tsf := s.TSF(now)
+	p := uint64(DWInterval * TU / time.Microsecond)
+	return int((tsf+p/2)/p) % (DW0Interval / DWInterval)
+}
+
+// ClusterID returns the current cluster ID, used as BSSID.
+func (s *Sync) ClusterID() net.HardwareAddr {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.clusterID
+}
+
+// Role returns the current role.
+func (s *Sync) Role() Role {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.role
+}
+
+// SetPreference changes the master preference of this device.
+func (s *Sync) SetPreference(p uint8) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	am := s.isAnchorMaster()
+	s.preference = p
+	if am {
+		s.anchorMaster = s.Rank()
+	}
+}
+
+// BeaconAttrs returns the cluster ID, TSF and the master indication and
+// cluster attributes to send in a beacon at the given time.
+func (s *Sync) BeaconAttrs(now time.Time) (net.HardwareAddr, uint64, *MasterIndication, *Cluster) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	tsf := uint64(s.localMicros(now) + s.tsfOffset)
+	c := &Cluster{
+		AnchorMaster:    s.anchorMaster,
+		HopCount:        s.hopCount,
+		AnchorMasterBTT: s.ambtt,
+	}
+	if s.isAnchorMaster() {
+		c.AnchorMasterBTT = uint32(tsf)
+	}
+	return s.clusterID, tsf,
+		&MasterIndication{Preference: s.preference, RandomFactor: s.random}, c
+}
+
+// OnBeacon updates the state from a beacon received from another device.
+func (s *Sync) OnBeacon(b *Beacon) {
+	mi, _ := Find(b.Attrs, AttrMasterIndication).(*MasterIndication)
+	cl, _ := Find(b.Attrs, AttrCluster).(*Cluster)
+	if mi == nil || cl == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !bytes.Equal(b.ClusterID, s.clusterID) && !s.maybeMerge(b, cl) {
+		return
+	}
+
+	if b.Interval != SyncBeaconInterval {
+		return
+	}
+
+	rank := NewMasterRank(mi.Preference, mi.RandomFactor, b.Src)
+	s.peers[b.Src.String()] = &syncPeer{
+		rank: rank,
+		am:   cl.AnchorMaster,
+		hop:  cl.HopCount,
+		rssi: b.RSSI,
+		last: b.Received,
+	}
+
+	s.selectAnchorMaster(b, cl)
+
+	// Follow the TSF of devices closer to the anchor master.
+	if !s.isAnchorMaster() && cl.AnchorMaster == s.anchorMaster &&
+		cl.HopCount < s.hopCount {
+		s.tsfOffset = int64(b.TSF) - s.localMicros(b.Received)
+	}
+}
+
+// selectAnchorMaster implements the anchor master selection rules, for a
+// sync beacon in the same cluster.
+func (s *Sync) selectAnchorMaster(b *Beacon, cl *Cluster) {
+	am := cl.AnchorMaster
+	switch {
+	case am > s.anchorMaster:
+		if bytes.Equal(am.Addr(), s.addr) {
+			// Stale info about this device
+			return
+		}
+		s.setAnchorMaster(b, cl)
+	case am < s.anchorMaster:
+		// Our AM lowered its rank, or the peer knows a different AM.
+		if !s.isAnchorMaster() && bytes.Equal(am.Addr(), s.anchorMaster.Addr()) {
+			s.setAnchorMaster(b, cl)
+		}
+	default:
+		if s.isAnchorMaster() {
+			return
+		}
+		if cl.AnchorMasterBTT > s.ambtt {
+			s.ambtt = cl.AnchorMasterBTT
+			s.amUpdated = b.Received
+		}
+		if cl.HopCount+1 < s.hopCount {
+			s.hopCount = cl.HopCount + 1
+		}
+	}
+}
+
+func (s *Sync) setAnchorMaster(b *Beacon, cl *Cluster) {
+	if s.isAnchorMaster() {
+		log.Println("NAN: anchor master", cl.AnchorMaster.Addr(), b.Src, cl.HopCount)
+	}
+	s.anchorMaster = cl.AnchorMaster
+	s.hopCount = cl.HopCount + 1
+	s.ambtt = cl.AnchorMasterBTT
+	s.amUpdated = b.Received
+	s.tsfOffset = int64(b.TSF) - s.localMicros(b.Received)
+}
+
+// maybeMerge joins the cluster of the beacon if it has a higher grade.
+// The grade is the master preference of the anchor master, then the TSF.
+func (s *Sync) maybeMerge(b *Beacon, cl *Cluster) bool {
+	theirs := cl.AnchorMaster.Preference()
+	ours := s.anchorMaster.Preference()
+	if theirs < ours {
+		return false
+	}
+	if theirs == ours &&
+		int64(b.TSF) <= s.localMicros(b.Received)+s.tsfOffset {
+		return false
+	}
+
+	log.Println("NAN: join cluster", b.ClusterID, "from", s.clusterID, b.Src,
+		cl.AnchorMaster.Addr())
+	s.clusterID = append(net.HardwareAddr{}, b.ClusterID...)
+	s.peers = map[string]*syncPeer{}
+	s.role = RoleNonMasterNonSync
+	s.setAnchorMaster(b, cl)
+	return true
+}
+
+// Update runs the master election - called on each DW - and returns the
+// role for the DW.
+func (s *Sync) Update(now time.Time) Role {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Beacons from the last 3 DWs are used.
+	exp := now.Add(-3 * DWInterval * TU)
+	for k, p := range s.peers {
+		if p.last.Before(exp) {
+			delete(s.peers, k)
+		}
+	}
+
+	if !s.isAnchorMaster() &&
+		now.Sub(s.amUpdated) > 3*DW0Interval*TU {
+		log.Println("NAN: anchor master lost", s.anchorMaster.Addr())
+		s.becomeAnchorMaster(now)
+	}
+
+	rank := s.Rank()
+	nClose, nMiddle, syncHigher := 0, 0, 0
+	for _, p := range s.peers {
+		if p.rank <= rank || p.am != s.anchorMaster {
+			continue
+		}
+		if p.rssi > RSSIClose {
+			nClose++
+		}
+		if p.rssi > RSSIMiddle {
+			nMiddle++
+		}
+		// Devices that are at most as far from the AM can sync the
+		// cluster instead of this device.
+		if p.rssi > RSSIClose && (p.hop <= s.hopCount || s.isAnchorMaster()) {
+			syncHigher++
+		}
+	}
+
+	role := RoleMaster
+	if nClose > 0 || nMiddle >= 3 {
+		role = RoleNonMasterSync
+		if syncHigher >= 2 {
+			role = RoleNonMasterNonSync
+		}
+	}
+	if role != s.role {
+		log.Println("NAN: role", s.role, "->", role, s.clusterID)
+	}
+	s.role = role
+	return role
+}
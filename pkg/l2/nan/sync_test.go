@@ -0,0 +1,118 @@
+package nan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	macA = net.HardwareAddr{2, 0, 0, 0, 0, 0xA}
+	macB = net.HardwareAddr{2, 0, 0, 0, 0, 0xB}
+	macC = net.HardwareAddr{2, 0, 0, 0, 0, 0xC}
+)
+
+// beaconFrom returns the sync beacon a device would send.
+func beaconFrom(s *Sync, src net.HardwareAddr, now time.Time, rssi int) *Beacon {
+	cid, tsf, mi, cl := s.BeaconAttrs(now)
+	return &Beacon{
+		Src:       src,
+		ClusterID: cid,
+		TSF:       tsf,
+		Interval:  SyncBeaconInterval,
+		RSSI:      rssi,
+		Received:  now,
+		Attrs:     []Attribute{mi, cl},
+	}
+}
+
+func TestSyncMerge(t *testing.T) {
+	now := time.Now()
+	a := NewSync(macA, 100)
+	b := NewSync(macB, 200)
+
+	if a.Role() != RoleMaster || !IsClusterID(a.ClusterID()) {
+		t.Fatal("Expecting master of new cluster", a.Role(), a.ClusterID())
+	}
+
+	// Lower grade cluster is ignored
+	b.OnBeacon(beaconFrom(a, macA, now, -50))
+	if bytes.Equal(b.ClusterID(), a.ClusterID()) {
+		t.Fatal("Unexpected merge into lower grade cluster")
+	}
+
+	a.OnBeacon(beaconFrom(b, macB, now, -50))
+	if !bytes.Equal(b.ClusterID(), a.ClusterID()) {
+		t.Fatal("Expecting merge", a.ClusterID(), b.ClusterID())
+	}
+	_, _, _, cl := a.BeaconAttrs(now)
+	if cl.AnchorMaster != b.Rank() || cl.HopCount != 1 {
+		t.Error("Unexpected anchor master", cl)
+	}
+
+	// TSF follows the anchor master
+	later := now.Add(time.Second)
+	// Microsecond truncation may differ by 1
+	if d := int64(a.TSF(later)) - int64(b.TSF(later)); d < -1 || d > 1 {
+		t.Error("TSF not synced", d)
+	}
+	dw := a.NextDW(later)
+	if a.TSF(dw)%(DWInterval*1024) != 0 {
+		t.Error("NextDW not aligned", a.TSF(dw))
+	}
+
+	// Close to a higher rank master - stops being master.
+	if r := a.Update(now); r != RoleNonMasterSync {
+		t.Error("Expecting non-master sync", r)
+	}
+}
+
+func TestSyncElection(t *testing.T) {
+	now := time.Now()
+	am := NewSync(macC, 250)
+	b := NewSync(macB, 200)
+	a := NewSync(macA, 100)
+	b.OnBeacon(beaconFrom(am, macC, now, -50))
+	a.OnBeacon(beaconFrom(am, macC, now, -50))
+	a.OnBeacon(beaconFrom(b, macB, now, -50))
+
+	// 2 higher rank devices closer or at same distance to the AM.
+	if r := a.Update(now); r != RoleNonMasterNonSync {
+		t.Error("Expecting non-master non-sync", r)
+	}
+
+	// Peers expire, AM lost - back to master of the same cluster.
+	cid := a.ClusterID()
+	if r := a.Update(now.Add(4 * DW0Interval * TU)); r != RoleMaster {
+		t.Error("Expecting master after AM timeout", r)
+	}
+	_, _, _, cl := a.BeaconAttrs(now)
+	if cl.AnchorMaster != a.Rank() || !bytes.Equal(cid, a.ClusterID()) {
+		t.Error("Expecting to be anchor master", cl)
+	}
+}
+
+func TestDWIndex(t *testing.T) {
+	s := NewSync(macA, 100)
+	now := time.Now()
+
+	dw0 := s.NextDW0(now)
+	if s.TSF(dw0)%(DW0Interval*1024) != 0 {
+		t.Fatal("NextDW0 not aligned", s.TSF(dw0))
+	}
+	if i := s.DWIndex(dw0); i != 0 {
+		t.Error("Expecting DW0", i)
+	}
+	// Waking up slightly early or late still finds the right DW.
+	dw3 := dw0.Add(3 * DWInterval * TU)
+	if i := s.DWIndex(dw3.Add(-time.Millisecond)); i != 3 {
+		t.Error("Expecting DW3", i)
+	}
+	if i := s.DWIndex(dw3.Add(time.Millisecond)); i != 3 {
+		t.Error("Expecting DW3", i)
+	}
+	if i := s.DWIndex(dw0.Add(-DWInterval * TU)); i != 15 {
+		t.Error("Expecting DW15", i)
+	}
+}
@@ -3,11 +3,14 @@ package l2
 import (
 	"context"
 	"log"
+	"net"
+	"os"
 	"strconv"
 	"time"
 
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
 	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
-	"github.com/jsimonetti/rtnetlink/rtnl"
+	msgs "github.com/costinm/ugate/webpush"
 )
 
 /*
@@ -64,6 +67,8 @@ tshark -i wlan0 -I -J IEE802_11_RADIO -n -s0 -f "wlan type mgt subtype 0xd0 and
 // Problems with mdlayher netlink package:
 // - Execute assumes all received packets are for itself.
 // - Receive assumes sequence of messages for same request.
+// wifi.Session works around both - one socket, replies matched by sequence,
+// the rest published as events.
 
 // vishvananda: focused on routing, supports ns, checks seq and pid !
 // fork of docker/libcontainer, which now uses it (opencontainers/runc/libcontainer)
@@ -78,12 +83,14 @@ func (l2 *L2) setupMonInterfaces() error {
 	if err != nil {
 		return err
 	}
-	log.Println(phys)
 
 	phyMap := map[int]*wifi.Phy{}
 	for _, p := range phys {
 		phyMap[p.PHY] = p
 	}
+	l2.m.Lock()
+	l2.phys = phyMap
+	l2.m.Unlock()
 
 	ifis, err := client.Interfaces()
 	if err != nil {
@@ -93,7 +100,6 @@ func (l2 *L2) setupMonInterfaces() error {
 	l2.actWifi = []*wifi.Interface{}
 
 	physMon := map[int]*wifi.Interface{}
-	mons := 0
 
 	for _, ifi := range ifis {
 		if ifi.Type == wifi.InterfaceTypeMonitor {
@@ -103,54 +109,194 @@ func (l2 *L2) setupMonInterfaces() error {
 		}
 	}
 	for id, p := range phyMap {
-		if physMon[id] == nil {
-			err = client.NewMon(p.PHY)
-			if err != nil {
-				log.Println("Failed to create mon ", p, err)
-			} else {
-				mons++
+		if physMon[id] != nil {
+			continue
+		}
+		if !p.Strategy().Monitor {
+			log.Println("No monitor support, beacons not received ", p.Name)
+			continue
+		}
+		mon, err := client.NewMon(p.PHY)
+		if err != nil {
+			log.Println("Failed to create mon ", p, err)
+			continue
+		}
+		if err := client.SetLinkUp(mon, true); err != nil {
+			log.Println("Failed to bring up mon ", mon.Name, err)
+		}
+		physMon[id] = mon
+	}
+
+	for _, ifi := range physMon {
+		l2.startMon(ifi)
+	}
+	l2.physMon = physMon
+
+	return nil
+}
+
+// startMon reads frames from the monitor interface, until it is removed.
+func (l2 *L2) startMon(ifi *wifi.Interface) {
+	go func() {
+		log.Println("Initialized mon ", ifi.Name)
+		err := l2.InitMon(ifi)
+		if err != nil {
+			log.Println("MON ERR: ", err)
+		}
+	}()
+}
+
+// watchInterfaces re-creates the monitor interfaces after a driver reset.
+// The phy creates its default interface when it comes back. New AP and GO
+// interfaces are added to the station watcher.
+func (l2 *L2) watchInterfaces(sub *wifi.Subscription) {
+	// Managed interfaces removed and not restored yet.
+	lost := map[string]bool{}
+	for ev := range sub.C {
+		switch e := ev.(type) {
+		case *wifi.InterfaceRemoved:
+			log.Println("WIFI: interface removed", e.Interface.Name, e.Interface.PHY)
+			if l2.managed()[e.Interface.Name] {
+				lost[e.Interface.Name] = true
+			}
+		case *wifi.InterfaceAdded:
+			if len(lost) > 0 {
+				l2.restoreInterfaces(lost)
+			}
+			l2.m.Lock()
+			stations := l2.stations
+			l2.m.Unlock()
+			if stations != nil && stations.Add(e.Interface) {
+				log.Println("WIFI: watching stations", e.Interface.Name)
 			}
 		}
 	}
-	rtcon, err := rtnl.Dial(nil)
-	if err != nil {
-		return err
+}
+
+// managed returns the names of the interfaces created by the client.
+func (l2 *L2) managed() map[string]bool {
+	res := map[string]bool{}
+	for _, ifi := range l2.netLinkWifi.ManagedInterfaces() {
+		res[ifi.Name] = true
 	}
-	ifl, err := rtcon.Links()
+	return res
+}
+
+// restoreInterfaces re-creates the lost interfaces, and removes them from
+// lost - with the ones deleted since.
+func (l2 *L2) restoreInterfaces(lost map[string]bool) {
+	restored, err := l2.netLinkWifi.RestoreInterfaces()
 	if err != nil {
-		return err
+		log.Println("WIFI: restore", err)
 	}
-	for _, l := range ifl {
-		if l.Name == "dmeshmon" {
-			rtcon.LinkUp(l)
+	for _, ifi := range restored {
+		delete(lost, ifi.Name)
+		if ifi.Type == wifi.InterfaceTypeMonitor {
+			l2.startMon(ifi)
+		}
+		l2.m.Lock()
+		if l2.mesh != nil && l2.mesh.Name == ifi.Name {
+			l2.mesh = ifi
 		}
+		l2.m.Unlock()
 	}
-	log.Println(ifl)
-
-	if mons > 0 {
-		ifis, err = client.Interfaces()
-		if err != nil {
-			return err
+	managed := l2.managed()
+	for name := range lost {
+		if !managed[name] {
+			delete(lost, name)
 		}
-		for _, ifi := range ifis {
-			if ifi.Type == wifi.InterfaceTypeMonitor {
-				physMon[ifi.PHY] = ifi
-			}
+	}
+}
+
+// phy returns the capabilities of the phy, or nil if not known.
+func (l2 *L2) phy(id int) *wifi.Phy {
+	l2.m.Lock()
+	defer l2.m.Unlock()
+	return l2.phys[id]
+}
+
+// canRunNan decides if NAN is started on the interface, based on the phy
+// capabilities. A connected station on a single channel radio would keep
+// leaving its channel for the DW - NAN_FORCE=1 starts it anyway.
+func (l2 *L2) canRunNan(ifi *wifi.Interface) bool {
+	p := l2.phy(ifi.PHY)
+	if p == nil {
+		return true
+	}
+	s := p.Strategy()
+	if !s.NAN && !s.NANOffload && l2.injectMon(ifi) == nil {
+		log.Println("NAN: frame TX or ROC not supported", ifi.Name, p.Name)
+		return false
+	}
+	if os.Getenv("NAN_FORCE") == "1" {
+		return true
+	}
+	if l2.netLinkWifi != nil {
+		if err := l2.netLinkWifi.CheckFreq(ifi.PHY, wifi.NANFreq); err != nil {
+			log.Println("NAN: DW channel not allowed, NAN disabled", ifi.Name, err)
+			return false
 		}
 	}
+	if ifi.Type == wifi.InterfaceTypeStation && ifi.Frequency != 0 &&
+		ifi.Frequency != wifi.NANFreq && !s.NANWithSTA {
+		log.Println("NAN: station connected on", ifi.Frequency,
+			"and no multi-channel support, NAN disabled", ifi.Name)
+		return false
+	}
+	return true
+}
 
-	for _, ifi := range physMon {
-		go func() {
-			log.Println("Initialized mon ", ifi.Name)
-			err := l2.InitMon(ifi)
-			if err != nil {
-				log.Println("MON ERR: ", err)
-			}
-		}()
+// injectMon returns the monitor used for injecting the frames of the
+// interface, or nil - no monitor, or a MonSource without netdev.
+func (l2 *L2) injectMon(ifi *wifi.Interface) *wifi.Interface {
+	if l2.MonSource != nil {
+		return nil
 	}
-	l2.physMon = physMon
+	return l2.physMon[ifi.PHY]
+}
 
-	return nil
+// channelChoice returns the constraints for the GO or NAN data channel on
+// the interface - the station channel if the radio can't use 2 channels.
+func (l2 *L2) channelChoice(ifi *wifi.Interface, forNan bool) wifi.ChannelChoice {
+	cc := wifi.ChannelChoice{}
+	if ifi.Type != wifi.InterfaceTypeStation || ifi.Frequency == 0 {
+		return cc
+	}
+	cc.StaFreq = ifi.Frequency
+	if p := l2.phy(ifi.PHY); p != nil && forNan {
+		cc.SingleChannel = !p.Strategy().NANWithSTA
+	} else if p != nil {
+		n, _ := p.Concurrent(wifi.InterfaceTypeStation, wifi.InterfaceTypeP2PGroupOwner)
+		cc.SingleChannel = n < 2
+	}
+	return cc
+}
+
+// Close removes the interfaces created by dmesh - including the emulated
+// NDIs - and stops sending the connection status.
+func (l2 *L2) Close() error {
+	l2.m.Lock()
+	ndis := l2.ndis
+	l2.ndis = nil
+	l2.m.Unlock()
+	for _, ndi := range ndis {
+		ndi.close()
+	}
+	if l2.netLinkWifi == nil {
+		return nil
+	}
+	l2.m.Lock()
+	offloads := l2.nanOffloads
+	connStatus := l2.connStatus
+	l2.connStatus = nil
+	l2.m.Unlock()
+	for _, o := range offloads {
+		o.Close()
+	}
+	if connStatus != nil {
+		connStatus.Close()
+	}
+	return l2.netLinkWifi.RemoveInterfaces()
 }
 
 // Low level Wifi, using monitor interfaces and netlink.
@@ -162,17 +308,70 @@ func (l2 *L2) InitWifi() error {
 		log.Println("Error initializing wifi ", err)
 		return err
 	}
+	return l2.InitWifiClient(client)
+}
+
+// InitWifiClient is InitWifi with an existing client - for example a
+// simulated radio from package sim, with MonSource set.
+func (l2 *L2) InitWifiClient(client *wifi.Client) error {
 	l2.netLinkWifi = client
+	client.Recorder = l2.Recorder
+	if err := client.WatchReg(); err != nil {
+		log.Println("REG: regulatory domain not loaded, all channels allowed", err)
+	}
 
-	err = l2.setupMonInterfaces()
+	err := l2.setupMonInterfaces()
 	if err != nil {
 		log.Println("Error initializing wifi ", err)
 		return err
 	}
 	cnt := 0
 
+	if _, err := l2.nanServices.Add(nan.NewPublish("dmesh", []byte{1})); err != nil {
+		return err
+	}
+	l2.mux.AddHandler("nan", l2)
+
+	// The driver NAN is used if supported, one per phy - NAN_EMULATE=1
+	// uses the user space NAN.
+	emulate := os.Getenv("NAN_EMULATE") == "1"
+	offloaded := map[int]bool{}
 	for _, ifi := range l2.actWifi {
-		nanc := wifi.NewNan(client, ifi)
+		if offloaded[ifi.PHY] || !l2.canRunNan(ifi) {
+			continue
+		}
+		b, err := wifi.NewNanBackend(client, l2.phy(ifi.PHY), ifi, l2.injectMon(ifi), emulate)
+		if err != nil {
+			log.Println("NAN: offload failed, using emulation", ifi.Name, err)
+			b = wifi.NewNan(client, ifi)
+		}
+		if o, ok := b.(*wifi.NanOffload); ok {
+			err = l2.startNanOffload(o)
+			if err == nil {
+				offloaded[ifi.PHY] = true
+				continue
+			}
+			log.Println("NAN: offload start failed, using emulation", o.IFace.Name, err)
+			o.Close()
+			if err := client.DeleteInterface(o.IFace); err != nil {
+				log.Println("NAN: remove offload interface", o.IFace.Name, err)
+			}
+			b, _ = wifi.NewNanBackend(client, l2.phy(ifi.PHY), ifi, l2.injectMon(ifi), true)
+		}
+		nanc := b.(*wifi.Nan)
+		nanc.Services = l2.nanServices
+		nanc.Link.OnMessage = l2.onNanMessage
+		l2.m.Lock()
+		l2.nans = append(l2.nans, nanc)
+		l2.m.Unlock()
+		if os.Getenv("NAN_CHANNELS") == "" {
+			if err := nanc.SelectChannels(l2.channelChoice(ifi, true), l2.physMon[ifi.PHY]); err != nil {
+				log.Println("NAN: default channels", ifi.Name, err)
+			}
+		}
+		if err := l2.setupNDI(nanc, l2.physMon[ifi.PHY]); err != nil {
+			log.Println("NAN NDI: data path disabled", ifi.Name, err)
+		}
 		// For more information about what a "BSS" is, see:
 		// https://en.wikipedia.org/wiki/Service_set_(802.11_network).
 		//bss, err := client.BSS(ifi)
@@ -195,6 +394,7 @@ func (l2 *L2) InitWifi() error {
 			// enable it only for beacon/discovery/data frames.
 			// Sometimes it doesn't work well with wpa_supplicant
 			client.RegisterFrame(a, 0xd0, []byte{0x04, 0x09, 0x50, 0x6f, 0x9A, 0x13})
+			client.RegisterFrame(a, 0xd0, []byte{0x04, 0x09, 0x50, 0x6f, 0x9A, nan.OUITypeNAF})
 
 			// invalid arg when wpa
 			//client.RegisterFrame(ifi, 0xd0, []byte{0x04, 0x09})
@@ -212,7 +412,7 @@ func (l2 *L2) InitWifi() error {
 
 		if true { // ifi.Type != wifi.InterfaceTypeMonitor {// ifi.Name == "wlx4494fce48415" || ifi.Name == "wlp2s0" {
 			go func() {
-				go ScheduleBeacon(nanc)
+				go nanc.RunDW(context.Background())
 
 				if false {
 					for {
@@ -238,30 +438,86 @@ func (l2 *L2) InitWifi() error {
 		//if ifi.Type == wifi.InterfaceTypeP2PDevice { //"wlp2s0" { // "msta" {
 		//	active = a
 		//}
-
-		//BSS:  &{costin 70:3a:cb:02:2b:36 5745 102.4ms 3h47m25.716s associated}
-		// 2020/02/13 22:32:51 wlp2s0 station 1 5745 38:ba:f8:49:d3:bf 0 &{2 wlp2s0 38:ba:f8:49:d3:bf 0 1 station 5745}
-		//si, err := client.StationInfo(ifi)
-		//if err != nil {
-		//	log.Println("SI err", err)
-		//} else {
-		//	for sii := range si {
-		//		log.Println("Station Info: ", sii)
-		//	}
-		//}
 	}
 
+	// Station stats for the AP, GO and mesh interfaces - see station.go
+	// and mesh.go.
+	l2.startStationWatcher()
+	l2.startMesh()
+
+	go l2.watchInterfaces(client.Events.Subscribe(wifi.SubscribeOptions{
+		Kinds: []wifi.EventKind{wifi.KindInterfaceAdded, wifi.KindInterfaceRemoved},
+	}))
 	go client.StartReceive()
 
 	return nil
 }
 
-func ScheduleBeacon(nanc *wifi.Nan) {
-	tick := time.NewTicker(512 * 1024 * time.Microsecond)
-	for {
-		select {
-		case _ = <-tick.C:
-			nanc.SendBeacon(true)
+// onNanMessage sends a message received with Link to the mux.
+func (l2 *L2) onNanMessage(from net.HardwareAddr, data []byte) {
+	log.Println("NAN IN: ", from, len(data))
+	l2.mux.SendMessage(msgs.NewMessage("/nan/msg",
+		map[string]string{
+			"from": from.String(),
+		}).SetDataJSON(data))
+}
+
+// startNanOffload starts the driver NAN, with the shared services. A
+// passive dmesh subscribe updates the device registry - there are no
+// SDFs from the monitor for the offload.
+func (l2 *L2) startNanOffload(o *wifi.NanOffload) error {
+	o.Services = l2.nanServices
+	o.Link.OnMessage = l2.onNanMessage
+	if err := o.Start(context.Background()); err != nil {
+		return err
+	}
+	if _, err := o.AddService(nan.NewSubscribe("dmesh", false, l2.onNanOffloadMatch)); err != nil {
+		return err
+	}
+	l2.m.Lock()
+	l2.nanOffloads = append(l2.nanOffloads, o)
+	l2.m.Unlock()
+	log.Println("NAN: using driver NAN on", o.IFace.Name, o.IFace.PHY)
+	return nil
+}
+
+// onNanOffloadMatch updates the registry from a dmesh publish discovered
+// by the driver.
+func (l2 *L2) onNanOffloadMatch(m *nan.Match) {
+	if m.Type != nan.Publish {
+		return
+	}
+	l2.onNanSDFDevice(m.Peer, m.RSSI, 0, time.Now(), []nan.Attribute{&nan.ServiceDescriptor{
+		ServiceID:   dmeshServiceID,
+		InstanceID:  m.PeerInstanceID,
+		Type:        nan.Publish,
+		ServiceInfo: m.ServiceInfo,
+	}})
+}
+
+// onNanSDF passes a received SDF to the first interface on the phy - the
+// services are shared.
+func (l2 *L2) onNanSDF(phy int, src net.HardwareAddr, rssi int, attrs []nan.Attribute) {
+	l2.m.Lock()
+	nans := l2.nans
+	l2.m.Unlock()
+	for _, n := range nans {
+		if n.IFace.PHY == phy {
+			n.OnSDF(src, rssi, attrs)
+			return
+		}
+	}
+}
+
+// onNanBeacon passes a received NAN beacon to the sync state of the
+// interfaces on the same phy.
+func (l2 *L2) onNanBeacon(phy int, b *nan.Beacon) {
+	l2.m.Lock()
+	nans := l2.nans
+	l2.m.Unlock()
+	for _, n := range nans {
+		if n.IFace.PHY == phy {
+			n.Sync.OnBeacon(b)
 		}
 	}
 }
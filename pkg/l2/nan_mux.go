@@ -0,0 +1,204 @@
+package l2
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/costinm/dmesh-l2/pkg/l2api"
+	msgs "github.com/costinm/ugate/webpush"
+)
+
+// Received NAN frames update the device registry, and are sent to the mux:
+//
+// /nan/discovered - device JSON, when a new device or new service info is seen
+// /nan/msg - a message received using Link, from=MAC
+// /nan/followup - follow-up for a non-dmesh service, from=MAC, svc, inst
+// /nan/ndp - data path established, peer=MAC, ndi=peer NDI, iface=local NDI
+// /nan/ndp/close - data path terminated, peer, ndi
+// /nan/sent - result of a /nan/send, to=MAC, id of the send and err if the
+//   message was not acked
+//
+// The "nan" handler allows other processes connected to the mux to send:
+//
+// /nan/send/MAC - reliable message, fragmented and retransmitted. Optional
+//   "id" is returned in /nan/sent.
+// /nan/followup/MAC - single follow-up, up to 255 bytes. Optional "inst"
+//   is the instance ID of the peer.
+// /nan/ndp/MAC - start a data path with the peer. "pub" is the publish ID
+//   of the peer service, data is the NDP specific info.
+
+var dmeshServiceID = nan.NewServiceID("dmesh")
+
+// updateNanDevice updates the device with the MAC, RSSI, freq and last seen
+// time. Returns the device and true if it was not known.
+// Must hold l2.m.
+func (l2 *L2) updateNanDevice(src net.HardwareAddr, rssi, freq int, now time.Time) (*l2api.MeshDevice, bool) {
+	key := Uint64(src)
+	node := l2.devByL2Id[key]
+	isNew := node == nil
+	if isNew {
+		node = &l2api.MeshDevice{MAC: src.String()}
+		l2.devByL2Id[key] = node
+	}
+	node.Level = rssi
+	if freq != 0 {
+		node.Freq = freq
+	}
+	node.LastSeen = now
+	return node, isNew
+}
+
+// onNanSDFDevice updates the device registry from a received SDF. The DMesh
+// publish service info uses the same TXT format as DNS-SD discovery - s, p,
+// c and i - the hex mesh ID.
+func (l2 *L2) onNanSDFDevice(src net.HardwareAddr, rssi, freq int, now time.Time,
+	attrs []nan.Attribute) {
+	l2.m.Lock()
+	node, changed := l2.updateNanDevice(src, rssi, freq, now)
+	for _, a := range attrs {
+		sda, ok := a.(*nan.ServiceDescriptor)
+		if !ok || sda.ServiceID != dmeshServiceID || sda.Type != nan.Publish {
+			continue
+		}
+		if sdea, ok := findSDEA(attrs, sda.InstanceID); ok {
+			if int(sdea.ServiceUpdateIndicator) != node.ServiceUpdateInd {
+				changed = true
+			}
+			node.ServiceUpdateInd = int(sdea.ServiceUpdateIndicator)
+		}
+		meta := parseDns(sda.ServiceInfo)
+		if s := meta["s"]; s != "" {
+			node.SSID = s
+			node.PSK = meta["p"]
+		}
+		if c := meta["c"]; c != "" {
+			node.Net = c
+		}
+		if id, err := strconv.ParseUint(meta["i"], 16, 64); err == nil && id != 0 {
+			l2.devByMeshId[id] = node
+		}
+	}
+	var js *msgs.Message
+	if changed {
+		js = msgs.NewMessage("/nan/discovered", nil).SetDataJSON(node)
+	}
+	l2.m.Unlock()
+
+	if js != nil && l2.mux != nil {
+		l2.mux.SendMessage(js)
+	}
+
+	// Follow-ups for dmesh are handled by Link
+	for _, a := range attrs {
+		sda, ok := a.(*nan.ServiceDescriptor)
+		if !ok || sda.Type != nan.FollowUp || sda.ServiceID == dmeshServiceID {
+			continue
+		}
+		if l2.mux != nil {
+			l2.mux.SendMessage(msgs.NewMessage("/nan/followup",
+				map[string]string{
+					"from": src.String(),
+					"svc":  hex.EncodeToString(sda.ServiceID[:]),
+					"inst": strconv.Itoa(int(sda.InstanceID)),
+				}).SetDataJSON(sda.ServiceInfo))
+		}
+	}
+}
+
+// sendResult sends the result of a /nan/send to the mux.
+func (l2 *L2) sendResult(to net.HardwareAddr, id string, err error) {
+	if l2.mux == nil {
+		return
+	}
+	meta := map[string]string{"to": to.String(), "id": id}
+	if err != nil {
+		meta["err"] = err.Error()
+	}
+	l2.mux.SendMessage(msgs.NewMessage("/nan/sent", meta))
+}
+
+func findSDEA(attrs []nan.Attribute, inst uint8) (*nan.ServiceDescriptorExt, bool) {
+	for _, a := range attrs {
+		if sdea, ok := a.(*nan.ServiceDescriptorExt); ok && sdea.InstanceID == inst {
+			return sdea, true
+		}
+	}
+	return nil, false
+}
+
+// nanFor returns the NAN backend to use for sending, by interface name or
+// the first one.
+func (l2 *L2) nanFor(name string) wifi.NanBackend {
+	l2.m.Lock()
+	defer l2.m.Unlock()
+	for _, n := range l2.nans {
+		if name == "" || n.IFace.Name == name {
+			return n
+		}
+	}
+	for _, o := range l2.nanOffloads {
+		if name == "" || o.IFace.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// HandleMessage handles "nan" messages from the mux.
+func (l2 *L2) HandleMessage(ctx context.Context, cmd string, meta map[string]string, data []byte) {
+	parts := strings.Split(cmd, "/")
+	if len(parts) < 4 || parts[1] != "nan" {
+		return
+	}
+
+	to, err := net.ParseMAC(parts[3])
+	if err != nil {
+		log.Println("NAN/MSG: invalid address", cmd, err)
+		return
+	}
+	n := l2.nanFor(meta["iface"])
+	if n == nil {
+		log.Println("NAN/MSG: no interface", cmd)
+		return
+	}
+
+	switch parts[2] {
+	case "send":
+		err = n.SendMessage(to, data, func(err error) {
+			l2.sendResult(to, meta["id"], err)
+		})
+	case "followup":
+		inst, _ := strconv.Atoi(meta["inst"])
+		if inst == 0 {
+			inst = 0x80
+		}
+		if len(data) > 255 {
+			log.Println("NAN/MSG: follow-up too large", cmd, len(data))
+			return
+		}
+		err = n.SendFollowup(to, byte(inst), wifi.NANFreq, data)
+	case "ndp":
+		nanc, ok := n.(*wifi.Nan)
+		if !ok {
+			log.Println("NAN/MSG: data path not supported with driver NAN", cmd)
+			return
+		}
+		pub, _ := strconv.Atoi(meta["pub"])
+		if pub == 0 {
+			pub = int(nanc.PeerInstance(to))
+		}
+		_, err = nanc.DataPaths.Request(to, uint8(pub), data)
+	default:
+		return
+	}
+	if err != nil {
+		log.Println("NAN/MSG: send error", cmd, err)
+	}
+}
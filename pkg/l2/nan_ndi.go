@@ -0,0 +1,293 @@
+package l2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	msgs "github.com/costinm/ugate/webpush"
+	"github.com/google/gopacket/layers"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"golang.org/x/sys/unix"
+)
+
+// NAN data interface (NDI).
+//
+// If the driver provides a NAN data interface - NAN_NDI env variable with
+// the name - it is used as is, and only the negotiation is done here.
+//
+// Otherwise a TAP interface is created, and ethernet frames are bridged to
+// 802.11 data frames: sent by injecting on the monitor interface, received
+// from the monitor. The kernel will configure the IPv6 link local address,
+// Android uses the same for the NDP.
+
+// tapName is the name of the emulated NDI - the kernel picks the number,
+// one for each NAN interface.
+const tapName = "dmnan%d"
+
+var errNoMon = errors.New("no monitor interface for NDI")
+
+// errSimMon is returned for monitors opened with L2.MonSource - there is no
+// netdev to inject the data frames on.
+var errSimMon = errors.New("no netdev for the monitor source")
+
+// nanNDI is the data interface of a NAN interface.
+type nanNDI struct {
+	nan  *wifi.Nan
+	name string
+	addr net.HardwareAddr
+
+	// TAP and injector on the monitor, for emulated NDI.
+	tap    *os.File
+	inject *wifi.Injector
+
+	// checkFreq returns an error if the regulatory domain doesn't allow
+	// sending on the NAN channel, where the frames are injected.
+	checkFreq func() error
+
+	m   sync.Mutex
+	seq uint16
+}
+
+// setupNDI finds or creates the data interface for the NAN interface, and
+// starts handling data path requests.
+func (l2 *L2) setupNDI(nanc *wifi.Nan, mon *wifi.Interface) error {
+	ndi := &nanNDI{nan: nanc}
+
+	if name := os.Getenv("NAN_NDI"); name != "" {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		ndi.name = name
+		ndi.addr = ifi.HardwareAddr
+	} else {
+		if mon == nil {
+			return errNoMon
+		}
+		if l2.MonSource != nil {
+			return errSimMon
+		}
+		if err := ndi.openTap(); err != nil {
+			return err
+		}
+		inject, err := wifi.OpenInjector(l2.netLinkWifi, mon, wifi.SendInject)
+		if err != nil {
+			ndi.tap.Close()
+			return err
+		}
+		ndi.inject = inject
+		if l2.netLinkWifi != nil {
+			ndi.checkFreq = func() error {
+				return l2.netLinkWifi.CheckFreq(mon.PHY, wifi.NANFreq)
+			}
+		}
+		go ndi.readTap()
+	}
+
+	nanc.DataPaths.OnEstablished = func(p *nan.DataPath) {
+		l2.mux.SendMessage(msgs.NewMessage("/nan/ndp", map[string]string{
+			"peer":  p.Peer.String(),
+			"ndi":   p.PeerNDI.String(),
+			"iface": ndi.name,
+		}))
+	}
+	nanc.DataPaths.OnTerminated = func(p *nan.DataPath) {
+		l2.mux.SendMessage(msgs.NewMessage("/nan/ndp/close", map[string]string{
+			"peer": p.Peer.String(),
+			"ndi":  p.PeerNDI.String(),
+		}))
+	}
+	// Last - received NAFs are handled once the NDI is set.
+	nanc.DataPaths.SetNDI(ndi.addr)
+
+	l2.m.Lock()
+	l2.ndis = append(l2.ndis, ndi)
+	l2.m.Unlock()
+	log.Println("NAN NDI: ", ndi.name, ndi.addr, ndi.tap != nil)
+	return nil
+}
+
+// openTap creates the TAP interface and brings it up.
+func (ndi *nanNDI) openTap() error {
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	// struct ifreq - name and flags
+	var req [unix.IFNAMSIZ + 24]byte
+	copy(req[:], tapName)
+	binary.NativeEndian.PutUint16(req[unix.IFNAMSIZ:], unix.IFF_TAP|unix.IFF_NO_PI)
+	// Not f.Fd() - it makes the file blocking, and Close would not stop
+	// readTap.
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	var errno unix.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, unix.TUNSETIFF,
+			uintptr(unsafe.Pointer(&req[0])))
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// The name picked by the kernel.
+	name := unix.ByteSliceToString(req[:unix.IFNAMSIZ])
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rtcon, err := rtnl.Dial(nil)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer rtcon.Close()
+	if err := rtcon.LinkUp(ifi); err != nil {
+		f.Close()
+		return err
+	}
+
+	ndi.tap = f
+	ndi.name = name
+	ndi.addr = ifi.HardwareAddr
+	return nil
+}
+
+// close removes the emulated NDI - the TAP is deleted by the kernel when
+// closed.
+func (ndi *nanNDI) close() {
+	if ndi.tap != nil {
+		ndi.tap.Close()
+	}
+	if ndi.inject != nil {
+		ndi.inject.Close()
+	}
+}
+
+// llcSNAP is the header of data frames carrying ethernet II payloads.
+var llcSNAP = []byte{0xAA, 0xAA, 0x03, 0, 0, 0}
+
+// readTap sends the frames written by the kernel to the TAP to the peers.
+// Multicast - IPv6 ND - is sent to each peer as unicast.
+func (ndi *nanNDI) readTap() {
+	buf := make([]byte, 2048)
+	for {
+		n, err := ndi.tap.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Println("NAN NDI: read error", err)
+			}
+			return
+		}
+		if n < 14 {
+			continue
+		}
+		eth := buf[:n]
+		dst := net.HardwareAddr(eth[0:6])
+		if dst[0]&1 == 0 {
+			if ndi.nan.DataPaths.FindByNDI(dst) != nil {
+				ndi.send(dst, eth)
+			}
+			continue
+		}
+		for _, p := range ndi.nan.DataPaths.List() {
+			if p.State == nan.NDPEstablished {
+				ndi.send(p.PeerNDI, eth)
+			}
+		}
+	}
+}
+
+// send injects an 802.11 data frame from the local NDI to a peer NDI.
+func (ndi *nanNDI) send(to net.HardwareAddr, eth []byte) {
+	if ndi.checkFreq != nil {
+		if err := ndi.checkFreq(); err != nil {
+			log.Println("NAN NDI: not sent", to, err)
+			return
+		}
+	}
+	ndi.m.Lock()
+	ndi.seq++
+	seq := ndi.seq
+	ndi.m.Unlock()
+
+	b := make([]byte, 0, 24+8+len(eth))
+	b = append(b, 0x08, 0x00, 0, 0)
+	b = append(b, to...)
+	b = append(b, ndi.addr...)
+	b = append(b, ndi.nan.Sync.ClusterID()...)
+	b = binary.LittleEndian.AppendUint16(b, seq<<4)
+	b = append(b, llcSNAP...)
+	b = append(b, eth[12:]...)
+
+	if err := ndi.inject.Inject(b, wifi.TxParams{}); err != nil {
+		log.Println("NAN NDI: inject error", to, err)
+	}
+}
+
+// onData writes a data frame received on the monitor to the TAP, if it is
+// from an established data path.
+func (ndi *nanNDI) onData(d11 *layers.Dot11) {
+	if ndi.tap == nil {
+		return
+	}
+	if !bytes.Equal(d11.Address1, ndi.addr) && d11.Address1[0]&1 == 0 {
+		return
+	}
+	if ndi.nan.DataPaths.FindByNDI(d11.Address2) == nil {
+		return
+	}
+	pl := d11.Payload
+	if len(pl) < 8 || !bytes.Equal(pl[:6], llcSNAP) {
+		return
+	}
+	eth := make([]byte, 0, 12+len(pl)-6)
+	eth = append(eth, d11.Address1...)
+	eth = append(eth, d11.Address2...)
+	eth = append(eth, pl[6:]...)
+	if _, err := ndi.tap.Write(eth); err != nil {
+		log.Println("NAN NDI: write error", err)
+	}
+}
+
+// onNanData passes a NAN data frame to the data interfaces on the phy.
+func (l2 *L2) onNanData(phy int, d11 *layers.Dot11) {
+	l2.m.Lock()
+	ndis := l2.ndis
+	l2.m.Unlock()
+	for _, ndi := range ndis {
+		if ndi.nan.IFace.PHY == phy {
+			ndi.onData(d11)
+		}
+	}
+}
+
+// onNanNAF passes a NAN action frame to the first interface on the phy.
+func (l2 *L2) onNanNAF(phy int, src net.HardwareAddr, t nan.NAFSubtype, attrs []nan.Attribute) {
+	l2.m.Lock()
+	nans := l2.nans
+	l2.m.Unlock()
+	for _, n := range nans {
+		if n.IFace.PHY == phy {
+			n.UpdatePeer(src, attrs)
+			n.DataPaths.OnNAF(src, t, attrs)
+			return
+		}
+	}
+}
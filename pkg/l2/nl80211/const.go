@@ -267,7 +267,9 @@ const (
 	CmdDelNanFunction          = 118
 	CmdChangeNanConfig         = 119
 	CmdNanMatch                = 120
-	__CmdAfterLast             = 121
+	CmdPortAuthorized          = 125
+	CmdControlPortFrame        = 129
+	__CmdAfterLast             = 130
 	CmdMax                     = __CmdAfterLast - 1
 )
 
@@ -518,7 +520,8 @@ const (
 	AttrNanDual                      = 239
 	AttrNanFunc                      = 240
 	AttrNanMatch                     = 241
-	__AttrAfterLast                  = 242
+	AttrControlPortOverNl80211       = 264
+	__AttrAfterLast                  = 265
 	Num_Attr                         = __AttrAfterLast
 	AttrMax                          = __AttrAfterLast - 1
 )
@@ -1451,17 +1454,27 @@ type nl80211ExtFeatureIndex int32
 
 // nl80211ExtFeatureIndex enumeration from nl80211/nl80211.h:4595
 const (
-	ExtFeatureVhtIbss          = iota
-	ExtFeatureRrm              = 1
-	ExtFeatureMuMimoAirSniffer = 2
-	ExtFeatureScanStartTime    = 3
-	ExtFeatureBssParentTsf     = 4
-	ExtFeatureSetScanDwell     = 5
-	ExtFeatureBeaconRateLegacy = 6
-	ExtFeatureBeaconRateHt     = 7
-	ExtFeatureBeaconRateVht    = 8
-	Num_ExtFeatures            = 9
-	Max_ExtFeatures            = Num_ExtFeatures - 1
+	ExtFeatureVhtIbss                        = iota
+	ExtFeatureRrm                            = 1
+	ExtFeatureMuMimoAirSniffer               = 2
+	ExtFeatureScanStartTime                  = 3
+	ExtFeatureBssParentTsf                   = 4
+	ExtFeatureSetScanDwell                   = 5
+	ExtFeatureBeaconRateLegacy               = 6
+	ExtFeatureBeaconRateHt                   = 7
+	ExtFeatureBeaconRateVht                  = 8
+	ExtFeatureFilsSta                        = 9
+	ExtFeatureMgmtTxRandomTa                 = 10
+	ExtFeatureMgmtTxRandomTaConnected        = 11
+	ExtFeatureSchedScanRelativeRssi          = 12
+	ExtFeatureCqmRssiList                    = 13
+	ExtFeatureControlPortOverNl80211         = 26
+	ExtFeatureAckSignalSupport               = 27
+	ExtFeatureTxqs                           = 28
+	ExtFeatureControlPortOverNl80211TxStatus = 48
+	ExtFeatureSecureNan                      = 63
+	Num_ExtFeatures                          = 64
+	Max_ExtFeatures                          = Num_ExtFeatures - 1
 )
 
 // nl80211ProbeRespOffloadSupportAttr as declared in nl80211/nl80211.h:4625
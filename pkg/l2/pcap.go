@@ -0,0 +1,76 @@
+package l2
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	msgs "github.com/costinm/ugate/webpush"
+)
+
+// All frames sent and received by dmesh - on the monitor interface and
+// with nl80211 - can be recorded to pcapng files, to debug interop
+// without running tcpdump next to dmesh. The files can be replayed with
+// NAN_REPLAY.
+//
+// The "pcap" handler controls the recording:
+//
+// /pcap/start - optional meta "dir", "size" (MB per file), "age" (seconds
+//   per file) and "files" (number of files to keep)
+// /pcap/stop
+// /pcap/status - replies with /pcap/status, meta "file", "frames", "size"
+
+// defaultPcapDir is used if /pcap/start has no dir.
+var defaultPcapDir = filepath.Join(os.TempDir(), "dmesh-pcap")
+
+// pcapHandler handles "pcap" messages from the mux.
+type pcapHandler struct {
+	l2 *L2
+}
+
+func (h pcapHandler) HandleMessage(ctx context.Context, cmd string, meta map[string]string, data []byte) {
+	parts := strings.Split(cmd, "/")
+	if len(parts) < 3 || parts[1] != "pcap" {
+		return
+	}
+	r := h.l2.Recorder
+	switch parts[2] {
+	case "start":
+		// Settings apply to a new file.
+		r.Stop()
+		if d := meta["dir"]; d != "" {
+			r.Dir = d
+		}
+		if mb, err := strconv.Atoi(meta["size"]); err == nil && mb > 0 {
+			r.MaxSize = int64(mb) << 20
+		}
+		if s, err := strconv.Atoi(meta["age"]); err == nil && s > 0 {
+			r.MaxAge = time.Duration(s) * time.Second
+		}
+		if n, err := strconv.Atoi(meta["files"]); err == nil && n > 0 {
+			r.MaxFiles = n
+		}
+		if err := r.Start(); err != nil {
+			log.Println("PCAP: start", r.Dir, err)
+			return
+		}
+		log.Println("PCAP: recording to", r.Dir)
+	case "stop":
+		if err := r.Stop(); err != nil {
+			log.Println("PCAP: stop", err)
+		}
+	case "status":
+		h.l2.mux.SendMessage(msgs.NewMessage("/pcap/status", r.Status()))
+	}
+}
+
+// StartRecording starts recording frames to dir, typically from the
+// DM_PCAP environment variable.
+func (l2 *L2) StartRecording(dir string) error {
+	l2.Recorder.Dir = dir
+	return l2.Recorder.Start()
+}
@@ -0,0 +1,216 @@
+package l2
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/costinm/dmesh-l2/pkg/l2api"
+	msgs "github.com/costinm/ugate/webpush"
+)
+
+// Without wpa_supplicant, scans use nl80211 directly. The "wifi" handler
+// from ScanHandler accepts:
+//
+// /wifi/scan - optional meta "ssid" and "freq" (comma separated filters),
+//   "passive" and "flush" ("1"). Sends /net/status with the results, like
+//   the wpa_supplicant scan.
+// /wifi/con/peer/SSID[/BSSID] - connect the first station interface to an
+//   open or OWE AP.
+// /wifi/con/stop - disconnect the station interfaces.
+// /wifi/mesh/... - join or leave the 802.11s mesh, see mesh.go.
+//
+// Connection state changes are sent as /net/status, with ConnectedWifi,
+// Freq and Level set from the current BSS.
+
+var (
+	errNoWifi    = errors.New("nl80211 not initialized")
+	errNoStation = errors.New("no station interface")
+)
+
+// ScanNL scans on all active wifi interfaces using nl80211, and returns
+// the visible networks. Scan has all the matching networks - not only
+// dmesh devices.
+func (l2 *L2) ScanNL(ctx context.Context, req *wifi.ScanRequest) (*l2api.L2NetStatus, error) {
+	if l2.netLinkWifi == nil {
+		return nil, errNoWifi
+	}
+	s := l2.ConnStatus()
+	now := time.Now()
+	var lastErr error
+	for _, ifi := range l2.actWifi {
+		res, err := l2.netLinkWifi.Scan(ctx, ifi, req)
+		if err != nil {
+			log.Println("SCAN: ", ifi.Name, err)
+			lastErr = err
+			continue
+		}
+		for _, b := range res {
+			s.Scan = append(s.Scan, &l2api.MeshDevice{
+				SSID:     b.SSID,
+				BSSID:    b.BSSID.String(),
+				Freq:     b.Frequency,
+				Level:    b.Signal,
+				Cap:      b.Flags(),
+				LastSeen: now.Add(-b.LastSeen),
+			})
+		}
+	}
+	s.Visible = len(s.Scan)
+	if len(s.Scan) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return s, nil
+}
+
+// ConnStatus returns the status with the BSS of the station connection
+// made with ConnectNL, if any.
+func (l2 *L2) ConnStatus() *l2api.L2NetStatus {
+	s := &l2api.L2NetStatus{}
+	if l2.netLinkWifi == nil {
+		return s
+	}
+	for _, ifi := range l2.actWifi {
+		st := l2.netLinkWifi.Connection(ifi)
+		if st == nil || st.State != wifi.ConnConnected {
+			continue
+		}
+		s.ConnectedWifi = st.SSID
+		s.Freq = st.Freq
+		s.Level = st.Signal
+		if bss, err := l2.netLinkWifi.BSS(ifi); err == nil && bss != nil {
+			s.Freq = bss.Frequency
+			s.Level = bss.Signal
+		}
+		break
+	}
+	return s
+}
+
+// ConnectNL connects the first station interface to the open or OWE AP
+// using nl80211. BSSID is optional.
+func (l2 *L2) ConnectNL(ctx context.Context, ssid string, bssid net.HardwareAddr) (*wifi.ConnectionState, error) {
+	if l2.netLinkWifi == nil {
+		return nil, errNoWifi
+	}
+	for _, ifi := range l2.actWifi {
+		if ifi.Type != wifi.InterfaceTypeStation {
+			continue
+		}
+		return l2.netLinkWifi.Connect(ctx, ifi, &wifi.ConnectRequest{SSID: ssid, BSSID: bssid})
+	}
+	return nil, errNoStation
+}
+
+// DisconnectNL disconnects the station interfaces.
+func (l2 *L2) DisconnectNL() error {
+	if l2.netLinkWifi == nil {
+		return errNoWifi
+	}
+	var lastErr error
+	for _, ifi := range l2.actWifi {
+		if ifi.Type != wifi.InterfaceTypeStation {
+			continue
+		}
+		if err := l2.netLinkWifi.Disconnect(ifi); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// sendConnStatus sends /net/status on connection state changes, until
+// Close. Started once.
+func (l2 *L2) sendConnStatus() {
+	l2.m.Lock()
+	if l2.connStatus != nil {
+		l2.m.Unlock()
+		return
+	}
+	sub := l2.netLinkWifi.Events.Subscribe(wifi.SubscribeOptions{
+		Kinds: []wifi.EventKind{wifi.KindConnectionState},
+	})
+	l2.connStatus = sub
+	l2.m.Unlock()
+	go func() {
+		for range sub.C {
+			l2.mux.SendMessage(msgs.NewMessage("/net/status", nil).SetDataJSON(l2.ConnStatus()))
+		}
+	}()
+}
+
+// ScanHandler returns a handler for the "wifi" topic, for nodes without
+// wpa_supplicant.
+func (l2 *L2) ScanHandler() msgs.MessageHandler {
+	if l2.netLinkWifi != nil {
+		l2.sendConnStatus()
+	}
+	return msgs.HandlerCallbackFunc(func(ctx context.Context, cmd string, meta map[string]string, data []byte) {
+		parts := strings.Split(cmd, "/")
+		if len(parts) < 3 || parts[1] != "wifi" {
+			return
+		}
+		if parts[2] == "con" {
+			l2.handleCon(parts)
+			return
+		}
+		if parts[2] == "mesh" {
+			l2.handleMesh(parts, meta)
+			return
+		}
+		if parts[2] != "scan" {
+			return
+		}
+		req := &wifi.ScanRequest{
+			Passive: meta["passive"] == "1",
+			Flush:   meta["flush"] == "1",
+		}
+		if ssid := meta["ssid"]; ssid != "" {
+			req.SSIDs = strings.Split(ssid, ",")
+		}
+		for _, f := range strings.Split(meta["freq"], ",") {
+			if n, err := strconv.Atoi(f); err == nil {
+				req.Freqs = append(req.Freqs, n)
+			}
+		}
+		go func() {
+			s, err := l2.ScanNL(context.Background(), req)
+			if err != nil {
+				log.Println("SCAN: ", err)
+				return
+			}
+			log.Println("Scan results: ", len(s.Scan))
+			l2.mux.SendMessage(msgs.NewMessage("/net/status", nil).SetDataJSON(s))
+		}()
+	})
+}
+
+func (l2 *L2) handleCon(parts []string) {
+	if len(parts) < 4 {
+		return
+	}
+	switch parts[3] {
+	case "peer":
+		if len(parts) < 5 {
+			return
+		}
+		var bssid net.HardwareAddr
+		if len(parts) > 5 {
+			bssid, _ = net.ParseMAC(parts[5])
+		}
+		go func() {
+			if _, err := l2.ConnectNL(context.Background(), parts[4], bssid); err != nil {
+				log.Println("CONN: ", parts[4], err)
+			}
+		}()
+	case "stop":
+		if err := l2.DisconnectNL(); err != nil {
+			log.Println("CONN: disconnect ", err)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-ble/ble"
+)
+
+// BLE devices use the same links as the radios of the nodes. A device
+// advertises with the ble.Device Advertise methods, and accepts
+// connections while advertising as connectable. The connected centrals
+// see the dmesh GATT profile - the Eddystone service with the proxy
+// write and notify characteristics. Writes are passed to OnWrite, Notify
+// sends to the subscribed centrals. Both go over the link, with its loss
+// and latency.
+
+var (
+	errBLENotSupported = errors.New("not supported by the simulated device")
+	errBLENotFound     = errors.New("device not advertising")
+	errBLEConnect      = errors.New("connection failed")
+	errBLEClosed       = errors.New("connection closed")
+)
+
+const (
+	// advInterval is how often the advertisements are received by a
+	// scan.
+	advInterval = 100 * time.Millisecond
+
+	// maxMTU is the max ATT MTU.
+	maxMTU = 517
+)
+
+var (
+	eddystoneUUID = ble.UUID16(0xFEAA)
+	proxyWrite    = ble.UUID16(0x2ADD)
+	proxyNotify   = ble.UUID16(0x2ADE)
+)
+
+// BLEDevice is a simulated BLE controller, implementing ble.Device.
+type BLEDevice struct {
+	// Name of the node, for the links.
+	Name string
+
+	// OnWrite is called with the data written by a central to the proxy
+	// write characteristic. Called from the medium goroutine.
+	OnWrite func(from ble.Addr, data []byte)
+
+	medium *Medium
+	addr   ble.Addr
+
+	m     sync.Mutex
+	adv   *advertisement
+	conns []*bleConn
+}
+
+// NewBLE adds a BLE device for the node.
+func (m *Medium) NewBLE(name string) *BLEDevice {
+	m.m.Lock()
+	defer m.m.Unlock()
+	d := &BLEDevice{
+		Name:   name,
+		medium: m,
+		addr:   ble.NewAddr(fmt.Sprintf("c0:00:00:00:00:%02x", m.node(name))),
+	}
+	m.bles = append(m.bles, d)
+	return d
+}
+
+// Addr returns the address of the device.
+func (d *BLEDevice) Addr() ble.Addr {
+	return d.addr
+}
+
+// advertisement is the data advertised by a device, and the RSSI seen by
+// the scanner.
+type advertisement struct {
+	name        string
+	mfg         []byte
+	services    []ble.UUID
+	sd          []ble.ServiceData
+	connectable bool
+
+	rssi int
+	addr ble.Addr
+}
+
+func (a *advertisement) LocalName() string              { return a.name }
+func (a *advertisement) ManufacturerData() []byte       { return a.mfg }
+func (a *advertisement) ServiceData() []ble.ServiceData { return a.sd }
+func (a *advertisement) Services() []ble.UUID           { return a.services }
+func (a *advertisement) OverflowService() []ble.UUID    { return nil }
+func (a *advertisement) TxPowerLevel() int              { return 0 }
+func (a *advertisement) Connectable() bool              { return a.connectable }
+func (a *advertisement) SolicitedService() []ble.UUID   { return nil }
+func (a *advertisement) RSSI() int                      { return a.rssi }
+func (a *advertisement) Addr() ble.Addr                 { return a.addr }
+
+// advertise sets the advertisement until the context is done, like the
+// linux device.
+func (d *BLEDevice) advertise(ctx context.Context, adv *advertisement) error {
+	d.m.Lock()
+	d.adv = adv
+	d.m.Unlock()
+	<-ctx.Done()
+	d.m.Lock()
+	if d.adv == adv {
+		d.adv = nil
+	}
+	d.m.Unlock()
+	return ctx.Err()
+}
+
+// The GATT server is the fixed dmesh profile.
+func (d *BLEDevice) AddService(svc *ble.Service) error     { return errBLENotSupported }
+func (d *BLEDevice) RemoveAllServices() error              { return errBLENotSupported }
+func (d *BLEDevice) SetServices(svcs []*ble.Service) error { return errBLENotSupported }
+
+// Stop stops advertising and closes the connections.
+func (d *BLEDevice) Stop() error {
+	d.m.Lock()
+	d.adv = nil
+	d.m.Unlock()
+	d.disconnect("")
+	return nil
+}
+
+func (d *BLEDevice) Advertise(ctx context.Context, adv ble.Advertisement) error {
+	return d.advertise(ctx, &advertisement{name: adv.LocalName(), mfg: adv.ManufacturerData(),
+		services: adv.Services(), sd: adv.ServiceData(), connectable: adv.Connectable()})
+}
+
+func (d *BLEDevice) AdvertiseNameAndServices(ctx context.Context, name string, uuids ...ble.UUID) error {
+	return d.advertise(ctx, &advertisement{name: name, services: uuids, connectable: true})
+}
+
+func (d *BLEDevice) AdvertiseMfgData(ctx context.Context, id uint16, b []byte) error {
+	return d.advertise(ctx, &advertisement{mfg: append([]byte{byte(id), byte(id >> 8)}, b...)})
+}
+
+// AdvertiseServiceData16 is used for the Eddystone beacon with the dmesh
+// ID - the device is connectable.
+func (d *BLEDevice) AdvertiseServiceData16(ctx context.Context, id uint16, b []byte) error {
+	u := ble.UUID16(id)
+	return d.advertise(ctx, &advertisement{services: []ble.UUID{u},
+		sd: []ble.ServiceData{{UUID: u, Data: b}}, connectable: true})
+}
+
+func (d *BLEDevice) AdvertiseIBeaconData(ctx context.Context, b []byte) error {
+	return d.AdvertiseMfgData(ctx, 0x004C, b)
+}
+
+func (d *BLEDevice) AdvertiseIBeacon(ctx context.Context, u ble.UUID, major, minor uint16, pwr int8) error {
+	b := append([]byte{0x02, 0x15}, ble.Reverse(u)...)
+	b = append(b, byte(major>>8), byte(major), byte(minor>>8), byte(minor), byte(pwr))
+	return d.AdvertiseIBeaconData(ctx, b)
+}
+
+// Scan calls the handler with the advertisements of the other devices
+// that reach this one, each advInterval. Without allowDup each device is
+// reported once. Returns the context error when done.
+func (d *BLEDevice) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	seen := map[string]bool{}
+	t := time.NewTicker(advInterval)
+	defer t.Stop()
+	for {
+		d.medium.m.Lock()
+		devs := d.medium.bles
+		d.medium.m.Unlock()
+		for _, o := range devs {
+			if o == d || (!allowDup && seen[o.addr.String()]) {
+				continue
+			}
+			o.m.Lock()
+			adv := o.adv
+			o.m.Unlock()
+			if adv == nil {
+				continue
+			}
+			cfg, ok := d.medium.transmit(o.Name, d.Name)
+			if !ok {
+				continue
+			}
+			seen[o.addr.String()] = true
+			a := *adv
+			a.rssi, a.addr = cfg.RSSI, o.addr
+			h(&a)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Dial connects to a device advertising as connectable. The connection
+// request can be lost on the link.
+func (d *BLEDevice) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
+	d.medium.m.Lock()
+	devs := d.medium.bles
+	d.medium.m.Unlock()
+	for _, p := range devs {
+		if p == d || p.addr.String() != a.String() {
+			continue
+		}
+		p.m.Lock()
+		adv := p.adv
+		p.m.Unlock()
+		if adv == nil || !adv.connectable {
+			return nil, errBLENotFound
+		}
+		if _, ok := d.medium.transmit(d.Name, p.Name); !ok {
+			return nil, errBLEConnect
+		}
+		c := &bleConn{local: d, peer: p, ctx: ctx, rxMTU: 23, txMTU: 23,
+			done: make(chan struct{})}
+		c.profile = c.newProfile()
+		p.m.Lock()
+		p.conns = append(p.conns, c)
+		p.m.Unlock()
+		return c, nil
+	}
+	return nil, errBLENotFound
+}
+
+// Notify sends the data to the centrals subscribed to the notify
+// characteristic.
+func (d *BLEDevice) Notify(data []byte) {
+	d.m.Lock()
+	conns := d.conns
+	d.m.Unlock()
+	b := append([]byte{}, data...)
+	for _, c := range conns {
+		c.m.Lock()
+		h := c.notify
+		c.m.Unlock()
+		if h == nil {
+			continue
+		}
+		cfg, ok := d.medium.transmit(d.Name, c.local.Name)
+		if !ok {
+			continue
+		}
+		c := c
+		d.medium.after(cfg.Latency, func() {
+			if !c.closed() {
+				h(b)
+			}
+		})
+	}
+}
+
+// disconnect closes the connections to the central on the node, or all
+// if node is empty.
+func (d *BLEDevice) disconnect(node string) {
+	d.m.Lock()
+	var keep, drop []*bleConn
+	for _, c := range d.conns {
+		if node == "" || c.local.Name == node {
+			drop = append(drop, c)
+		} else {
+			keep = append(keep, c)
+		}
+	}
+	d.conns = keep
+	d.m.Unlock()
+	for _, c := range drop {
+		c.close()
+	}
+}
+
+func (d *BLEDevice) remove(c *bleConn) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	for i, o := range d.conns {
+		if o == c {
+			d.conns = append(d.conns[:i], d.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// bleConn is a connection from a central to a device - both the
+// ble.Client and its ble.Conn.
+type bleConn struct {
+	local, peer *BLEDevice
+	profile     *ble.Profile
+	ctx         context.Context
+
+	m      sync.Mutex
+	rxMTU  int
+	txMTU  int
+	notify ble.NotificationHandler
+
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *bleConn) newProfile() *ble.Profile {
+	cccd := &ble.Descriptor{UUID: ble.ClientCharacteristicConfigUUID, Handle: 5}
+	return &ble.Profile{Services: []*ble.Service{{
+		UUID:   eddystoneUUID,
+		Handle: 1, EndHandle: 5,
+		Characteristics: []*ble.Characteristic{
+			{UUID: proxyWrite, Property: ble.CharWriteNR, Handle: 2, ValueHandle: 3},
+			{UUID: proxyNotify, Property: ble.CharNotify, Handle: 4, ValueHandle: 5,
+				CCCD: cccd, Descriptors: []*ble.Descriptor{cccd}},
+		},
+	}}}
+}
+
+func (c *bleConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *bleConn) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+func (c *bleConn) Addr() ble.Addr        { return c.peer.addr }
+func (c *bleConn) Name() string          { return c.peer.Name }
+func (c *bleConn) Profile() *ble.Profile { return c.profile }
+
+func (c *bleConn) DiscoverProfile(force bool) (*ble.Profile, error) {
+	return c.profile, nil
+}
+
+func (c *bleConn) DiscoverServices(filter []ble.UUID) ([]*ble.Service, error) {
+	res := []*ble.Service{}
+	for _, s := range c.profile.Services {
+		if filter == nil || ble.Contains(filter, s.UUID) {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+func (c *bleConn) DiscoverIncludedServices(filter []ble.UUID, s *ble.Service) ([]*ble.Service, error) {
+	return nil, nil
+}
+
+func (c *bleConn) DiscoverCharacteristics(filter []ble.UUID, s *ble.Service) ([]*ble.Characteristic, error) {
+	res := []*ble.Characteristic{}
+	for _, ch := range s.Characteristics {
+		if filter == nil || ble.Contains(filter, ch.UUID) {
+			res = append(res, ch)
+		}
+	}
+	return res, nil
+}
+
+func (c *bleConn) DiscoverDescriptors(filter []ble.UUID, ch *ble.Characteristic) ([]*ble.Descriptor, error) {
+	return ch.Descriptors, nil
+}
+
+func (c *bleConn) ReadCharacteristic(ch *ble.Characteristic) ([]byte, error) {
+	return nil, errBLENotSupported
+}
+
+func (c *bleConn) ReadLongCharacteristic(ch *ble.Characteristic) ([]byte, error) {
+	return nil, errBLENotSupported
+}
+
+// WriteCharacteristic sends the value to OnWrite of the device. Without
+// noRsp a lost write returns an error.
+func (c *bleConn) WriteCharacteristic(ch *ble.Characteristic, value []byte, noRsp bool) error {
+	if c.closed() {
+		return errBLEClosed
+	}
+	if !ch.UUID.Equal(proxyWrite) {
+		return errBLENotSupported
+	}
+	cfg, ok := c.local.medium.transmit(c.local.Name, c.peer.Name)
+	if !ok {
+		if noRsp {
+			return nil
+		}
+		return errBLEConnect
+	}
+	b := append([]byte{}, value...)
+	from := c.local.addr
+	c.local.medium.after(cfg.Latency, func() {
+		if h := c.peer.OnWrite; h != nil && !c.closed() {
+			h(from, b)
+		}
+	})
+	return nil
+}
+
+func (c *bleConn) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
+	return nil, errBLENotSupported
+}
+
+func (c *bleConn) WriteDescriptor(d *ble.Descriptor, v []byte) error {
+	return errBLENotSupported
+}
+
+// ReadRSSI returns the RSSI of the link from the device.
+func (c *bleConn) ReadRSSI() int {
+	return c.local.medium.Link(c.peer.Name, c.local.Name).RSSI
+}
+
+func (c *bleConn) ExchangeMTU(rxMTU int) (int, error) {
+	if c.closed() {
+		return 0, errBLEClosed
+	}
+	mtu := rxMTU
+	if mtu > maxMTU {
+		mtu = maxMTU
+	}
+	c.m.Lock()
+	c.rxMTU, c.txMTU = mtu, mtu
+	c.m.Unlock()
+	return mtu, nil
+}
+
+// Subscribe to the notify characteristic - only one handler.
+func (c *bleConn) Subscribe(ch *ble.Characteristic, ind bool, h ble.NotificationHandler) error {
+	if !ch.UUID.Equal(proxyNotify) {
+		return errBLENotSupported
+	}
+	c.m.Lock()
+	c.notify = h
+	c.m.Unlock()
+	return nil
+}
+
+func (c *bleConn) Unsubscribe(ch *ble.Characteristic, ind bool) error {
+	return c.ClearSubscriptions()
+}
+
+func (c *bleConn) ClearSubscriptions() error {
+	c.m.Lock()
+	c.notify = nil
+	c.m.Unlock()
+	return nil
+}
+
+func (c *bleConn) CancelConnection() error {
+	c.peer.remove(c)
+	c.close()
+	return nil
+}
+
+func (c *bleConn) Disconnected() <-chan struct{} { return c.done }
+func (c *bleConn) Conn() ble.Conn                { return c }
+
+// ble.Conn - the L2 only uses the MTUs.
+
+func (c *bleConn) Read(b []byte) (int, error)  { return 0, errBLENotSupported }
+func (c *bleConn) Write(b []byte) (int, error) { return 0, errBLENotSupported }
+func (c *bleConn) Close() error                { return c.CancelConnection() }
+
+func (c *bleConn) Context() context.Context       { return c.ctx }
+func (c *bleConn) SetContext(ctx context.Context) { c.ctx = ctx }
+func (c *bleConn) LocalAddr() ble.Addr            { return c.local.addr }
+func (c *bleConn) RemoteAddr() ble.Addr           { return c.peer.addr }
+
+func (c *bleConn) RxMTU() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.rxMTU
+}
+
+func (c *bleConn) SetRxMTU(mtu int) {
+	c.m.Lock()
+	c.rxMTU = mtu
+	c.m.Unlock()
+}
+
+func (c *bleConn) TxMTU() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.txMTU
+}
+
+func (c *bleConn) SetTxMTU(mtu int) {
+	c.m.Lock()
+	c.txMTU = mtu
+	c.m.Unlock()
+}
@@ -0,0 +1,106 @@
+package sim
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+)
+
+func TestBLE(t *testing.T) {
+	m := NewMedium(1)
+	defer m.Close()
+	p, c := m.NewBLE("p"), m.NewBLE("c")
+	m.SetLink("p", "c", LinkConfig{RSSI: -70})
+
+	writes := make(chan []byte, 1)
+	p.OnWrite = func(from ble.Addr, data []byte) {
+		if from.String() != c.Addr().String() {
+			t.Error("Unexpected central", from)
+		}
+		writes <- data
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.AdvertiseServiceData16(ctx, 0xFEAA, []byte{0x10, 1, 2})
+
+	var found ble.Advertisement
+	sctx, scancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	err := c.Scan(sctx, false, func(a ble.Advertisement) {
+		if found != nil {
+			t.Error("Duplicate advertisement")
+		}
+		found = a
+	})
+	scancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Unexpected scan error", err)
+	}
+	if found == nil || found.Addr().String() != p.Addr().String() || found.RSSI() != -70 ||
+		!found.Connectable() || len(found.ServiceData()) != 1 || !found.Services()[0].Equal(eddystoneUUID) {
+		t.Fatal("Unexpected advertisement", found)
+	}
+
+	cl, err := c.Dial(context.Background(), found.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu, err := cl.ExchangeMTU(2048); err != nil || mtu != maxMTU || cl.Conn().TxMTU() != maxMTU {
+		t.Error("Unexpected MTU", mtu, err)
+	}
+	svcs, err := cl.DiscoverServices([]ble.UUID{eddystoneUUID})
+	if err != nil || len(svcs) != 1 {
+		t.Fatal("Unexpected services", svcs, err)
+	}
+	chars, _ := cl.DiscoverCharacteristics(nil, svcs[0])
+	var tx, rx *ble.Characteristic
+	for _, ch := range chars {
+		switch ch.Property {
+		case ble.CharWriteNR:
+			tx = ch
+		case ble.CharNotify:
+			rx = ch
+		}
+	}
+	if tx == nil || rx == nil {
+		t.Fatal("Missing characteristics", chars)
+	}
+
+	if err := cl.WriteCharacteristic(tx, []byte("ping"), true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-writes:
+		if string(d) != "ping" {
+			t.Error("Unexpected write", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write not received")
+	}
+
+	notifs := make(chan []byte, 1)
+	if err := cl.Subscribe(rx, false, func(d []byte) { notifs <- d }); err != nil {
+		t.Fatal(err)
+	}
+	p.Notify([]byte("pong"))
+	select {
+	case d := <-notifs:
+		if string(d) != "pong" {
+			t.Error("Unexpected notification", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Notification not received")
+	}
+
+	// Out of range - the connection is closed.
+	m.SetLink("p", "c", LinkConfig{Disabled: true})
+	select {
+	case <-cl.Disconnected():
+	case <-time.After(time.Second):
+		t.Fatal("Not disconnected")
+	}
+	if _, err := c.Dial(context.Background(), p.Addr()); err == nil {
+		t.Error("Connected out of range")
+	}
+}
@@ -0,0 +1,228 @@
+// Package sim is an in-process radio medium, for running multiple dmesh
+// nodes in one test process.
+//
+// Each node has a Radio - a fake nl80211 kernel used by a wifi.Client,
+// with monitor sources for the L2 - and optionally a BLEDevice. Frames
+// sent by a radio are delivered to the radios on the same channel, with
+// the RSSI, loss and latency of the link between the nodes. The loss is
+// decided by a seeded random source and deliveries run in order on one
+// goroutine, so the same test sees the same frames on each run.
+package sim
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LinkConfig is the link from one node to another, for both wifi and BLE.
+type LinkConfig struct {
+	// RSSI of the received frames, in dBm.
+	RSSI int
+
+	// Loss is the probability that a frame is lost, 0 to 1.
+	Loss float64
+
+	// Latency is the delay of each frame.
+	Latency time.Duration
+
+	// Disabled links don't deliver frames - the nodes are out of range.
+	Disabled bool
+}
+
+// DefaultLink is used for the nodes without a link set.
+var DefaultLink = LinkConfig{RSSI: -50}
+
+type linkKey struct {
+	from, to string
+}
+
+// Medium connects the radios and BLE devices.
+type Medium struct {
+	m      sync.Mutex
+	rand   *rand.Rand
+	links  map[linkKey]LinkConfig
+	radios []*Radio
+	bles   []*BLEDevice
+
+	// nodes numbers the node names, for the addresses.
+	nodes map[string]int
+
+	// nextIndex is the ifindex of the next interface. Starts high, so
+	// net.InterfaceByIndex doesn't find a host netdev.
+	nextIndex int
+
+	seq   uint64
+	queue deliveries
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewMedium returns a medium where the loss is decided by a random source
+// with the seed.
+func NewMedium(seed int64) *Medium {
+	m := &Medium{
+		rand:      rand.New(rand.NewSource(seed)),
+		links:     map[linkKey]LinkConfig{},
+		nodes:     map[string]int{},
+		nextIndex: 10000,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go m.deliverLoop()
+	return m
+}
+
+// Close stops the deliveries. Frames in flight are lost.
+func (m *Medium) Close() {
+	m.once.Do(func() { close(m.done) })
+}
+
+// SetLink sets the link between the nodes, in both directions.
+func (m *Medium) SetLink(a, b string, cfg LinkConfig) {
+	m.SetLinkFrom(a, b, cfg)
+	m.SetLinkFrom(b, a, cfg)
+}
+
+// SetLinkFrom sets the link for the frames sent by from to to. A disabled
+// link closes the BLE connections between the nodes.
+func (m *Medium) SetLinkFrom(from, to string, cfg LinkConfig) {
+	m.m.Lock()
+	m.links[linkKey{from, to}] = cfg
+	bles := m.bles
+	m.m.Unlock()
+	if !cfg.Disabled {
+		return
+	}
+	for _, d := range bles {
+		if d.Name == from {
+			d.disconnect(to)
+		} else if d.Name == to {
+			d.disconnect(from)
+		}
+	}
+}
+
+// Link returns the link from one node to another.
+func (m *Medium) Link(from, to string) LinkConfig {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.link(from, to)
+}
+
+func (m *Medium) link(from, to string) LinkConfig {
+	if cfg, ok := m.links[linkKey{from, to}]; ok {
+		return cfg
+	}
+	return DefaultLink
+}
+
+// transmit returns the link and true if a frame from one node reaches the
+// other. Called in the order the frames are sent, so the random source
+// gives the same losses on each run.
+func (m *Medium) transmit(from, to string) (LinkConfig, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	cfg := m.link(from, to)
+	if cfg.Disabled {
+		return cfg, false
+	}
+	if cfg.Loss > 0 && m.rand.Float64() < cfg.Loss {
+		return cfg, false
+	}
+	return cfg, true
+}
+
+// node returns the number of the node, assigned in order of creation.
+// Must be called with the lock held.
+func (m *Medium) node(name string) int {
+	n, ok := m.nodes[name]
+	if !ok {
+		n = len(m.nodes) + 1
+		m.nodes[name] = n
+	}
+	return n
+}
+
+func (m *Medium) newIndex() int {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.nextIndex++
+	return m.nextIndex
+}
+
+// delivery is a function called by the deliver loop at the due time.
+// Deliveries with the same time run in the order they were added.
+type delivery struct {
+	due time.Time
+	seq uint64
+	f   func()
+}
+
+type deliveries []*delivery
+
+func (d deliveries) Len() int { return len(d) }
+func (d deliveries) Less(i, j int) bool {
+	if d[i].due.Equal(d[j].due) {
+		return d[i].seq < d[j].seq
+	}
+	return d[i].due.Before(d[j].due)
+}
+func (d deliveries) Swap(i, j int)       { d[i], d[j] = d[j], d[i] }
+func (d *deliveries) Push(x interface{}) { *d = append(*d, x.(*delivery)) }
+func (d *deliveries) Pop() interface{} {
+	old := *d
+	x := old[len(old)-1]
+	*d = old[:len(old)-1]
+	return x
+}
+
+// after calls f from the deliver loop, after the delay.
+func (m *Medium) after(delay time.Duration, f func()) {
+	m.m.Lock()
+	m.seq++
+	heap.Push(&m.queue, &delivery{due: time.Now().Add(delay), seq: m.seq, f: f})
+	m.m.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Medium) deliverLoop() {
+	t := time.NewTimer(time.Hour)
+	defer t.Stop()
+	for {
+		m.m.Lock()
+		var next *delivery
+		wait := time.Hour
+		if len(m.queue) > 0 {
+			if d := time.Until(m.queue[0].due); d <= 0 {
+				next = heap.Pop(&m.queue).(*delivery)
+			} else {
+				wait = d
+			}
+		}
+		m.m.Unlock()
+		if next != nil {
+			next.f()
+			continue
+		}
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(wait)
+		select {
+		case <-m.done:
+			return
+		case <-m.wake:
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sim
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/google/gopacket"
+)
+
+var errNotMonitor = errors.New("not a monitor interface of the radio")
+
+// monQueueSize is the number of frames buffered for a monitor source.
+// Frames received when the reader is behind are dropped, like a full
+// socket buffer.
+const monQueueSize = 256
+
+// monFrame is a radiotap frame received on the monitor.
+type monFrame struct {
+	data []byte
+	ts   time.Time
+}
+
+// monSource is a gopacket.PacketDataSource with the frames received by a
+// monitor interface - what the L2 reads from the monitor netdev.
+type monSource struct {
+	c    chan monFrame
+	done chan struct{}
+	once sync.Once
+}
+
+// MonSource returns the frames received by the monitor interface, with a
+// radiotap header. Returns io.EOF when the interface is deleted or the
+// radio is closed. Opening the monitor again closes the previous source.
+func (r *Radio) MonSource(ifi *wifi.Interface) (gopacket.PacketDataSource, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, si := range r.ifaces {
+		if si.index != ifi.Index || si.typ != wifi.InterfaceTypeMonitor {
+			continue
+		}
+		if si.mon != nil {
+			si.mon.close()
+		}
+		si.mon = &monSource{c: make(chan monFrame, monQueueSize), done: make(chan struct{})}
+		return si.mon, nil
+	}
+	return nil, errNotMonitor
+}
+
+func (s *monSource) add(d []byte, ts time.Time) {
+	select {
+	case s.c <- monFrame{data: d, ts: ts}:
+	default:
+	}
+}
+
+func (s *monSource) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *monSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case f := <-s.c:
+		return f.data, gopacket.CaptureInfo{Timestamp: f.ts, CaptureLength: len(f.data),
+			Length: len(f.data)}, nil
+	case <-s.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+// radiotap adds the header with the flags, channel and signal fields.
+func radiotap(freq, rssi int, frame []byte) []byte {
+	const hdrLen = 15
+	b := make([]byte, hdrLen, hdrLen+len(frame))
+	b[0] = 0 // version
+	binary.LittleEndian.PutUint16(b[2:], hdrLen)
+	// Flags, Channel, DBMAntennaSignal
+	binary.LittleEndian.PutUint32(b[4:], 1<<1|1<<3|1<<5)
+	b[8] = 0 // flags - no FCS
+	// b[9] is padding - the channel is 2 byte aligned
+	binary.LittleEndian.PutUint16(b[10:], uint16(freq))
+	chFlags := uint16(0x00a0) // 2GHz, CCK
+	if freq > 5000 {
+		chFlags = 0x0140 // 5GHz, OFDM
+	}
+	binary.LittleEndian.PutUint16(b[12:], chFlags)
+	b[14] = byte(int8(rssi))
+	return append(b, frame...)
+}
@@ -0,0 +1,694 @@
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// The Radio is a single phy with a station interface, like a laptop card.
+// It answers the nl80211 commands used by dmesh: phy and interface dumps,
+// interface create/delete, frame registration, frame TX with TX status,
+// remain on channel, and the regulatory domain. Other commands fail with
+// EOPNOTSUPP. Only the unicast events are sent - received frames, TX
+// status and ROC - there are no multicast events.
+//
+// The interfaces have no netdevs: links are brought up with the socket,
+// and the monitor frames are read with MonSource.
+
+var errRadioClosed = errors.New("radio closed")
+
+// Family is the nl80211 family of the radios.
+var Family = genetlink.Family{
+	ID:      0x1c,
+	Version: 1,
+	Name:    nl80211.GenlName,
+	Groups: []genetlink.MulticastGroup{{ID: 3, Name: nl80211.MulticastGroupConfig},
+		{ID: 4, Name: nl80211.MulticastGroupScan},
+		{ID: 5, Name: nl80211.MulticastGroupReg},
+		{ID: 6, Name: nl80211.MulticastGroupMlme}},
+}
+
+// Radio is the fake kernel of a node, used by a wifi.Client as socket.
+type Radio struct {
+	// Name of the node, for the links.
+	Name string
+
+	medium *Medium
+	node   int
+	addr   net.HardwareAddr
+
+	m       sync.Mutex
+	ifaces  []*simIface
+	nextDev int
+	freq    int
+	roc     *roc
+	cookie  uint64
+	groups  []uint32
+
+	in     chan []netlink.Message
+	closed chan struct{}
+	once   sync.Once
+}
+
+// simIface is an interface on the radio.
+type simIface struct {
+	index int
+	wdev  uint64
+	name  string
+	typ   wifi.InterfaceType
+	addr  net.HardwareAddr
+	up    bool
+	regs  []frameReg
+	mon   *monSource
+}
+
+// frameReg is a RegisterFrame for the interface.
+type frameReg struct {
+	typ   uint16
+	match []byte
+}
+
+// roc is the remain on channel in progress.
+type roc struct {
+	cookie  uint64
+	freq    int
+	end     time.Time
+	ifindex int
+	wdev    uint64
+	timer   *time.Timer
+}
+
+// NewRadio adds a radio for the node, on the NAN channel. It has a
+// station interface "wlan0", up.
+func (m *Medium) NewRadio(name string) *Radio {
+	m.m.Lock()
+	node := m.node(name)
+	m.m.Unlock()
+	r := &Radio{
+		Name:   name,
+		medium: m,
+		node:   node,
+		addr:   net.HardwareAddr{2, 0, 0, 0, byte(node), 0},
+		freq:   wifi.NANFreq,
+		in:     make(chan []netlink.Message, 256),
+		closed: make(chan struct{}),
+	}
+	r.m.Lock()
+	r.newIface("wlan0", wifi.InterfaceTypeStation, nil).up = true
+	r.m.Unlock()
+
+	m.m.Lock()
+	m.radios = append(m.radios, r)
+	m.m.Unlock()
+	return r
+}
+
+// Client returns a wifi.Client using the radio.
+func (r *Radio) Client() *wifi.Client {
+	return wifi.NewClientSocket(r, Family)
+}
+
+// SetFreq sets the channel of the radio when it is not in a ROC.
+func (r *Radio) SetFreq(freq int) {
+	r.m.Lock()
+	r.freq = freq
+	r.m.Unlock()
+}
+
+// Freq returns the channel the radio is on.
+func (r *Radio) Freq() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.channel(time.Now())
+}
+
+func (r *Radio) channel(now time.Time) int {
+	if r.roc != nil && now.Before(r.roc.end) {
+		return r.roc.freq
+	}
+	return r.freq
+}
+
+// newIface adds an interface, with the next address if addr is nil.
+// Must be called with the lock held.
+func (r *Radio) newIface(name string, t wifi.InterfaceType, addr net.HardwareAddr) *simIface {
+	dev := r.nextDev
+	r.nextDev++
+	if addr == nil {
+		addr = net.HardwareAddr{2, 0, 0, 0, byte(r.node), byte(dev)}
+	}
+	ifi := &simIface{
+		index: r.medium.newIndex(),
+		wdev:  uint64(r.node)<<32 | uint64(dev),
+		name:  name,
+		typ:   t,
+		addr:  addr,
+	}
+	r.ifaces = append(r.ifaces, ifi)
+	return ifi
+}
+
+// lookup finds the interface by ifindex or wdev. Must be called with the
+// lock held.
+func (r *Radio) lookup(a map[uint16][]byte) *simIface {
+	idx, byIndex := a[nl80211.AttrIfindex]
+	wdev, byWdev := a[nl80211.AttrWdev]
+	for _, ifi := range r.ifaces {
+		if byIndex && int(nlenc.Uint32(idx)) == ifi.index ||
+			!byIndex && byWdev && nlenc.Uint64(wdev) == ifi.wdev {
+			return ifi
+		}
+	}
+	return nil
+}
+
+// Send handles a request, and queues the replies for Receive.
+func (r *Radio) Send(m netlink.Message) error {
+	var req genetlink.Message
+	if err := req.UnmarshalBinary(m.Data); err != nil {
+		return err
+	}
+	attrs, err := netlink.UnmarshalAttributes(req.Data)
+	if err != nil {
+		return err
+	}
+	a := map[uint16][]byte{}
+	for _, at := range attrs {
+		a[at.Type] = at.Data
+	}
+	replies, after, err := r.serve(req.Header.Command, a)
+
+	hdr := m.Header
+	hdr.Flags = 0
+	var out []netlink.Message
+	dump := m.Header.Flags&netlink.Dump == netlink.Dump
+	if errno, ok := err.(syscall.Errno); ok {
+		hdr.Type = netlink.Error
+		out = append(out, netlink.Message{Header: hdr, Data: nlenc.Int32Bytes(-int32(errno))})
+	} else if err != nil {
+		return err
+	} else {
+		if dump {
+			hdr.Flags = netlink.Multi
+		}
+		for _, gm := range replies {
+			b, err := gm.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			out = append(out, netlink.Message{Header: hdr, Data: b})
+		}
+		if dump {
+			hdr.Type = netlink.Done
+			out = append(out, netlink.Message{Header: hdr, Data: nlenc.Int32Bytes(0)})
+		} else if m.Header.Flags&netlink.Acknowledge != 0 {
+			hdr.Type = netlink.Error
+			out = append(out, netlink.Message{Header: hdr, Data: nlenc.Int32Bytes(0)})
+		}
+	}
+	r.push(out)
+	if after != nil {
+		after()
+	}
+	return nil
+}
+
+// Receive returns the replies and events - all unicast.
+func (r *Radio) Receive() ([]netlink.Message, uint32, error) {
+	select {
+	case msgs := <-r.in:
+		return msgs, 0, nil
+	case <-r.closed:
+		return nil, 0, errRadioClosed
+	}
+}
+
+// PID is the port ID of the client socket - the node number.
+func (r *Radio) PID() uint32 {
+	return uint32(r.node)
+}
+
+// JoinGroup is recorded - there are no multicast events.
+func (r *Radio) JoinGroup(group uint32) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.groups = append(r.groups, group)
+	return nil
+}
+
+// Close stops the radio. The monitor sources return io.EOF.
+func (r *Radio) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.m.Lock()
+		for _, ifi := range r.ifaces {
+			if ifi.mon != nil {
+				ifi.mon.close()
+			}
+		}
+		r.m.Unlock()
+	})
+	return nil
+}
+
+// SetLinkUp is used by the wifi.Client instead of rtnetlink. Interfaces
+// that are down don't receive frames.
+func (r *Radio) SetLinkUp(ifindex int, up bool) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, ifi := range r.ifaces {
+		if ifi.index == ifindex {
+			ifi.up = up
+			return nil
+		}
+	}
+	return syscall.ENODEV
+}
+
+func (r *Radio) push(msgs []netlink.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	select {
+	case r.in <- msgs:
+	case <-r.closed:
+	}
+}
+
+// event returns an unsolicited message.
+func event(cmd uint8, attrs ...netlink.Attribute) netlink.Message {
+	b, _ := msg(cmd, attrs...).MarshalBinary()
+	return netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(Family.ID)}, Data: b}
+}
+
+func msg(cmd uint8, attrs ...netlink.Attribute) genetlink.Message {
+	return genetlink.Message{Header: genetlink.Header{Command: cmd, Version: Family.Version},
+		Data: nest(attrs...)}
+}
+
+func nest(attrs ...netlink.Attribute) []byte {
+	b, _ := netlink.MarshalAttributes(attrs)
+	return b
+}
+
+func flags(types ...int) []byte {
+	attrs := []netlink.Attribute{}
+	for _, t := range types {
+		attrs = append(attrs, netlink.Attribute{Type: uint16(t), Data: []byte{}})
+	}
+	return nest(attrs...)
+}
+
+func u32(v int) []byte {
+	return nlenc.Uint32Bytes(uint32(v))
+}
+
+// serve handles a command. after is called once the replies are queued,
+// for events that follow the reply.
+func (r *Radio) serve(cmd uint8, a map[uint16][]byte) (replies []genetlink.Message, after func(), err error) {
+	switch cmd {
+	case nl80211.CmdGetWiphy:
+		return []genetlink.Message{r.wiphy()}, nil, nil
+	case nl80211.CmdGetReg:
+		return []genetlink.Message{regDomain()}, nil, nil
+	case nl80211.CmdGetStation, nl80211.CmdGetSurvey, nl80211.CmdGetMpath, nl80211.CmdGetScan:
+		return nil, nil, nil
+	case nl80211.CmdFrame:
+		return r.txFrame(a)
+	case nl80211.CmdRemainOnChannel:
+		return r.remainOnChannel(a)
+	case nl80211.CmdCancelRemainOnChannel:
+		return r.cancelRemainOnChannel(a)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	switch cmd {
+	case nl80211.CmdGetInterface:
+		if _, ok := a[nl80211.AttrIfindex]; ok {
+			ifi := r.lookup(a)
+			if ifi == nil {
+				return nil, nil, syscall.ENODEV
+			}
+			return []genetlink.Message{r.ifaceMsg(ifi)}, nil, nil
+		}
+		for _, ifi := range r.ifaces {
+			replies = append(replies, r.ifaceMsg(ifi))
+		}
+		return replies, nil, nil
+
+	case nl80211.CmdNewInterface:
+		name := nlenc.String(a[nl80211.AttrIfname])
+		for _, ifi := range r.ifaces {
+			if ifi.name == name {
+				return nil, nil, syscall.EEXIST
+			}
+		}
+		var addr net.HardwareAddr
+		if len(a[nl80211.AttrMac]) == 6 {
+			addr = append(net.HardwareAddr{}, a[nl80211.AttrMac]...)
+		}
+		ifi := r.newIface(name, wifi.InterfaceType(nlenc.Uint32(a[nl80211.AttrIftype])), addr)
+		return []genetlink.Message{r.ifaceMsg(ifi)}, nil, nil
+
+	case nl80211.CmdDelInterface:
+		ifi := r.lookup(a)
+		if ifi == nil {
+			return nil, nil, syscall.ENODEV
+		}
+		for i, o := range r.ifaces {
+			if o == ifi {
+				r.ifaces = append(r.ifaces[:i], r.ifaces[i+1:]...)
+				break
+			}
+		}
+		if ifi.mon != nil {
+			ifi.mon.close()
+		}
+		return nil, nil, nil
+
+	case nl80211.CmdSetInterface:
+		ifi := r.lookup(a)
+		if ifi == nil {
+			return nil, nil, syscall.ENODEV
+		}
+		if t, ok := a[nl80211.AttrIftype]; ok {
+			ifi.typ = wifi.InterfaceType(nlenc.Uint32(t))
+		}
+		return nil, nil, nil
+
+	case nl80211.CmdSetWiphy:
+		if f, ok := a[nl80211.AttrWiphyFreq]; ok {
+			r.freq = int(nlenc.Uint32(f))
+		}
+		return nil, nil, nil
+
+	case nl80211.CmdRegisterFrame:
+		ifi := r.lookup(a)
+		if ifi == nil {
+			return nil, nil, syscall.ENODEV
+		}
+		ifi.regs = append(ifi.regs, frameReg{typ: nlenc.Uint16(a[nl80211.AttrFrameType]),
+			match: append([]byte{}, a[nl80211.AttrFrameMatch]...)})
+		return nil, nil, nil
+	}
+	return nil, nil, syscall.EOPNOTSUPP
+}
+
+func (r *Radio) ifaceMsg(ifi *simIface) genetlink.Message {
+	attrs := []netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: u32(ifi.index)},
+		{Type: nl80211.AttrIfname, Data: nlenc.Bytes(ifi.name)},
+		{Type: nl80211.AttrWiphy, Data: u32(0)},
+		{Type: nl80211.AttrIftype, Data: u32(int(ifi.typ))},
+		{Type: nl80211.AttrWdev, Data: nlenc.Uint64Bytes(ifi.wdev)},
+		{Type: nl80211.AttrMac, Data: ifi.addr},
+	}
+	if ifi.typ == wifi.InterfaceTypeMonitor {
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrWiphyFreq, Data: u32(r.freq)})
+	}
+	return msg(nl80211.CmdNewInterface, attrs...)
+}
+
+// wiphy is a dual band phy with frame TX, ROC and TX status - user space
+// NAN with a station on another channel. No mesh point, no NAN offload.
+func (r *Radio) wiphy() genetlink.Message {
+	ch := func(idx uint16, freq int) netlink.Attribute {
+		return netlink.Attribute{Type: idx, Data: nest(netlink.Attribute{Type: nl80211.FrequencyAttrFreq, Data: u32(freq)})}
+	}
+	var ch2, ch5 []netlink.Attribute
+	for i := 0; i < 11; i++ {
+		ch2 = append(ch2, ch(uint16(i), 2412+5*i))
+	}
+	for i, f := range []int{5180, 5200, 5220, 5240, 5745, 5765, 5785, 5805} {
+		ch5 = append(ch5, ch(uint16(i), f))
+	}
+	limits := nest(
+		netlink.Attribute{Type: 1, Data: nest(
+			netlink.Attribute{Type: nl80211.IfaceLimitMax, Data: u32(1)},
+			netlink.Attribute{Type: nl80211.IfaceLimitTypes, Data: flags(nl80211.IftypeStation)})},
+		netlink.Attribute{Type: 2, Data: nest(
+			netlink.Attribute{Type: nl80211.IfaceLimitMax, Data: u32(2)},
+			netlink.Attribute{Type: nl80211.IfaceLimitTypes, Data: flags(nl80211.IftypeAp,
+				nl80211.IftypeP2pClient, nl80211.IftypeP2pGo, nl80211.IftypeP2pDevice)})})
+	combs := nest(netlink.Attribute{Type: 1, Data: nest(
+		netlink.Attribute{Type: nl80211.IfaceCombLimits, Data: limits},
+		netlink.Attribute{Type: nl80211.IfaceCombMaxnum, Data: u32(3)},
+		netlink.Attribute{Type: nl80211.IfaceCombNumChannels, Data: u32(2)})})
+
+	return msg(nl80211.CmdNewWiphy,
+		netlink.Attribute{Type: nl80211.AttrWiphy, Data: u32(0)},
+		netlink.Attribute{Type: nl80211.AttrWiphyName, Data: nlenc.Bytes("phy0")},
+		netlink.Attribute{Type: nl80211.AttrMac, Data: r.addr},
+		netlink.Attribute{Type: nl80211.AttrMaxRemainOnChannelDuration, Data: u32(5000)},
+		netlink.Attribute{Type: nl80211.AttrOffchannelTxOk, Data: []byte{}},
+		netlink.Attribute{Type: nl80211.AttrFeatureFlags, Data: u32(nl80211.FeatureSkTxStatus)},
+		netlink.Attribute{Type: nl80211.AttrSupportedIftypes, Data: flags(nl80211.IftypeStation,
+			nl80211.IftypeAp, nl80211.IftypeMonitor, nl80211.IftypeP2pClient, nl80211.IftypeP2pGo,
+			nl80211.IftypeP2pDevice)},
+		netlink.Attribute{Type: nl80211.AttrSoftwareIftypes, Data: flags(nl80211.IftypeMonitor)},
+		netlink.Attribute{Type: nl80211.AttrInterfaceCombinations, Data: combs},
+		netlink.Attribute{Type: nl80211.AttrSupportedCommands, Data: nest(
+			netlink.Attribute{Type: 1, Data: u32(nl80211.CmdFrame)},
+			netlink.Attribute{Type: 2, Data: u32(nl80211.CmdRemainOnChannel)},
+			netlink.Attribute{Type: 3, Data: u32(nl80211.CmdRegisterFrame)})},
+		netlink.Attribute{Type: nl80211.AttrWiphyBands, Data: nest(
+			netlink.Attribute{Type: nl80211.Band2ghz, Data: nest(
+				netlink.Attribute{Type: nl80211.BandAttrFreqs, Data: nest(ch2...)})},
+			netlink.Attribute{Type: nl80211.Band5ghz, Data: nest(
+				netlink.Attribute{Type: nl80211.BandAttrFreqs, Data: nest(ch5...)})})})
+}
+
+// regDomain allows all the channels of the phy, without restrictions.
+func regDomain() genetlink.Message {
+	rule := func(idx uint16, start, end, bw int) netlink.Attribute {
+		return netlink.Attribute{Type: idx, Data: nest(
+			netlink.Attribute{Type: nl80211.AttrRegRuleFlags, Data: u32(0)},
+			netlink.Attribute{Type: nl80211.AttrFreqRangeStart, Data: u32(start * 1000)},
+			netlink.Attribute{Type: nl80211.AttrFreqRangeEnd, Data: u32(end * 1000)},
+			netlink.Attribute{Type: nl80211.AttrFreqRangeMaxBw, Data: u32(bw * 1000)},
+			netlink.Attribute{Type: nl80211.AttrPowerRuleMaxEirp, Data: u32(2000)})}
+	}
+	return msg(nl80211.CmdGetReg,
+		netlink.Attribute{Type: nl80211.AttrRegAlpha2, Data: []byte("ZZ\x00")},
+		netlink.Attribute{Type: nl80211.AttrRegRules, Data: nest(
+			rule(1, 2402, 2482, 40),
+			rule(2, 5170, 5250, 80),
+			rule(3, 5735, 5835, 80))})
+}
+
+// txFrame sends the frame on the requested channel - off channel TX is
+// supported. The TX status is sent after the slowest delivery, acked if
+// a unicast frame was received.
+func (r *Radio) txFrame(a map[uint16][]byte) ([]genetlink.Message, func(), error) {
+	r.m.Lock()
+	ifi := r.lookup(a)
+	if ifi == nil {
+		r.m.Unlock()
+		return nil, nil, syscall.ENODEV
+	}
+	frame := append([]byte{}, a[nl80211.AttrFrame]...)
+	if len(frame) < 24 {
+		r.m.Unlock()
+		return nil, nil, syscall.EINVAL
+	}
+	freq := r.channel(time.Now())
+	if f, ok := a[nl80211.AttrWiphyFreq]; ok {
+		freq = int(nlenc.Uint32(f))
+	}
+	r.cookie++
+	cookie := r.cookie
+	index, wdev := ifi.index, ifi.wdev
+	r.m.Unlock()
+
+	m := r.medium
+	m.m.Lock()
+	radios := m.radios
+	m.m.Unlock()
+
+	// Only used from the deliver loop.
+	acked := false
+	var last time.Duration
+	for _, to := range radios {
+		if to == r {
+			continue
+		}
+		cfg, ok := m.transmit(r.Name, to.Name)
+		if !ok {
+			continue
+		}
+		if cfg.Latency > last {
+			last = cfg.Latency
+		}
+		to := to
+		m.after(cfg.Latency, func() {
+			if to.receive(freq, cfg.RSSI, frame) {
+				acked = true
+			}
+		})
+	}
+	m.after(last, func() {
+		attrs := []netlink.Attribute{
+			{Type: nl80211.AttrIfindex, Data: u32(index)},
+			{Type: nl80211.AttrWdev, Data: nlenc.Uint64Bytes(wdev)},
+			{Type: nl80211.AttrWiphy, Data: u32(0)},
+			{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(cookie)},
+			{Type: nl80211.AttrFrame, Data: frame},
+		}
+		if acked {
+			attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrAck, Data: []byte{}})
+		}
+		r.push([]netlink.Message{event(nl80211.CmdFrameTxStatus, attrs...)})
+	})
+
+	return []genetlink.Message{msg(nl80211.CmdFrame,
+		netlink.Attribute{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(cookie)})}, nil, nil
+}
+
+// receive delivers a frame sent on freq to the monitors, and to the
+// interfaces with the destination address and a matching registration.
+// Returns true if a unicast frame was received - the sender gets an ack.
+func (r *Radio) receive(freq, rssi int, frame []byte) bool {
+	now := time.Now()
+	r.m.Lock()
+	if r.channel(now) != freq {
+		r.m.Unlock()
+		return false
+	}
+	dst := net.HardwareAddr(frame[4:10])
+	group := dst[0]&1 == 1
+	acked := false
+	var mons []*monSource
+	var events []netlink.Message
+	for _, ifi := range r.ifaces {
+		if !ifi.up {
+			continue
+		}
+		if ifi.typ == wifi.InterfaceTypeMonitor {
+			if ifi.mon != nil {
+				mons = append(mons, ifi.mon)
+			}
+			continue
+		}
+		if !group && !bytes.Equal(dst, ifi.addr) {
+			continue
+		}
+		acked = acked || !group
+		if ifi.registered(frame) {
+			events = append(events, event(nl80211.CmdFrame,
+				netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(ifi.index)},
+				netlink.Attribute{Type: nl80211.AttrWdev, Data: nlenc.Uint64Bytes(ifi.wdev)},
+				netlink.Attribute{Type: nl80211.AttrWiphy, Data: u32(0)},
+				netlink.Attribute{Type: nl80211.AttrWiphyFreq, Data: u32(freq)},
+				netlink.Attribute{Type: nl80211.AttrRxSignalDbm, Data: nlenc.Int32Bytes(int32(rssi))},
+				netlink.Attribute{Type: nl80211.AttrFrame, Data: frame}))
+		}
+	}
+	r.m.Unlock()
+
+	if len(mons) > 0 {
+		rt := radiotap(freq, rssi, frame)
+		for _, mon := range mons {
+			mon.add(rt, now)
+		}
+	}
+	r.push(events)
+	return acked
+}
+
+// registered returns true if the frame type and the start of the body
+// match a registration.
+func (ifi *simIface) registered(frame []byte) bool {
+	for _, reg := range ifi.regs {
+		if frame[0]&0xfc == byte(reg.typ)&0xfc && bytes.HasPrefix(frame[24:], reg.match) {
+			return true
+		}
+	}
+	return false
+}
+
+// remainOnChannel replaces the ROC in progress. The started event follows
+// the reply, the cancel event is sent at the end.
+func (r *Radio) remainOnChannel(a map[uint16][]byte) ([]genetlink.Message, func(), error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	ifi := r.lookup(a)
+	if ifi == nil {
+		return nil, nil, syscall.ENODEV
+	}
+	var events []netlink.Message
+	if prev := r.roc; prev != nil {
+		if prev.timer != nil {
+			prev.timer.Stop()
+		}
+		events = append(events, prev.cancelled())
+	}
+	r.cookie++
+	dur := time.Duration(nlenc.Uint32(a[nl80211.AttrDuration])) * time.Millisecond
+	ro := &roc{cookie: r.cookie, freq: int(nlenc.Uint32(a[nl80211.AttrWiphyFreq])),
+		end: time.Now().Add(dur), ifindex: ifi.index, wdev: ifi.wdev}
+	r.roc = ro
+	events = append(events, event(nl80211.CmdRemainOnChannel, ro.attrs(
+		netlink.Attribute{Type: nl80211.AttrDuration, Data: u32(int(dur / time.Millisecond))})...))
+
+	after := func() {
+		r.push(events)
+		r.m.Lock()
+		if r.roc == ro {
+			ro.timer = time.AfterFunc(time.Until(ro.end), func() { r.endROC(ro) })
+		}
+		r.m.Unlock()
+	}
+	return []genetlink.Message{msg(nl80211.CmdRemainOnChannel,
+		netlink.Attribute{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(ro.cookie)})}, after, nil
+}
+
+func (r *Radio) cancelRemainOnChannel(a map[uint16][]byte) ([]genetlink.Message, func(), error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	ro := r.roc
+	if ro == nil || nlenc.Uint64(a[nl80211.AttrCookie]) != ro.cookie {
+		return nil, nil, syscall.ENOENT
+	}
+	if ro.timer != nil {
+		ro.timer.Stop()
+	}
+	r.roc = nil
+	return nil, func() { r.push([]netlink.Message{ro.cancelled()}) }, nil
+}
+
+// endROC returns to the radio channel at the end of the ROC.
+func (r *Radio) endROC(ro *roc) {
+	r.m.Lock()
+	if r.roc != ro {
+		r.m.Unlock()
+		return
+	}
+	r.roc = nil
+	r.m.Unlock()
+	r.push([]netlink.Message{ro.cancelled()})
+}
+
+func (ro *roc) attrs(extra ...netlink.Attribute) []netlink.Attribute {
+	return append([]netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: u32(ro.ifindex)},
+		{Type: nl80211.AttrWdev, Data: nlenc.Uint64Bytes(ro.wdev)},
+		{Type: nl80211.AttrWiphy, Data: u32(0)},
+		{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(ro.cookie)},
+		{Type: nl80211.AttrWiphyFreq, Data: u32(ro.freq)},
+	}, extra...)
+}
+
+func (ro *roc) cancelled() netlink.Message {
+	return event(nl80211.CmdCancelRemainOnChannel, ro.attrs()...)
+}
@@ -0,0 +1,227 @@
+package sim
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var broadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// testNode is a radio with a client, receiving the NAN action frames on
+// wlan0.
+type testNode struct {
+	t   *testing.T
+	r   *Radio
+	c   *wifi.Client
+	ifi *wifi.Interface
+	sub *wifi.Subscription
+}
+
+func newTestNode(t *testing.T, m *Medium, name string) *testNode {
+	r := m.NewRadio(name)
+	c := r.Client()
+	t.Cleanup(func() { c.Close() })
+	ifis, err := c.Interfaces()
+	if err != nil || len(ifis) != 1 || ifis[0].Name != "wlan0" {
+		t.Fatal("Unexpected interfaces", ifis, err)
+	}
+	if err := c.RegisterFrame(ifis[0], 0xd0, []byte{0x04, 0x09}); err != nil {
+		t.Fatal(err)
+	}
+	return &testNode{t: t, r: r, c: c, ifi: ifis[0],
+		sub: c.Events.Subscribe(wifi.SubscribeOptions{Buffer: 128,
+			Kinds: []wifi.EventKind{wifi.KindFrameReceived, wifi.KindTxStatus,
+				wifi.KindRemainOnChannelStarted, wifi.KindRemainOnChannelCancelled}})}
+}
+
+// actionFrame is a public action frame, with the NAN SDF OUI.
+func actionFrame(dst, src net.HardwareAddr, body string) []byte {
+	b := []byte{0xd0, 0, 0, 0}
+	b = append(b, dst...)
+	b = append(b, src...)
+	b = append(b, 0x50, 0x6f, 0x9a, 0x01, 0, 0)
+	b = append(b, 0, 0, 0x04, 0x09, 0x50, 0x6f, 0x9a, 0x13)
+	return append(b, body...)
+}
+
+func (n *testNode) send(dst net.HardwareAddr, freq int, body string) {
+	if _, err := n.c.TxFrame(n.ifi, actionFrame(dst, n.ifi.HardwareAddr, body), freq, 0); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+func (n *testNode) next(kind wifi.EventKind) wifi.Event {
+	for {
+		select {
+		case ev := <-n.sub.C:
+			if ev.Kind() == kind {
+				return ev
+			}
+		case <-time.After(2 * time.Second):
+			n.t.Fatal("Timeout waiting for event", n.r.Name, kind)
+			return nil
+		}
+	}
+}
+
+// txStatus waits for the TX status, and returns true if acked.
+func (n *testNode) txStatus() bool {
+	return n.next(wifi.KindTxStatus).(*wifi.TxStatusEvent).Acked
+}
+
+// idle fails if a frame was received.
+func (n *testNode) idle() {
+	for {
+		select {
+		case ev := <-n.sub.C:
+			if ev.Kind() == wifi.KindFrameReceived {
+				n.t.Error("Unexpected frame on", n.r.Name)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestRadioFrames(t *testing.T) {
+	m := NewMedium(1)
+	defer m.Close()
+	a, b, c := newTestNode(t, m, "a"), newTestNode(t, m, "b"), newTestNode(t, m, "c")
+	m.SetLink("a", "b", LinkConfig{RSSI: -60})
+	c.r.SetFreq(2412)
+
+	mon, err := b.c.NewMon(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.c.SetLinkUp(mon, true); err != nil {
+		t.Fatal(err)
+	}
+	src, err := b.r.MonSource(mon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.r.MonSource(b.ifi); err == nil {
+		t.Error("Expecting error for station monitor")
+	}
+
+	// Broadcast - received by b, not by c on another channel. Not acked.
+	a.send(broadcast, wifi.NANFreq, "hello")
+	if a.txStatus() {
+		t.Error("Broadcast acked")
+	}
+	f := b.next(wifi.KindFrameReceived).(*wifi.FrameReceived)
+	if f.Signal != -60 || f.Freq != wifi.NANFreq || !bytes.HasSuffix(f.Frame, []byte("hello")) {
+		t.Error("Unexpected frame", f)
+	}
+	c.idle()
+
+	d, _, err := src.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(d, layers.LayerTypeRadioTap, gopacket.Default)
+	rt, ok := p.Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+	d11, ok11 := p.Layer(layers.LayerTypeDot11).(*layers.Dot11)
+	if !ok || !ok11 || rt.DBMAntennaSignal != -60 || rt.ChannelFrequency != wifi.NANFreq ||
+		d11.Address2.String() != a.ifi.HardwareAddr.String() {
+		t.Error("Unexpected monitor frame", p)
+	}
+
+	// Unicast to b is acked, to c is not - c is on another channel.
+	a.send(b.ifi.HardwareAddr, wifi.NANFreq, "to b")
+	if !a.txStatus() {
+		t.Error("Unicast not acked")
+	}
+	b.next(wifi.KindFrameReceived)
+	a.send(c.ifi.HardwareAddr, wifi.NANFreq, "to c")
+	if a.txStatus() {
+		t.Error("Acked on another channel")
+	}
+	c.idle()
+
+	// c listens on the NAN channel for a while.
+	if _, err := c.c.RemainOnChannel(c.ifi, wifi.NANFreq, 200); err != nil {
+		t.Fatal(err)
+	}
+	c.next(wifi.KindRemainOnChannelStarted)
+	if c.r.Freq() != wifi.NANFreq {
+		t.Error("Not on channel", c.r.Freq())
+	}
+	a.send(c.ifi.HardwareAddr, wifi.NANFreq, "to c")
+	if !a.txStatus() {
+		t.Error("Not acked in ROC")
+	}
+	c.next(wifi.KindFrameReceived)
+	c.next(wifi.KindRemainOnChannelCancelled)
+	if c.r.Freq() != 2412 {
+		t.Error("ROC not ended", c.r.Freq())
+	}
+
+	// Deleted monitor ends the source.
+	if err := b.c.DeleteInterface(mon); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, _, err := src.ReadPacketData(); err != nil {
+			break
+		}
+	}
+}
+
+func TestMediumLoss(t *testing.T) {
+	const frames = 50
+	run := func(seed int64) int {
+		m := NewMedium(seed)
+		defer m.Close()
+		a, b := newTestNode(t, m, "a"), newTestNode(t, m, "b")
+		m.SetLink("a", "b", LinkConfig{RSSI: -80, Loss: 0.5})
+		for i := 0; i < frames; i++ {
+			a.send(b.ifi.HardwareAddr, wifi.NANFreq, "x")
+		}
+		acked := 0
+		for i := 0; i < frames; i++ {
+			if a.txStatus() {
+				acked++
+			}
+		}
+		for i := 0; i < acked; i++ {
+			b.next(wifi.KindFrameReceived)
+		}
+		b.idle()
+		return acked
+	}
+	n := run(7)
+	if n < 10 || n > 40 {
+		t.Error("Unexpected loss", n)
+	}
+	if n2 := run(7); n2 != n {
+		t.Error("Loss not deterministic", n, n2)
+	}
+}
+
+func TestMediumLatency(t *testing.T) {
+	m := NewMedium(1)
+	defer m.Close()
+	a, b := newTestNode(t, m, "a"), newTestNode(t, m, "b")
+	m.SetLink("a", "b", LinkConfig{RSSI: -50, Latency: 50 * time.Millisecond})
+
+	t0 := time.Now()
+	a.send(broadcast, wifi.NANFreq, "late")
+	f := b.next(wifi.KindFrameReceived)
+	if d := f.Header().Time.Sub(t0); d < 50*time.Millisecond {
+		t.Error("Frame received too early", d)
+	}
+	a.txStatus()
+
+	m.SetLink("a", "b", LinkConfig{Disabled: true})
+	a.send(broadcast, wifi.NANFreq, "lost")
+	a.txStatus()
+	b.idle()
+}
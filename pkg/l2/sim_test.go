@@ -0,0 +1,132 @@
+package l2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/sim"
+	msgs "github.com/costinm/ugate/webpush"
+)
+
+// simNodes starts the nodes on the medium, with the emulated NAN. Returns
+// the nodes, the wlan0 address - used by the emulated NAN - and a handler
+// with the messages sent to the mux of each node.
+func simNodes(t *testing.T, m *sim.Medium, names ...string) ([]*L2, []net.HardwareAddr, []*msgs.ChannelHandler) {
+	var nodes []*L2
+	var addrs []net.HardwareAddr
+	var chs []*msgs.ChannelHandler
+	for _, name := range names {
+		r := m.NewRadio(name)
+		mux := msgs.NewMux()
+		ch := msgs.NewChannelHandler()
+		mux.AddHandler("*", ch)
+		l := NewL2(mux)
+		l.MonSource = r.MonSource
+		client := r.Client()
+		if err := l.InitWifiClient(client); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		ifis, err := client.Interfaces()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ifi := range ifis {
+			if ifi.Name == "wlan0" {
+				addrs = append(addrs, ifi.HardwareAddr)
+			}
+		}
+		nodes = append(nodes, l)
+		chs = append(chs, ch)
+	}
+	return nodes, addrs, chs
+}
+
+// waitDiscovered waits until the nodes found each other, with the RSSI.
+func waitDiscovered(t *testing.T, nodes []*L2, addrs []net.HardwareAddr, rssi int) {
+	found := func(l *L2, addr net.HardwareAddr) bool {
+		l.m.Lock()
+		defer l.m.Unlock()
+		node := l.devByL2Id[Uint64(addr)]
+		return node != nil && node.Level == rssi
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !found(nodes[0], addrs[1]) || !found(nodes[1], addrs[0]) {
+		if time.Now().After(deadline) {
+			t.Fatal("Nodes not discovered", nodes[0].devByL2Id, nodes[1].devByL2Id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestSimNAN runs 2 nodes on the simulated medium, discovering each other
+// with the emulated NAN.
+func TestSimNAN(t *testing.T) {
+	m := sim.NewMedium(1)
+	defer m.Close()
+	m.SetLink("a", "b", sim.LinkConfig{RSSI: -65})
+
+	nodes, addrs, _ := simNodes(t, m, "a", "b")
+	waitDiscovered(t, nodes, addrs, -65)
+}
+
+// TestSimNANSend sends a message with /nan/send over a lossy link - the
+// lost fragments are retransmitted by Link, and the message is received
+// as /nan/msg on the other node.
+func TestSimNANSend(t *testing.T) {
+	m := sim.NewMedium(1)
+	defer m.Close()
+	m.SetLink("a", "b", sim.LinkConfig{RSSI: -65, Loss: 0.5})
+
+	nodes, addrs, chs := simNodes(t, m, "a", "b")
+	waitDiscovered(t, nodes, addrs, -65)
+	link := nodes[0].nans[0].Link
+	link.MaxRetries = 30
+
+	for i := 0; i < 5; i++ {
+		id := strconv.Itoa(i)
+		data := bytes.Repeat([]byte(id), 600)
+		nodes[0].mux.Send("/nan/send/"+addrs[1].String(), data, "id", id)
+
+		ev := chs[1].WaitEvent("/nan/msg")
+		if ev == nil {
+			t.Fatal("Message not received", i)
+		}
+		var got []byte
+		if err := json.Unmarshal(ev.Binary(), &got); err != nil || !bytes.Equal(got, data) ||
+			ev.Meta["from"] != addrs[0].String() {
+			t.Fatal("Unexpected message", ev.Meta, len(got), err)
+		}
+		ev = chs[0].WaitEvent("/nan/sent")
+		if ev == nil || ev.Meta["id"] != id || ev.Meta["err"] != "" {
+			t.Fatal("Unexpected send result", ev)
+		}
+	}
+	if link.Retransmits == 0 {
+		t.Error("No fragment retransmitted", link.Sent)
+	}
+}
+
+// TestSimBLE scans for a node advertising the DMesh beacon.
+func TestSimBLE(t *testing.T) {
+	m := sim.NewMedium(1)
+	defer m.Close()
+	peer := m.NewBLE("peer")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go peer.AdvertiseServiceData16(ctx, 0xFEAA, []byte{0x10})
+
+	b := NewBLE(NewL2(msgs.NewMux()), m.NewBLE("local"))
+	if err := b.Scan(300 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	n := b.nodes[peer.Addr().String()]
+	if n == nil || n.adv.RSSI() != sim.DefaultLink.RSSI {
+		t.Fatal("Peer not found", b.nodes)
+	}
+}
@@ -0,0 +1,114 @@
+package l2
+
+import (
+	"context"
+	"log"
+	"net"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+	"github.com/costinm/dmesh-l2/pkg/l2api"
+	msgs "github.com/costinm/ugate/webpush"
+)
+
+// Devices connected to our AP, P2P GO or mesh interfaces have link stats
+// from the driver - signal, bitrates, retries. The watcher publishes
+// changes in link quality, which update the device and are sent to the
+// mux:
+//
+// /wifi/sta - device JSON with Link set, mac=MAC, q=good|fair|poor|gone
+//
+// Mesh paths are handled in mesh.go.
+
+// startStationWatcher watches the AP, GO and mesh interfaces. Interfaces
+// created later are added by watchInterfaces and JoinMesh.
+func (l2 *L2) startStationWatcher() {
+	w := wifi.NewStationWatcher(l2.netLinkWifi)
+	for _, ifi := range l2.actWifi {
+		w.Add(ifi)
+	}
+	l2.m.Lock()
+	l2.stations = w
+	l2.m.Unlock()
+
+	go l2.watchStations(l2.netLinkWifi.Events.Subscribe(wifi.SubscribeOptions{
+		Kinds: []wifi.EventKind{wifi.KindStationStats, wifi.KindMeshPath},
+	}))
+	go func() {
+		if err := w.Run(context.Background()); err != nil {
+			log.Println("STA: watcher stopped", err)
+		}
+	}()
+}
+
+func (l2 *L2) watchStations(sub *wifi.Subscription) {
+	for ev := range sub.C {
+		switch e := ev.(type) {
+		case *wifi.StationStats:
+			l2.onStationStats(e)
+		case *wifi.MeshPathChanged:
+			l2.onMeshPath(e)
+		}
+	}
+}
+
+// onStationStats updates the device with the link stats, and sends it to
+// the mux.
+func (l2 *L2) onStationStats(s *wifi.StationStats) {
+	l2.m.Lock()
+	key := Uint64(s.MAC)
+	node := l2.devByL2Id[key]
+	if node == nil {
+		if s.Quality == wifi.LinkGone {
+			l2.m.Unlock()
+			return
+		}
+		node = &l2api.MeshDevice{MAC: s.MAC.String()}
+		l2.devByL2Id[key] = node
+	}
+	if s.Quality == wifi.LinkGone {
+		node.Link = nil
+	} else {
+		node.Link = linkStats(s)
+		if s.Signal != 0 {
+			node.Level = s.Signal
+		}
+		if s.Freq != 0 {
+			node.Freq = s.Freq
+		}
+		node.LastSeen = s.Time.Add(-s.Inactive)
+	}
+	js := msgs.NewMessage("/wifi/sta", map[string]string{
+		"mac": s.MAC.String(),
+		"q":   s.Quality.String(),
+	}).SetDataJSON(node)
+	l2.m.Unlock()
+
+	if l2.mux != nil {
+		l2.mux.SendMessage(js)
+	}
+}
+
+func linkStats(s *wifi.StationStats) *l2api.LinkStats {
+	ls := &l2api.LinkStats{
+		Signal:   s.Signal,
+		RxRate:   s.RxBitrate / 1000,
+		TxRate:   s.TxBitrate / 1000,
+		Retries:  s.RetryRate,
+		Failures: s.FailRate,
+		Inactive: s.Inactive.Milliseconds(),
+		Quality:  s.Quality.String(),
+		Iface:    ifName(s.Ifindex),
+	}
+	if s.Mesh {
+		ls.PeerLink = s.PeerLink.String()
+	}
+	return ls
+}
+
+// ifName returns the name of the interface, or "" if not found.
+func ifName(ifindex int) string {
+	if ifi, err := net.InterfaceByIndex(ifindex); err == nil {
+		return ifi.Name
+	}
+	return ""
+}
@@ -0,0 +1,39 @@
+package l2
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
+)
+
+func TestOnStationStats(t *testing.T) {
+	l := NewL2(nil)
+	mac := net.HardwareAddr{0x2a, 0, 0, 0, 0, 3}
+	now := time.Now()
+
+	l.onStationStats(&wifi.StationStats{EventHeader: wifi.EventHeader{Time: now},
+		MAC: mac, Freq: 2437, Signal: -72, TxBitrate: 54000000,
+		Inactive: time.Second, Quality: wifi.LinkFair})
+	node := l.devByL2Id[Uint64(mac)]
+	if node == nil || node.Link == nil {
+		t.Fatal("Device not added", l.devByL2Id)
+	}
+	if node.Level != -72 || node.Freq != 2437 || node.Link.TxRate != 54000 ||
+		node.Link.Quality != "fair" || !node.LastSeen.Equal(now.Add(-time.Second)) {
+		t.Error("Unexpected device", node, node.Link)
+	}
+
+	l.onStationStats(&wifi.StationStats{MAC: mac, Quality: wifi.LinkGone})
+	if node.Link != nil || node.Level != -72 {
+		t.Error("Link not removed", node.Link)
+	}
+
+	// Unknown devices are not added when they leave
+	other := net.HardwareAddr{0x2a, 0, 0, 0, 0, 4}
+	l.onStationStats(&wifi.StationStats{MAC: other, Quality: wifi.LinkGone})
+	if l.devByL2Id[Uint64(other)] != nil {
+		t.Error("Unexpected device")
+	}
+}
@@ -17,10 +17,13 @@ import (
 
 	//"github.com/costinm/dmesh-l2/pkg/l2/genetlink"
 	//"github.com/costinm/dmesh-l2/pkg/l2/netlink"
+	"github.com/costinm/dmesh-l2/pkg/l2/capture"
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
 	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
 	"github.com/mdlayher/genetlink"
 	"github.com/mdlayher/netlink"
 	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
 )
 
 //
@@ -29,6 +32,7 @@ import (
 var (
 	errInvalidCommand       = errors.New("invalid generic netlink response command")
 	errInvalidFamilyVersion = errors.New("invalid generic netlink response family version")
+
 )
 
 var (
@@ -45,6 +49,13 @@ var (
 
 var dwelltime = 0
 
+// dwPeriod is the default Nan.DWPeriod - NAN_DW_PERIOD env, 1, 2, 4, 8 or 16.
+var dwPeriod = 1
+
+// injectTx is set with NAN_INJECT=1, to inject all frames on the monitor
+// instead of CmdFrame.
+var injectTx = false
+
 func init() {
 	// 148 ms - get 2 messages
 	// 150 - gets all
@@ -55,6 +66,21 @@ func init() {
 		dwelltime = 30
 	}
 
+	if p, err := strconv.Atoi(os.Getenv("NAN_PREF")); err == nil {
+		masterPreference = uint8(p)
+	}
+	if ch := os.Getenv("NAN_CHANNELS"); ch != "" {
+		if chans, err := nan.ParseChannels(ch); err == nil {
+			nanChannels = chans
+		} else {
+			log.Println("Invalid NAN_CHANNELS", ch, err)
+		}
+	}
+	if p, err := strconv.Atoi(os.Getenv("NAN_DW_PERIOD")); err == nil && p > 0 && p <= 16 {
+		dwPeriod = p
+	}
+	injectTx = os.Getenv("NAN_INJECT") == "1"
+
 	attrTable = map[uint16]string{}
 	attrTable[1] = "Wiphy"
 	attrTable[3] = "Ifindex"
@@ -90,60 +116,50 @@ func New() (*Client, error) {
 // newClient dials a generic netlink connection and verifies that nl80211
 // is available for use by this package.
 func newClient() (*Client, error) {
-
-	c, err := genetlink.Dial(&netlink.Config{
+	nc, err := netlink.Dial(unix.NETLINK_GENERIC, &netlink.Config{
 		DisableNSLockThread: true,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	family, err := c.GetFamily(nl80211.GenlName)
+	// Before the session starts reading the socket.
+	family, err := genetlink.NewConn(nc).GetFamily(nl80211.GenlName)
 	if err != nil {
 		// Ensure the genl socket is closed on error to avoid leaking file
 		// descriptors.
-		_ = c.Close()
+		_ = nc.Close()
 		return nil, err
 	}
+	if err := nc.SetReadBuffer(40960); err != nil {
+		log.Println("NL read buffer", err)
+	}
 
-	// Client for reading - due to linking
-	cr, err := genetlink.Dial(&netlink.Config{
-		DisableNSLockThread: true,
-	})
+	sock, err := newRawSocket(nc)
 	if err != nil {
+		_ = nc.Close()
 		return nil, err
 	}
+	return newClientSession(sock, family), nil
+}
+
+// NewClientSocket returns a client using the socket instead of the kernel
+// nl80211 - for simulated radios, see package sim.
+func NewClientSocket(sock Socket, family genetlink.Family) *Client {
+	return newClientSession(sock, family)
+}
 
-	return &Client{
-		c: c,
-		//cr:             c,
-		cr:            cr,
+// newClientSession returns a client using the socket - tests use a fake
+// nl80211 family.
+func newClientSession(sock Socket, family genetlink.Family) *Client {
+	c := &Client{
 		familyID:      family.ID,
 		familyVersion: family.Version,
 		family:        family,
-	}, nil
-}
-
-// Close releases resources used by a Client.
-func (c *Client) Scan() error {
-	req := genetlink.Message{
-		Header: genetlink.Header{
-			Command: nl80211.CmdGetScan,
-			Version: c.familyVersion,
-		},
-	}
-
-	flags := netlink.Request | netlink.Dump
-	msgs, err := c.c.Execute(req, c.familyID, flags)
-	if err != nil {
-		return err
-	}
-
-	if err := c.checkMessages(msgs, nl80211.CmdNewInterface); err != nil {
-		return err
+		Events:        NewEventBus(),
 	}
-
-	return nil
+	c.s = newSession(sock, family.ID, c.onEvent)
+	return c
 }
 
 /*
@@ -156,42 +172,174 @@ func (c *Client) Scan() error {
 // netlink, generic netlink, and nl80211 to provide access to WiFi device
 // actions and statistics.
 type Client struct {
-	// Old style - doesn't have good reading
-	c *genetlink.Conn
+	// s is used for all requests and events.
+	s *Session
 
 	familyID      uint16
 	familyVersion uint8
 	family        genetlink.Family
-	cr            *genetlink.Conn
-}
 
-var NanClients = map[uint32]*Nan{}
+	m sync.Mutex
+
+	// NAN interfaces, by ifindex - receive TX status and ROC events.
+	nans map[uint32]*Nan
+
+	// Interfaces created by the client, by name.
+	managed map[string]*managedInterface
+
+	// State of the connections made with Connect, by ifindex.
+	conns map[int]*ConnectionState
+
+	// phys from the last Phys call, by index.
+	phys map[int]*Phy
 
+	// Regulatory domain and channels of the phys, from WatchReg. reg is
+	// the global domain.
+	reg     *RegDomain
+	regs    map[int]*RegDomain
+	regPhys map[int]*Phy
+
+	// The last survey by ifindex and frequency - for RankChannels.
+	surveys map[int]map[int]*SurveyInfo
+
+	// Events receives the typed nl80211 events, from StartReceive.
+	Events *EventBus
+
+	// Recorder saves received frames, if started. Nan interfaces created
+	// with NewNan record sent frames to the same recorder.
+	Recorder *capture.Recorder
+}
+
+// Nan runs NAN on one interface. Each Nan has its own TX queue, frame
+// sequence numbers and ROC state - multiple interfaces and senders can
+// run concurrently.
 type Nan struct {
 	IFace *Interface
-	c     *Client
+
+	drv    Driver
+	client *Client
+
+	// Sync tracks the cluster this interface is part of, and its TSF.
+	Sync *nan.Sync
+
+	// Services published or subscribed on this interface. May be shared
+	// with other interfaces.
+	Services *nan.Services
+
+	// Link sends reliable messages to dmesh peers, using follow-ups.
+	Link *nan.Link
+
+	// DataPaths negotiates NDPs. The NDI is set when the data interface
+	// is created.
+	DataPaths *nan.DataPaths
+
+	// Schedule is the local availability - use SetSchedule to change.
+	Schedule *nan.Schedule
 
 	m sync.Mutex
 
-	SendErrors   int
-	LastSent     time.Time
-	LastSentTime time.Duration
-	LastSentSeq  uint32
+	// Instance IDs of the dmesh publish of discovered peers - follow-ups
+	// are sent to this instance.
+	peerInstances map[string]uint8
+
+	// Availability of peers, from the last received Availability.
+	peerSchedules map[string]*nan.Schedule
+
+	SendErrors int
+
+	txq      chan *txFrame
+	txEvents chan txEvent
+	txStats  map[string]*TxStats
+
+	// DWPeriod is the awake interval, in DWs, for sending discovery frames.
+	// Android uses 1 (every DW) when the screen is on.
+	DWPeriod int
+
+	// Frames waiting for the next DW.
+	dwq []*dwFrame
+
+	// seq is the sequence number of the last frame.
+	seq uint16
+
+	roc rocState
+
+	// dwBlocked is set if the regulatory domain doesn't allow sending on
+	// the DW channel.
+	dwBlocked bool
+
+	// Recorder saves the sent frames and TX status, if started.
+	Recorder *capture.Recorder
+
+	done chan struct{}
 }
 
+// NewNan starts NAN on the interface, using nl80211. The Client receive
+// loop delivers the TX status and ROC events.
 func NewNan(c *Client, i *Interface) *Nan {
-	n := &Nan{IFace: i, c: c}
-	NanClients[uint32(i.Index)] = n
+	return newClientNan(c, c, i)
+}
+
+// newClientNan starts NAN on the interface, sending with the driver. The
+// client delivers the events - the driver may be an Injector.
+func newClientNan(c *Client, d Driver, i *Interface) *Nan {
+	n := NewNanDriver(d, i)
+	n.client = c
+	n.Recorder = c.Recorder
+	c.register(n)
 	return n
 }
 
+// NewNanDriver starts NAN on the interface, using the driver to send.
+func NewNanDriver(d Driver, i *Interface) *Nan {
+	n := &Nan{IFace: i, drv: d,
+		Sync:          nan.NewSync(i.HardwareAddr, masterPreference),
+		Services:      nan.NewServices(),
+		peerInstances: map[string]uint8{},
+		peerSchedules: map[string]*nan.Schedule{},
+		txq:           make(chan *txFrame, txQueueSize),
+		txEvents:      make(chan txEvent, txQueueSize),
+		txStats:       map[string]*TxStats{},
+		DWPeriod:      dwPeriod,
+		done:          make(chan struct{})}
+	n.Link = nan.NewLink(n.sendLinkFrame)
+	// A full DW queue delays follow-ups by several DWs.
+	n.Link.Timeout = (dwQueueSize/dwMaxFrames+1)*nan.DWInterval*nan.TU + txStatusTimeout
+	n.DataPaths = nan.NewDataPaths(nil, n.SendNAF)
+	if nanChannels != nil {
+		n.SetSchedule(nan.NewSchedule(nanChannels...))
+	} else {
+		n.SetSchedule(radioSchedule(i.Frequency, NANFreq))
+	}
+	go n.txLoop()
+	return n
+}
+
+// Close stops the TX loop and closes the injector. Queued frames are not sent.
+func (c *Nan) Close() {
+	if c.client != nil {
+		c.client.unregister(c)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+		if j, ok := c.drv.(*Injector); ok {
+			j.Close()
+		}
+	}
+}
+
 // Close closes the client's generic netlink connection.
 func (c *Client) Close() error {
-	return c.c.Close()
+	c.Events.Close()
+	return c.s.Close()
 }
 
-func (c *Client) Conn() *genetlink.Conn {
-	return c.c
+// Session returns the netlink session, for sending other nl80211 commands.
+func (c *Client) Session() *Session {
+	return c.s
 }
 
 // Interfaces requests that nl80211 return a list of all WiFi interfaces present
@@ -206,7 +354,7 @@ func (c *Client) Interfaces() ([]*Interface, error) {
 	}
 
 	flags := netlink.Request | netlink.Dump
-	msgs, err := c.c.Execute(req, c.familyID, flags)
+	msgs, err := c.s.Execute(req, c.familyID, flags)
 	if err != nil {
 		return nil, err
 	}
@@ -251,7 +399,7 @@ func (c *Client) BSS(ifi *Interface) (*BSS, error) {
 	}
 
 	flags := netlink.Request | netlink.Dump
-	msgs, err := c.c.Execute(req, c.familyID, flags)
+	msgs, err := c.s.Execute(req, c.familyID, flags)
 	if err != nil {
 		return nil, err
 	}
@@ -285,7 +433,7 @@ func (c *Client) StationInfo(ifi *Interface) ([]*StationInfo, error) {
 	}
 
 	flags := netlink.Request | netlink.Dump
-	msgs, err := c.c.Execute(req, c.familyID, flags)
+	msgs, err := c.s.Execute(req, c.familyID, flags)
 	if err != nil {
 		return nil, err
 	}
@@ -445,6 +593,7 @@ func (ifi *Phy) parsePhys(attrs []netlink.Attribute) error {
 		case nl80211.AttrGeneration: // 46
 		case nl80211.AttrNanDual: // 239
 		case nl80211.AttrExtFeatures: // 217
+			ifi.ExtFeatures = append([]byte{}, a.Data...)
 		case nl80211.AttrExtCapa: // 169
 		case nl80211.AttrExtCapaMask: // 170
 		case nl80211.AttrVhtCapabilityMask: // 176
@@ -453,6 +602,7 @@ func (ifi *Phy) parsePhys(attrs []netlink.Attribute) error {
 		case nl80211.AttrWiphyFragThreshold:
 		case nl80211.AttrWiphyRtsThreshold:
 		case nl80211.AttrMaxNumScanSsids:
+			ifi.MaxScanSSIDs = int(nlenc.Uint8(a.Data))
 		case nl80211.AttrMaxNumSchedScanSsids:
 		case nl80211.AttrMaxScanIeLen:
 		case nl80211.AttrMaxMatchSets: // 123
@@ -460,10 +610,29 @@ func (ifi *Phy) parsePhys(attrs []netlink.Attribute) error {
 		case nl80211.AttrTxFrameTypes: // 99
 		case nl80211.AttrRxFrameTypes: // 100
 		case nl80211.AttrSupportedIftypes: // 32
+			ifi.InterfaceTypes = parseIftypes(a.Data)
 		case nl80211.AttrWiphyBands: // 22
+			if err := ifi.parseBands(a.Data); err != nil {
+				return err
+			}
 		case nl80211.AttrOffchannelTxOk: // 108 - true if present
+			ifi.OffchannelTx = true
 		case nl80211.AttrSoftwareIftypes:
+			ifi.SoftwareTypes = parseIftypes(a.Data)
 		case nl80211.AttrInterfaceCombinations:
+			combs, err := parseCombinations(a.Data)
+			if err != nil {
+				return err
+			}
+			ifi.Combinations = append(ifi.Combinations, combs...)
+		case nl80211.AttrSupportedCommands: // 50
+			for _, c := range parseNestedU32(a.Data) {
+				ifi.Commands = append(ifi.Commands, uint8(c))
+			}
+		case nl80211.AttrFeatureFlags: // 143
+			ifi.Features = nlenc.Uint32(a.Data)
+		case nl80211.AttrMaxRemainOnChannelDuration: // 111
+			ifi.MaxRemainOnChannel = time.Duration(nlenc.Uint32(a.Data)) * time.Millisecond
 
 		default:
 			//log.Println("interface attribute ", a.Type, a.Data)
@@ -529,7 +698,13 @@ func (b *BSS) parseAttributes(attrs []netlink.Attribute) error {
 			// NOTE: BSSStatus copies the ordering of nl80211's BSS status
 			// constants.  This may not be the case on other operating systems.
 			b.Status = BSSStatus(nlenc.Uint32(a.Data))
+		case nl80211.BssSignalMbm:
+			// mBm - 1/100 dBm
+			b.Signal = int(int32(nlenc.Uint32(a.Data))) / 100
+		case nl80211.BssCapability:
+			b.Capability = nlenc.Uint16(a.Data)
 		case nl80211.BssInformationElements:
+			b.IEs = append([]byte{}, a.Data...)
 			ies, err := ParseIEs(a.Data)
 			if err != nil {
 				return err
@@ -617,6 +792,9 @@ func (info *StationInfo) parseAttributes(attrs []netlink.Attribute) error {
 			info.TransmitFailed = int(nlenc.Uint32(a.Data))
 		case nl80211.StaInfoBeaconLoss:
 			info.BeaconLoss = int(nlenc.Uint32(a.Data))
+		case nl80211.StaInfoPlinkState:
+			info.PeerLink = PeerLinkState(nlenc.Uint8(a.Data))
+			info.Mesh = true
 		case nl80211.StaInfoRxBitrate, nl80211.StaInfoTxBitrate:
 			rate, err := parseRateInfo(a.Data)
 			if err != nil {
@@ -0,0 +1,425 @@
+package wifi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Station connect without wpa_supplicant, for minimal nodes. Only open
+// and OWE networks are supported - dmesh APs don't need a PSK, security
+// is at L6.
+//
+// The kernel SME does the authentication and association (CmdConnect).
+// For OWE the DH parameter is added to the association request, and the
+// 4-way handshake runs here - the EAPOL frames use control port over
+// nl80211, and the connection is removed by the kernel if the client
+// socket is closed.
+
+var (
+	errNoBSS         = errors.New("no open or OWE BSS with the SSID")
+	errSecurity      = errors.New("BSS requires a password")
+	errNoControlPort = errors.New("driver doesn't support control port over nl80211, required for OWE")
+	errConnectFailed = errors.New("connect failed")
+	errDisconnected  = errors.New("disconnected")
+)
+
+// connectTimeout is used if the context has no deadline - association and
+// handshake take less than a second.
+const connectTimeout = 10 * time.Second
+
+// reasonDeauthLeaving is the 802.11 reason code for Disconnect.
+const reasonDeauthLeaving = 3
+
+// ConnectRequest selects the network for Connect.
+type ConnectRequest struct {
+	SSID string
+
+	// BSSID selects the AP - if not set, the strongest open or OWE BSS
+	// with the SSID is used.
+	BSSID net.HardwareAddr
+}
+
+// ConnState is the state of a station connection made with Connect.
+type ConnState int
+
+const (
+	ConnDisconnected ConnState = iota
+	ConnConnecting
+	// ConnHandshake - associated, running the OWE 4-way handshake.
+	ConnHandshake
+	ConnConnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnHandshake:
+		return "handshake"
+	case ConnConnected:
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// ConnectionState is published on Events when a connection made with
+// Connect changes state.
+type ConnectionState struct {
+	EventHeader
+	State ConnState
+
+	SSID  string
+	BSSID net.HardwareAddr
+	Freq  int
+
+	// Signal of the BSS in the last scan, in dBm.
+	Signal int
+
+	// OWE is set if the connection is encrypted.
+	OWE bool
+
+	// Err is the reason of a failed connect or disconnect.
+	Err error
+}
+
+// Connection returns the state of the last Connect on the interface, or
+// nil.
+func (c *Client) Connection(ifi *Interface) *ConnectionState {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if st := c.conns[ifi.Index]; st != nil {
+		cp := *st
+		return &cp
+	}
+	return nil
+}
+
+// setConnState saves and publishes the new state.
+func (c *Client) setConnState(ifi *Interface, st *ConnectionState, state ConnState, err error) {
+	cp := *st
+	cp.EventHeader = EventHeader{Ifindex: ifi.Index, Wiphy: ifi.PHY, Time: time.Now()}
+	cp.State = state
+	cp.Err = err
+	c.m.Lock()
+	if c.conns == nil {
+		c.conns = map[int]*ConnectionState{}
+	}
+	c.conns[ifi.Index] = &cp
+	c.m.Unlock()
+	log.Println("CONN: ", ifi.Name, cp.SSID, cp.BSSID, state, err)
+	c.Events.Publish(&cp)
+}
+
+// onDisconnected updates the state of a connection made with Connect. Not
+// called while connecting - Connect gets the event.
+func (c *Client) onDisconnected(e *Disconnected) {
+	c.m.Lock()
+	st := c.conns[e.Ifindex]
+	c.m.Unlock()
+	if st == nil || st.State != ConnConnected {
+		return
+	}
+	c.setConnState(&Interface{Index: e.Ifindex, PHY: st.Wiphy}, st, ConnDisconnected,
+		fmt.Errorf("%w: reason %d", errDisconnected, e.Reason))
+}
+
+// Connect associates the station interface with an open or OWE AP, and
+// returns when the connection can be used.
+func (c *Client) Connect(ctx context.Context, ifi *Interface, req *ConnectRequest) (*ConnectionState, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
+	}
+	bss, err := c.selectBSS(ctx, ifi, req)
+	if err != nil {
+		return nil, err
+	}
+	var o *owe
+	if rsn, err := bssRSN(bss); err != nil {
+		return nil, err
+	} else if rsn != nil {
+		if p := c.phyOf(ifi); p != nil && !p.HasExtFeature(nl80211.ExtFeatureControlPortOverNl80211) {
+			return nil, errNoControlPort
+		}
+		if o, err = newOWE(rsn, ifi.HardwareAddr, bss.BSSID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Events for the interface - subscribed before connect, the EAPOL
+	// message 1 follows the association.
+	if err := c.joinGroup(nl80211.MulticastGroupMlme); err != nil {
+		return nil, err
+	}
+	sub := c.Events.Subscribe(SubscribeOptions{
+		Kinds:   []EventKind{KindConnected, KindDisconnected, KindControlPortFrame},
+		Ifindex: ifi.Index,
+	})
+	defer sub.Close()
+
+	st := &ConnectionState{SSID: bss.SSID, BSSID: bss.BSSID, Freq: bss.Frequency,
+		Signal: bss.Signal, OWE: o != nil}
+	c.setConnState(ifi, st, ConnConnecting, nil)
+	if _, err = c.execute(nl80211.CmdConnect, connectAttrs(ifi, bss, o), netlink.Request); err == nil {
+		err = c.waitConnect(ctx, ifi, st, sub, o)
+	}
+	if err != nil {
+		if !errors.Is(err, errDisconnected) {
+			c.Disconnect(ifi)
+		}
+		c.setConnState(ifi, st, ConnDisconnected, err)
+		return nil, err
+	}
+	c.setConnState(ifi, st, ConnConnected, nil)
+	return c.Connection(ifi), nil
+}
+
+// Disconnect the station - the state changes when the kernel sends the
+// event.
+func (c *Client) Disconnect(ifi *Interface) error {
+	_, err := c.execute(nl80211.CmdDisconnect, []netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(ifi.Index))},
+		{Type: nl80211.AttrReasonCode, Data: nlenc.Uint16Bytes(reasonDeauthLeaving)},
+	}, netlink.Request)
+	return err
+}
+
+// selectBSS returns the strongest BSS with the SSID and supported
+// security, from the BSS cache or a new scan.
+func (c *Client) selectBSS(ctx context.Context, ifi *Interface, req *ConnectRequest) (*BSS, error) {
+	sreq := &ScanRequest{SSIDs: []string{req.SSID}}
+	res, err := c.ScanResults(ifi, sreq)
+	if err != nil {
+		return nil, err
+	}
+	if b := bestBSS(res, req); b != nil {
+		return b, nil
+	}
+	if res, err = c.Scan(ctx, ifi, sreq); err != nil {
+		return nil, err
+	}
+	if b := bestBSS(res, req); b != nil {
+		return b, nil
+	}
+	return nil, errNoBSS
+}
+
+func bestBSS(res []*BSS, req *ConnectRequest) *BSS {
+	var best *BSS
+	for _, b := range res {
+		if b.SSID != req.SSID || (req.BSSID != nil && !bytes.Equal(b.BSSID, req.BSSID)) {
+			continue
+		}
+		if _, err := bssRSN(b); err != nil {
+			continue
+		}
+		if best == nil || b.Signal > best.Signal {
+			best = b
+		}
+	}
+	return best
+}
+
+// bssRSN returns nil for open networks, the RSN IE for OWE networks, and
+// an error if the network requires a password.
+func bssRSN(b *BSS) (*rsnInfo, error) {
+	ies, err := ParseIEs(b.IEs)
+	if err != nil {
+		return nil, err
+	}
+	for _, ie := range ies {
+		switch ie.ID {
+		case ieRSN:
+			rsn, err := parseRSN(ie.Data)
+			if err != nil {
+				return nil, err
+			}
+			if !hasSuite(rsn.AKM, akmOWE) {
+				return nil, errSecurity
+			}
+			return rsn, nil
+		case ieVendor:
+			if bytes.HasPrefix(ie.Data, wpaOUI) {
+				return nil, errSecurity
+			}
+		}
+	}
+	if b.Capability&capPrivacy != 0 {
+		// WEP
+		return nil, errSecurity
+	}
+	return nil, nil
+}
+
+// phyOf returns the phy of the interface, nil if not found. The phys are
+// dumped again only for unknown phys - new, or renumbered by a reset.
+func (c *Client) phyOf(ifi *Interface) *Phy {
+	c.m.Lock()
+	p := c.phys[ifi.PHY]
+	c.m.Unlock()
+	if p != nil {
+		return p
+	}
+	if _, err := c.Phys(); err != nil {
+		return nil
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.phys[ifi.PHY]
+}
+
+// connectAttrs returns the CmdConnect attributes - open system auth, with
+// the OWE IEs and control port if o is set.
+func connectAttrs(ifi *Interface, bss *BSS, o *owe) []netlink.Attribute {
+	attrs := []netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(ifi.Index))},
+		{Type: nl80211.AttrSsid, Data: []byte(bss.SSID)},
+		{Type: nl80211.AttrMac, Data: bss.BSSID},
+		{Type: nl80211.AttrWiphyFreq, Data: nlenc.Uint32Bytes(uint32(bss.Frequency))},
+		{Type: nl80211.AttrAuthType, Data: nlenc.Uint32Bytes(nl80211.AuthtypeOpenSystem)},
+	}
+	if o == nil {
+		return attrs
+	}
+	attrs = append(attrs,
+		netlink.Attribute{Type: nl80211.AttrPrivacy, Data: []byte{}},
+		netlink.Attribute{Type: nl80211.AttrWpaVersions, Data: nlenc.Uint32Bytes(nl80211.WpaVersion2)},
+		netlink.Attribute{Type: nl80211.AttrCipherSuitesPairwise, Data: nlenc.Uint32Bytes(suiteCCMP)},
+		netlink.Attribute{Type: nl80211.AttrCipherSuiteGroup, Data: nlenc.Uint32Bytes(o.group)},
+		netlink.Attribute{Type: nl80211.AttrAkmSuites, Data: nlenc.Uint32Bytes(akmOWE)},
+		netlink.Attribute{Type: nl80211.AttrIe, Data: o.IEs()},
+		netlink.Attribute{Type: nl80211.AttrControlPort, Data: []byte{}},
+		netlink.Attribute{Type: nl80211.AttrControlPortEthertype, Data: nlenc.Uint16Bytes(EtherTypeEAPOL)},
+		netlink.Attribute{Type: nl80211.AttrControlPortOverNl80211, Data: []byte{}},
+		netlink.Attribute{Type: nl80211.AttrSocketOwner, Data: []byte{}},
+	)
+	if o.MFP {
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrUseMfp,
+			Data: nlenc.Uint32Bytes(nl80211.MfpRequired)})
+	}
+	return attrs
+}
+
+// waitConnect waits for the association and runs the OWE handshake.
+func (c *Client) waitConnect(ctx context.Context, ifi *Interface, st *ConnectionState,
+	sub *Subscription, o *owe) error {
+	// EAPOL frames received before the connect event.
+	var early [][]byte
+	for {
+		var ev Event
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok = <-sub.C:
+			if !ok {
+				return errSessionClosed
+			}
+		}
+		var frames [][]byte
+		switch e := ev.(type) {
+		case *Connected:
+			if e.Status != 0 || e.TimedOut {
+				return fmt.Errorf("%w: status %d timeout %v", errConnectFailed, e.Status, e.TimedOut)
+			}
+			if o == nil {
+				return nil
+			}
+			if err := o.SetResponse(e.RespIE); err != nil {
+				return err
+			}
+			c.setConnState(ifi, st, ConnHandshake, nil)
+			frames, early = early, nil
+		case *Disconnected:
+			return fmt.Errorf("%w: reason %d", errDisconnected, e.Reason)
+		case *ControlPortFrame:
+			if o == nil || e.Proto != EtherTypeEAPOL || !bytes.Equal(e.Src, st.BSSID) {
+				continue
+			}
+			if o.pmk == nil {
+				early = append(early, e.Frame)
+				continue
+			}
+			frames = [][]byte{e.Frame}
+		}
+		for _, f := range frames {
+			reply, keys, err := o.HandleKey(f)
+			if err != nil {
+				// The AP retries - a bad frame is not fatal.
+				log.Println("EAPOL: ", ifi.Name, err)
+				continue
+			}
+			if err := c.sendControlPort(ifi, st.BSSID, reply); err != nil {
+				return err
+			}
+			if keys != nil {
+				return c.installKeys(ifi, st.BSSID, o.group, keys)
+			}
+		}
+	}
+}
+
+// sendControlPort sends an EAPOL frame to the AP, unencrypted.
+func (c *Client) sendControlPort(ifi *Interface, dst net.HardwareAddr, frame []byte) error {
+	_, err := c.execute(nl80211.CmdControlPortFrame, []netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(ifi.Index))},
+		{Type: nl80211.AttrMac, Data: dst},
+		{Type: nl80211.AttrControlPortEthertype, Data: nlenc.Uint16Bytes(EtherTypeEAPOL)},
+		{Type: nl80211.AttrControlPortNoEncrypt, Data: []byte{}},
+		{Type: nl80211.AttrFrame, Data: frame},
+	}, netlink.Request)
+	return err
+}
+
+// installKeys installs the pairwise and group keys from the handshake and
+// authorizes the port.
+func (c *Client) installKeys(ifi *Interface, bssid net.HardwareAddr, group uint32, keys *oweKeys) error {
+	ifidx := netlink.Attribute{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(ifi.Index))}
+	_, err := c.execute(nl80211.CmdNewKey, []netlink.Attribute{ifidx,
+		{Type: nl80211.AttrMac, Data: bssid},
+		{Type: nl80211.AttrKeyData, Data: keys.TK},
+		{Type: nl80211.AttrKeyCipher, Data: nlenc.Uint32Bytes(suiteCCMP)},
+		{Type: nl80211.AttrKeyIdx, Data: []byte{0}},
+	}, netlink.Request)
+	if err != nil {
+		return err
+	}
+	// Group keys have no MAC - only used for receive.
+	_, err = c.execute(nl80211.CmdNewKey, []netlink.Attribute{ifidx,
+		{Type: nl80211.AttrKeyData, Data: keys.GTK},
+		{Type: nl80211.AttrKeyCipher, Data: nlenc.Uint32Bytes(group)},
+		{Type: nl80211.AttrKeyIdx, Data: []byte{byte(keys.GTKIdx)}},
+		{Type: nl80211.AttrKeySeq, Data: keys.GTKSeq},
+	}, netlink.Request)
+	if err != nil {
+		return err
+	}
+	if keys.IGTK != nil {
+		_, err = c.execute(nl80211.CmdNewKey, []netlink.Attribute{ifidx,
+			{Type: nl80211.AttrKeyData, Data: keys.IGTK},
+			{Type: nl80211.AttrKeyCipher, Data: nlenc.Uint32Bytes(suiteBIPCMAC)},
+			{Type: nl80211.AttrKeyIdx, Data: []byte{byte(keys.IGTKIdx)}},
+			{Type: nl80211.AttrKeySeq, Data: keys.IGTKSeq},
+		}, netlink.Request)
+		if err != nil {
+			return err
+		}
+	}
+	// struct nl80211_sta_flag_update - mask, set
+	flags := append(nlenc.Uint32Bytes(1<<nl80211.StaFlagAuthorized), nlenc.Uint32Bytes(1<<nl80211.StaFlagAuthorized)...)
+	_, err = c.execute(nl80211.CmdSetStation, []netlink.Attribute{ifidx,
+		{Type: nl80211.AttrMac, Data: bssid},
+		{Type: nl80211.AttrStaFlags2, Data: flags},
+	}, netlink.Request)
+	return err
+}
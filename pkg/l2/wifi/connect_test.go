@@ -0,0 +1,193 @@
+package wifi
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+var mlmeFamily = genetlink.Family{
+	ID:      0x1c,
+	Version: 1,
+	Name:    nl80211.GenlName,
+	Groups: []genetlink.MulticastGroup{{ID: 3, Name: nl80211.MulticastGroupScan},
+		{ID: 4, Name: nl80211.MulticastGroupMlme}},
+}
+
+// fakeAP is a fake kernel with one BSS in the scan cache. The OWE
+// handshake is done by the testAP, if set.
+type fakeAP struct {
+	*fakeNL80211
+	ap *testAP
+
+	m    sync.Mutex
+	keys int
+	auth bool
+}
+
+func (f *fakeAP) event(cmd uint8, attrs ...netlink.Attribute) {
+	attrs = append([]netlink.Attribute{{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(3)}}, attrs...)
+	f.inject(eventNL(f.t, 0, cmd, attrs...))
+}
+
+func (f *fakeAP) eapol(frame []byte) {
+	f.event(nl80211.CmdControlPortFrame,
+		netlink.Attribute{Type: nl80211.AttrMac, Data: f.ap.addr},
+		netlink.Attribute{Type: nl80211.AttrControlPortEthertype, Data: nlenc.Uint16Bytes(EtherTypeEAPOL)},
+		netlink.Attribute{Type: nl80211.AttrFrame, Data: frame})
+}
+
+func (f *fakeAP) connect(_ genetlink.Message, attrs map[uint16][]byte) ([]genetlink.Message, error) {
+	bssid := net.HardwareAddr{2, 0, 0, 0, 0, 0xa}
+	if f.ap == nil {
+		f.event(nl80211.CmdConnect, netlink.Attribute{Type: nl80211.AttrMac, Data: bssid},
+			netlink.Attribute{Type: nl80211.AttrStatusCode, Data: nlenc.Uint16Bytes(0)})
+		return nil, nil
+	}
+	if _, ok := attrs[nl80211.AttrControlPortOverNl80211]; !ok {
+		f.t.Error("Connect without control port")
+	}
+	// EAPOL message 1 before the connect event
+	f.eapol(f.ap.msg1())
+	f.event(nl80211.CmdConnect, netlink.Attribute{Type: nl80211.AttrMac, Data: bssid},
+		netlink.Attribute{Type: nl80211.AttrStatusCode, Data: nlenc.Uint16Bytes(0)},
+		netlink.Attribute{Type: nl80211.AttrRespIe, Data: f.ap.assocResp(attrs[nl80211.AttrIe])})
+	return nil, nil
+}
+
+func newFakeAP(t *testing.T, ies []byte, capab uint16) (*Client, *fakeAP) {
+	bssid := net.HardwareAddr{2, 0, 0, 0, 0, 0xa}
+	c, k := newFakeNL80211(t, mlmeFamily)
+	f := &fakeAP{fakeNL80211: k}
+
+	res := scanResult(t, bssid, "dmesh", 2437, -5000, ies)
+	attrs, _ := netlink.UnmarshalAttributes(res.Data)
+	bss, _ := netlink.UnmarshalAttributes(attrs[1].Data)
+	bss[2].Data = nlenc.Uint16Bytes(capab)
+	attrs[1].Data, _ = netlink.MarshalAttributes(bss)
+	res.Data, _ = netlink.MarshalAttributes(attrs)
+	res.Header.Version = mlmeFamily.Version
+	k.reply(nl80211.CmdGetScan, res)
+
+	k.handle(nl80211.CmdConnect, f.connect)
+	k.handle(nl80211.CmdControlPortFrame, func(_ genetlink.Message, attrs map[uint16][]byte) ([]genetlink.Message, error) {
+		frame := attrs[nl80211.AttrFrame]
+		if binary.BigEndian.Uint16(frame[offKeyInfo:])&keyInfoSecure == 0 {
+			f.eapol(f.ap.msg3(frame))
+		}
+		return nil, nil
+	})
+	k.handle(nl80211.CmdNewKey, func(genetlink.Message, map[uint16][]byte) ([]genetlink.Message, error) {
+		f.m.Lock()
+		f.keys++
+		f.m.Unlock()
+		return nil, nil
+	})
+	k.handle(nl80211.CmdSetStation, func(genetlink.Message, map[uint16][]byte) ([]genetlink.Message, error) {
+		f.m.Lock()
+		f.auth = true
+		f.m.Unlock()
+		return nil, nil
+	})
+	return c, f
+}
+
+func TestConnectOpen(t *testing.T) {
+	c, _ := newFakeAP(t, nil, capESS)
+	sub := c.Events.Subscribe(SubscribeOptions{Kinds: []EventKind{KindConnectionState}, Buffer: 10})
+	defer sub.Close()
+
+	ifi := &Interface{Index: 3, Name: "wlan0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	st, err := c.Connect(context.Background(), ifi, &ConnectRequest{SSID: "dmesh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != ConnConnected || st.OWE || st.Freq != 2437 || st.Signal != -50 {
+		t.Error("Unexpected state", st)
+	}
+	for _, want := range []ConnState{ConnConnecting, ConnConnected} {
+		ev := <-sub.C
+		if ev.(*ConnectionState).State != want {
+			t.Error("Unexpected event", ev, want)
+		}
+	}
+
+	c.dispatch(&Disconnected{EventHeader: EventHeader{Ifindex: 3}, Reason: 3}, 0)
+	if ev := <-sub.C; ev.(*ConnectionState).State != ConnDisconnected {
+		t.Error("Expecting disconnected", ev)
+	}
+	if c.Connection(ifi).State != ConnDisconnected {
+		t.Error("State not updated")
+	}
+}
+
+func TestConnectOWE(t *testing.T) {
+	c, f := newFakeAP(t, oweRSN, capESS|capPrivacy)
+	ifi := &Interface{Index: 3, Name: "wlan0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	f.ap = newTestAP(t, ifi.HardwareAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := c.Connect(ctx, ifi, &ConnectRequest{SSID: "dmesh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != ConnConnected || !st.OWE {
+		t.Error("Unexpected state", st)
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	// PTK, GTK and IGTK
+	if f.keys != 3 || !f.auth {
+		t.Error("Keys not installed", f.keys, f.auth)
+	}
+}
+
+// The phys are dumped again only for unknown phy indexes.
+func TestPhyOf(t *testing.T) {
+	c, f := newFakeNL80211(t, mlmeFamily)
+	msgs := wiphyDump(t, 1)
+	for i := range msgs {
+		msgs[i].Header.Version = 1
+	}
+	f.reply(nl80211.CmdGetWiphy, msgs...)
+	for i := 0; i < 2; i++ {
+		if p := c.phyOf(&Interface{PHY: 1}); p == nil || p.Name != "phy1" {
+			t.Fatal("Unexpected phy", p)
+		}
+	}
+	if p := c.phyOf(&Interface{PHY: 2}); p != nil {
+		t.Error("Unexpected phy", p)
+	}
+	if n := len(f.requests(nl80211.CmdGetWiphy)); n != 2 {
+		t.Error("Unexpected dumps", n)
+	}
+}
+
+func TestBSSRSN(t *testing.T) {
+	psk := []byte{ieRSN, 20, 1, 0, 0, 0x0f, 0xac, 4, 1, 0, 0, 0x0f, 0xac, 4, 1, 0, 0, 0x0f, 0xac, 2, 0, 0}
+	for _, tc := range []struct {
+		bss  *BSS
+		owe  bool
+		fail bool
+	}{
+		{bss: &BSS{Capability: capESS}},
+		{bss: &BSS{Capability: capESS | capPrivacy}, fail: true},
+		{bss: &BSS{Capability: capESS | capPrivacy, IEs: oweRSN}, owe: true},
+		{bss: &BSS{Capability: capESS | capPrivacy, IEs: psk}, fail: true},
+		{bss: &BSS{Capability: capESS | capPrivacy, IEs: append([]byte{ieVendor, 4}, wpaOUI...)}, fail: true},
+	} {
+		rsn, err := bssRSN(tc.bss)
+		if (err != nil) != tc.fail || (rsn != nil) != tc.owe {
+			t.Error("Unexpected security", tc.bss, rsn, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package wifi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Driver is the radio used by Nan to send frames. Client implements it
+// with nl80211; tests and emulation use a simulated radio.
+//
+// The TX status for a frame is delivered by calling Nan.OnTxStatus with
+// the cookie returned by TxFrame.
+type Driver interface {
+	// TxFrame sends a management frame on the channel, staying dwell ms
+	// if off channel. Returns the cookie of the frame.
+	TxFrame(ifi *Interface, frame []byte, freq, dwell int) (uint64, error)
+
+	// RemainOnChannel listens on the channel for dur ms. Returns the
+	// cookie of the request.
+	RemainOnChannel(ifi *Interface, freq, dur int) (uint64, error)
+}
+
+// rocState tracks the 'remain on channel' timing of an interface.
+type rocState struct {
+	cookie uint64
+
+	// Requested is when the ROC was sent, Started when the driver
+	// reported it on channel.
+	Requested time.Time
+	Started   time.Time
+
+	Freq     int
+	Duration uint32
+
+	// started is closed when the driver reports the requested ROC on
+	// channel, nil if no ROC was requested. ended is set when it expired.
+	started chan struct{}
+	ended   bool
+}
+
+// register adds the Nan to the interfaces receiving TX status and ROC
+// events.
+func (c *Client) register(n *Nan) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.nans == nil {
+		c.nans = map[uint32]*Nan{}
+	}
+	c.nans[uint32(n.IFace.Index)] = n
+}
+
+func (c *Client) unregister(n *Nan) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.nans[uint32(n.IFace.Index)] == n {
+		delete(c.nans, uint32(n.IFace.Index))
+	}
+}
+
+// nan returns the Nan for the interface index, or nil.
+func (c *Client) nan(ifindex uint32) *Nan {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.nans[ifindex]
+}
+
+// RemainOnChannel asks the driver to stay on the channel, for receiving
+// frames in the DW. The start and end events are dispatched to the Nan.
+func (c *Client) RemainOnChannel(ifi *Interface, freq, dur int) (uint64, error) {
+	// Listening is allowed on NoIR and DFS channels.
+	if ch := c.ChannelInfo(ifi.PHY, freq); !ch.Allowed {
+		return 0, fmt.Errorf("%w: %d", errFreqNotAllowed, freq)
+	}
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{
+			Type: nl80211.AttrIfindex,
+			Data: nlenc.Uint32Bytes(uint32(ifi.Index)),
+		},
+		{
+			Type: nl80211.AttrWdev,
+			Data: nlenc.Uint64Bytes(uint64(ifi.Device)),
+		},
+		{Type: nl80211.AttrWiphyFreq,
+			Data: nlenc.Uint32Bytes(uint32(freq)),
+		},
+		{
+			Type: nl80211.AttrDuration,
+			Data: nlenc.Uint32Bytes(uint32(dur)), // ms
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: nl80211.CmdRemainOnChannel,
+			Version: c.familyVersion,
+		},
+		Data: b,
+	}
+
+	msgs, err := c.s.Execute(req, c.familyID, netlink.Request)
+	if err != nil {
+		log.Println("Execute error", err, ifi.Name)
+		return 0, err
+	}
+	return replyCookie(msgs)
+}
+
+// TxFrame sends the frame with CmdFrame and returns the cookie. The TX
+// status is dispatched to the Nan, and may arrive before the reply.
+// Channels where the regulatory domain doesn't allow sending are refused.
+func (c *Client) TxFrame(ifi *Interface, frame []byte, freq, dwell int) (uint64, error) {
+	if err := c.CheckFreq(ifi.PHY, freq); err != nil {
+		return 0, err
+	}
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{
+			Type: nl80211.AttrIfindex,
+			Data: nlenc.Uint32Bytes(uint32(ifi.Index)),
+		},
+		{
+			Type: nl80211.AttrWdev,
+			Data: nlenc.Uint64Bytes(uint64(ifi.Device)),
+		},
+		{ // if not set, use the sta freq. Must set the next one as well
+			// ch 6: 2437
+			// 44: 5220
+			// 149 (if possible): 5745
+			// checked against the regulatory domain above.
+			Type: nl80211.AttrWiphyFreq,
+			Data: nlenc.Uint32Bytes(uint32(freq)),
+		},
+		{ // checks OFFCHAN_TX flag of the interface
+			Type: nl80211.AttrOffchannelTxOk, // flag
+		},
+		{
+			Type: nl80211.AttrDuration,
+			Data: nlenc.Uint32Bytes(uint32(dwell)), // ms
+		},
+		// nocckrate, csacoff
+		{
+			Type: nl80211.AttrFrame,
+			Data: frame,
+		}})
+	if err != nil {
+		return 0, err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: nl80211.CmdFrame,
+			Version: c.familyVersion,
+		},
+		Data: b,
+	}
+
+	msgs, err := c.s.Execute(req, c.familyID, netlink.Request)
+	if err != nil {
+		return 0, err
+	}
+	return replyCookie(msgs)
+}
+
+// replyCookie returns the cookie attribute from the reply.
+func replyCookie(msgs []genetlink.Message) (uint64, error) {
+	for _, m := range msgs {
+		attrs, err := netlink.UnmarshalAttributes(m.Data)
+		if err != nil {
+			return 0, err
+		}
+		for _, a := range attrs {
+			if a.Type == nl80211.AttrCookie && len(a.Data) == 8 {
+				return binary.LittleEndian.Uint64(a.Data), nil
+			}
+		}
+	}
+	return 0, errNoCookie
+}
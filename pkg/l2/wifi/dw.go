@@ -0,0 +1,216 @@
+package wifi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+)
+
+// Android devices are only awake in the discovery windows - frames sent
+// at other times are lost. SDFs and NAFs are queued and sent at the start
+// of the next DW, while the radio remains on the NAN channel for the DW.
+
+var errDWQueueFull = errors.New("nan DW queue full")
+
+const (
+	// NANFreq is the 2.4GHz NAN channel - 6.
+	NANFreq = 2437
+
+	dwQueueSize = 32
+
+	// dwMaxFrames is the max number of queued frames sent in one DW, the
+	// rest wait for the next DW.
+	dwMaxFrames = 8
+)
+
+// dwFrame is a SDF or NAF waiting for the DW. The header is added when
+// sending, using the cluster ID at that time.
+type dwFrame struct {
+	to    net.HardwareAddr
+	naf   bool
+	t     nan.NAFSubtype
+	attrs []nan.Attribute
+	done  func(TxResult)
+}
+
+// queueDW adds a frame to the DW queue.
+func (c *Nan) queueDW(f *dwFrame) error {
+	if err := nan.ValidateAttributes(f.attrs...); err != nil {
+		return err
+	}
+	c.m.Lock()
+	if len(c.dwq) >= dwQueueSize {
+		c.m.Unlock()
+		if f.done != nil {
+			f.done(TxResult{Status: TxDropped, Err: errDWQueueFull})
+		}
+		return errDWQueueFull
+	}
+	c.dwq = append(c.dwq, f)
+	c.m.Unlock()
+	return nil
+}
+
+// RunDW calls OnDW at the start of each DW, until the context is done.
+// The cluster TSF may change when joining a cluster, so the next DW is
+// computed each time instead of using a ticker.
+func (c *Nan) RunDW(ctx context.Context) {
+	for {
+		now := time.Now()
+		t := time.NewTimer(c.Sync.NextDW(now).Sub(now))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-c.done:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		c.OnDW(time.Now())
+	}
+}
+
+// OnDW runs the master election, sends the sync beacon and the queued
+// frames. Discovery frames are sent in the DWs where devices with the
+// DWPeriod awake interval are awake.
+func (c *Nan) OnDW(now time.Time) {
+	idx := c.Sync.DWIndex(now)
+	c.remainOnChannel(NANFreq, nan.DWDuration)
+
+	role := c.Sync.Update(now)
+	if !c.dwAllowed() {
+		// Only listening - the queued frames wait for a domain change.
+		c.DataPaths.Expire(now)
+		return
+	}
+	if role != nan.RoleNonMasterNonSync {
+		c.SendBeacon(true)
+	}
+
+	if c.DWPeriod <= 1 || idx%c.DWPeriod == 0 {
+		c.SendDiscovery(c.IFace, nan.DWDuration)
+	}
+
+	c.m.Lock()
+	q := c.dwq
+	if len(q) > dwMaxFrames {
+		q = q[:dwMaxFrames]
+	}
+	c.dwq = append([]*dwFrame{}, c.dwq[len(q):]...)
+	c.m.Unlock()
+
+	cid := c.Sync.ClusterID()
+	for _, f := range q {
+		b := appendMgmtHeader(make([]byte, 0, 256), 0xD0, f.to, cid)
+		if f.naf {
+			b = nan.AppendNAFHeader(b, f.t)
+		} else {
+			b = nan.AppendSDFHeader(b)
+		}
+		// Validated by queueDW.
+		b, _ = nan.AppendAttributes(b, f.attrs...)
+		c.SendFrame(b, NANFreq, nan.DWDuration, f.done)
+	}
+
+	c.DataPaths.Expire(now)
+}
+
+// dwAllowed returns false if the regulatory domain doesn't allow sending
+// on the DW channel. Changes are logged.
+func (c *Nan) dwAllowed() bool {
+	if c.client == nil {
+		return true
+	}
+	err := c.client.CheckFreq(c.IFace.PHY, NANFreq)
+	c.m.Lock()
+	changed := (err != nil) != c.dwBlocked
+	c.dwBlocked = err != nil
+	c.m.Unlock()
+	if changed {
+		log.Println("NAN: DW channel ", c.IFace.Name, err)
+	}
+	return err == nil
+}
+
+// remainOnChannel starts listening on the channel, and records the
+// request time for the ROC timing.
+func (c *Nan) remainOnChannel(freq, dur int) {
+	c.m.Lock()
+	c.roc.Requested = time.Now()
+	c.roc.started = make(chan struct{})
+	c.roc.ended = false
+	c.m.Unlock()
+	cookie, err := c.drv.RemainOnChannel(c.IFace, freq, dur)
+	if err != nil {
+		log.Println("NAN: DW remain on channel", c.IFace.Name, err)
+		c.m.Lock()
+		c.roc.started = nil
+		c.m.Unlock()
+		return
+	}
+	c.m.Lock()
+	c.roc.cookie = cookie
+	c.m.Unlock()
+}
+
+// onROCStarted is called when the driver is on channel. The event may
+// arrive before the reply with the cookie.
+func (c *Nan) onROCStarted(cookie uint64, freq int, duration uint32) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.roc.Started = time.Now()
+	c.roc.Freq = freq
+	c.roc.Duration = duration
+	if c.roc.started != nil {
+		select {
+		case <-c.roc.started:
+		default:
+			close(c.roc.started)
+		}
+	}
+}
+
+// onROCEnded is called when the ROC expires.
+func (c *Nan) onROCEnded(cookie uint64, ts int64) {
+	c.m.Lock()
+	if cookie == c.roc.cookie {
+		c.roc.ended = true
+	}
+	roc := c.roc
+	c.m.Unlock()
+	if false {
+		log.Println("ROC: if ", c.IFace.Name, "freq", roc.Freq, "duration", roc.Duration,
+			"ts", ts, "startTime", roc.Started.Sub(roc.Requested),
+			"sinceStart", time.Since(roc.Started))
+	}
+}
+
+// rocChannel returns the channel of the ROC in progress, 0 if none. A
+// requested ROC is waited for up to timeout - frames are sent right after
+// the request.
+func (c *Nan) rocChannel(timeout time.Duration) int {
+	c.m.Lock()
+	started := c.roc.started
+	c.m.Unlock()
+	if started == nil {
+		return 0
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-started:
+	case <-t.C:
+		return 0
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.roc.ended || time.Since(c.roc.Started) > time.Duration(c.roc.Duration)*time.Millisecond {
+		return 0
+	}
+	return c.roc.Freq
+}
@@ -0,0 +1,591 @@
+package wifi
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// The receive loop parses the nl80211 multicast messages into typed
+// events, and publishes them on Client.Events. The L2 driver, NAN and
+// metrics subscribe to the events they need, instead of parsing logs.
+
+// EventKind identifies the type of an Event, for filtering.
+type EventKind int
+
+const (
+	KindOther EventKind = iota
+	KindFrameReceived
+	KindTxStatus
+	KindRemainOnChannelStarted
+	KindRemainOnChannelCancelled
+	KindScanDone
+	KindScanAborted
+	KindInterfaceAdded
+	KindInterfaceRemoved
+	KindConnected
+	KindDisconnected
+	KindCQMRSSI
+	KindRegChange
+	KindNanMatch
+	KindNanTerminated
+	KindControlPortFrame
+	KindConnectionState
+	KindStationAdded
+	KindStationRemoved
+	KindStationStats
+	KindMeshPath
+)
+
+// Event is a typed nl80211 event.
+type Event interface {
+	Kind() EventKind
+
+	// Header has the interface and receive time.
+	Header() *EventHeader
+}
+
+// EventHeader has the fields common to all events. Ifindex is 0 for
+// events not associated with an interface - for example RegChange.
+type EventHeader struct {
+	Ifindex int
+	Wiphy   int
+	Wdev    uint64
+
+	// Time the event was received.
+	Time time.Time
+}
+
+func (h *EventHeader) Header() *EventHeader { return h }
+
+// FrameReceived is a management frame registered with RegisterFrame.
+type FrameReceived struct {
+	EventHeader
+	Freq int
+
+	// Signal in dBm, 0 if not known.
+	Signal int
+
+	// Frame starts with the 802.11 header.
+	Frame []byte
+}
+
+// TxStatusEvent is the result of a frame sent with CmdFrame.
+type TxStatusEvent struct {
+	EventHeader
+	Cookie uint64
+	Acked  bool
+	Frame  []byte
+}
+
+// RemainOnChannelStarted is sent when the radio is on the channel.
+type RemainOnChannelStarted struct {
+	EventHeader
+	Cookie   uint64
+	Freq     int
+	Duration time.Duration
+}
+
+// RemainOnChannelCancelled is sent when the ROC expired or was cancelled.
+type RemainOnChannelCancelled struct {
+	EventHeader
+	Cookie uint64
+	Freq   int
+}
+
+// ScanDone is sent when a scan completes - results are in the BSS cache.
+type ScanDone struct {
+	EventHeader
+}
+
+// ScanAborted is sent when a scan was aborted.
+type ScanAborted struct {
+	EventHeader
+}
+
+// InterfaceAdded is sent when an interface is created.
+type InterfaceAdded struct {
+	EventHeader
+	Interface *Interface
+}
+
+// InterfaceRemoved is sent when an interface is deleted.
+type InterfaceRemoved struct {
+	EventHeader
+	Interface *Interface
+}
+
+// Connected is the result of a connect - Status 0 is success.
+type Connected struct {
+	EventHeader
+	BSSID  net.HardwareAddr
+	Status uint16
+
+	// TimedOut is set if the AP didn't respond.
+	TimedOut bool
+
+	// IEs of the association request and response - OWE uses the DH
+	// parameter in the response.
+	ReqIE, RespIE []byte
+}
+
+// ControlPortFrame is an EAPOL frame received with control port over
+// nl80211 - only sent to the socket that connected.
+type ControlPortFrame struct {
+	EventHeader
+	Src   net.HardwareAddr
+	Proto uint16
+
+	// Frame starts with the 802.1X header.
+	Frame []byte
+
+	// Unencrypted is set if the frame was received without encryption.
+	Unencrypted bool
+}
+
+// Disconnected is sent when the STA is disconnected.
+type Disconnected struct {
+	EventHeader
+	BSSID  net.HardwareAddr
+	Reason uint16
+	ByAP   bool
+}
+
+// CQMRSSI is sent when the signal crosses the threshold set for
+// connection quality monitoring.
+type CQMRSSI struct {
+	EventHeader
+
+	// Low is true if the signal dropped below the threshold.
+	Low bool
+
+	// Level is the signal in dBm, if reported by the driver.
+	Level int
+}
+
+// RegChange is sent when the regulatory domain changes.
+type RegChange struct {
+	EventHeader
+	Initiator uint8
+	Type      uint8
+
+	// Alpha2 is the country, for Type country.
+	Alpha2 string
+}
+
+// NanMatch is a discovery result or follow-up from the NAN offload - a
+// peer publish matching a local subscribe, or a follow-up to a local
+// instance.
+type NanMatch struct {
+	EventHeader
+
+	// Cookie of the local function.
+	Cookie uint64
+
+	Peer          net.HardwareAddr
+	LocalInstance uint8
+	PeerInstance  uint8
+
+	// Type of the peer function - NanFuncPublish or NanFuncFollowUp.
+	Type        uint8
+	ServiceInfo []byte
+}
+
+// NanTerminated is sent when the driver removes a NAN function - TTL
+// expired, error or a single follow-up was sent.
+type NanTerminated struct {
+	EventHeader
+	Cookie   uint64
+	Instance uint8
+	Reason   uint8
+}
+
+// StationAdded is sent when a peer associates with a local AP or GO, or a
+// mesh peer is added.
+type StationAdded struct {
+	EventHeader
+	MAC net.HardwareAddr
+}
+
+// StationRemoved is sent when a peer leaves a local AP or GO.
+type StationRemoved struct {
+	EventHeader
+	MAC net.HardwareAddr
+}
+
+// OtherEvent is any other nl80211 multicast message.
+type OtherEvent struct {
+	EventHeader
+	Command uint8
+	Attrs   []netlink.Attribute
+}
+
+func (*FrameReceived) Kind() EventKind            { return KindFrameReceived }
+func (*TxStatusEvent) Kind() EventKind            { return KindTxStatus }
+func (*RemainOnChannelStarted) Kind() EventKind   { return KindRemainOnChannelStarted }
+func (*RemainOnChannelCancelled) Kind() EventKind { return KindRemainOnChannelCancelled }
+func (*ScanDone) Kind() EventKind                 { return KindScanDone }
+func (*ScanAborted) Kind() EventKind              { return KindScanAborted }
+func (*InterfaceAdded) Kind() EventKind           { return KindInterfaceAdded }
+func (*InterfaceRemoved) Kind() EventKind         { return KindInterfaceRemoved }
+func (*Connected) Kind() EventKind                { return KindConnected }
+func (*Disconnected) Kind() EventKind             { return KindDisconnected }
+func (*CQMRSSI) Kind() EventKind                  { return KindCQMRSSI }
+func (*RegChange) Kind() EventKind                { return KindRegChange }
+func (*NanMatch) Kind() EventKind                 { return KindNanMatch }
+func (*NanTerminated) Kind() EventKind            { return KindNanTerminated }
+func (*ControlPortFrame) Kind() EventKind         { return KindControlPortFrame }
+func (*ConnectionState) Kind() EventKind          { return KindConnectionState }
+func (*StationAdded) Kind() EventKind             { return KindStationAdded }
+func (*StationRemoved) Kind() EventKind           { return KindStationRemoved }
+func (*StationStats) Kind() EventKind             { return KindStationStats }
+func (*MeshPathChanged) Kind() EventKind          { return KindMeshPath }
+func (*OtherEvent) Kind() EventKind               { return KindOther }
+
+// cqmRSSILevel is NL80211_ATTR_CQM_RSSI_LEVEL - newer than the constants.
+const cqmRSSILevel = 9
+
+// parseEvent returns the typed event for a nl80211 message.
+func parseEvent(m genetlink.Message, now time.Time) (Event, error) {
+	attrs, err := netlink.UnmarshalAttributes(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	h := EventHeader{Time: now}
+	var freq, signal int
+	var frame, mac []byte
+	var cookie uint64
+	var status, reason uint16
+	var dur uint32
+	var acked, byAP, timedOut bool
+	var cqm []byte
+	var regInit, regType uint8
+	var alpha2 string
+	var nanMatch, nanFunc []byte
+	var reqIE, respIE []byte
+	var proto uint16
+	var noEncrypt bool
+	for _, a := range attrs {
+		switch a.Type {
+		case nl80211.AttrIfindex:
+			h.Ifindex = int(nlenc.Uint32(a.Data))
+		case nl80211.AttrWiphy:
+			h.Wiphy = int(nlenc.Uint32(a.Data))
+		case nl80211.AttrWdev:
+			h.Wdev = nlenc.Uint64(a.Data)
+		case nl80211.AttrWiphyFreq:
+			freq = int(nlenc.Uint32(a.Data))
+		case nl80211.AttrRxSignalDbm:
+			signal = int(nlenc.Int32(a.Data))
+		case nl80211.AttrFrame:
+			frame = a.Data
+		case nl80211.AttrCookie:
+			cookie = nlenc.Uint64(a.Data)
+		case nl80211.AttrDuration:
+			dur = nlenc.Uint32(a.Data)
+		case nl80211.AttrAck:
+			acked = true
+		case nl80211.AttrMac:
+			mac = a.Data
+		case nl80211.AttrStatusCode:
+			status = nlenc.Uint16(a.Data)
+		case nl80211.AttrReasonCode:
+			reason = nlenc.Uint16(a.Data)
+		case nl80211.AttrDisconnectedByAp:
+			byAP = true
+		case nl80211.AttrTimedOut:
+			timedOut = true
+		case nl80211.AttrCqm:
+			cqm = a.Data
+		case nl80211.AttrRegInitiator:
+			regInit = nlenc.Uint8(a.Data)
+		case nl80211.AttrRegType:
+			regType = nlenc.Uint8(a.Data)
+		case nl80211.AttrRegAlpha2:
+			alpha2 = nlenc.String(a.Data)
+		case nl80211.AttrNanMatch:
+			nanMatch = a.Data
+		case nl80211.AttrNanFunc:
+			nanFunc = a.Data
+		case nl80211.AttrReqIe:
+			reqIE = a.Data
+		case nl80211.AttrRespIe:
+			respIE = a.Data
+		case nl80211.AttrControlPortEthertype:
+			proto = nlenc.Uint16(a.Data)
+		case nl80211.AttrControlPortNoEncrypt:
+			noEncrypt = true
+		}
+	}
+
+	switch m.Header.Command {
+	case nl80211.CmdFrame:
+		return &FrameReceived{EventHeader: h, Freq: freq, Signal: signal, Frame: frame}, nil
+	case nl80211.CmdFrameTxStatus:
+		return &TxStatusEvent{EventHeader: h, Cookie: cookie, Acked: acked, Frame: frame}, nil
+	case nl80211.CmdRemainOnChannel:
+		return &RemainOnChannelStarted{EventHeader: h, Cookie: cookie, Freq: freq,
+			Duration: time.Duration(dur) * time.Millisecond}, nil
+	case nl80211.CmdCancelRemainOnChannel:
+		return &RemainOnChannelCancelled{EventHeader: h, Cookie: cookie, Freq: freq}, nil
+	case nl80211.CmdNewScanResults:
+		return &ScanDone{EventHeader: h}, nil
+	case nl80211.CmdScanAborted:
+		return &ScanAborted{EventHeader: h}, nil
+	case nl80211.CmdNewInterface, nl80211.CmdDelInterface:
+		ifi := &Interface{}
+		if err := ifi.parseAttributes(attrs); err != nil {
+			return nil, err
+		}
+		if m.Header.Command == nl80211.CmdNewInterface {
+			return &InterfaceAdded{EventHeader: h, Interface: ifi}, nil
+		}
+		return &InterfaceRemoved{EventHeader: h, Interface: ifi}, nil
+	case nl80211.CmdConnect:
+		return &Connected{EventHeader: h, BSSID: net.HardwareAddr(mac), Status: status,
+			TimedOut: timedOut, ReqIE: reqIE, RespIE: respIE}, nil
+	case nl80211.CmdControlPortFrame:
+		return &ControlPortFrame{EventHeader: h, Src: net.HardwareAddr(mac), Proto: proto,
+			Frame: frame, Unencrypted: noEncrypt}, nil
+	case nl80211.CmdDisconnect:
+		return &Disconnected{EventHeader: h, BSSID: net.HardwareAddr(mac), Reason: reason,
+			ByAP: byAP}, nil
+	case nl80211.CmdNewStation:
+		return &StationAdded{EventHeader: h, MAC: net.HardwareAddr(mac)}, nil
+	case nl80211.CmdDelStation:
+		return &StationRemoved{EventHeader: h, MAC: net.HardwareAddr(mac)}, nil
+	case nl80211.CmdNotifyCqm:
+		ev := &CQMRSSI{EventHeader: h}
+		cattrs, err := netlink.UnmarshalAttributes(cqm)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range cattrs {
+			switch a.Type {
+			case nl80211.AttrCqmRssiThresholdEvent:
+				ev.Low = nlenc.Uint32(a.Data) == nl80211.CqmRssiThresholdEventLow
+			case cqmRSSILevel:
+				ev.Level = int(nlenc.Int32(a.Data))
+			}
+		}
+		return ev, nil
+	case nl80211.CmdRegChange, nl80211.CmdWiphyRegChange:
+		return &RegChange{EventHeader: h, Initiator: regInit, Type: regType,
+			Alpha2: alpha2}, nil
+	case nl80211.CmdNanMatch:
+		ev := &NanMatch{EventHeader: h, Cookie: cookie, Peer: net.HardwareAddr(mac)}
+		mattrs, err := netlink.UnmarshalAttributes(nanMatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range mattrs {
+			f, err := parseNanFunc(a.Data)
+			if err != nil {
+				return nil, err
+			}
+			switch a.Type {
+			case nl80211.NanMatchFuncLocal:
+				ev.LocalInstance = f.instance
+			case nl80211.NanMatchFuncPeer:
+				ev.PeerInstance = f.instance
+				ev.Type = f.typ
+				ev.ServiceInfo = f.info
+			}
+		}
+		return ev, nil
+	case nl80211.CmdDelNanFunction:
+		f, err := parseNanFunc(nanFunc)
+		if err != nil {
+			return nil, err
+		}
+		return &NanTerminated{EventHeader: h, Cookie: cookie, Instance: f.instance,
+			Reason: f.reason}, nil
+	}
+	return &OtherEvent{EventHeader: h, Command: m.Header.Command, Attrs: attrs}, nil
+}
+
+// nanFunc has the NanFunc attributes used in events and replies.
+type nanFunc struct {
+	typ      uint8
+	instance uint8
+	reason   uint8
+	info     []byte
+}
+
+func parseNanFunc(b []byte) (*nanFunc, error) {
+	f := &nanFunc{}
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case nl80211.NanFuncType:
+			f.typ = nlenc.Uint8(a.Data)
+		case nl80211.NanFuncInstanceId:
+			f.instance = nlenc.Uint8(a.Data)
+		case nl80211.NanFuncTermReason:
+			f.reason = nlenc.Uint8(a.Data)
+		case nl80211.NanFuncServiceInfo:
+			f.info = a.Data
+		}
+	}
+	return f, nil
+}
+
+// SubscribeOptions selects the events delivered to a subscription, and
+// what happens when the subscriber is slow.
+type SubscribeOptions struct {
+	// Kinds to deliver - all if empty.
+	Kinds []EventKind
+
+	// Ifindex to deliver events for - 0 for all interfaces. Events
+	// without an interface are always delivered.
+	Ifindex int
+
+	// Match is an optional additional filter.
+	Match func(Event) bool
+
+	// Buffer is the channel size - defaultEventBuffer if 0.
+	Buffer int
+
+	// Block is the max time the receive loop waits for a full channel.
+	// If 0, events are dropped when the channel is full. The receive loop
+	// also delivers the TX status needed by senders - blocking subscribers
+	// delay all other events.
+	Block time.Duration
+}
+
+func (o *SubscribeOptions) match(ev Event) bool {
+	if len(o.Kinds) > 0 {
+		found := false
+		for _, k := range o.Kinds {
+			if k == ev.Kind() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if o.Ifindex != 0 {
+		if idx := ev.Header().Ifindex; idx != 0 && idx != o.Ifindex {
+			return false
+		}
+	}
+	if o.Match != nil && !o.Match(ev) {
+		return false
+	}
+	return true
+}
+
+// Subscription receives events on C, until Close. Events that can't be
+// delivered are counted in Dropped.
+type Subscription struct {
+	C <-chan Event
+
+	c    chan Event
+	opts SubscribeOptions
+	bus  *EventBus
+
+	dropped uint64
+}
+
+// Dropped returns the number of events dropped because C was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close removes the subscription. C is closed.
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// EventBus delivers events to the subscriptions.
+type EventBus struct {
+	m      sync.RWMutex
+	subs   []*Subscription
+	closed bool
+}
+
+// defaultEventBuffer is the subscription buffer if not specified.
+const defaultEventBuffer = 64
+
+// NewEventBus returns an empty bus.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe returns a subscription for the events matching the options.
+func (b *EventBus) Subscribe(opts SubscribeOptions) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultEventBuffer
+	}
+	c := make(chan Event, opts.Buffer)
+	s := &Subscription{C: c, c: c, opts: opts, bus: b}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		close(c)
+		return s
+	}
+	b.subs = append(b.subs, s)
+	return s
+}
+
+// Close closes all subscriptions - the receivers of C return. Later
+// subscriptions are closed.
+func (b *EventBus) Close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, s := range b.subs {
+		close(s.c)
+	}
+	b.subs = nil
+	b.closed = true
+}
+
+func (b *EventBus) unsubscribe(s *Subscription) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for i, x := range b.subs {
+		if x == s {
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+// Publish delivers the event to the matching subscriptions.
+func (b *EventBus) Publish(ev Event) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	for _, s := range b.subs {
+		if !s.opts.match(ev) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+			continue
+		default:
+		}
+		if s.opts.Block > 0 {
+			t := time.NewTimer(s.opts.Block)
+			select {
+			case s.c <- ev:
+				t.Stop()
+				continue
+			case <-t.C:
+			}
+		}
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
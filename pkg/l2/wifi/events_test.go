@@ -0,0 +1,142 @@
+package wifi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+func eventMsg(t *testing.T, cmd uint8, attrs ...netlink.Attribute) genetlink.Message {
+	b, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return genetlink.Message{Header: genetlink.Header{Command: cmd}, Data: b}
+}
+
+func TestParseEvent(t *testing.T) {
+	now := time.Now()
+	ifidx := netlink.Attribute{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(3)}
+
+	ev, err := parseEvent(eventMsg(t, nl80211.CmdFrame, ifidx,
+		netlink.Attribute{Type: nl80211.AttrWiphyFreq, Data: nlenc.Uint32Bytes(2437)},
+		netlink.Attribute{Type: nl80211.AttrRxSignalDbm, Data: nlenc.Int32Bytes(-60)},
+		netlink.Attribute{Type: nl80211.AttrFrame, Data: []byte{0xD0, 0}}), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := ev.(*FrameReceived); !ok || f.Ifindex != 3 || f.Freq != 2437 ||
+		f.Signal != -60 || len(f.Frame) != 2 || f.Time != now {
+		t.Error("Unexpected frame", ev)
+	}
+
+	ev, _ = parseEvent(eventMsg(t, nl80211.CmdFrameTxStatus, ifidx,
+		netlink.Attribute{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(42)},
+		netlink.Attribute{Type: nl80211.AttrAck}), now)
+	if s, ok := ev.(*TxStatusEvent); !ok || s.Cookie != 42 || !s.Acked {
+		t.Error("Unexpected TX status", ev)
+	}
+
+	ev, _ = parseEvent(eventMsg(t, nl80211.CmdRemainOnChannel, ifidx,
+		netlink.Attribute{Type: nl80211.AttrDuration, Data: nlenc.Uint32Bytes(16)}), now)
+	if r, ok := ev.(*RemainOnChannelStarted); !ok || r.Duration != 16*time.Millisecond {
+		t.Error("Unexpected ROC", ev)
+	}
+
+	cqm, _ := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nl80211.AttrCqmRssiThresholdEvent, Data: nlenc.Uint32Bytes(nl80211.CqmRssiThresholdEventLow)},
+		{Type: cqmRSSILevel, Data: nlenc.Int32Bytes(-80)},
+	})
+	ev, _ = parseEvent(eventMsg(t, nl80211.CmdNotifyCqm, ifidx,
+		netlink.Attribute{Type: nl80211.AttrCqm, Data: cqm}), now)
+	if c, ok := ev.(*CQMRSSI); !ok || !c.Low || c.Level != -80 {
+		t.Error("Unexpected CQM", ev)
+	}
+
+	ev, _ = parseEvent(eventMsg(t, nl80211.CmdDisconnect, ifidx,
+		netlink.Attribute{Type: nl80211.AttrReasonCode, Data: nlenc.Uint16Bytes(3)},
+		netlink.Attribute{Type: nl80211.AttrDisconnectedByAp}), now)
+	if d, ok := ev.(*Disconnected); !ok || d.Reason != 3 || !d.ByAP {
+		t.Error("Unexpected disconnect", ev)
+	}
+
+	ev, _ = parseEvent(eventMsg(t, nl80211.CmdRegChange,
+		netlink.Attribute{Type: nl80211.AttrRegInitiator, Data: []byte{1}},
+		netlink.Attribute{Type: nl80211.AttrRegAlpha2, Data: []byte("US\x00")}), now)
+	if r, ok := ev.(*RegChange); !ok || r.Alpha2 != "US" || r.Initiator != 1 || r.Ifindex != 0 {
+		t.Error("Unexpected reg change", ev)
+	}
+
+	ev, _ = parseEvent(eventMsg(t, nl80211.CmdNewInterface, ifidx,
+		netlink.Attribute{Type: nl80211.AttrIfname, Data: []byte("wlan1\x00")}), now)
+	if i, ok := ev.(*InterfaceAdded); !ok || i.Interface.Name != "wlan1" || i.Interface.Index != 3 {
+		t.Error("Unexpected interface", ev)
+	}
+
+	ev, _ = parseEvent(eventMsg(t, nl80211.CmdFrameWaitCancel, ifidx), now)
+	if o, ok := ev.(*OtherEvent); !ok || o.Command != nl80211.CmdFrameWaitCancel {
+		t.Error("Unexpected other", ev)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus()
+	all := b.Subscribe(SubscribeOptions{Buffer: 2})
+	frames := b.Subscribe(SubscribeOptions{Kinds: []EventKind{KindFrameReceived}, Ifindex: 3})
+
+	// Slow subscriber - Publish waits for it.
+	blocking := b.Subscribe(SubscribeOptions{Buffer: 1, Block: 5 * time.Second})
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range blocking.C {
+			time.Sleep(time.Millisecond)
+			n++
+		}
+		received <- n
+	}()
+
+	b.Publish(&FrameReceived{EventHeader: EventHeader{Ifindex: 3}})
+	b.Publish(&FrameReceived{EventHeader: EventHeader{Ifindex: 4}})
+	b.Publish(&RegChange{Alpha2: "US"})
+	for i := 0; i < 10; i++ {
+		b.Publish(&ScanDone{})
+	}
+
+	if len(frames.C) != 1 {
+		t.Error("Filter", len(frames.C))
+	}
+	if len(all.C) != 2 || all.Dropped() != 11 {
+		t.Error("Expecting drop when full", len(all.C), all.Dropped())
+	}
+
+	blocking.Close()
+	if n := <-received; n != 13 || blocking.Dropped() != 0 {
+		t.Error("Blocking subscriber dropped", n, blocking.Dropped())
+	}
+
+	frames.Close()
+	if _, ok := <-frames.C; !ok {
+		t.Error("Expecting buffered event before close")
+	}
+	if _, ok := <-frames.C; ok {
+		t.Error("Expecting closed channel")
+	}
+	b.Publish(&FrameReceived{EventHeader: EventHeader{Ifindex: 3}})
+	all.Close()
+
+	// Close ends the remaining and the later subscriptions.
+	open := b.Subscribe(SubscribeOptions{})
+	b.Close()
+	if _, ok := <-open.C; ok {
+		t.Error("Expecting closed subscription")
+	}
+	if _, ok := <-b.Subscribe(SubscribeOptions{}).C; ok {
+		t.Error("Expecting closed subscription after close")
+	}
+	b.Publish(&ScanDone{})
+}
@@ -0,0 +1,456 @@
+package wifi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Virtual interfaces created by dmesh - monitor, NAN, P2P device, mesh -
+// are tracked by the Client, so they can be removed on exit and re-created
+// after a driver reset, with the same name, link state, channel and mesh.
+
+var errNoInterface = errors.New("no interface in reply")
+
+// MonitorFlag selects the frames received on a monitor interface.
+type MonitorFlag uint16
+
+const (
+	MonitorFCSFail  MonitorFlag = nl80211.MntrFlagFcsfail
+	MonitorPLCPFail MonitorFlag = nl80211.MntrFlagPlcpfail
+	MonitorControl  MonitorFlag = nl80211.MntrFlagControl
+	MonitorOtherBSS MonitorFlag = nl80211.MntrFlagOtherBss
+	MonitorCook     MonitorFlag = nl80211.MntrFlagCookFrames
+
+	// MonitorActive acks unicast frames to the interface address.
+	MonitorActive MonitorFlag = nl80211.MntrFlagActive
+)
+
+// InterfaceConfig describes a virtual interface to create.
+type InterfaceConfig struct {
+	Name string
+	PHY  int
+	Type InterfaceType
+
+	// MonitorFlags for monitor interfaces. Kernel defaults if empty.
+	MonitorFlags []MonitorFlag
+
+	// HardwareAddr is optional - P2P device and NAN interfaces may use a
+	// random address.
+	HardwareAddr net.HardwareAddr
+}
+
+// ChannelWidth is the channel width, as in nl80211.
+type ChannelWidth uint32
+
+const (
+	Width20NoHT ChannelWidth = nl80211.ChanWidth20Noht
+	Width20     ChannelWidth = nl80211.ChanWidth20
+	Width40     ChannelWidth = nl80211.ChanWidth40
+	Width80     ChannelWidth = nl80211.ChanWidth80
+	Width80P80  ChannelWidth = nl80211.ChanWidth80p80
+	Width160    ChannelWidth = nl80211.ChanWidth160
+)
+
+// ChannelConfig is the channel of an interface - for monitor interfaces,
+// the channel to listen on.
+type ChannelConfig struct {
+	Freq  int
+	Width ChannelWidth
+
+	// CenterFreq1 is required for 40MHz and wider, CenterFreq2 for 80+80.
+	CenterFreq1 int
+	CenterFreq2 int
+}
+
+// managedInterface is an interface created by the Client, with the state
+// to restore.
+type managedInterface struct {
+	cfg InterfaceConfig
+	ifi *Interface
+	up  bool
+	ch  *ChannelConfig
+
+	// mesh joined with JoinMesh.
+	mesh *MeshConfig
+
+	// phyAddrs are the addresses of the interfaces on the phy at creation
+	// - the phy index changes after a driver reset, the addresses don't.
+	phyAddrs map[string]bool
+}
+
+// attrs returns the NewInterface attributes.
+func (cfg *InterfaceConfig) attrs() ([]netlink.Attribute, error) {
+	attrs := []netlink.Attribute{
+		{
+			Type: nl80211.AttrWiphy,
+			Data: nlenc.Uint32Bytes(uint32(cfg.PHY)),
+		},
+		{
+			Type: nl80211.AttrIfname,
+			Data: nlenc.Bytes(cfg.Name),
+		},
+		{
+			Type: nl80211.AttrIftype,
+			Data: nlenc.Uint32Bytes(uint32(cfg.Type)),
+		},
+	}
+	if cfg.Type == InterfaceTypeMonitor && len(cfg.MonitorFlags) > 0 {
+		b, err := monitorFlagsAttr(cfg.MonitorFlags)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrMntrFlags, Data: b})
+	}
+	if len(cfg.HardwareAddr) == 6 {
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrMac, Data: cfg.HardwareAddr})
+	}
+	return attrs, nil
+}
+
+// monitorFlagsAttr returns the nested flags.
+func monitorFlagsAttr(flags []MonitorFlag) ([]byte, error) {
+	fa := []netlink.Attribute{}
+	for _, f := range flags {
+		fa = append(fa, netlink.Attribute{Type: uint16(f)})
+	}
+	return netlink.MarshalAttributes(fa)
+}
+
+// wdevAttrs identifies the interface - P2P device and NAN interfaces have
+// no netdev, only a wdev.
+func (ifi *Interface) wdevAttrs() []netlink.Attribute {
+	if ifi.Index != 0 {
+		return []netlink.Attribute{
+			{
+				Type: nl80211.AttrIfindex,
+				Data: nlenc.Uint32Bytes(uint32(ifi.Index)),
+			},
+		}
+	}
+	return []netlink.Attribute{
+		{
+			Type: nl80211.AttrWdev,
+			Data: nlenc.Uint64Bytes(uint64(ifi.Device)),
+		},
+	}
+}
+
+// channelAttrs returns the SetWiphy attributes for the channel.
+func channelAttrs(ifi *Interface, ch *ChannelConfig) []netlink.Attribute {
+	attrs := append(ifi.wdevAttrs(),
+		netlink.Attribute{
+			Type: nl80211.AttrWiphyFreq,
+			Data: nlenc.Uint32Bytes(uint32(ch.Freq)),
+		},
+		netlink.Attribute{
+			Type: nl80211.AttrChannelWidth,
+			Data: nlenc.Uint32Bytes(uint32(ch.Width)),
+		})
+	if ch.CenterFreq1 != 0 {
+		attrs = append(attrs, netlink.Attribute{
+			Type: nl80211.AttrCenterFreq1,
+			Data: nlenc.Uint32Bytes(uint32(ch.CenterFreq1)),
+		})
+	}
+	if ch.CenterFreq2 != 0 {
+		attrs = append(attrs, netlink.Attribute{
+			Type: nl80211.AttrCenterFreq2,
+			Data: nlenc.Uint32Bytes(uint32(ch.CenterFreq2)),
+		})
+	}
+	return attrs
+}
+
+// execute sends a nl80211 command with the attributes.
+func (c *Client) execute(cmd uint8, attrs []netlink.Attribute, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	b, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return c.s.Execute(genetlink.Message{
+		Header: genetlink.Header{
+			Command: cmd,
+			Version: c.familyVersion,
+		},
+		Data: b,
+	}, c.familyID, flags)
+}
+
+// CreateInterface creates a virtual interface on the phy, and tracks it
+// for RemoveInterfaces and RestoreInterfaces. The interface is down.
+func (c *Client) CreateInterface(cfg InterfaceConfig) (*Interface, error) {
+	ifi, err := c.createInterface(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	addrs := c.phyAddrs(cfg.PHY)
+	c.m.Lock()
+	if c.managed == nil {
+		c.managed = map[string]*managedInterface{}
+	}
+	c.managed[cfg.Name] = &managedInterface{cfg: cfg, ifi: ifi, phyAddrs: addrs}
+	c.m.Unlock()
+	return ifi, nil
+}
+
+func (c *Client) createInterface(cfg *InterfaceConfig) (*Interface, error) {
+	attrs, err := cfg.attrs()
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := c.execute(nl80211.CmdNewInterface, attrs, netlink.Request)
+	if err != nil {
+		return nil, fmt.Errorf("create %s: %w", cfg.Name, err)
+	}
+	if err := c.checkMessages(msgs, nl80211.CmdNewInterface); err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		rattrs, err := netlink.UnmarshalAttributes(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		ifi := &Interface{}
+		if err := ifi.parseAttributes(rattrs); err != nil {
+			return nil, err
+		}
+		log.Println("WIFI: created", ifi.Name, ifi.Type, "phy", ifi.PHY, ifi.Index)
+		return ifi, nil
+	}
+	return nil, errNoInterface
+}
+
+// DeleteInterface removes the interface.
+func (c *Client) DeleteInterface(ifi *Interface) error {
+	_, err := c.execute(nl80211.CmdDelInterface, ifi.wdevAttrs(), netlink.Request|netlink.Acknowledge)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	if m := c.managed[ifi.Name]; m != nil && m.ifi == ifi {
+		delete(c.managed, ifi.Name)
+	}
+	c.m.Unlock()
+	return nil
+}
+
+// SetInterfaceType changes the type of the interface - it must be down.
+// flags are used if the new type is monitor.
+func (c *Client) SetInterfaceType(ifi *Interface, t InterfaceType, flags ...MonitorFlag) error {
+	attrs := append(ifi.wdevAttrs(), netlink.Attribute{
+		Type: nl80211.AttrIftype,
+		Data: nlenc.Uint32Bytes(uint32(t)),
+	})
+	if t == InterfaceTypeMonitor && len(flags) > 0 {
+		b, err := monitorFlagsAttr(flags)
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrMntrFlags, Data: b})
+	}
+	if _, err := c.execute(nl80211.CmdSetInterface, attrs, netlink.Request|netlink.Acknowledge); err != nil {
+		return err
+	}
+	ifi.Type = t
+	c.m.Lock()
+	if m := c.managed[ifi.Name]; m != nil {
+		m.cfg.Type = t
+		m.cfg.MonitorFlags = flags
+	}
+	c.m.Unlock()
+	return nil
+}
+
+// SetChannel sets the channel and width of the interface, with SetWiphy.
+// Used for monitor interfaces - other types get the channel from the
+// connection.
+func (c *Client) SetChannel(ifi *Interface, ch ChannelConfig) error {
+	_, err := c.execute(nl80211.CmdSetWiphy, channelAttrs(ifi, &ch), netlink.Request|netlink.Acknowledge)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	if m := c.managed[ifi.Name]; m != nil {
+		m.ch = &ch
+	}
+	c.m.Unlock()
+	return nil
+}
+
+// InterfaceByIndex returns the interface with its current channel -
+// Frequency is 0 if the driver doesn't report it.
+func (c *Client) InterfaceByIndex(index int) (*Interface, error) {
+	msgs, err := c.execute(nl80211.CmdGetInterface, []netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(index))},
+	}, netlink.Request)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errNoInterface
+	}
+	attrs, err := netlink.UnmarshalAttributes(msgs[0].Data)
+	if err != nil {
+		return nil, err
+	}
+	ifi := &Interface{}
+	if err := ifi.parseAttributes(attrs); err != nil {
+		return nil, err
+	}
+	return ifi, nil
+}
+
+// linkSetter is implemented by sockets without netdevs - simulated
+// radios bring the interfaces up and down themselves.
+type linkSetter interface {
+	SetLinkUp(ifindex int, up bool) error
+}
+
+// SetLinkUp brings the interface up or down, using rtnetlink.
+func (c *Client) SetLinkUp(ifi *Interface, up bool) error {
+	var err error
+	if ls, ok := c.s.sock.(linkSetter); ok {
+		err = ls.SetLinkUp(ifi.Index, up)
+	} else {
+		err = c.rtnlLinkUp(ifi, up)
+	}
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	if m := c.managed[ifi.Name]; m != nil {
+		m.up = up
+	}
+	c.m.Unlock()
+	return nil
+}
+
+func (c *Client) rtnlLinkUp(ifi *Interface, up bool) error {
+	rtcon, err := rtnl.Dial(nil)
+	if err != nil {
+		return err
+	}
+	defer rtcon.Close()
+	nifi := &net.Interface{Index: ifi.Index, Name: ifi.Name}
+	if up {
+		return rtcon.LinkUp(nifi)
+	}
+	return rtcon.LinkDown(nifi)
+}
+
+// ManagedInterfaces returns the interfaces created with CreateInterface.
+func (c *Client) ManagedInterfaces() []*Interface {
+	c.m.Lock()
+	defer c.m.Unlock()
+	res := []*Interface{}
+	for _, m := range c.managed {
+		res = append(res, m.ifi)
+	}
+	return res
+}
+
+// RemoveInterfaces deletes all interfaces created with CreateInterface -
+// called on exit.
+func (c *Client) RemoveInterfaces() error {
+	var lastErr error
+	for _, ifi := range c.ManagedInterfaces() {
+		if err := c.DeleteInterface(ifi); err != nil {
+			log.Println("WIFI: delete", ifi.Name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// RestoreInterfaces re-creates the managed interfaces that no longer
+// exist - after a driver reset or if deleted by another process - and
+// restores the channel and link state. Returns the re-created interfaces.
+//
+// The phy is found again by the addresses of its interfaces - the index
+// changes after a driver reset. The Interface returned by CreateInterface
+// is not updated, use the returned ones or ManagedInterfaces.
+func (c *Client) RestoreInterfaces() ([]*Interface, error) {
+	ifis, err := c.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	exists := map[string]bool{}
+	for _, ifi := range ifis {
+		exists[ifi.Name] = true
+	}
+
+	c.m.Lock()
+	missing := []*managedInterface{}
+	cfgs := []InterfaceConfig{}
+	for name, m := range c.managed {
+		if exists[name] {
+			continue
+		}
+		for _, ifi := range ifis {
+			if m.phyAddrs[ifi.HardwareAddr.String()] && ifi.PHY != m.cfg.PHY {
+				log.Println("WIFI: phy renumbered", name, m.cfg.PHY, ifi.PHY)
+				m.cfg.PHY = ifi.PHY
+				break
+			}
+		}
+		missing = append(missing, m)
+		cfgs = append(cfgs, m.cfg)
+	}
+	c.m.Unlock()
+
+	res := []*Interface{}
+	var lastErr error
+	for i, m := range missing {
+		ifi, err := c.createInterface(&cfgs[i])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.m.Lock()
+		m.ifi = ifi
+		up, ch, mesh := m.up, m.ch, m.mesh
+		c.m.Unlock()
+		if ch != nil {
+			if err := c.SetChannel(ifi, *ch); err != nil {
+				log.Println("WIFI: restore channel", ifi.Name, err)
+			}
+		}
+		if up {
+			if err := c.SetLinkUp(ifi, true); err != nil {
+				log.Println("WIFI: restore link", ifi.Name, err)
+			}
+		}
+		if mesh != nil {
+			if err := c.JoinMesh(ifi, *mesh); err != nil {
+				log.Println("WIFI: restore mesh", ifi.Name, err)
+			}
+		}
+		res = append(res, ifi)
+	}
+	return res, lastErr
+}
+
+// phyAddrs returns the addresses of the interfaces on the phy, used to
+// find it after a driver reset.
+func (c *Client) phyAddrs(phy int) map[string]bool {
+	ifis, err := c.Interfaces()
+	if err != nil {
+		log.Println("WIFI: interfaces", err)
+		return nil
+	}
+	res := map[string]bool{}
+	for _, ifi := range ifis {
+		if ifi.PHY == phy && len(ifi.HardwareAddr) == 6 {
+			res[ifi.HardwareAddr.String()] = true
+		}
+	}
+	return res
+}
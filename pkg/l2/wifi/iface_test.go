@@ -0,0 +1,203 @@
+package wifi
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+func attrMap(attrs []netlink.Attribute) map[uint16][]byte {
+	m := map[uint16][]byte{}
+	for _, a := range attrs {
+		m[a.Type] = a.Data
+	}
+	return m
+}
+
+// fakeNL80211 is a fake nl80211 kernel, shared by the Client tests.
+// Requests are recorded, and answered by the handler or the replies set
+// for the command - other commands get an empty reply.
+type fakeNL80211 struct {
+	t    *testing.T
+	sock *fakeSocket
+
+	m        sync.Mutex
+	reqs     []genetlink.Message
+	replies  map[uint8][]genetlink.Message
+	handlers map[uint8]func(greq genetlink.Message, attrs map[uint16][]byte) ([]genetlink.Message, error)
+}
+
+// newFakeNL80211 returns a Client using a fake kernel with the family.
+func newFakeNL80211(t *testing.T, family genetlink.Family) (*Client, *fakeNL80211) {
+	f := &fakeNL80211{t: t, replies: map[uint8][]genetlink.Message{},
+		handlers: map[uint8]func(genetlink.Message, map[uint16][]byte) ([]genetlink.Message, error){}}
+	f.sock = newFakeSocket(f.serve)
+	c := newClientSession(f.sock, family)
+	t.Cleanup(func() { c.Close() })
+	return c, f
+}
+
+// reply sets the replies to the command - dumps and gets.
+func (f *fakeNL80211) reply(cmd uint8, msgs ...genetlink.Message) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.replies[cmd] = msgs
+}
+
+// handle sets the handler of the command. Handlers are called without
+// holding the lock.
+func (f *fakeNL80211) handle(cmd uint8, h func(greq genetlink.Message, attrs map[uint16][]byte) ([]genetlink.Message, error)) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.handlers[cmd] = h
+}
+
+// inject sends an event to the Client.
+func (f *fakeNL80211) inject(msgs ...netlink.Message) {
+	f.sock.Inject(msgs...)
+}
+
+func (f *fakeNL80211) serve(greq genetlink.Message, _ netlink.Message) ([]genetlink.Message, error) {
+	f.m.Lock()
+	f.reqs = append(f.reqs, greq)
+	h := f.handlers[greq.Header.Command]
+	msgs := f.replies[greq.Header.Command]
+	f.m.Unlock()
+	if h != nil {
+		attrs, err := netlink.UnmarshalAttributes(greq.Data)
+		if err != nil {
+			return nil, err
+		}
+		return h(greq, attrMap(attrs))
+	}
+	return msgs, nil
+}
+
+// requests returns the attributes of the requests with the command.
+func (f *fakeNL80211) requests(cmd uint8) []map[uint16][]byte {
+	f.m.Lock()
+	defer f.m.Unlock()
+	res := []map[uint16][]byte{}
+	for _, r := range f.reqs {
+		if r.Header.Command == cmd {
+			attrs, err := netlink.UnmarshalAttributes(r.Data)
+			if err != nil {
+				f.t.Fatal(err)
+			}
+			res = append(res, attrMap(attrs))
+		}
+	}
+	return res
+}
+
+// last returns the attributes of the last request with the command.
+func (f *fakeNL80211) last(cmd uint8) map[uint16][]byte {
+	reqs := f.requests(cmd)
+	if len(reqs) == 0 {
+		f.t.Fatal("Request not sent", cmd)
+	}
+	return reqs[len(reqs)-1]
+}
+
+func TestInterfaceAttrs(t *testing.T) {
+	cfg := InterfaceConfig{Name: "dmeshmon1", PHY: 1, Type: InterfaceTypeMonitor,
+		MonitorFlags: []MonitorFlag{MonitorOtherBSS, MonitorControl}}
+	attrs, err := cfg.attrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := attrMap(attrs)
+	if nlenc.String(m[nl80211.AttrIfname]) != "dmeshmon1" || nlenc.Uint32(m[nl80211.AttrWiphy]) != 1 ||
+		nlenc.Uint32(m[nl80211.AttrIftype]) != nl80211.IftypeMonitor {
+		t.Error("Unexpected attributes", m)
+	}
+	flags, err := netlink.UnmarshalAttributes(m[nl80211.AttrMntrFlags])
+	if err != nil || len(flags) != 2 || flags[0].Type != nl80211.MntrFlagOtherBss ||
+		flags[1].Type != nl80211.MntrFlagControl {
+		t.Error("Unexpected monitor flags", flags, err)
+	}
+
+	// Flags only for monitor
+	cfg = InterfaceConfig{Name: "nan0", Type: InterfaceTypeNAN, MonitorFlags: []MonitorFlag{MonitorActive}}
+	attrs, _ = cfg.attrs()
+	if _, ok := attrMap(attrs)[nl80211.AttrMntrFlags]; ok {
+		t.Error("Monitor flags on NAN interface")
+	}
+	if InterfaceTypeNAN != nl80211.IftypeNan || InterfaceTypeP2PDevice != nl80211.IftypeP2pDevice {
+		t.Error("Interface types don't match nl80211")
+	}
+}
+
+func TestChannelAttrs(t *testing.T) {
+	m := attrMap(channelAttrs(&Interface{Index: 5},
+		&ChannelConfig{Freq: 5180, Width: Width80, CenterFreq1: 5210}))
+	if nlenc.Uint32(m[nl80211.AttrIfindex]) != 5 || nlenc.Uint32(m[nl80211.AttrWiphyFreq]) != 5180 ||
+		nlenc.Uint32(m[nl80211.AttrChannelWidth]) != nl80211.ChanWidth80 ||
+		nlenc.Uint32(m[nl80211.AttrCenterFreq1]) != 5210 {
+		t.Error("Unexpected attributes", m)
+	}
+	if _, ok := m[nl80211.AttrCenterFreq2]; ok {
+		t.Error("Unexpected center freq 2")
+	}
+
+	// No netdev - wdev is used
+	m = attrMap(channelAttrs(&Interface{Device: 0x100000002}, &ChannelConfig{Freq: 2437}))
+	if _, ok := m[nl80211.AttrIfindex]; ok || nlenc.Uint64(m[nl80211.AttrWdev]) != 0x100000002 {
+		t.Error("Expecting wdev", m)
+	}
+}
+
+// ifaceMsg is an interface dump entry.
+func ifaceMsg(t *testing.T, index, phy int, name string, typ uint32, attrs ...netlink.Attribute) genetlink.Message {
+	b, err := netlink.MarshalAttributes(append([]netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(index))},
+		{Type: nl80211.AttrIfname, Data: nlenc.Bytes(name)},
+		{Type: nl80211.AttrWiphy, Data: nlenc.Uint32Bytes(uint32(phy))},
+		{Type: nl80211.AttrIftype, Data: nlenc.Uint32Bytes(typ)}}, attrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdNewInterface, Version: 1}, Data: b}
+}
+
+// After a driver reset the phy has a new index - it is found again by the
+// address of the station interface.
+func TestRestoreInterfaces(t *testing.T) {
+	c, f := newFakeNL80211(t, genetlink.Family{ID: 0x1c, Version: 1, Name: nl80211.GenlName})
+	wlan := netlink.Attribute{Type: nl80211.AttrMac, Data: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}}
+	f.reply(nl80211.CmdGetInterface, ifaceMsg(t, 3, 1, "wlan0", nl80211.IftypeStation, wlan))
+	f.handle(nl80211.CmdNewInterface, func(_ genetlink.Message, m map[uint16][]byte) ([]genetlink.Message, error) {
+		return []genetlink.Message{ifaceMsg(t, 9, int(nlenc.Uint32(m[nl80211.AttrWiphy])),
+			nlenc.String(m[nl80211.AttrIfname]), nlenc.Uint32(m[nl80211.AttrIftype]))}, nil
+	})
+
+	ifi, err := c.CreateInterface(InterfaceConfig{Name: "dmeshmon", PHY: 1, Type: InterfaceTypeMonitor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.reply(nl80211.CmdGetInterface, ifaceMsg(t, 3, 1, "wlan0", nl80211.IftypeStation, wlan),
+		ifaceMsg(t, 9, 1, "dmeshmon", nl80211.IftypeMonitor))
+	if restored, err := c.RestoreInterfaces(); err != nil || len(restored) != 0 {
+		t.Fatal("Unexpected restore", restored, err)
+	}
+
+	f.reply(nl80211.CmdGetInterface, ifaceMsg(t, 4, 2, "wlan0", nl80211.IftypeStation, wlan))
+	restored, err := c.RestoreInterfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0] == ifi || restored[0].PHY != 2 {
+		t.Fatal("Unexpected restore", restored)
+	}
+	if phy := nlenc.Uint32(f.last(nl80211.CmdNewInterface)[nl80211.AttrWiphy]); phy != 2 {
+		t.Error("Created on the old phy", phy)
+	}
+	if m := c.ManagedInterfaces(); len(m) != 1 || m[0] != restored[0] {
+		t.Error("Unexpected managed interfaces", m)
+	}
+}
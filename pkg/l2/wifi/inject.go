@@ -0,0 +1,296 @@
+package wifi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+)
+
+// Frames can also be sent by writing them with a radiotap header to the
+// monitor interface - 'injection'. The kernel doesn't apply the CmdFrame
+// rules: no encryption, any frame type, and it works when CmdFrame is
+// refused - beacons on station interfaces, monitor only setups, or
+// wpa_supplicant holding the frame registrations. The frame is sent on the
+// current channel of the radio, and there is no ACK status - frames for
+// another channel are refused.
+
+const (
+	// injectCookie is set on the cookies of injected frames, so they
+	// don't match the cookies of the kernel.
+	injectCookie = 1 << 63
+
+	// rocStartTimeout is how long an injected frame waits for the
+	// requested ROC to start.
+	rocStartTimeout = 10 * time.Millisecond
+)
+
+var (
+	errNoClient = errors.New("fallback send requires a client")
+
+	// errNotOnChannel is returned for injected frames when the radio is
+	// on another channel.
+	errNotOnChannel = errors.New("radio not on the channel")
+)
+
+// TxParams are the radiotap TX fields of an injected frame. Zero values
+// use the driver defaults. Drivers may ignore the rate and power - most
+// mac80211 drivers honor the rate, no-ack and retries.
+type TxParams struct {
+	// Rate in 500 kbps units - 2 is 1 Mbps, 12 is 6 Mbps.
+	Rate uint8
+
+	// TxPower in dBm.
+	TxPower int8
+
+	// NoAck sends unicast frames without waiting for the ACK.
+	NoAck bool
+
+	// Retries is the max number of retries of unicast frames.
+	Retries uint8
+}
+
+// Radiotap fields and TX flags, from include/net/ieee80211_radiotap.h.
+const (
+	radiotapRate        = 2
+	radiotapDBMTxPower  = 10
+	radiotapTxFlags     = 15
+	radiotapDataRetries = 17
+
+	radiotapTxNoAck = 0x0008
+)
+
+// appendRadiotap appends the radiotap header with the TX params. The
+// fields are in bit order - all are 1 byte except the 2 byte aligned TX
+// flags.
+func appendRadiotap(b []byte, p TxParams) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	present := uint32(0)
+	if p.Rate != 0 {
+		present |= 1 << radiotapRate
+		b = append(b, p.Rate)
+	}
+	if p.TxPower != 0 {
+		present |= 1 << radiotapDBMTxPower
+		b = append(b, byte(p.TxPower))
+	}
+	if p.NoAck {
+		present |= 1 << radiotapTxFlags
+		if (len(b)-start)%2 == 1 {
+			b = append(b, 0)
+		}
+		b = binary.LittleEndian.AppendUint16(b, radiotapTxNoAck)
+	}
+	if p.Retries != 0 {
+		present |= 1 << radiotapDataRetries
+		b = append(b, p.Retries)
+	}
+	binary.LittleEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	binary.LittleEndian.PutUint32(b[start+4:], present)
+	return b
+}
+
+// SendBackend is how frames are sent on an interface.
+type SendBackend int
+
+const (
+	// SendCmdFrame uses CmdFrame, with the TX status from the driver.
+	SendCmdFrame SendBackend = iota
+
+	// SendInject writes the frames to the monitor interface.
+	SendInject
+
+	// SendFallback uses CmdFrame, and injects the frame types the driver
+	// refuses.
+	SendFallback
+)
+
+func (b SendBackend) String() string {
+	switch b {
+	case SendCmdFrame:
+		return "cmdframe"
+	case SendInject:
+		return "inject"
+	case SendFallback:
+		return "fallback"
+	}
+	return "unknown"
+}
+
+// SendBackend picks how frames are sent on the interface. Injection needs
+// a monitor interface on the phy. It is used for all frames if the phy
+// can't send with CmdFrame, the interface is a monitor - CmdFrame is not
+// supported on monitors - or NAN_INJECT=1. Otherwise only the frames
+// refused by CmdFrame are injected.
+func (p *Phy) SendBackend(ifi *Interface) SendBackend {
+	if !p.SupportsType(InterfaceTypeMonitor) {
+		return SendCmdFrame
+	}
+	if injectTx || ifi.Type == InterfaceTypeMonitor || !p.SupportsCommand(nl80211.CmdFrame) {
+		return SendInject
+	}
+	return SendFallback
+}
+
+// Injector sends frames by writing them with a radiotap header to the
+// monitor interface. It implements Driver - remain on channel uses the
+// client, or sets the monitor channel if the phy has no ROC.
+type Injector struct {
+	client *Client
+	mon    *Interface
+	w      io.WriteCloser
+
+	// backend is SendInject or SendFallback.
+	backend SendBackend
+
+	// Params are used for the frames sent without TX params.
+	Params TxParams
+
+	// setChannel is set if the phy can't remain on channel.
+	setChannel bool
+
+	m      sync.Mutex
+	cookie uint64
+
+	// refused has the frame control of the frames refused by CmdFrame,
+	// in fallback mode - EOPNOTSUPP. Other errors, like EINVAL for a bad
+	// frame or channel, are returned and the type is retried.
+	refused map[byte]bool
+}
+
+// NewInjector sends the frames by writing them to w - a packet socket on
+// the monitor, see OpenInjector - or with CmdFrame first for SendFallback.
+// The client may be nil if the injector is only used with Inject and
+// SendInject.
+func NewInjector(c *Client, mon *Interface, w io.WriteCloser, backend SendBackend) (*Injector, error) {
+	if backend == SendFallback && c == nil {
+		return nil, errNoClient
+	}
+	return &Injector{client: c, mon: mon, w: w, backend: backend,
+		refused: map[byte]bool{}}, nil
+}
+
+// NewNanInject starts NAN on the interface, sending frames with the
+// injector.
+func NewNanInject(c *Client, p *Phy, i *Interface, j *Injector) *Nan {
+	j.setChannel = p != nil && !p.SupportsCommand(nl80211.CmdRemainOnChannel)
+	return newClientNan(c, j, i)
+}
+
+// Inject writes the frame to the monitor, with the radiotap header.
+func (j *Injector) Inject(frame []byte, p TxParams) error {
+	if len(frame) < 24 {
+		return errShortFrame
+	}
+	b := appendRadiotap(make([]byte, 0, 16+len(frame)), p)
+	b = append(b, frame...)
+	_, err := j.w.Write(b)
+	return err
+}
+
+// TxFrame sends the frame with the default params.
+func (j *Injector) TxFrame(ifi *Interface, frame []byte, freq, dwell int) (uint64, error) {
+	return j.TxFrameParams(ifi, frame, freq, dwell, j.Params)
+}
+
+// TxFrameParams sends the frame with the TX params. Injected frames are
+// reported to the Nan of the interface as sent, without ACK, and refused
+// if the radio is not on freq. The params are ignored for frames sent
+// with CmdFrame.
+func (j *Injector) TxFrameParams(ifi *Interface, frame []byte, freq, dwell int, p TxParams) (uint64, error) {
+	if j.client != nil {
+		if err := j.client.CheckFreq(ifi.PHY, freq); err != nil {
+			return 0, err
+		}
+	}
+	if j.backend == SendFallback && len(frame) > 0 {
+		j.m.Lock()
+		refused := j.refused[frame[0]]
+		j.m.Unlock()
+		if !refused {
+			cookie, err := j.client.TxFrame(ifi, frame, freq, dwell)
+			if !errors.Is(err, syscall.EOPNOTSUPP) {
+				return cookie, err
+			}
+			log.Println("TX: CmdFrame refused, injecting", ifi.Name, fmt.Sprintf("%02x", frame[0]), err)
+			j.m.Lock()
+			j.refused[frame[0]] = true
+			j.m.Unlock()
+		}
+	}
+
+	if err := j.onChannel(ifi, freq); err != nil {
+		return 0, err
+	}
+	if err := j.Inject(frame, p); err != nil {
+		return 0, err
+	}
+	j.m.Lock()
+	j.cookie++
+	cookie := injectCookie | j.cookie
+	j.m.Unlock()
+	if j.client != nil {
+		if n := j.client.nan(uint32(ifi.Index)); n != nil {
+			n.OnTxSent(cookie)
+		}
+	}
+	return cookie, nil
+}
+
+// onChannel returns an error if the radio is not on freq - the ROC of the
+// interface in progress, else the channel of the monitor or the
+// interface. Without ROC the monitor is moved to freq first.
+func (j *Injector) onChannel(ifi *Interface, freq int) error {
+	if j.client == nil {
+		return nil
+	}
+	cur := 0
+	if n := j.client.nan(uint32(ifi.Index)); n != nil && !j.setChannel {
+		cur = n.rocChannel(rocStartTimeout)
+	}
+	if cur == 0 {
+		cur = j.channel(ifi)
+	}
+	if cur == freq {
+		return nil
+	}
+	if j.setChannel {
+		return j.client.SetChannel(j.mon, ChannelConfig{Freq: freq})
+	}
+	return fmt.Errorf("%w: %d, on %d", errNotOnChannel, freq, cur)
+}
+
+// channel returns the current channel of the monitor, or of the interface
+// if the driver doesn't report it for the monitor. 0 if unknown.
+func (j *Injector) channel(ifi *Interface) int {
+	for _, i := range []*Interface{j.mon, ifi} {
+		if cur, err := j.client.InterfaceByIndex(i.Index); err == nil && cur.Frequency != 0 {
+			return cur.Frequency
+		}
+	}
+	return 0
+}
+
+// RemainOnChannel listens on the channel. Without ROC support the monitor
+// is moved to the channel, until the next call - there is no cookie.
+func (j *Injector) RemainOnChannel(ifi *Interface, freq, dur int) (uint64, error) {
+	if !j.setChannel {
+		return j.client.RemainOnChannel(ifi, freq, dur)
+	}
+	if ch := j.client.ChannelInfo(ifi.PHY, freq); !ch.Allowed {
+		return 0, fmt.Errorf("%w: %d", errFreqNotAllowed, freq)
+	}
+	return 0, j.client.SetChannel(j.mon, ChannelConfig{Freq: freq})
+}
+
+// Close closes the monitor socket.
+func (j *Injector) Close() error {
+	return j.w.Close()
+}
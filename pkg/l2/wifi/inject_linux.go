@@ -0,0 +1,51 @@
+package wifi
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetConn is a raw packet socket bound to an interface.
+type packetConn struct {
+	fd int
+}
+
+func (p *packetConn) Write(b []byte) (int, error) {
+	return unix.Write(p.fd, b)
+}
+
+func (p *packetConn) Close() error {
+	return unix.Close(p.fd)
+}
+
+// OpenInjector opens a raw packet socket on the monitor interface, for
+// injecting frames. Requires CAP_NET_RAW.
+func OpenInjector(c *Client, mon *Interface, backend SendBackend) (*Injector, error) {
+	proto := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(proto))
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{
+		Protocol: proto,
+		Ifindex:  mon.Index,
+	})
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	j, err := NewInjector(c, mon, &packetConn{fd: fd}, backend)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return j, nil
+}
+
+// htons converts to network byte order, on any host.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,267 @@
+package wifi
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// monWriter records the frames written to the monitor.
+type monWriter struct {
+	m      sync.Mutex
+	frames [][]byte
+}
+
+func (w *monWriter) Write(b []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.frames = append(w.frames, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (w *monWriter) Close() error { return nil }
+
+func (w *monWriter) packets(t *testing.T) []gopacket.Packet {
+	w.m.Lock()
+	defer w.m.Unlock()
+	var res []gopacket.Packet
+	for _, f := range w.frames {
+		p := gopacket.NewPacket(f, layers.LayerTypeRadioTap, gopacket.Default)
+		if p.ErrorLayer() != nil {
+			t.Fatal("Invalid frame", p)
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+func TestRadiotapTx(t *testing.T) {
+	if b := appendRadiotap(nil, TxParams{}); len(b) != 8 || b[2] != 8 {
+		t.Error("Unexpected empty header", b)
+	}
+
+	// The decoder aligns the TX flags - the rate makes them unaligned.
+	frame := appendMgmtHeader(nil, 0xd0, broadcastAddr, broadcastAddr)
+	for _, p := range []TxParams{
+		{Rate: 12, TxPower: 10, NoAck: true, Retries: 3},
+		{Rate: 12, NoAck: true},
+		{NoAck: true},
+		{TxPower: -5, Retries: 1},
+	} {
+		b := append(appendRadiotap(nil, p), frame...)
+		pkt := gopacket.NewPacket(b, layers.LayerTypeRadioTap, gopacket.Default)
+		rt, ok := pkt.Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+		if !ok || pkt.Layer(layers.LayerTypeDot11) == nil {
+			t.Fatal("Not decoded", p, pkt)
+		}
+		if uint8(rt.Rate) != p.Rate || rt.DBMTxPower != p.TxPower ||
+			rt.TxFlags.NoACK() != p.NoAck || rt.DataRetries != p.Retries {
+			t.Error("Unexpected radiotap", p, rt)
+		}
+	}
+}
+
+// onChannel makes the fake kernel report the interfaces on freq.
+func onChannel(f *fakeNL80211, freq int) {
+	f.handle(nl80211.CmdGetInterface, func(greq genetlink.Message, attrs map[uint16][]byte) ([]genetlink.Message, error) {
+		b, _ := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: nl80211.AttrIfindex, Data: attrs[nl80211.AttrIfindex]},
+			{Type: nl80211.AttrWiphyFreq, Data: nlenc.Uint32Bytes(uint32(freq))},
+		})
+		return []genetlink.Message{{Header: greq.Header, Data: b}}, nil
+	})
+}
+
+func TestInjector(t *testing.T) {
+	c, f := newFakeClient(t)
+	onChannel(f, NANFreq)
+	w := &monWriter{}
+	j, err := NewInjector(c, &Interface{Index: 9, Name: "dmeshmon"}, w, SendInject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Params = TxParams{Rate: 12}
+	ifi := &Interface{Index: 3, Name: "wlan0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 3}}
+	n := NewNanInject(c, nil, ifi, j)
+	defer n.Close()
+
+	results := make(chan TxResult, 2)
+	done := func(r TxResult) { results <- r }
+	peer := net.HardwareAddr{2, 0, 0, 0, 0, 4}
+	if err := n.SendFrame(appendMgmtHeader(nil, 0xd0, broadcastAddr, broadcastAddr), NANFreq, 0, done); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SendFrameParams(appendMgmtHeader(nil, 0xd0, peer, broadcastAddr), NANFreq, 0,
+		TxParams{Rate: 2, NoAck: true, Retries: 2}, done); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.Status != TxSent || r.Cookie&injectCookie == 0 {
+				t.Error("Unexpected result", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout")
+		}
+	}
+
+	pkts := w.packets(t)
+	if len(pkts) != 2 {
+		t.Fatal("Unexpected frames", len(pkts))
+	}
+	rt := pkts[0].Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+	d11 := pkts[0].Layer(layers.LayerTypeDot11).(*layers.Dot11)
+	if rt.Rate != 12 || rt.TxFlags.NoACK() || d11.Address2.String() != ifi.HardwareAddr.String() {
+		t.Error("Unexpected broadcast", rt, d11)
+	}
+	rt = pkts[1].Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+	d11 = pkts[1].Layer(layers.LayerTypeDot11).(*layers.Dot11)
+	if rt.Rate != 2 || !rt.TxFlags.NoACK() || rt.DataRetries != 2 ||
+		d11.Address1.String() != peer.String() {
+		t.Error("Unexpected unicast", rt, d11)
+	}
+
+	if err := j.Inject([]byte{0x80, 0}, TxParams{}); err != errShortFrame {
+		t.Error("Expecting short frame error", err)
+	}
+}
+
+// Beacons refused by CmdFrame are injected, other frames are sent with
+// CmdFrame.
+func TestInjectorFallback(t *testing.T) {
+	if _, err := NewInjector(nil, &Interface{Index: 9, Name: "dmeshmon"}, &monWriter{}, SendFallback); err != errNoClient {
+		t.Error("Expecting fallback without client to fail", err)
+	}
+
+	c, f := newFakeNL80211(t, fakeFamily)
+	onChannel(f, NANFreq)
+	f.handle(nl80211.CmdFrame, func(greq genetlink.Message, attrs map[uint16][]byte) ([]genetlink.Message, error) {
+		switch attrs[nl80211.AttrFrame][0] {
+		case 0x80:
+			return nil, syscall.EOPNOTSUPP
+		case 0x40:
+			return nil, syscall.EINVAL
+		}
+		b, _ := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(42)},
+		})
+		return []genetlink.Message{{Header: greq.Header, Data: b}}, nil
+	})
+	w := &monWriter{}
+	j, err := NewInjector(c, &Interface{Index: 9, Name: "dmeshmon"}, w, SendFallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifi := &Interface{Index: 3, Name: "wlan0"}
+
+	beacon := appendMgmtHeader(nil, 0x80, broadcastAddr, broadcastAddr)
+	for i := 0; i < 2; i++ {
+		if cookie, err := j.TxFrame(ifi, beacon, NANFreq, 0); err != nil || cookie&injectCookie == 0 {
+			t.Fatal("Beacon not injected", cookie, err)
+		}
+	}
+	action := appendMgmtHeader(nil, 0xd0, broadcastAddr, broadcastAddr)
+	if cookie, err := j.TxFrame(ifi, action, NANFreq, 0); err != nil || cookie != 42 {
+		t.Fatal("Action not sent with CmdFrame", cookie, err)
+	}
+	// Other errors are returned, and the frame type is not injected.
+	probe := appendMgmtHeader(nil, 0x40, broadcastAddr, broadcastAddr)
+	for i := 0; i < 2; i++ {
+		if _, err := j.TxFrame(ifi, probe, NANFreq, 0); !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("Expecting EINVAL", err)
+		}
+	}
+	sent := f.requests(nl80211.CmdFrame)
+	if len(sent) != 4 || sent[0][nl80211.AttrFrame][0] != 0x80 || sent[1][nl80211.AttrFrame][0] != 0xd0 ||
+		sent[3][nl80211.AttrFrame][0] != 0x40 {
+		t.Error("Unexpected CmdFrame requests", len(sent))
+	}
+	if len(w.packets(t)) != 2 {
+		t.Error("Unexpected injected frames", len(w.frames))
+	}
+}
+
+// Injected frames go out on the current channel - frames for another
+// channel are refused, the ROC in progress is the current channel. Without
+// ROC the monitor is moved to the channel.
+func TestInjectorChannel(t *testing.T) {
+	c, f := newFakeNL80211(t, fakeFamily)
+	onChannel(f, 2412)
+	f.handle(nl80211.CmdRemainOnChannel, func(greq genetlink.Message, _ map[uint16][]byte) ([]genetlink.Message, error) {
+		b, _ := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(7)},
+		})
+		return []genetlink.Message{{Header: greq.Header, Data: b}}, nil
+	})
+	mon := &Interface{Index: 9, Name: "dmeshmon"}
+	j, err := NewInjector(c, mon, &monWriter{}, SendInject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifi := &Interface{Index: 3, Name: "wlan0"}
+	n := NewNanInject(c, nil, ifi, j)
+	defer n.Close()
+	frame := appendMgmtHeader(nil, 0xd0, broadcastAddr, broadcastAddr)
+
+	if _, err := j.TxFrame(ifi, frame, NANFreq, 0); !errors.Is(err, errNotOnChannel) {
+		t.Error("Expecting frame refused off channel", err)
+	}
+	if _, err := j.TxFrame(ifi, frame, 2412, 0); err != nil {
+		t.Error("Frame on the monitor channel", err)
+	}
+
+	n.remainOnChannel(NANFreq, 50)
+	c.dispatch(&RemainOnChannelStarted{EventHeader: EventHeader{Ifindex: 3}, Cookie: 7,
+		Freq: NANFreq, Duration: time.Second}, 0)
+	if _, err := j.TxFrame(ifi, frame, NANFreq, 0); err != nil {
+		t.Error("Frame in the ROC", err)
+	}
+	if _, err := j.TxFrame(ifi, frame, 2412, 0); !errors.Is(err, errNotOnChannel) {
+		t.Error("Expecting frame refused during the ROC", err)
+	}
+	c.dispatch(&RemainOnChannelCancelled{EventHeader: EventHeader{Ifindex: 3}, Cookie: 7, Freq: NANFreq}, 0)
+	if _, err := j.TxFrame(ifi, frame, NANFreq, 0); !errors.Is(err, errNotOnChannel) {
+		t.Error("Expecting frame refused after the ROC", err)
+	}
+
+	// No ROC - the monitor is moved.
+	j.setChannel = true
+	if _, err := j.TxFrame(ifi, frame, 5180, 0); err != nil {
+		t.Fatal(err)
+	}
+	if a := f.last(nl80211.CmdSetWiphy); a == nil || nlenc.Uint32(a[nl80211.AttrWiphyFreq]) != 5180 {
+		t.Error("Monitor not moved", a)
+	}
+}
+
+func TestSendBackend(t *testing.T) {
+	sta := &Interface{Name: "wlan0", Type: InterfaceTypeStation}
+	mon := &Interface{Name: "dmeshmon", Type: InterfaceTypeMonitor}
+	p := &Phy{InterfaceTypes: []InterfaceType{InterfaceTypeStation},
+		Commands: []uint8{nl80211.CmdFrame, nl80211.CmdRemainOnChannel}}
+	if b := p.SendBackend(sta); b != SendCmdFrame {
+		t.Error("Expecting CmdFrame without monitor", b)
+	}
+	p.InterfaceTypes = append(p.InterfaceTypes, InterfaceTypeMonitor)
+	if b := p.SendBackend(sta); b != SendFallback {
+		t.Error("Expecting fallback", b)
+	}
+	if b := p.SendBackend(mon); b != SendInject {
+		t.Error("Expecting injection on monitor", b)
+	}
+	p.Commands = nil
+	if b := p.SendBackend(sta); b != SendInject {
+		t.Error("Expecting injection without CmdFrame", b)
+	}
+}
@@ -0,0 +1,218 @@
+package wifi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// 802.11s mesh point. The kernel (mac80211) does the peering and the HWMP
+// path selection - the mesh interface is a regular netdev, frames to any
+// mesh node are forwarded over multiple hops. The peers are stations on
+// the interface, and the paths are read with GetMpath.
+//
+// Only open meshes are supported - secure mesh (SAE) requires user space
+// peering.
+
+var errMeshID = errors.New("mesh ID must be 1-32 bytes")
+
+// PeerLinkState is the state of the peering with a mesh station.
+type PeerLinkState uint8
+
+const (
+	PeerLinkListen   PeerLinkState = nl80211.PlinkListen
+	PeerLinkOpenSent PeerLinkState = nl80211.PlinkOpnSnt
+	PeerLinkOpenRcvd PeerLinkState = nl80211.PlinkOpnRcvd
+	PeerLinkCnfRcvd  PeerLinkState = nl80211.PlinkCnfRcvd
+	PeerLinkEstab    PeerLinkState = nl80211.PlinkEstab
+	PeerLinkHolding  PeerLinkState = nl80211.PlinkHolding
+	PeerLinkBlocked  PeerLinkState = nl80211.PlinkBlocked
+)
+
+func (s PeerLinkState) String() string {
+	switch s {
+	case PeerLinkListen:
+		return "listen"
+	case PeerLinkOpenSent:
+		return "open-sent"
+	case PeerLinkOpenRcvd:
+		return "open-rcvd"
+	case PeerLinkCnfRcvd:
+		return "cnf-rcvd"
+	case PeerLinkEstab:
+		return "estab"
+	case PeerLinkHolding:
+		return "holding"
+	case PeerLinkBlocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("plink-%d", uint8(s))
+}
+
+// MeshConfig is the mesh to join. All nodes must use the same ID and
+// channel.
+type MeshConfig struct {
+	MeshID string
+
+	ChannelConfig
+
+	// MaxPeerLinks limits the number of peers - kernel default if 0.
+	MaxPeerLinks int
+}
+
+// MeshPath is a path to a mesh node, from the HWMP path selection.
+type MeshPath struct {
+	Dest    net.HardwareAddr
+	NextHop net.HardwareAddr
+
+	// Metric is the airtime metric of the path - lower is better.
+	Metric int
+
+	// Sn is the sequence number of the destination.
+	Sn uint32
+
+	// Expires is the time until the path expires, if not refreshed.
+	Expires time.Duration
+
+	// QueueLen is the number of frames waiting for the path.
+	QueueLen int
+
+	// Flags are the nl80211.MpathFlag* flags.
+	Flags uint8
+}
+
+// Active returns true if the path can be used.
+func (p *MeshPath) Active() bool {
+	return p.Flags&nl80211.MpathFlagActive != 0
+}
+
+// Direct returns true if the destination is a peer.
+func (p *MeshPath) Direct() bool {
+	return p.Dest.String() == p.NextHop.String()
+}
+
+// MeshPathChanged is published by the StationWatcher when a path on a mesh
+// interface is added or removed, or the next hop changes.
+type MeshPathChanged struct {
+	EventHeader
+	Path MeshPath
+
+	// Removed is set if the path no longer exists.
+	Removed bool
+}
+
+// JoinMesh joins the mesh on the interface - created with type
+// InterfaceTypeMeshPoint, and up. The mesh is joined again by
+// RestoreInterfaces.
+func (c *Client) JoinMesh(ifi *Interface, cfg MeshConfig) error {
+	if len(cfg.MeshID) == 0 || len(cfg.MeshID) > 32 {
+		return errMeshID
+	}
+	// Mesh beacons are sent on the channel - same rules as a GO.
+	if err := c.CheckFreq(ifi.PHY, cfg.Freq); err != nil {
+		return err
+	}
+	attrs := append(channelAttrs(ifi, &cfg.ChannelConfig), netlink.Attribute{
+		Type: nl80211.AttrMeshId,
+		Data: []byte(cfg.MeshID),
+	})
+	if cfg.MaxPeerLinks > 0 {
+		b, err := netlink.MarshalAttributes([]netlink.Attribute{{
+			Type: nl80211.MeshconfMaxPeerLinks,
+			Data: nlenc.Uint16Bytes(uint16(cfg.MaxPeerLinks)),
+		}})
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrMeshConfig, Data: b})
+	}
+	if _, err := c.execute(nl80211.CmdJoinMesh, attrs, netlink.Request|netlink.Acknowledge); err != nil {
+		return fmt.Errorf("join mesh %s: %w", cfg.MeshID, err)
+	}
+	log.Println("MESH: joined", ifi.Name, cfg.MeshID, cfg.Freq)
+	c.m.Lock()
+	if m := c.managed[ifi.Name]; m != nil {
+		m.mesh = &cfg
+	}
+	c.m.Unlock()
+	return nil
+}
+
+// LeaveMesh leaves the mesh joined on the interface.
+func (c *Client) LeaveMesh(ifi *Interface) error {
+	if _, err := c.execute(nl80211.CmdLeaveMesh, ifi.wdevAttrs(), netlink.Request|netlink.Acknowledge); err != nil {
+		return err
+	}
+	c.m.Lock()
+	if m := c.managed[ifi.Name]; m != nil {
+		m.mesh = nil
+	}
+	c.m.Unlock()
+	return nil
+}
+
+// MeshPaths returns the paths known on the mesh interface.
+func (c *Client) MeshPaths(ifi *Interface) ([]*MeshPath, error) {
+	msgs, err := c.execute(nl80211.CmdGetMpath, ifi.wdevAttrs(), netlink.Request|netlink.Dump)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkMessages(msgs, nl80211.CmdNewMpath); err != nil {
+		return nil, err
+	}
+	res := []*MeshPath{}
+	for _, m := range msgs {
+		p, err := parseMeshPath(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func parseMeshPath(b []byte) (*MeshPath, error) {
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return nil, err
+	}
+	p := &MeshPath{}
+	for _, a := range attrs {
+		switch a.Type {
+		case nl80211.AttrMac:
+			p.Dest = net.HardwareAddr(a.Data)
+		case nl80211.AttrMpathNextHop:
+			p.NextHop = net.HardwareAddr(a.Data)
+		case nl80211.AttrMpathInfo:
+			iattrs, err := netlink.UnmarshalAttributes(a.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, ia := range iattrs {
+				switch ia.Type {
+				case nl80211.MpathInfoFrameQlen:
+					p.QueueLen = int(nlenc.Uint32(ia.Data))
+				case nl80211.MpathInfoSn:
+					p.Sn = nlenc.Uint32(ia.Data)
+				case nl80211.MpathInfoMetric:
+					p.Metric = int(nlenc.Uint32(ia.Data))
+				case nl80211.MpathInfoExptime:
+					p.Expires = time.Duration(nlenc.Uint32(ia.Data)) * time.Millisecond
+				case nl80211.MpathInfoFlags:
+					p.Flags = nlenc.Uint8(ia.Data)
+				}
+			}
+		}
+	}
+	if p.Dest == nil {
+		return nil, os.ErrNotExist
+	}
+	return p, nil
+}
@@ -0,0 +1,196 @@
+package wifi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+var staC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0c}
+
+func mpathMsg(t *testing.T, dest, next net.HardwareAddr, metric int, flags uint8) genetlink.Message {
+	return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdNewMpath, Version: 1},
+		Data: nested(t,
+			netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(5)},
+			netlink.Attribute{Type: nl80211.AttrMac, Data: dest},
+			netlink.Attribute{Type: nl80211.AttrMpathNextHop, Data: next},
+			netlink.Attribute{Type: nl80211.AttrMpathInfo, Data: nested(t,
+				netlink.Attribute{Type: nl80211.MpathInfoSn, Data: u32(7)},
+				netlink.Attribute{Type: nl80211.MpathInfoMetric, Data: u32(metric)},
+				netlink.Attribute{Type: nl80211.MpathInfoExptime, Data: u32(2000)},
+				netlink.Attribute{Type: nl80211.MpathInfoFlags, Data: []byte{flags}})})}
+}
+
+func meshStaMsg(t *testing.T, mac net.HardwareAddr, plink PeerLinkState) genetlink.Message {
+	return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdNewStation, Version: 1},
+		Data: nested(t,
+			netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(5)},
+			netlink.Attribute{Type: nl80211.AttrMac, Data: mac},
+			netlink.Attribute{Type: nl80211.AttrStaInfo, Data: nested(t,
+				netlink.Attribute{Type: nl80211.StaInfoSignal, Data: []byte{0xc9}}, // -55 dBm
+				netlink.Attribute{Type: nl80211.StaInfoPlinkState, Data: []byte{byte(plink)}})})}
+}
+
+// newFakeMesh returns a Client using a fake kernel with a mesh interface,
+// where the stations and paths are set by the test.
+func newFakeMesh(t *testing.T, sta, paths []genetlink.Message) (*Client, *fakeNL80211) {
+	c, f := newFakeNL80211(t, mlmeFamily)
+	f.handle(nl80211.CmdNewInterface, func(_ genetlink.Message, m map[uint16][]byte) ([]genetlink.Message, error) {
+		return []genetlink.Message{{Header: genetlink.Header{Command: nl80211.CmdNewInterface, Version: 1},
+			Data: nested(t,
+				netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(5)},
+				netlink.Attribute{Type: nl80211.AttrIfname, Data: m[nl80211.AttrIfname]},
+				netlink.Attribute{Type: nl80211.AttrWiphy, Data: m[nl80211.AttrWiphy]},
+				netlink.Attribute{Type: nl80211.AttrIftype, Data: m[nl80211.AttrIftype]})}}, nil
+	})
+	f.reply(nl80211.CmdGetStation, sta...)
+	f.reply(nl80211.CmdGetMpath, paths...)
+	return c, f
+}
+
+func TestParseMeshPath(t *testing.T) {
+	p, err := parseMeshPath(mpathMsg(t, staB, staA, 300, nl80211.MpathFlagActive|nl80211.MpathFlagSnValid).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Dest.String() != staB.String() || p.NextHop.String() != staA.String() || p.Metric != 300 ||
+		p.Sn != 7 || p.Expires != 2*time.Second || !p.Active() || p.Direct() {
+		t.Error("Unexpected path", p)
+	}
+	if _, err := parseMeshPath(nil); err == nil {
+		t.Error("Expecting error for path without destination")
+	}
+}
+
+func TestJoinMesh(t *testing.T) {
+	c, f := newFakeMesh(t, nil, nil)
+
+	ifi, err := c.CreateInterface(InterfaceConfig{Name: "dmmesh0", PHY: 1, Type: InterfaceTypeMeshPoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.JoinMesh(ifi, MeshConfig{}); !errors.Is(err, errMeshID) {
+		t.Error("Expecting mesh ID error", err)
+	}
+	cfg := MeshConfig{MeshID: "dmesh", ChannelConfig: ChannelConfig{Freq: 2437, Width: Width20},
+		MaxPeerLinks: 8}
+	if err := c.JoinMesh(ifi, cfg); err != nil {
+		t.Fatal(err)
+	}
+	joins := f.requests(nl80211.CmdJoinMesh)
+	if len(joins) != 1 {
+		t.Fatal("Mesh not joined")
+	}
+	m := joins[0]
+	if string(m[nl80211.AttrMeshId]) != "dmesh" || nlenc.Uint32(m[nl80211.AttrWiphyFreq]) != 2437 ||
+		nlenc.Uint32(m[nl80211.AttrIfindex]) != 5 {
+		t.Error("Unexpected join", m)
+	}
+	conf, err := netlink.UnmarshalAttributes(m[nl80211.AttrMeshConfig])
+	if err != nil || len(conf) != 1 || conf[0].Type != nl80211.MeshconfMaxPeerLinks ||
+		nlenc.Uint16(conf[0].Data) != 8 {
+		t.Error("Unexpected mesh config", conf, err)
+	}
+
+	// Interface lost - re-created and joined again
+	if _, err := c.RestoreInterfaces(); err != nil {
+		t.Fatal(err)
+	}
+	joins = f.requests(nl80211.CmdJoinMesh)
+	if len(joins) != 2 || string(joins[1][nl80211.AttrMeshId]) != "dmesh" {
+		t.Error("Mesh not joined after restore", len(joins))
+	}
+
+	if err := c.LeaveMesh(ifi); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RestoreInterfaces(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.requests(nl80211.CmdJoinMesh)) != 2 {
+		t.Error("Mesh joined after leave")
+	}
+}
+
+func TestStationWatcherMesh(t *testing.T) {
+	c, f := newFakeMesh(t,
+		[]genetlink.Message{meshStaMsg(t, staA, PeerLinkEstab), meshStaMsg(t, staC, PeerLinkOpenSent)},
+		[]genetlink.Message{mpathMsg(t, staA, staA, 100, nl80211.MpathFlagActive),
+			mpathMsg(t, staB, staA, 300, nl80211.MpathFlagActive)})
+
+	sub := c.Events.Subscribe(SubscribeOptions{Kinds: []EventKind{KindStationStats, KindMeshPath}})
+	next := func() Event {
+		select {
+		case ev := <-sub.C:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for event")
+		}
+		return nil
+	}
+
+	w := NewStationWatcher(c)
+	w.Interval = time.Hour
+	w.Add(&Interface{Index: 5, PHY: 1, Type: InterfaceTypeMeshPoint})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	stats := map[string]*StationStats{}
+	paths := map[string]*MeshPathChanged{}
+	for i := 0; i < 4; i++ {
+		switch e := next().(type) {
+		case *StationStats:
+			stats[e.MAC.String()] = e
+		case *MeshPathChanged:
+			paths[e.Path.Dest.String()] = e
+		}
+	}
+	if s := stats[staA.String()]; s == nil || !s.Mesh || s.PeerLink != PeerLinkEstab || s.Quality != LinkGood {
+		t.Error("Unexpected peer", s)
+	}
+	if s := stats[staC.String()]; s == nil || s.Quality != LinkPoor {
+		t.Error("Unexpected peer", s)
+	}
+	if p := paths[staA.String()]; p == nil || !p.Path.Direct() {
+		t.Error("Unexpected path", p)
+	}
+	if p := paths[staB.String()]; p == nil || p.Path.NextHop.String() != staA.String() || p.Removed {
+		t.Error("Unexpected path", p)
+	}
+
+	// C is established, and B is now reached through C. The path to A
+	// expired.
+	f.reply(nl80211.CmdGetStation, meshStaMsg(t, staA, PeerLinkEstab), meshStaMsg(t, staC, PeerLinkEstab))
+	f.reply(nl80211.CmdGetMpath, mpathMsg(t, staB, staC, 200, nl80211.MpathFlagActive))
+	w.poke()
+	stats = map[string]*StationStats{}
+	paths = map[string]*MeshPathChanged{}
+	for i := 0; i < 3; i++ {
+		switch e := next().(type) {
+		case *StationStats:
+			stats[e.MAC.String()] = e
+		case *MeshPathChanged:
+			paths[e.Path.Dest.String()] = e
+		}
+	}
+	if s := stats[staC.String()]; s == nil || s.Quality != LinkGood {
+		t.Error("Unexpected peer", s)
+	}
+	if p := paths[staB.String()]; p == nil || p.Path.NextHop.String() != staC.String() {
+		t.Error("Unexpected path", p)
+	}
+	if p := paths[staA.String()]; p == nil || !p.Removed {
+		t.Error("Unexpected path", p)
+	}
+	if len(w.Paths()) != 1 {
+		t.Error("Unexpected paths", w.Paths())
+	}
+}
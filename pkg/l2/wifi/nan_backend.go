@@ -0,0 +1,109 @@
+package wifi
+
+import (
+	"context"
+	"log"
+	"net"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+)
+
+// NanBackend runs NAN discovery and messaging on a phy. There are 2
+// implementations:
+//
+// - Nan emulates NAN in user space - sync and SDFs are sent with CmdFrame
+// and remain on channel, beacons received on the monitor interface.
+//
+// - NanOffload uses the NAN implementation in the driver or firmware, with
+// StartNan and AddNanFunction. The firmware stays synchronized with the
+// cluster while the station is connected.
+//
+// NewNanBackend picks one based on the phy capabilities.
+type NanBackend interface {
+	// Start starts discovery, until ctx is done or Close is called.
+	Start(ctx context.Context) error
+
+	// AddService publishes or subscribes, returns the instance ID.
+	AddService(s *nan.Service) (uint8, error)
+
+	// RemoveService cancels a publish or subscribe.
+	RemoveService(instanceID uint8) error
+
+	// SendFollowup sends a single dmesh follow-up to the peer instance.
+	// freq is ignored by the offload - the firmware uses the peer schedule.
+	SendFollowup(to []byte, toPort byte, freq int, sdu []byte) error
+
+	// SendMessage sends a reliable message to the peer, using Link. done,
+	// if not nil, is called with the delivery result.
+	SendMessage(to net.HardwareAddr, data []byte, done func(error)) error
+
+	// Interface used for NAN - for the offload a NAN interface with no
+	// netdev.
+	Interface() *Interface
+
+	Close()
+}
+
+var (
+	_ NanBackend = &Nan{}
+	_ NanBackend = &NanOffload{}
+)
+
+// NewNanBackend returns the NAN backend for the interface. The offload is
+// used if the phy supports it and emulate is false - a NAN interface is
+// created on the phy. Otherwise NAN is emulated on the interface, and the
+// frames are sent with the backend picked by Phy.SendBackend - injected on
+// the monitor mon, if not nil.
+func NewNanBackend(c *Client, p *Phy, ifi, mon *Interface, emulate bool) (NanBackend, error) {
+	if emulate || p == nil || !p.NANOffload() {
+		return newNanEmulated(c, p, ifi, mon), nil
+	}
+	o, err := NewNanOffloadPhy(c, p.PHY)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// newNanEmulated returns the user space NAN, sending with CmdFrame or the
+// injector on the monitor.
+func newNanEmulated(c *Client, p *Phy, ifi, mon *Interface) *Nan {
+	if p == nil || mon == nil {
+		return NewNan(c, ifi)
+	}
+	backend := p.SendBackend(ifi)
+	if backend == SendCmdFrame {
+		return NewNan(c, ifi)
+	}
+	j, err := OpenInjector(c, mon, backend)
+	if err != nil {
+		log.Println("NAN: injection not available, using CmdFrame", ifi.Name, mon.Name, err)
+		return NewNan(c, ifi)
+	}
+	log.Println("NAN: send backend", ifi.Name, backend, mon.Name)
+	return NewNanInject(c, p, ifi, j)
+}
+
+// Start runs the DW loop in the background.
+func (c *Nan) Start(ctx context.Context) error {
+	go c.RunDW(ctx)
+	return nil
+}
+
+// AddService adds the service to the SDFs sent in the DW.
+func (c *Nan) AddService(s *nan.Service) (uint8, error) {
+	return c.Services.Add(s)
+}
+
+func (c *Nan) RemoveService(instanceID uint8) error {
+	c.Services.Remove(instanceID)
+	return nil
+}
+
+func (c *Nan) SendMessage(to net.HardwareAddr, data []byte, done func(error)) error {
+	return c.Link.Send(to, data, done)
+}
+
+func (c *Nan) Interface() *Interface {
+	return c.IFace
+}
@@ -0,0 +1,447 @@
+package wifi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// NAN offload - the driver or firmware implements sync, DW scheduling and
+// SDFs. User space registers publish, subscribe and follow-up 'functions'
+// on a NAN interface, and receives matches and follow-ups as CmdNanMatch
+// events on the "nan" group.
+
+var (
+	errNoDmeshPublish = errors.New("dmesh publish not registered")
+	errNoNanReply     = errors.New("no NAN function in reply")
+)
+
+// dwInterval is the time between DWs - 512 TU. Used for the function TTL,
+// which is in DWs.
+const dwInterval = 512 * 1024 * time.Microsecond
+
+// nanFunction is a function registered with the driver.
+type nanFunction struct {
+	cookie   uint64
+	instance uint8
+	svc      *nan.Service
+
+	// Instance ID in Services - may be different from the driver ID.
+	local uint8
+}
+
+// NanOffload is the NanBackend using the driver NAN implementation.
+type NanOffload struct {
+	IFace *Interface
+
+	// Services registered with the driver.
+	Services *nan.Services
+
+	// Link sends reliable messages to dmesh peers, using follow-ups.
+	Link *nan.Link
+
+	// MasterPref is sent to the driver in StartNan.
+	MasterPref uint8
+
+	// Bands is a bitmap of 1<<Band*, 0 for the driver default.
+	Bands uint32
+
+	c *Client
+
+	m sync.Mutex
+
+	// Functions by driver instance ID.
+	funcs map[uint8]*nanFunction
+
+	// Instance IDs of the dmesh publish of peers.
+	peerInstances map[string]uint8
+
+	started bool
+	sub     *Subscription
+}
+
+// NewNanOffloadPhy creates a NAN interface on the phy, and returns a
+// stopped offload backend.
+func NewNanOffloadPhy(c *Client, phy int) (*NanOffload, error) {
+	name := "dmeshnan"
+	if phy != 0 {
+		name = "dmeshnan" + strconv.Itoa(phy)
+	}
+	ifi, err := c.CreateInterface(InterfaceConfig{
+		Name: name,
+		PHY:  phy,
+		Type: InterfaceTypeNAN,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewNanOffload(c, ifi), nil
+}
+
+// NewNanOffload returns the offload backend for an existing NAN interface.
+func NewNanOffload(c *Client, ifi *Interface) *NanOffload {
+	o := &NanOffload{
+		IFace:         ifi,
+		Services:      nan.NewServices(),
+		MasterPref:    masterPreference,
+		c:             c,
+		funcs:         map[uint8]*nanFunction{},
+		peerInstances: map[string]uint8{},
+	}
+	o.Link = nan.NewLink(o.sendLinkFrame)
+	return o
+}
+
+func (o *NanOffload) Interface() *Interface {
+	return o.IFace
+}
+
+// Start joins or starts a cluster, and handles the match events until ctx
+// is done. Services added before Start are registered with the driver.
+func (o *NanOffload) Start(ctx context.Context) error {
+	attrs := append(o.IFace.wdevAttrs(), netlink.Attribute{
+		Type: nl80211.AttrNanMasterPref,
+		Data: []byte{o.MasterPref},
+	})
+	if o.Bands != 0 {
+		// Renamed to NL80211_ATTR_BANDS, a u32 bitmap, in newer kernels.
+		attrs = append(attrs, netlink.Attribute{
+			Type: nl80211.AttrNanDual,
+			Data: nlenc.Uint32Bytes(o.Bands),
+		})
+	}
+	if _, err := o.c.execute(nl80211.CmdStartNan, attrs, netlink.Request|netlink.Acknowledge); err != nil {
+		return err
+	}
+
+	wdev := uint64(o.IFace.Device)
+	sub := o.c.Events.Subscribe(SubscribeOptions{
+		Kinds: []EventKind{KindNanMatch, KindNanTerminated},
+		Match: func(ev Event) bool {
+			return ev.Header().Wdev == wdev
+		},
+	})
+
+	o.m.Lock()
+	o.started = true
+	o.sub = sub
+	o.m.Unlock()
+
+	for _, s := range o.Services.List() {
+		if _, err := o.addFunction(s, s.InstanceID()); err != nil {
+			log.Println("NAN offload: add", s.Name, err)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		o.Close()
+	}()
+	go o.handleEvents(sub)
+	return nil
+}
+
+// Close stops NAN - the functions are removed by the driver.
+func (o *NanOffload) Close() {
+	o.m.Lock()
+	if !o.started {
+		o.m.Unlock()
+		return
+	}
+	o.started = false
+	o.funcs = map[uint8]*nanFunction{}
+	sub := o.sub
+	o.m.Unlock()
+
+	sub.Close()
+	if _, err := o.c.execute(nl80211.CmdStopNan, o.IFace.wdevAttrs(), netlink.Request|netlink.Acknowledge); err != nil {
+		log.Println("NAN offload: stop", o.IFace.Name, err)
+	}
+}
+
+// AddService adds the service to Services, and registers it with the
+// driver if started. The returned ID is the Services instance ID.
+func (o *NanOffload) AddService(s *nan.Service) (uint8, error) {
+	id, err := o.Services.Add(s)
+	if err != nil {
+		return 0, err
+	}
+	o.m.Lock()
+	started := o.started
+	o.m.Unlock()
+	if !started {
+		return id, nil
+	}
+	if _, err := o.addFunction(s, id); err != nil {
+		o.Services.Remove(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// RemoveService removes the service and the driver function.
+func (o *NanOffload) RemoveService(instanceID uint8) error {
+	o.Services.Remove(instanceID)
+	o.m.Lock()
+	var f *nanFunction
+	for id, e := range o.funcs {
+		if e.local == instanceID {
+			f = e
+			delete(o.funcs, id)
+		}
+	}
+	o.m.Unlock()
+	if f == nil {
+		return nil
+	}
+	_, err := o.c.execute(nl80211.CmdDelNanFunction, append(o.IFace.wdevAttrs(),
+		netlink.Attribute{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(f.cookie)}),
+		netlink.Request|netlink.Acknowledge)
+	return err
+}
+
+// funcAttrs returns the NanFunc attributes for a publish or subscribe.
+func funcAttrs(s *nan.Service) ([]byte, error) {
+	attrs := []netlink.Attribute{
+		{Type: nl80211.NanFuncServiceId, Data: s.ID[:]},
+	}
+	switch s.Type {
+	case nan.Publish:
+		pt := uint8(0)
+		if s.Solicited {
+			pt |= nl80211.NanSolicitedPublish
+		}
+		if s.Unsolicited {
+			pt |= nl80211.NanUnsolicitedPublish
+		}
+		attrs = append(attrs,
+			netlink.Attribute{Type: nl80211.NanFuncType, Data: []byte{nl80211.NanFuncPublish}},
+			netlink.Attribute{Type: nl80211.NanFuncPublishType, Data: []byte{pt}})
+	case nan.Subscribe:
+		attrs = append(attrs,
+			netlink.Attribute{Type: nl80211.NanFuncType, Data: []byte{nl80211.NanFuncSubscribe}})
+		if s.Active {
+			attrs = append(attrs, netlink.Attribute{Type: nl80211.NanFuncSubscribeActive, Data: []byte{}})
+		}
+	}
+	if s.TTL > 0 {
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.NanFuncTtl,
+			Data: nlenc.Uint32Bytes(uint32(s.TTL/dwInterval) + 1)})
+	}
+	if len(s.ServiceInfo) > 0 {
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.NanFuncServiceInfo, Data: s.ServiceInfo})
+	}
+	if len(s.MatchFilter) > 0 {
+		mf := []netlink.Attribute{}
+		for i, f := range s.MatchFilter {
+			mf = append(mf, netlink.Attribute{Type: uint16(i + 1), Data: f})
+		}
+		b, err := netlink.MarshalAttributes(mf)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs,
+			netlink.Attribute{Type: nl80211.NanFuncTxMatchFilter, Data: b},
+			netlink.Attribute{Type: nl80211.NanFuncRxMatchFilter, Data: b})
+	}
+	return netlink.MarshalAttributes(attrs)
+}
+
+// followupAttrs returns the NanFunc attributes for a follow-up from the
+// local instance to the peer instance.
+func followupAttrs(to net.HardwareAddr, local, peer uint8, sdu []byte) ([]byte, error) {
+	return netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nl80211.NanFuncType, Data: []byte{nl80211.NanFuncFollowUp}},
+		{Type: nl80211.NanFuncServiceId, Data: dmeshServiceID[:]},
+		{Type: nl80211.NanFuncFollowUpId, Data: []byte{peer}},
+		{Type: nl80211.NanFuncFollowUpReqId, Data: []byte{local}},
+		{Type: nl80211.NanFuncFollowUpDest, Data: to},
+		{Type: nl80211.NanFuncServiceInfo, Data: sdu},
+	})
+}
+
+// addFunction registers the service with the driver.
+func (o *NanOffload) addFunction(s *nan.Service, local uint8) (*nanFunction, error) {
+	b, err := funcAttrs(s)
+	if err != nil {
+		return nil, err
+	}
+	f, err := o.add(b)
+	if err != nil {
+		return nil, err
+	}
+	f.svc = s
+	f.local = local
+	o.m.Lock()
+	o.funcs[f.instance] = f
+	o.m.Unlock()
+	return f, nil
+}
+
+// add sends AddNanFunction and returns the cookie and driver instance ID
+// from the reply.
+func (o *NanOffload) add(fn []byte) (*nanFunction, error) {
+	msgs, err := o.c.execute(nl80211.CmdAddNanFunction, append(o.IFace.wdevAttrs(),
+		netlink.Attribute{Type: nl80211.AttrNanFunc, Data: fn}), netlink.Request)
+	if err != nil {
+		return nil, err
+	}
+	return parseAddNanReply(msgs)
+}
+
+func parseAddNanReply(msgs []genetlink.Message) (*nanFunction, error) {
+	for _, m := range msgs {
+		attrs, err := netlink.UnmarshalAttributes(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		f := &nanFunction{}
+		found := false
+		for _, a := range attrs {
+			switch a.Type {
+			case nl80211.AttrCookie:
+				f.cookie = nlenc.Uint64(a.Data)
+			case nl80211.AttrNanFunc:
+				nf, err := parseNanFunc(a.Data)
+				if err != nil {
+					return nil, err
+				}
+				f.instance = nf.instance
+				found = true
+			}
+		}
+		if found {
+			return f, nil
+		}
+	}
+	return nil, errNoNanReply
+}
+
+// dmeshInstance returns the driver instance ID of the dmesh publish, used
+// as source of the follow-ups.
+func (o *NanOffload) dmeshInstance() (uint8, bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	for id, f := range o.funcs {
+		if f.svc.ID == dmeshServiceID && f.svc.Type == nan.Publish {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// SendFollowup sends a follow-up from the dmesh publish. The driver
+// terminates the function after sending it.
+func (o *NanOffload) SendFollowup(to []byte, toPort byte, freq int, sdu []byte) error {
+	local, ok := o.dmeshInstance()
+	if !ok {
+		return errNoDmeshPublish
+	}
+	b, err := followupAttrs(to, local, toPort, sdu)
+	if err != nil {
+		return err
+	}
+	_, err = o.add(b)
+	return err
+}
+
+func (o *NanOffload) SendMessage(to net.HardwareAddr, data []byte, done func(error)) error {
+	return o.Link.Send(to, data, done)
+}
+
+// sendLinkFrame sends a Link fragment. There is no TX status for offload
+// follow-ups - a fragment accepted by the driver is reported as sent, and
+// Link waits for the peer ack.
+func (o *NanOffload) sendLinkFrame(to net.HardwareAddr, sdu []byte) error {
+	o.m.Lock()
+	id, f := o.peerInstances[to.String()]
+	o.m.Unlock()
+	if !f {
+		id = 0x80
+	}
+	err := o.SendFollowup(to, id, 0, sdu)
+	if err == nil {
+		go o.Link.TxSent(to, sdu)
+	}
+	return err
+}
+
+// PeerInstance returns the instance ID of the dmesh publish of the peer,
+// 0 if not known.
+func (o *NanOffload) PeerInstance(peer net.HardwareAddr) uint8 {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.peerInstances[peer.String()]
+}
+
+func (o *NanOffload) handleEvents(sub *Subscription) {
+	for ev := range sub.C {
+		switch e := ev.(type) {
+		case *NanMatch:
+			o.onMatch(e)
+		case *NanTerminated:
+			// A stale event for a function replaced with the same
+			// instance ID is ignored.
+			o.m.Lock()
+			f := o.funcs[e.Instance]
+			if f != nil && f.cookie != e.Cookie {
+				f = nil
+			}
+			if f != nil {
+				delete(o.funcs, e.Instance)
+			}
+			o.m.Unlock()
+			if f != nil {
+				log.Println("NAN offload: terminated", f.svc.Name, e.Reason)
+				o.Services.Remove(f.local)
+			}
+		}
+	}
+}
+
+// onMatch delivers a discovery result or follow-up to the local service.
+// DMesh follow-ups are passed to Link.
+func (o *NanOffload) onMatch(e *NanMatch) {
+	o.m.Lock()
+	f := o.funcs[e.LocalInstance]
+	o.m.Unlock()
+	if f == nil {
+		log.Println("NAN offload: match for unknown instance", e.LocalInstance, e.Peer)
+		return
+	}
+
+	m := &nan.Match{
+		Service:        f.svc,
+		Type:           nan.Publish,
+		Peer:           e.Peer,
+		PeerInstanceID: e.PeerInstance,
+		ServiceInfo:    e.ServiceInfo,
+	}
+	if e.Type == nl80211.NanFuncFollowUp {
+		m.Type = nan.FollowUp
+	}
+
+	if f.svc.ID == dmeshServiceID {
+		o.m.Lock()
+		o.peerInstances[e.Peer.String()] = e.PeerInstance
+		o.m.Unlock()
+		if m.Type == nan.FollowUp {
+			if err := o.Link.Receive(e.Peer, e.ServiceInfo); err != nil {
+				log.Println("NAN offload: link receive", e.Peer, err)
+			}
+		}
+	}
+	if f.svc.OnMatch != nil {
+		f.svc.OnMatch(m)
+	}
+}
@@ -0,0 +1,233 @@
+package wifi
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+var fakeFamily = genetlink.Family{
+	ID:      0x1c,
+	Version: 1,
+	Name:    nl80211.GenlName,
+	Groups:  []genetlink.MulticastGroup{{ID: 5, Name: nl80211.MulticastGroupNan}},
+}
+
+// newFakeClient returns a Client with a NAN capable driver.
+func newFakeClient(t *testing.T) (*Client, *fakeNL80211) {
+	c, f := newFakeNL80211(t, fakeFamily)
+	next := uint8(0)
+	f.handle(nl80211.CmdAddNanFunction, func(greq genetlink.Message, _ map[uint16][]byte) ([]genetlink.Message, error) {
+		f.m.Lock()
+		next++
+		id := next
+		f.m.Unlock()
+		fn, _ := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: nl80211.NanFuncInstanceId, Data: []byte{id}},
+		})
+		b, _ := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(100 + uint64(id))},
+			{Type: nl80211.AttrNanFunc, Data: fn},
+		})
+		return []genetlink.Message{{Header: greq.Header, Data: b}}, nil
+	})
+	b, _ := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nl80211.AttrIfname, Data: nlenc.Bytes("dmeshnan1")},
+		{Type: nl80211.AttrWiphy, Data: nlenc.Uint32Bytes(1)},
+		{Type: nl80211.AttrIftype, Data: nlenc.Uint32Bytes(nl80211.IftypeNan)},
+		{Type: nl80211.AttrWdev, Data: nlenc.Uint64Bytes(0x100000002)},
+	})
+	f.reply(nl80211.CmdNewInterface, genetlink.Message{
+		Header: genetlink.Header{Command: nl80211.CmdNewInterface, Version: 1}, Data: b})
+	return c, f
+}
+
+// nanMatchEvent returns the event the kernel sends for a match on the
+// local driver instance.
+func nanMatchEvent(t *testing.T, wdev uint64, peer net.HardwareAddr, local, peerInst, typ uint8,
+	info []byte) Event {
+	localFn := nested(t, netlink.Attribute{Type: nl80211.NanFuncInstanceId, Data: []byte{local}})
+	peerFn := nested(t,
+		netlink.Attribute{Type: nl80211.NanFuncType, Data: []byte{typ}},
+		netlink.Attribute{Type: nl80211.NanFuncInstanceId, Data: []byte{peerInst}},
+		netlink.Attribute{Type: nl80211.NanFuncServiceInfo, Data: info})
+	ev, err := parseEvent(genetlink.Message{
+		Header: genetlink.Header{Command: nl80211.CmdNanMatch},
+		Data: nested(t,
+			netlink.Attribute{Type: nl80211.AttrWdev, Data: nlenc.Uint64Bytes(wdev)},
+			netlink.Attribute{Type: nl80211.AttrCookie, Data: nlenc.Uint64Bytes(101)},
+			netlink.Attribute{Type: nl80211.AttrMac, Data: peer},
+			netlink.Attribute{Type: nl80211.AttrNanMatch, Data: nested(t,
+				netlink.Attribute{Type: nl80211.NanMatchFuncLocal, Data: localFn},
+				netlink.Attribute{Type: nl80211.NanMatchFuncPeer, Data: peerFn})}),
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestNanOffload(t *testing.T) {
+	c, f := newFakeClient(t)
+	ifi := &Interface{Name: "dmeshnan1", PHY: 1, Device: 0x100000002}
+	o := NewNanOffload(c, ifi)
+	peer := net.HardwareAddr{2, 0, 0, 0, 0, 7}
+
+	// Added before start - registered in Start
+	if _, err := o.AddService(nan.NewPublish("dmesh", []byte("s=x"))); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := o.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m := f.last(nl80211.CmdStartNan)
+	if nlenc.Uint64(m[nl80211.AttrWdev]) != 0x100000002 || m[nl80211.AttrNanMasterPref][0] != masterPreference {
+		t.Error("Unexpected StartNan", m)
+	}
+	fn, _ := netlink.UnmarshalAttributes(f.last(nl80211.CmdAddNanFunction)[nl80211.AttrNanFunc])
+	fm := attrMap(fn)
+	if fm[nl80211.NanFuncType][0] != nl80211.NanFuncPublish ||
+		fm[nl80211.NanFuncPublishType][0] != nl80211.NanSolicitedPublish|nl80211.NanUnsolicitedPublish ||
+		!bytes.Equal(fm[nl80211.NanFuncServiceId], dmeshServiceID[:]) ||
+		string(fm[nl80211.NanFuncServiceInfo]) != "s=x" {
+		t.Error("Unexpected publish", fm)
+	}
+
+	matches := make(chan *nan.Match, 4)
+	sub := nan.NewSubscribe("other", true, func(m *nan.Match) { matches <- m })
+	subID, err := o.AddService(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, _ = netlink.UnmarshalAttributes(f.last(nl80211.CmdAddNanFunction)[nl80211.AttrNanFunc])
+	fm = attrMap(fn)
+	if _, active := fm[nl80211.NanFuncSubscribeActive]; fm[nl80211.NanFuncType][0] != nl80211.NanFuncSubscribe || !active {
+		t.Error("Unexpected subscribe", fm)
+	}
+
+	// Driver instance 2 is the subscribe. Events for other wdevs are ignored.
+	c.dispatch(nanMatchEvent(t, 0x200000001, peer, 2, 9, nl80211.NanFuncPublish, []byte("wrong")), 0)
+	c.dispatch(nanMatchEvent(t, 0x100000002, peer, 2, 7, nl80211.NanFuncPublish, []byte("info")), 0)
+	select {
+	case mt := <-matches:
+		if mt.Service != sub || mt.Type != nan.Publish || mt.PeerInstanceID != 7 ||
+			!bytes.Equal(mt.Peer, peer) || string(mt.ServiceInfo) != "info" {
+			t.Error("Unexpected match", mt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No match")
+	}
+
+	// Link message, sent and received as follow-ups of the dmesh publish.
+	got := make(chan []byte, 1)
+	o.Link.OnMessage = func(from net.HardwareAddr, data []byte) { got <- data }
+	delivered := make(chan error, 1)
+	if err := o.SendMessage(peer, []byte("hello"), func(err error) { delivered <- err }); err != nil {
+		t.Fatal(err)
+	}
+	fn, _ = netlink.UnmarshalAttributes(f.last(nl80211.CmdAddNanFunction)[nl80211.AttrNanFunc])
+	fm = attrMap(fn)
+	if fm[nl80211.NanFuncType][0] != nl80211.NanFuncFollowUp || fm[nl80211.NanFuncFollowUpReqId][0] != 1 ||
+		fm[nl80211.NanFuncFollowUpId][0] != 0x80 || !bytes.Equal(fm[nl80211.NanFuncFollowUpDest], peer) {
+		t.Error("Unexpected follow-up", fm)
+	}
+	c.dispatch(nanMatchEvent(t, 0x100000002, peer, 1, 5, nl80211.NanFuncFollowUp,
+		fm[nl80211.NanFuncServiceInfo]), 0)
+	select {
+	case d := <-got:
+		if string(d) != "hello" {
+			t.Error("Unexpected message", string(d))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message")
+	}
+	if o.PeerInstance(peer) != 5 {
+		t.Error("Peer instance not saved", o.PeerInstance(peer))
+	}
+
+	// There is no TX status - the fragment is sent again requesting the
+	// ack, and delivered when the peer acks it.
+	var si []byte
+	for i := 0; i < 100 && (len(si) < 4 || si[1]&0x80 == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+		fn, _ = netlink.UnmarshalAttributes(f.last(nl80211.CmdAddNanFunction)[nl80211.AttrNanFunc])
+		si = attrMap(fn)[nl80211.NanFuncServiceInfo]
+	}
+	if len(si) < 4 || si[1]&0x80 == 0 {
+		t.Fatal("Expecting ack request", si)
+	}
+	c.dispatch(nanMatchEvent(t, 0x100000002, peer, 1, 5, nl80211.NanFuncFollowUp,
+		[]byte{si[0], si[1] &^ 0x80, si[2], 0}), 0)
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Error("Expecting delivered", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Not acked")
+	}
+
+	// Terminated with the cookie of an older function - the subscribe
+	// still gets matches.
+	c.dispatch(&NanTerminated{EventHeader: EventHeader{Wdev: 0x100000002}, Cookie: 99, Instance: 2}, 0)
+	c.dispatch(nanMatchEvent(t, 0x100000002, peer, 2, 7, nl80211.NanFuncPublish, []byte("info")), 0)
+	select {
+	case <-matches:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Subscribe removed by stale terminate")
+	}
+	if o.Services.Get(subID) != sub {
+		t.Error("Subscribe removed from the services")
+	}
+
+	if err := o.RemoveService(subID); err != nil {
+		t.Fatal(err)
+	}
+	if cookie := nlenc.Uint64(f.last(nl80211.CmdDelNanFunction)[nl80211.AttrCookie]); cookie != 102 {
+		t.Error("Unexpected cookie", cookie)
+	}
+	o.Close()
+	f.last(nl80211.CmdStopNan)
+}
+
+func TestNewNanBackend(t *testing.T) {
+	c, _ := newFakeClient(t)
+	ifi := &Interface{Name: "wlan0", Index: 3, PHY: 1}
+
+	p := &Phy{PHY: 1, InterfaceTypes: []InterfaceType{InterfaceTypeStation}}
+	b, err := NewNanBackend(c, p, ifi, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*Nan); !ok || b.Interface() != ifi {
+		t.Error("Expecting emulation", b)
+	}
+	b.Close()
+
+	p.InterfaceTypes = append(p.InterfaceTypes, InterfaceTypeNAN)
+	p.Commands = []uint8{nl80211.CmdStartNan}
+	b, err = NewNanBackend(c, p, ifi, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*NanOffload); !ok || b.Interface().Name != "dmeshnan1" ||
+		b.Interface().Type != InterfaceTypeNAN {
+		t.Error("Expecting offload", b, b.Interface())
+	}
+
+	b, _ = NewNanBackend(c, p, ifi, nil, true)
+	if _, ok := b.(*Nan); !ok {
+		t.Error("Expecting forced emulation", b)
+	}
+	b.Close()
+}
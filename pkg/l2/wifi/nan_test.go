@@ -0,0 +1,235 @@
+package wifi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+)
+
+// simDriver records the sent frames and acks unicast frames.
+type simDriver struct {
+	m      sync.Mutex
+	cookie uint64
+	frames map[int][][]byte
+	nans   map[int]*Nan
+	rocs   int
+
+	// lost is the number of frames sent without a TX status.
+	lost int
+}
+
+func newSimDriver() *simDriver {
+	return &simDriver{frames: map[int][][]byte{}, nans: map[int]*Nan{}}
+}
+
+func (d *simDriver) TxFrame(ifi *Interface, frame []byte, freq, dwell int) (uint64, error) {
+	d.m.Lock()
+	d.cookie++
+	cookie := d.cookie
+	d.frames[ifi.Index] = append(d.frames[ifi.Index], append([]byte{}, frame...))
+	n := d.nans[ifi.Index]
+	lost := d.lost > 0
+	if lost {
+		d.lost--
+	}
+	d.m.Unlock()
+	if !lost {
+		go n.OnTxStatus(cookie, frame[4]&1 == 0)
+	}
+	return cookie, nil
+}
+
+func (d *simDriver) RemainOnChannel(ifi *Interface, freq, dur int) (uint64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.rocs++
+	d.cookie++
+	return d.cookie, nil
+}
+
+func (d *simDriver) newNan(idx int) *Nan {
+	ifi := &Interface{Index: idx, Name: "sim" + string(rune('0'+idx)),
+		HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, byte(idx)}}
+	n := NewNanDriver(d, ifi)
+	d.m.Lock()
+	d.nans[idx] = n
+	d.m.Unlock()
+	return n
+}
+
+// Multiple interfaces sending beacons, discovery, follow-ups and Link
+// messages concurrently. Run with -race.
+func TestNanConcurrent(t *testing.T) {
+	d := newSimDriver()
+	nans := []*Nan{d.newNan(1), d.newNan(2)}
+	peer := net.HardwareAddr{2, 0, 0, 0, 0, 0x10}
+
+	var wg sync.WaitGroup
+	var cm sync.Mutex
+	completed := 0
+	done := func(r TxResult) {
+		cm.Lock()
+		completed++
+		cm.Unlock()
+	}
+
+	const rounds = 20
+	for _, n := range nans {
+		n.Services.Add(nan.NewPublish("dmesh", []byte("i=1")))
+		n := n
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				n.OnDW(time.Now())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				n.SendBeacon(true)
+				n.SendFollowup(peer, 0x80, 2412, []byte("off channel"))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				n.Link.Send(peer, []byte("link"), nil)
+				n.OnSDF(peer, -50, []nan.Attribute{&nan.ServiceDescriptor{
+					ServiceID: dmeshServiceID, InstanceID: 3, Type: nan.Publish}})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				b := appendMgmtHeader(nil, 0xD0, peer, n.Sync.ClusterID())
+				b = nan.AppendSDFHeader(b)
+				n.SendFrame(b, 2437, 10, done)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// All frames sent with SendFrame complete - sent or dropped.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cm.Lock()
+		c := completed
+		cm.Unlock()
+		if c == rounds*len(nans) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Frames not completed", c)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, n := range nans {
+		n.Close()
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.rocs != rounds*len(nans) {
+		t.Error("Expecting ROC in each DW", d.rocs)
+	}
+	for _, n := range nans {
+		frames := d.frames[n.IFace.Index]
+		if len(frames) < rounds {
+			t.Fatal("Missing frames", n.IFace.Name, len(frames))
+		}
+		seqs := map[uint16]bool{}
+		for _, f := range frames {
+			if !bytes.Equal(f[10:16], n.IFace.HardwareAddr) {
+				t.Fatal("Frame with wrong source", n.IFace.Name, net.HardwareAddr(f[10:16]))
+			}
+			seq := binary.LittleEndian.Uint16(f[22:]) >> 4
+			if seqs[seq] {
+				t.Fatal("Duplicate sequence", n.IFace.Name, seq)
+			}
+			seqs[seq] = true
+			switch f[0] {
+			case 0x80:
+				if _, err := nan.ParseBeaconIEs(f[36:]); err != nil {
+					t.Fatal("Invalid beacon", err)
+				}
+			case 0xD0:
+				if _, err := nan.ParseSDF(f[24:]); err != nil {
+					t.Fatal("Invalid SDF", err)
+				}
+			}
+		}
+	}
+}
+
+func TestSendShortFrame(t *testing.T) {
+	d := newSimDriver()
+	n := d.newNan(1)
+	defer n.Close()
+
+	var res TxResult
+	if err := n.SendFrame([]byte{0xD0, 0}, NANFreq, 0, func(r TxResult) { res = r }); err != errShortFrame {
+		t.Fatal("Expecting short frame error", err)
+	}
+	if res.Status != TxDropped || res.Err != errShortFrame {
+		t.Error("Expecting dropped", res)
+	}
+}
+
+// Frames are sent without waiting for the TX status of the previous ones.
+func TestSendPipelined(t *testing.T) {
+	d := newSimDriver()
+	d.lost = 1
+	n := d.newNan(1)
+	defer n.Close()
+
+	results := make(chan TxResult, 3)
+	done := func(r TxResult) { results <- r }
+	peer := net.HardwareAddr{2, 0, 0, 0, 0, 9}
+	for i := 0; i < 3; i++ {
+		n.SendFrame(appendMgmtHeader(nil, 0xD0, peer, broadcastAddr), NANFreq, 0, done)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.Status != TxAcked || r.Cookie == 1 {
+				t.Error("Unexpected result", r)
+			}
+		case <-time.After(txStatusTimeout / 2):
+			t.Fatal("Frames waiting for the lost TX status")
+		}
+	}
+	select {
+	case r := <-results:
+		if r.Status != TxTimeout || r.Cookie != 1 {
+			t.Error("Expecting timeout", r)
+		}
+	case <-time.After(2 * txStatusTimeout):
+		t.Fatal("No timeout")
+	}
+}
+
+// The default schedule is committed only on the channel of the interface.
+func TestDefaultSchedule(t *testing.T) {
+	d := newSimDriver()
+	n := d.newNan(1)
+	defer n.Close()
+	if sl := n.Schedule.Slots; len(sl) != 1 || sl[0].Type != nan.AvailPotential || sl[0].Channel.Number != 6 {
+		t.Error("Expecting only potential without channel", sl)
+	}
+
+	ifi := &Interface{Index: 2, Name: "sim2", Frequency: 2412, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}
+	n2 := NewNanDriver(d, ifi)
+	defer n2.Close()
+	sl := n2.Schedule.Slots
+	if len(sl) != 2 || sl[0].Type != nan.AvailCommitted || sl[0].Channel.Number != 1 ||
+		sl[1].Type != nan.AvailPotential || sl[1].Channel.Number != 6 {
+		t.Error("Expecting committed on the interface channel", sl)
+	}
+}
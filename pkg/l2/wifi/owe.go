@@ -0,0 +1,480 @@
+package wifi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+)
+
+// OWE (RFC 8110) is an open network with encryption: the STA and AP
+// exchange ECDH public keys in the association, the PMK is derived from
+// the shared secret, then the usual 4-way handshake installs the keys.
+// There is no authentication - dmesh authenticates at L6, the goal is to
+// not send the frames in clear.
+//
+// Only group 19 (P-256) and CCMP are supported - the mandatory ones.
+// The handshake runs in user space, with the EAPOL frames sent and received
+// using control port over nl80211.
+
+var (
+	errInvalidRSN    = errors.New("invalid RSN IE")
+	errNoCCMP        = errors.New("AP doesn't support CCMP")
+	errNoDHParam     = errors.New("no OWE DH parameter in association response")
+	errOWEGroup      = errors.New("unsupported OWE group")
+	errInvalidKey    = errors.New("invalid EAPOL key frame")
+	errKeyMIC        = errors.New("EAPOL key MIC mismatch")
+	errANonce        = errors.New("ANonce changed in message 3")
+	errReplay        = errors.New("EAPOL key replay counter not increasing")
+	errNoGTK         = errors.New("no GTK in message 3")
+	errKeyWrap       = errors.New("AES key unwrap integrity check failed")
+	errKeyWrapLength = errors.New("invalid AES key wrap length")
+)
+
+// Cipher and AKM suite selectors, in the nl80211 format - OUI << 8 | type.
+const (
+	suiteCCMP    = 0x000FAC04
+	suiteBIPCMAC = 0x000FAC06
+	akmOWE       = 0x000FAC12
+)
+
+// ieExtension is the element ID for extension elements. The OWE DH
+// parameter is extension 32.
+const (
+	ieExtension  = 255
+	ieExtOWEDH   = 32
+	oweGroupP256 = 19
+)
+
+// RSN capabilities - management frame protection capable and required.
+const (
+	rsnCapMFPR = 1 << 6
+	rsnCapMFPC = 1 << 7
+)
+
+// rsnInfo is a parsed RSN IE.
+type rsnInfo struct {
+	Group    uint32
+	Pairwise []uint32
+	AKM      []uint32
+	Caps     uint16
+}
+
+func parseRSN(b []byte) (*rsnInfo, error) {
+	if len(b) < 6 || binary.LittleEndian.Uint16(b) != 1 {
+		return nil, errInvalidRSN
+	}
+	r := &rsnInfo{Group: binary.BigEndian.Uint32(b[2:6])}
+	b = b[6:]
+	suites := func() ([]uint32, error) {
+		if len(b) < 2 {
+			return nil, nil
+		}
+		n := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+4*n {
+			return nil, errInvalidRSN
+		}
+		var res []uint32
+		for i := 0; i < n; i++ {
+			res = append(res, binary.BigEndian.Uint32(b[2+4*i:]))
+		}
+		b = b[2+4*n:]
+		return res, nil
+	}
+	var err error
+	if r.Pairwise, err = suites(); err != nil {
+		return nil, err
+	}
+	if r.AKM, err = suites(); err != nil {
+		return nil, err
+	}
+	if len(b) >= 2 {
+		r.Caps = binary.LittleEndian.Uint16(b)
+	}
+	return r, nil
+}
+
+func hasSuite(l []uint32, s uint32) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// owe is the STA side of an OWE association and handshake.
+type owe struct {
+	priv *ecdh.PrivateKey
+
+	// rsnIE is sent in the association request and message 2.
+	rsnIE []byte
+
+	// MFP is set if both sides support management frame protection.
+	MFP bool
+
+	group uint32
+
+	spa, aa net.HardwareAddr
+
+	pmk    []byte
+	kck    []byte
+	kek    []byte
+	tk     []byte
+	anonce []byte
+	snonce []byte
+
+	replay []byte
+}
+
+// newOWE returns the OWE state for the AP RSN IE.
+func newOWE(ap *rsnInfo, spa, aa net.HardwareAddr) (*owe, error) {
+	if !hasSuite(ap.Pairwise, suiteCCMP) {
+		return nil, errNoCCMP
+	}
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	o := &owe{priv: priv, group: ap.Group, spa: spa, aa: aa,
+		MFP: ap.Caps&rsnCapMFPC != 0}
+
+	var caps uint16
+	if o.MFP {
+		caps = rsnCapMFPC
+	}
+	rsn := []byte{1, 0}
+	rsn = binary.BigEndian.AppendUint32(rsn, ap.Group)
+	rsn = append(rsn, 1, 0)
+	rsn = binary.BigEndian.AppendUint32(rsn, suiteCCMP)
+	rsn = append(rsn, 1, 0)
+	rsn = binary.BigEndian.AppendUint32(rsn, akmOWE)
+	rsn = binary.LittleEndian.AppendUint16(rsn, caps)
+	o.rsnIE = append([]byte{ieRSN, byte(len(rsn))}, rsn...)
+	return o, nil
+}
+
+// publicX is the x coordinate of the public key - the only part sent.
+func (o *owe) publicX() []byte {
+	return o.priv.PublicKey().Bytes()[1:33]
+}
+
+// IEs returns the IEs for the association request - RSN and DH parameter.
+func (o *owe) IEs() []byte {
+	dh := []byte{ieExtension, 3 + 32, ieExtOWEDH, oweGroupP256, 0}
+	dh = append(dh, o.publicX()...)
+	return append(append([]byte{}, o.rsnIE...), dh...)
+}
+
+// SetResponse derives the PMK from the DH parameter in the association
+// response IEs.
+func (o *owe) SetResponse(respIE []byte) error {
+	ies, err := ParseIEs(respIE)
+	if err != nil {
+		return err
+	}
+	var apX []byte
+	for _, ie := range ies {
+		if ie.ID == ieExtension && len(ie.Data) > 3 && ie.Data[0] == ieExtOWEDH {
+			if binary.LittleEndian.Uint16(ie.Data[1:]) != oweGroupP256 {
+				return errOWEGroup
+			}
+			apX = ie.Data[3:]
+		}
+	}
+	if len(apX) != 32 {
+		return errNoDHParam
+	}
+	z, err := oweShared(o.priv, apX)
+	if err != nil {
+		return err
+	}
+	// prk = HKDF-Extract(C | A | group, z)
+	salt := append(append(append([]byte{}, o.publicX()...), apX...), oweGroupP256, 0)
+	prk := hmacSHA256(salt, z)
+	o.pmk = hkdfExpand(prk, []byte("OWE Key Generation"), 32)
+	return nil
+}
+
+// oweShared returns the x coordinate of the ECDH shared secret. The peer
+// sends only x - either y gives the same x for the shared point.
+func oweShared(priv *ecdh.PrivateKey, x []byte) ([]byte, error) {
+	px, py := elliptic.UnmarshalCompressed(elliptic.P256(), append([]byte{2}, x...))
+	if px == nil {
+		return nil, errNoDHParam
+	}
+	pub, err := ecdh.P256().NewPublicKey(uncompressed(px, py))
+	if err != nil {
+		return nil, err
+	}
+	return priv.ECDH(pub)
+}
+
+func uncompressed(x, y *big.Int) []byte {
+	b := make([]byte, 65)
+	b[0] = 4
+	x.FillBytes(b[1:33])
+	y.FillBytes(b[33:])
+	return b
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// hkdfExpand is RFC 5869 HKDF-Expand with SHA-256.
+func hkdfExpand(prk, info []byte, l int) []byte {
+	var out, t []byte
+	for i := byte(1); len(out) < l; i++ {
+		t = hmacSHA256(prk, t, info, []byte{i})
+		out = append(out, t...)
+	}
+	return out[:l]
+}
+
+// kdfSHA256 is the 802.11 KDF (12.7.1.7.2), with SHA-256.
+func kdfSHA256(key []byte, label string, context []byte, bits int) []byte {
+	var out []byte
+	for i := uint16(1); len(out)*8 < bits; i++ {
+		out = append(out, hmacSHA256(key,
+			binary.LittleEndian.AppendUint16(nil, i),
+			[]byte(label), context,
+			binary.LittleEndian.AppendUint16(nil, uint16(bits)))...)
+	}
+	return out[:bits/8]
+}
+
+// derivePTK sets KCK, KEK and TK - 16 bytes each for CCMP.
+func (o *owe) derivePTK() {
+	ctx := append(minMax(o.aa, o.spa), minMax(o.anonce, o.snonce)...)
+	ptk := kdfSHA256(o.pmk, "Pairwise key expansion", ctx, 384)
+	o.kck, o.kek, o.tk = ptk[0:16], ptk[16:32], ptk[32:48]
+}
+
+func minMax(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return append(append([]byte{}, a...), b...)
+}
+
+// EAPOL-Key frame, with the 16 byte MIC used by OWE group 19.
+const (
+	eapolKeyType   = 3
+	keyDescRSN     = 2
+	eapolHeaderLen = 4
+	eapolKeyLen    = eapolHeaderLen + 95
+
+	offKeyInfo   = 5
+	offKeyLength = 7
+	offReplay    = 9
+	offNonce     = 17
+	offRSC       = 65
+	offMIC       = 81
+	offDataLen   = 97
+
+	// EtherTypeEAPOL is the control port protocol.
+	EtherTypeEAPOL = 0x888e
+)
+
+// Key information bits. The descriptor version is 0 - the AKM defines
+// the algorithms.
+const (
+	keyInfoPairwise = 1 << 3
+	keyInfoInstall  = 1 << 6
+	keyInfoAck      = 1 << 7
+	keyInfoMIC      = 1 << 8
+	keyInfoSecure   = 1 << 9
+	keyInfoEncData  = 1 << 12
+)
+
+// oweKeys are installed after message 3.
+type oweKeys struct {
+	TK []byte
+
+	GTK    []byte
+	GTKIdx int
+	GTKSeq []byte
+
+	// IGTK is set if MFP is used.
+	IGTK    []byte
+	IGTKIdx int
+	IGTKSeq []byte
+}
+
+// HandleKey processes an EAPOL-Key frame from the AP, and returns the
+// reply. keys is set after message 3 - the handshake is complete when the
+// reply is sent and the keys installed.
+func (o *owe) HandleKey(frame []byte) (reply []byte, keys *oweKeys, err error) {
+	if len(frame) < eapolKeyLen || frame[1] != eapolKeyType || frame[4] != keyDescRSN {
+		return nil, nil, errInvalidKey
+	}
+	dataLen := int(binary.BigEndian.Uint16(frame[offDataLen:]))
+	if len(frame) < eapolKeyLen+dataLen {
+		return nil, nil, errInvalidKey
+	}
+	frame = frame[:eapolKeyLen+dataLen]
+	info := binary.BigEndian.Uint16(frame[offKeyInfo:])
+	if info&keyInfoPairwise == 0 || info&keyInfoAck == 0 {
+		return nil, nil, errInvalidKey
+	}
+	replay := frame[offReplay : offReplay+8]
+	if o.replay != nil && bytes.Compare(replay, o.replay) <= 0 {
+		return nil, nil, errReplay
+	}
+
+	if info&keyInfoMIC == 0 {
+		// Message 1 - a new ANonce restarts the handshake.
+		if o.pmk == nil {
+			return nil, nil, errNoDHParam
+		}
+		o.replay = append([]byte{}, replay...)
+		o.anonce = append([]byte{}, frame[offNonce:offNonce+32]...)
+		o.snonce = make([]byte, 32)
+		if _, err := rand.Read(o.snonce); err != nil {
+			return nil, nil, err
+		}
+		o.derivePTK()
+		return o.keyFrame(frame[0], keyInfoPairwise|keyInfoMIC, o.snonce, o.rsnIE), nil, nil
+	}
+
+	// Message 3
+	if o.kck == nil {
+		return nil, nil, errInvalidKey
+	}
+	if !bytes.Equal(frame[offNonce:offNonce+32], o.anonce) {
+		return nil, nil, errANonce
+	}
+	if !o.checkMIC(frame) {
+		return nil, nil, errKeyMIC
+	}
+	o.replay = append([]byte{}, replay...)
+	data := frame[eapolKeyLen:]
+	if info&keyInfoEncData != 0 {
+		if data, err = aesUnwrap(o.kek, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	keys, err = o.parseKeyData(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys.TK = o.tk
+	keys.GTKSeq = append([]byte{}, frame[offRSC:offRSC+6]...)
+	return o.keyFrame(frame[0], keyInfoPairwise|keyInfoMIC|keyInfoSecure, nil, nil), keys, nil
+}
+
+// keyFrame returns message 2 or 4, with the MIC.
+func (o *owe) keyFrame(version byte, info uint16, nonce, data []byte) []byte {
+	b := make([]byte, eapolKeyLen+len(data))
+	b[0] = version
+	b[1] = eapolKeyType
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-eapolHeaderLen))
+	b[4] = keyDescRSN
+	binary.BigEndian.PutUint16(b[offKeyInfo:], info)
+	// Key length is 0 for RSN, in messages from the STA.
+	copy(b[offReplay:], o.replay)
+	copy(b[offNonce:], nonce)
+	binary.BigEndian.PutUint16(b[offDataLen:], uint16(len(data)))
+	copy(b[eapolKeyLen:], data)
+	copy(b[offMIC:], keyMIC(o.kck, b))
+	return b
+}
+
+// keyMIC is HMAC-SHA-256 truncated to 128 bits, over the frame with the
+// MIC field zero.
+func keyMIC(kck, frame []byte) []byte {
+	b := append([]byte{}, frame...)
+	copy(b[offMIC:offMIC+16], make([]byte, 16))
+	return hmacSHA256(kck, b)[:16]
+}
+
+func (o *owe) checkMIC(frame []byte) bool {
+	return hmac.Equal(frame[offMIC:offMIC+16], keyMIC(o.kck, frame))
+}
+
+// KDE types in the key data, with the 00-0F-AC OUI.
+const (
+	kdeGTK  = 1
+	kdeIGTK = 9
+)
+
+func (o *owe) parseKeyData(data []byte) (*oweKeys, error) {
+	keys := &oweKeys{}
+	for len(data) >= 2 {
+		id, l := data[0], int(data[1])
+		if id == 0xdd && l == 0 {
+			// Padding
+			break
+		}
+		if len(data) < 2+l {
+			return nil, errInvalidKey
+		}
+		kde := data[2 : 2+l]
+		data = data[2+l:]
+		if id != 0xdd || l < 4 || !bytes.Equal(kde[:3], []byte{0, 0x0f, 0xac}) {
+			continue
+		}
+		switch kde[3] {
+		case kdeGTK:
+			if l < 6 {
+				return nil, errInvalidKey
+			}
+			keys.GTKIdx = int(kde[4] & 3)
+			keys.GTK = append([]byte{}, kde[6:]...)
+		case kdeIGTK:
+			if l < 4+2+6+16 {
+				return nil, errInvalidKey
+			}
+			keys.IGTKIdx = int(binary.LittleEndian.Uint16(kde[4:]))
+			keys.IGTKSeq = append([]byte{}, kde[6:12]...)
+			keys.IGTK = append([]byte{}, kde[12:]...)
+		}
+	}
+	if keys.GTK == nil {
+		return nil, errNoGTK
+	}
+	return keys, nil
+}
+
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// aesUnwrap is RFC 3394 key unwrap.
+func aesUnwrap(kek, c []byte) ([]byte, error) {
+	if len(c)%8 != 0 || len(c) < 24 {
+		return nil, errKeyWrapLength
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(c)/8 - 1
+	a := append([]byte{}, c[:8]...)
+	r := append([]byte{}, c[8:]...)
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := binary.BigEndian.Uint64(a) ^ uint64(n*j+i)
+			binary.BigEndian.PutUint64(b, t)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(r[(i-1)*8:], b[8:])
+		}
+	}
+	if !bytes.Equal(a, keyWrapIV) {
+		return nil, errKeyWrap
+	}
+	return r, nil
+}
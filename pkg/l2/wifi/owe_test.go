@@ -0,0 +1,228 @@
+package wifi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// aesWrap is RFC 3394 key wrap - used by the AP.
+func aesWrap(kek, p []byte) []byte {
+	block, _ := aes.NewCipher(kek)
+	n := len(p) / 8
+	a := append([]byte{}, keyWrapIV...)
+	r := append([]byte{}, p...)
+	b := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, a)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Encrypt(b, b)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b)^uint64(n*j+i))
+			copy(r[(i-1)*8:], b[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+func TestAESUnwrap(t *testing.T) {
+	// RFC 3394 4.1
+	kek := unhex(t, "000102030405060708090A0B0C0D0E0F")
+	c := unhex(t, "1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+	p, err := aesUnwrap(kek, c)
+	if err != nil || !bytes.Equal(p, unhex(t, "00112233445566778899AABBCCDDEEFF")) {
+		t.Fatal("Unexpected unwrap", hex.EncodeToString(p), err)
+	}
+	if !bytes.Equal(aesWrap(kek, p), c) {
+		t.Error("Unexpected wrap")
+	}
+	c[3]++
+	if _, err := aesUnwrap(kek, c); err != errKeyWrap {
+		t.Error("Expecting integrity error", err)
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869 A.1
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt := unhex(t, "000102030405060708090a0b0c")
+	prk := hmacSHA256(salt, ikm)
+	if hex.EncodeToString(prk) != "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5" {
+		t.Error("Unexpected PRK", hex.EncodeToString(prk))
+	}
+	okm := hkdfExpand(prk, unhex(t, "f0f1f2f3f4f5f6f7f8f9"), 42)
+	if hex.EncodeToString(okm) != "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+		t.Error("Unexpected OKM", hex.EncodeToString(okm))
+	}
+}
+
+// testAP is the AP side of OWE and the 4-way handshake.
+type testAP struct {
+	t    *testing.T
+	priv *ecdh.PrivateKey
+	addr net.HardwareAddr
+	sta  net.HardwareAddr
+
+	rsnIE  []byte
+	pmk    []byte
+	anonce []byte
+	kck    []byte
+	kek    []byte
+	tk     []byte
+	gtk    []byte
+	replay byte
+}
+
+// oweRSN is the RSN IE of an OWE AP with MFP capable.
+var oweRSN = []byte{ieRSN, 20, 1, 0, 0, 0x0f, 0xac, 4, 1, 0, 0, 0x0f, 0xac, 4,
+	1, 0, 0, 0x0f, 0xac, 18, rsnCapMFPC, 0}
+
+func newTestAP(t *testing.T, sta net.HardwareAddr) *testAP {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap := &testAP{t: t, priv: priv, addr: net.HardwareAddr{2, 0, 0, 0, 0, 0xa}, sta: sta,
+		rsnIE: oweRSN, anonce: make([]byte, 32), gtk: bytes.Repeat([]byte{7}, 16)}
+	rand.Read(ap.anonce)
+	return ap
+}
+
+// assocResp returns the response IEs for the association request IEs.
+func (ap *testAP) assocResp(reqIE []byte) []byte {
+	ies, err := ParseIEs(reqIE)
+	if err != nil {
+		ap.t.Fatal(err)
+	}
+	var staX []byte
+	for _, ie := range ies {
+		if ie.ID == ieExtension && ie.Data[0] == ieExtOWEDH {
+			staX = ie.Data[3:]
+		}
+	}
+	z, err := oweShared(ap.priv, staX)
+	if err != nil {
+		ap.t.Fatal(err)
+	}
+	apX := ap.priv.PublicKey().Bytes()[1:33]
+	prk := hmacSHA256(append(append(append([]byte{}, staX...), apX...), oweGroupP256, 0), z)
+	ap.pmk = hkdfExpand(prk, []byte("OWE Key Generation"), 32)
+	return append([]byte{ieExtension, 35, ieExtOWEDH, oweGroupP256, 0}, apX...)
+}
+
+func (ap *testAP) keyFrame(info uint16, nonce, data, kck []byte) []byte {
+	ap.replay++
+	b := make([]byte, eapolKeyLen+len(data))
+	b[0] = 2
+	b[1] = eapolKeyType
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-eapolHeaderLen))
+	b[4] = keyDescRSN
+	binary.BigEndian.PutUint16(b[offKeyInfo:], info)
+	binary.BigEndian.PutUint16(b[offKeyLength:], 16)
+	b[offReplay+7] = ap.replay
+	copy(b[offNonce:], nonce)
+	b[offRSC] = 5
+	binary.BigEndian.PutUint16(b[offDataLen:], uint16(len(data)))
+	copy(b[eapolKeyLen:], data)
+	if kck != nil {
+		copy(b[offMIC:], keyMIC(kck, b))
+	}
+	return b
+}
+
+func (ap *testAP) msg1() []byte {
+	return ap.keyFrame(keyInfoPairwise|keyInfoAck, ap.anonce, nil, nil)
+}
+
+// msg3 checks message 2 and returns message 3.
+func (ap *testAP) msg3(msg2 []byte) []byte {
+	snonce := msg2[offNonce : offNonce+32]
+	ctx := append(minMax(ap.addr, ap.sta), minMax(ap.anonce, snonce)...)
+	ptk := kdfSHA256(ap.pmk, "Pairwise key expansion", ctx, 384)
+	ap.kck, ap.kek, ap.tk = ptk[0:16], ptk[16:32], ptk[32:48]
+	if !bytes.Equal(msg2[offMIC:offMIC+16], keyMIC(ap.kck, msg2)) {
+		ap.t.Fatal("Message 2 MIC")
+	}
+	gtkKDE := append([]byte{0xdd, 22, 0, 0x0f, 0xac, kdeGTK, 1, 0}, ap.gtk...)
+	igtkKDE := append([]byte{0xdd, 28, 0, 0x0f, 0xac, kdeIGTK, 4, 0, 1, 0, 0, 0, 0, 0},
+		bytes.Repeat([]byte{9}, 16)...)
+	data := append(append(append([]byte{}, ap.rsnIE...), gtkKDE...), igtkKDE...)
+	for len(data)%8 != 0 {
+		if len(data)%8 == 7 {
+			data = append(data, 0)
+		} else {
+			data = append(data, 0xdd, 0)
+		}
+	}
+	return ap.keyFrame(keyInfoPairwise|keyInfoAck|keyInfoMIC|keyInfoSecure|keyInfoInstall|keyInfoEncData,
+		ap.anonce, aesWrap(ap.kek, data), ap.kck)
+}
+
+func TestOWEHandshake(t *testing.T) {
+	sta := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ap := newTestAP(t, sta)
+	rsn, err := parseRSN(oweRSN[2:])
+	if err != nil || rsn.Group != suiteCCMP || !hasSuite(rsn.AKM, akmOWE) {
+		t.Fatal("Unexpected RSN", rsn, err)
+	}
+	o, err := newOWE(rsn, sta, ap.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.MFP || !bytes.Equal(o.rsnIE, oweRSN) {
+		t.Error("Unexpected STA RSN IE", o.rsnIE)
+	}
+	if err := o.SetResponse(ap.assocResp(o.IEs())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(o.pmk, ap.pmk) {
+		t.Fatal("PMK mismatch")
+	}
+
+	msg2, keys, err := o.HandleKey(ap.msg1())
+	if err != nil || keys != nil {
+		t.Fatal("Message 1", err, keys)
+	}
+	if !bytes.Equal(msg2[eapolKeyLen:], o.rsnIE) {
+		t.Error("Message 2 without RSN IE")
+	}
+	msg3 := ap.msg3(msg2)
+
+	bad := append([]byte{}, msg3...)
+	bad[offMIC]++
+	if _, _, err := o.HandleKey(bad); err != errKeyMIC {
+		t.Error("Expecting MIC error", err)
+	}
+
+	msg4, keys, err := o.HandleKey(msg3)
+	if err != nil || keys == nil {
+		t.Fatal("Message 3", err)
+	}
+	if !bytes.Equal(keys.TK, ap.tk) || !bytes.Equal(keys.GTK, ap.gtk) || keys.GTKIdx != 1 ||
+		keys.GTKSeq[0] != 5 || keys.IGTKIdx != 4 || keys.IGTKSeq[0] != 1 || len(keys.IGTK) != 16 {
+		t.Error("Unexpected keys", keys)
+	}
+	info := binary.BigEndian.Uint16(msg4[offKeyInfo:])
+	if info != keyInfoPairwise|keyInfoMIC|keyInfoSecure ||
+		!bytes.Equal(msg4[offMIC:offMIC+16], keyMIC(ap.kck, msg4)) || msg4[offReplay+7] != 2 {
+		t.Error("Unexpected message 4", info)
+	}
+
+	// Replayed message 3
+	if _, _, err := o.HandleKey(msg3); err != errReplay {
+		t.Error("Expecting replay error", err)
+	}
+}
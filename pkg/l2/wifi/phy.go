@@ -0,0 +1,517 @@
+package wifi
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Phy capabilities, from the wiphy dump - the equivalent of 'iw list'.
+// Used to decide what dmesh can do on each radio: monitor, NAN next to
+// a station, which channels can be used for sending.
+
+// Phy is a physical wifi device and its capabilities.
+type Phy struct {
+	// The index of the interface.
+	Index int
+
+	// The name of the interface.
+	Name string
+
+	// The hardware address of the interface.
+	HardwareAddr net.HardwareAddr
+
+	// The physical device that this interface belongs to.
+	PHY int
+
+	// The virtual device number of this interface within a PHY.
+	Device int
+
+	// The operating mode of the interface.
+	Type InterfaceType
+
+	// The interface's wireless frequency in MHz.
+	Frequency int
+
+	// Bands and their channels, with the regulatory flags.
+	Bands []*Band
+
+	// InterfaceTypes that can be created.
+	InterfaceTypes []InterfaceType
+
+	// SoftwareTypes are not limited by the combinations - usually monitor
+	// and AP VLAN.
+	SoftwareTypes []InterfaceType
+
+	// Combinations of interfaces that can be active at the same time.
+	Combinations []InterfaceCombination
+
+	// Commands supported by the driver.
+	Commands []uint8
+
+	// Features is the nl80211 feature flags - FeatureSkTxStatus, etc.
+	Features uint32
+
+	// ExtFeatures is the extended feature bitmap, indexed by ExtFeature*.
+	ExtFeatures []byte
+
+	// MaxRemainOnChannel is the longest ROC the driver accepts.
+	MaxRemainOnChannel time.Duration
+
+	// OffchannelTx is set if frames can be sent with CmdFrame on a
+	// channel other than the operating channel.
+	OffchannelTx bool
+
+	MaxScanSSIDs int
+}
+
+// Band is a frequency band - nl80211.Band2ghz, Band5ghz, Band60ghz.
+type Band struct {
+	ID       int
+	Channels []PhyChannel
+}
+
+// PhyChannel is a channel supported by the phy, with the flags from the
+// regulatory domain.
+type PhyChannel struct {
+	Freq int
+
+	// Disabled channels can't be used at all.
+	Disabled bool
+
+	// NoIR channels can't initiate radiation - no beacons, probes or
+	// action frames unless a beacon was received on the channel.
+	NoIR bool
+
+	// Radar detection is required before sending.
+	Radar bool
+
+	// MaxPower in mBm.
+	MaxPower int
+}
+
+// InterfaceLimit is the max number of interfaces of the types.
+type InterfaceLimit struct {
+	Max   int
+	Types []InterfaceType
+}
+
+// InterfaceCombination is a valid set of concurrent interfaces.
+type InterfaceCombination struct {
+	Limits []InterfaceLimit
+
+	// MaxInterfaces is the total number of interfaces in the combination.
+	MaxInterfaces int
+
+	// NumChannels is the number of different channels the interfaces can
+	// use at the same time.
+	NumChannels int
+}
+
+// Strategy is what dmesh uses on a phy, based on the capabilities.
+type Strategy struct {
+	// Monitor is set if a monitor interface can be created, for
+	// receiving beacons and frames to other addresses.
+	Monitor bool
+
+	// NAN can be sent with CmdFrame and remain on channel.
+	NAN bool
+
+	// NANOffload is set if the driver implements NAN - StartNan and a NAN
+	// interface type.
+	NANOffload bool
+
+	// NANWithSTA is set if NAN can run while a station is connected on a
+	// different channel - the radio supports 2 channels at the same time.
+	NANWithSTA bool
+
+	// OffchannelTx is set if CmdFrame can send on a channel other than
+	// the operating one - AttrOffchannelTxOk.
+	OffchannelTx bool
+
+	// TxStatus is set if the driver reports the ACK status of frames sent
+	// on sockets or the control port - FeatureSkTxStatus or the control
+	// port TX status ext feature.
+	TxStatus bool
+
+	// APScan is set if the phy can scan while an AP or GO is running -
+	// FeatureApScan.
+	APScan bool
+
+	// MaxRemainOnChannel limits the DW listen time.
+	MaxRemainOnChannel time.Duration
+
+	// Freqs that can be used for sending - not disabled, no radar and no
+	// NoIR restriction.
+	Freqs []int
+}
+
+// Phys calls 'CMD_GET_WIPHY' to list the phy devices and their capabilities.
+// The split dump is requested - newer capabilities are only included in
+// split mode. Each phy is sent in multiple messages, merged by index.
+func (c *Client) Phys() ([]*Phy, error) {
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nl80211.AttrSplitWiphyDump, Data: []byte{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: nl80211.CmdGetWiphy,
+			Version: c.familyVersion,
+		},
+		Data: b,
+	}
+
+	flags := netlink.Request | netlink.Dump
+	msgs, err := c.s.Execute(req, c.familyID, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkMessages(msgs, nl80211.CmdNewWiphy); err != nil {
+		return nil, err
+	}
+
+	phys, err := parsePhyDump(msgs)
+	if err != nil {
+		return nil, err
+	}
+	byIndex := map[int]*Phy{}
+	for _, p := range phys {
+		log.Println("PHY: ", p.Name, p.InterfaceTypes, p.Combinations, p.Strategy())
+		byIndex[p.PHY] = p
+	}
+	c.m.Lock()
+	c.phys = byIndex
+	c.m.Unlock()
+	return phys, nil
+}
+
+// parsePhyDump merges the messages of a split wiphy dump.
+func parsePhyDump(msgs []genetlink.Message) ([]*Phy, error) {
+	phys := []*Phy{}
+	byIndex := map[int]*Phy{}
+	for _, m := range msgs {
+		attrs, err := netlink.UnmarshalAttributes(m.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		idx := -1
+		for _, a := range attrs {
+			if a.Type == nl80211.AttrWiphy {
+				idx = int(nlenc.Uint32(a.Data))
+			}
+		}
+		p := byIndex[idx]
+		if p == nil {
+			p = &Phy{}
+			byIndex[idx] = p
+			phys = append(phys, p)
+		}
+		if err := p.parsePhys(attrs); err != nil {
+			return nil, err
+		}
+	}
+	return phys, nil
+}
+
+// parseIftypes parses a nested attribute with one flag per interface type.
+func parseIftypes(b []byte) []InterfaceType {
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return nil
+	}
+	res := []InterfaceType{}
+	for _, a := range attrs {
+		res = append(res, InterfaceType(a.Type))
+	}
+	return res
+}
+
+// parseNestedU32 returns the values of a nested list of u32.
+func parseNestedU32(b []byte) []uint32 {
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return nil
+	}
+	res := []uint32{}
+	for _, a := range attrs {
+		if len(a.Data) == 4 {
+			res = append(res, nlenc.Uint32(a.Data))
+		}
+	}
+	return res
+}
+
+// parseBands adds the channels in the bands attribute. In a split dump
+// the channels of a band may be sent in more than one message.
+func (p *Phy) parseBands(b []byte) error {
+	bands, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return err
+	}
+	for _, ba := range bands {
+		var band *Band
+		for _, e := range p.Bands {
+			if e.ID == int(ba.Type) {
+				band = e
+			}
+		}
+		if band == nil {
+			band = &Band{ID: int(ba.Type)}
+			p.Bands = append(p.Bands, band)
+		}
+
+		attrs, err := netlink.UnmarshalAttributes(ba.Data)
+		if err != nil {
+			return err
+		}
+		for _, a := range attrs {
+			if a.Type != nl80211.BandAttrFreqs {
+				continue
+			}
+			freqs, err := netlink.UnmarshalAttributes(a.Data)
+			if err != nil {
+				return err
+			}
+			for _, f := range freqs {
+				ch, err := parseChannel(f.Data)
+				if err != nil {
+					return err
+				}
+				band.Channels = append(band.Channels, ch)
+			}
+		}
+	}
+	return nil
+}
+
+func parseChannel(b []byte) (PhyChannel, error) {
+	ch := PhyChannel{}
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return ch, err
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case nl80211.FrequencyAttrFreq:
+			ch.Freq = int(nlenc.Uint32(a.Data))
+		case nl80211.FrequencyAttrDisabled:
+			ch.Disabled = true
+		case nl80211.FrequencyAttrNoIr:
+			ch.NoIR = true
+		case nl80211.FrequencyAttrRadar:
+			ch.Radar = true
+		case nl80211.FrequencyAttrMaxTxPower:
+			ch.MaxPower = int(nlenc.Uint32(a.Data))
+		}
+	}
+	return ch, nil
+}
+
+func parseCombinations(b []byte) ([]InterfaceCombination, error) {
+	combs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return nil, err
+	}
+	res := []InterfaceCombination{}
+	for _, ca := range combs {
+		attrs, err := netlink.UnmarshalAttributes(ca.Data)
+		if err != nil {
+			return nil, err
+		}
+		comb := InterfaceCombination{}
+		for _, a := range attrs {
+			switch a.Type {
+			case nl80211.IfaceCombLimits:
+				limits, err := netlink.UnmarshalAttributes(a.Data)
+				if err != nil {
+					return nil, err
+				}
+				for _, la := range limits {
+					lattrs, err := netlink.UnmarshalAttributes(la.Data)
+					if err != nil {
+						return nil, err
+					}
+					l := InterfaceLimit{}
+					for _, a := range lattrs {
+						switch a.Type {
+						case nl80211.IfaceLimitMax:
+							l.Max = int(nlenc.Uint32(a.Data))
+						case nl80211.IfaceLimitTypes:
+							l.Types = parseIftypes(a.Data)
+						}
+					}
+					comb.Limits = append(comb.Limits, l)
+				}
+			case nl80211.IfaceCombMaxnum:
+				comb.MaxInterfaces = int(nlenc.Uint32(a.Data))
+			case nl80211.IfaceCombNumChannels:
+				comb.NumChannels = int(nlenc.Uint32(a.Data))
+			}
+		}
+		res = append(res, comb)
+	}
+	return res, nil
+}
+
+func hasType(types []InterfaceType, t InterfaceType) bool {
+	for _, e := range types {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsType returns true if an interface of the type can be created.
+func (p *Phy) SupportsType(t InterfaceType) bool {
+	return hasType(p.InterfaceTypes, t)
+}
+
+// SupportsCommand returns true if the driver implements the nl80211 command.
+func (p *Phy) SupportsCommand(cmd uint8) bool {
+	for _, c := range p.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFeature checks a nl80211.Feature* flag.
+func (p *Phy) HasFeature(f uint32) bool {
+	return p.Features&f != 0
+}
+
+// HasExtFeature checks a nl80211.ExtFeature* index.
+func (p *Phy) HasExtFeature(i int) bool {
+	if i/8 >= len(p.ExtFeatures) {
+		return false
+	}
+	return p.ExtFeatures[i/8]&(1<<uint(i%8)) != 0
+}
+
+// Concurrent returns true if interfaces of all the types can be active at
+// the same time, and the max number of channels they can use. Software
+// interface types are not counted.
+func (p *Phy) Concurrent(types ...InterfaceType) (int, bool) {
+	hw := []InterfaceType{}
+	for _, t := range types {
+		if !p.SupportsType(t) {
+			return 0, false
+		}
+		if !hasType(p.SoftwareTypes, t) {
+			hw = append(hw, t)
+		}
+	}
+	if len(p.Combinations) == 0 {
+		// No combinations - a single interface, on one channel.
+		return 1, len(hw) <= 1
+	}
+	channels, ok := 0, false
+	for _, c := range p.Combinations {
+		if c.allows(hw) && c.NumChannels > channels {
+			channels, ok = c.NumChannels, true
+		}
+	}
+	return channels, ok
+}
+
+// allows returns true if each of the types can be assigned to a limit.
+func (c *InterfaceCombination) allows(types []InterfaceType) bool {
+	if len(types) > c.MaxInterfaces {
+		return false
+	}
+	used := make([]int, len(c.Limits))
+	var assign func(i int) bool
+	assign = func(i int) bool {
+		if i == len(types) {
+			return true
+		}
+		for j, l := range c.Limits {
+			if used[j] < l.Max && hasType(l.Types, types[i]) {
+				used[j]++
+				if assign(i + 1) {
+					return true
+				}
+				used[j]--
+			}
+		}
+		return false
+	}
+	return assign(0)
+}
+
+// Channel returns the channel for the frequency, or nil if not supported.
+func (p *Phy) Channel(freq int) *PhyChannel {
+	for _, b := range p.Bands {
+		for i := range b.Channels {
+			if b.Channels[i].Freq == freq {
+				return &b.Channels[i]
+			}
+		}
+	}
+	return nil
+}
+
+// CanTransmit returns true if frames can be sent on the frequency without
+// a prior beacon or radar detection.
+func (p *Phy) CanTransmit(freq int) bool {
+	ch := p.Channel(freq)
+	return ch != nil && !ch.Disabled && !ch.NoIR && !ch.Radar
+}
+
+// Frequencies returns the frequencies that can be used for sending.
+func (p *Phy) Frequencies() []int {
+	res := []int{}
+	for _, b := range p.Bands {
+		for _, ch := range b.Channels {
+			if !ch.Disabled && !ch.NoIR && !ch.Radar {
+				res = append(res, ch.Freq)
+			}
+		}
+	}
+	return res
+}
+
+// NANOffload returns true if the driver implements NAN.
+func (p *Phy) NANOffload() bool {
+	return p.SupportsType(InterfaceTypeNAN) && p.SupportsCommand(nl80211.CmdStartNan)
+}
+
+// Strategy returns what dmesh should use on the phy.
+func (p *Phy) Strategy() *Strategy {
+	s := &Strategy{
+		Monitor:      p.SupportsType(InterfaceTypeMonitor),
+		NAN:          p.SupportsCommand(nl80211.CmdFrame) && p.SupportsCommand(nl80211.CmdRemainOnChannel),
+		NANOffload:   p.NANOffload(),
+		OffchannelTx: p.OffchannelTx,
+		TxStatus: p.HasFeature(nl80211.FeatureSkTxStatus) ||
+			p.HasExtFeature(nl80211.ExtFeatureControlPortOverNl80211TxStatus),
+		APScan:             p.HasFeature(nl80211.FeatureApScan),
+		MaxRemainOnChannel: p.MaxRemainOnChannel,
+		Freqs:              p.Frequencies(),
+	}
+	if s.NANOffload {
+		_, s.NANWithSTA = p.Concurrent(InterfaceTypeStation, InterfaceTypeNAN)
+	} else if s.NAN {
+		// User space NAN uses ROC on the station interface - the DW is
+		// only received if the radio can stay on the station channel too.
+		// P2P device is the usual type for the second channel.
+		n, ok := p.Concurrent(InterfaceTypeStation, InterfaceTypeP2PDevice)
+		if !ok {
+			n, ok = p.Concurrent(InterfaceTypeStation, InterfaceTypeAP)
+		}
+		s.NANWithSTA = ok && n >= 2 && p.OffchannelTx
+	}
+	return s
+}
@@ -0,0 +1,170 @@
+package wifi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+func nested(t *testing.T, attrs ...netlink.Attribute) []byte {
+	b, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func flags(t *testing.T, types ...int) []byte {
+	attrs := []netlink.Attribute{}
+	for _, typ := range types {
+		attrs = append(attrs, netlink.Attribute{Type: uint16(typ), Data: []byte{}})
+	}
+	return nested(t, attrs...)
+}
+
+func u32(v int) []byte {
+	return nlenc.Uint32Bytes(uint32(v))
+}
+
+func channel(t *testing.T, idx uint16, freq int, fl ...uint16) netlink.Attribute {
+	attrs := []netlink.Attribute{{Type: nl80211.FrequencyAttrFreq, Data: u32(freq)}}
+	for _, f := range fl {
+		attrs = append(attrs, netlink.Attribute{Type: f, Data: []byte{}})
+	}
+	return netlink.Attribute{Type: idx, Data: nested(t, attrs...)}
+}
+
+// wiphyDump returns a split dump for a single channel radio with STA,
+// AP, P2P and monitor, in the order the kernel sends it.
+func wiphyDump(t *testing.T, numChannels int) []genetlink.Message {
+	hdr := func(attrs ...netlink.Attribute) genetlink.Message {
+		all := append([]netlink.Attribute{
+			{Type: nl80211.AttrWiphy, Data: u32(1)},
+			{Type: nl80211.AttrWiphyName, Data: []byte("phy1\x00")},
+		}, attrs...)
+		return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdNewWiphy},
+			Data: nested(t, all...)}
+	}
+
+	limits := nested(t,
+		netlink.Attribute{Type: 1, Data: nested(t,
+			netlink.Attribute{Type: nl80211.IfaceLimitMax, Data: u32(1)},
+			netlink.Attribute{Type: nl80211.IfaceLimitTypes, Data: flags(t, nl80211.IftypeStation)})},
+		netlink.Attribute{Type: 2, Data: nested(t,
+			netlink.Attribute{Type: nl80211.IfaceLimitMax, Data: u32(1)},
+			netlink.Attribute{Type: nl80211.IfaceLimitTypes,
+				Data: flags(t, nl80211.IftypeAp, nl80211.IftypeP2pGo, nl80211.IftypeP2pDevice)})})
+	combs := nested(t, netlink.Attribute{Type: 1, Data: nested(t,
+		netlink.Attribute{Type: nl80211.IfaceCombLimits, Data: limits},
+		netlink.Attribute{Type: nl80211.IfaceCombMaxnum, Data: u32(2)},
+		netlink.Attribute{Type: nl80211.IfaceCombNumChannels, Data: u32(numChannels)})})
+
+	return []genetlink.Message{
+		hdr(netlink.Attribute{Type: nl80211.AttrMaxRemainOnChannelDuration, Data: u32(5000)},
+			netlink.Attribute{Type: nl80211.AttrOffchannelTxOk, Data: []byte{}},
+			netlink.Attribute{Type: nl80211.AttrFeatureFlags, Data: u32(nl80211.FeatureSkTxStatus)}),
+		hdr(netlink.Attribute{Type: nl80211.AttrSupportedIftypes,
+			Data: flags(t, nl80211.IftypeStation, nl80211.IftypeAp, nl80211.IftypeMonitor,
+				nl80211.IftypeP2pGo, nl80211.IftypeP2pDevice)}),
+		// Band 0 is split in 2 messages
+		hdr(netlink.Attribute{Type: nl80211.AttrWiphyBands, Data: nested(t,
+			netlink.Attribute{Type: nl80211.Band2ghz, Data: nested(t,
+				netlink.Attribute{Type: nl80211.BandAttrFreqs, Data: nested(t,
+					channel(t, 0, 2412),
+					channel(t, 1, 2437)),
+				})})}),
+		hdr(netlink.Attribute{Type: nl80211.AttrWiphyBands, Data: nested(t,
+			netlink.Attribute{Type: nl80211.Band2ghz, Data: nested(t,
+				netlink.Attribute{Type: nl80211.BandAttrFreqs, Data: nested(t,
+					channel(t, 2, 2467, nl80211.FrequencyAttrNoIr),
+					channel(t, 3, 2484, nl80211.FrequencyAttrDisabled)),
+				})})}),
+		hdr(netlink.Attribute{Type: nl80211.AttrWiphyBands, Data: nested(t,
+			netlink.Attribute{Type: nl80211.Band5ghz, Data: nested(t,
+				netlink.Attribute{Type: nl80211.BandAttrFreqs, Data: nested(t,
+					channel(t, 0, 5180),
+					channel(t, 1, 5260, nl80211.FrequencyAttrRadar)),
+				})})}),
+		hdr(netlink.Attribute{Type: nl80211.AttrSupportedCommands, Data: nested(t,
+			netlink.Attribute{Type: 1, Data: u32(nl80211.CmdFrame)},
+			netlink.Attribute{Type: 2, Data: u32(nl80211.CmdRemainOnChannel)})}),
+		hdr(netlink.Attribute{Type: nl80211.AttrSoftwareIftypes, Data: flags(t, nl80211.IftypeMonitor)},
+			netlink.Attribute{Type: nl80211.AttrInterfaceCombinations, Data: combs}),
+		hdr(netlink.Attribute{Type: nl80211.AttrExtFeatures, Data: []byte{0, 0, 0, 0, 0, 0, 0, 0x80}}),
+	}
+}
+
+func TestParsePhyDump(t *testing.T) {
+	phys, err := parsePhyDump(wiphyDump(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(phys) != 1 {
+		t.Fatal("Split dump not merged", len(phys))
+	}
+	p := phys[0]
+	if p.PHY != 1 || p.Name != "phy1" || p.MaxRemainOnChannel != 5*time.Second || !p.OffchannelTx {
+		t.Error("Unexpected phy", p)
+	}
+	if len(p.Bands) != 2 || len(p.Bands[0].Channels) != 4 || len(p.Bands[1].Channels) != 2 {
+		t.Fatal("Unexpected bands", p.Bands)
+	}
+	if !p.Bands[0].Channels[2].NoIR || !p.Bands[0].Channels[3].Disabled || !p.Bands[1].Channels[1].Radar {
+		t.Error("Unexpected channel flags", p.Bands[0].Channels, p.Bands[1].Channels)
+	}
+	freqs := p.Frequencies()
+	if len(freqs) != 3 || freqs[0] != 2412 || freqs[1] != 2437 || freqs[2] != 5180 {
+		t.Error("Unexpected frequencies", freqs)
+	}
+	if p.CanTransmit(2467) || p.CanTransmit(5260) || !p.CanTransmit(5180) || p.CanTransmit(5500) {
+		t.Error("Unexpected CanTransmit")
+	}
+
+	if !p.SupportsType(InterfaceTypeMonitor) || p.SupportsType(InterfaceTypeNAN) ||
+		!p.SupportsCommand(nl80211.CmdFrame) || p.SupportsCommand(nl80211.CmdStartNan) {
+		t.Error("Unexpected types or commands", p.InterfaceTypes, p.Commands)
+	}
+	if !p.HasFeature(nl80211.FeatureSkTxStatus) || p.HasFeature(nl80211.FeatureApScan) ||
+		!p.HasExtFeature(nl80211.ExtFeatureSecureNan) || p.HasExtFeature(nl80211.ExtFeatureRrm) ||
+		p.HasExtFeature(200) {
+		t.Error("Unexpected features", p.Features, p.ExtFeatures)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	phys, _ := parsePhyDump(wiphyDump(t, 1))
+	p := phys[0]
+
+	if n, ok := p.Concurrent(InterfaceTypeStation, InterfaceTypeP2PGroupOwner); !ok || n != 1 {
+		t.Error("STA+GO", n, ok)
+	}
+	// Monitor is a software type, not counted
+	if _, ok := p.Concurrent(InterfaceTypeStation, InterfaceTypeAP, InterfaceTypeMonitor); !ok {
+		t.Error("STA+AP+monitor")
+	}
+	if _, ok := p.Concurrent(InterfaceTypeStation, InterfaceTypeStation); ok {
+		t.Error("2 STA allowed")
+	}
+	if _, ok := p.Concurrent(InterfaceTypeAP, InterfaceTypeP2PGroupOwner); ok {
+		t.Error("AP+GO allowed")
+	}
+	if _, ok := p.Concurrent(InterfaceTypeStation, InterfaceTypeNAN); ok {
+		t.Error("NAN not supported")
+	}
+
+	s := p.Strategy()
+	if !s.Monitor || !s.NAN || s.NANOffload || s.NANWithSTA || !s.OffchannelTx || !s.TxStatus || s.APScan ||
+		len(s.Freqs) != 3 {
+		t.Error("Unexpected single channel strategy", s)
+	}
+
+	phys, _ = parsePhyDump(wiphyDump(t, 2))
+	s = phys[0].Strategy()
+	if !s.NANWithSTA {
+		t.Error("Unexpected multi channel strategy", s)
+	}
+}
@@ -0,0 +1,370 @@
+package wifi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Regulatory domain: which channels can be used in the country, and how.
+// The kernel also applies the domain to the phy channel flags, but the
+// rules have the power limits and some drivers only report the flags for
+// the world domain.
+//
+// WatchReg loads the domain of each phy, and reloads it on RegChange.
+// TxFrame and RemainOnChannel refuse channels that are not allowed, and
+// dmesh uses CheckFreq and AdjustFreq for all channel choices - NAN DW,
+// P2P GO and injection.
+
+var (
+	errFreqNotAllowed = errors.New("channel not allowed in the regulatory domain")
+	errFreqNoIR       = errors.New("channel doesn't allow initiating radiation")
+	errFreqDFS        = errors.New("channel requires radar detection")
+	errNoChannel      = errors.New("no channel allowed for sending")
+	errNoRegDomain    = errors.New("no regulatory domain in reply")
+)
+
+// RegRule is a frequency range of the regulatory domain.
+type RegRule struct {
+	// Start and End of the range, and MaxBandwidth, in kHz.
+	Start        int
+	End          int
+	MaxBandwidth int
+
+	// MaxAntennaGain in mBi and MaxEIRP in mBm.
+	MaxAntennaGain int
+	MaxEIRP        int
+
+	// Flags are the nl80211.Rrf* flags.
+	Flags uint32
+
+	// CACTime is the DFS channel availability check, in ms.
+	CACTime int
+}
+
+// RegDomain is the regulatory domain of a phy, or the global one.
+type RegDomain struct {
+	// Alpha2 is the country, "00" for world.
+	Alpha2 string
+
+	// DFSRegion is nl80211.DfsFcc, DfsEtsi or DfsJp.
+	DFSRegion int
+
+	// SelfManaged is set if the driver has its own domain.
+	SelfManaged bool
+
+	Rules []RegRule
+}
+
+// Rule returns the rule covering the 20MHz channel, or nil.
+func (r *RegDomain) Rule(freq int) *RegRule {
+	lo, hi := (freq-10)*1000, (freq+10)*1000
+	for i := range r.Rules {
+		if r.Rules[i].Start <= lo && hi <= r.Rules[i].End {
+			return &r.Rules[i]
+		}
+	}
+	return nil
+}
+
+// ChannelInfo is what the phy and regulatory domain allow on a channel.
+type ChannelInfo struct {
+	Freq int
+
+	// Allowed is false if the channel is disabled or outside the domain -
+	// it can't be used at all, not even for receiving.
+	Allowed bool
+
+	// NoIR channels can't initiate radiation - only reply to an AP.
+	NoIR bool
+
+	// DFS channels require radar detection before sending.
+	DFS bool
+
+	// MaxPower in mBm, 0 if not known.
+	MaxPower int
+}
+
+// CanTransmit returns true if frames can be sent without a beacon received
+// first or radar detection.
+func (ch *ChannelInfo) CanTransmit() bool {
+	return ch.Allowed && !ch.NoIR && !ch.DFS
+}
+
+// GetReg returns the regulatory domain of the phy - the global one if phy
+// is negative or the phy doesn't have its own.
+func (c *Client) GetReg(phy int) (*RegDomain, error) {
+	var attrs []netlink.Attribute
+	if phy >= 0 {
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrWiphy, Data: nlenc.Uint32Bytes(uint32(phy))})
+	}
+	msgs, err := c.execute(nl80211.CmdGetReg, attrs, netlink.Request)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errNoRegDomain
+	}
+	return parseReg(msgs[0].Data)
+}
+
+func parseReg(b []byte) (*RegDomain, error) {
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return nil, err
+	}
+	r := &RegDomain{}
+	for _, a := range attrs {
+		switch a.Type {
+		case nl80211.AttrRegAlpha2:
+			r.Alpha2 = strings.TrimRight(string(a.Data), "\x00")
+		case nl80211.AttrDfsRegion:
+			if len(a.Data) > 0 {
+				r.DFSRegion = int(a.Data[0])
+			}
+		case nl80211.AttrWiphySelfManagedReg:
+			r.SelfManaged = true
+		case nl80211.AttrRegRules:
+			rules, err := netlink.UnmarshalAttributes(a.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, ra := range rules {
+				rule, err := parseRegRule(ra.Data)
+				if err != nil {
+					return nil, err
+				}
+				r.Rules = append(r.Rules, rule)
+			}
+		}
+	}
+	return r, nil
+}
+
+func parseRegRule(b []byte) (RegRule, error) {
+	var rule RegRule
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return rule, err
+	}
+	for _, a := range attrs {
+		if len(a.Data) != 4 {
+			continue
+		}
+		v := nlenc.Uint32(a.Data)
+		switch a.Type {
+		case nl80211.AttrRegRuleFlags:
+			rule.Flags = v
+		case nl80211.AttrFreqRangeStart:
+			rule.Start = int(v)
+		case nl80211.AttrFreqRangeEnd:
+			rule.End = int(v)
+		case nl80211.AttrFreqRangeMaxBw:
+			rule.MaxBandwidth = int(v)
+		case nl80211.AttrPowerRuleMaxAntGain:
+			rule.MaxAntennaGain = int(v)
+		case nl80211.AttrPowerRuleMaxEirp:
+			rule.MaxEIRP = int(v)
+		case nl80211.AttrDfsCacTime:
+			rule.CACTime = int(v)
+		}
+	}
+	return rule, nil
+}
+
+// WatchReg loads the regulatory domain and channels of the phys, and
+// reloads them when the domain changes. Until it is called all channels
+// are allowed - the kernel still rejects the illegal ones.
+func (c *Client) WatchReg() error {
+	if err := c.joinGroup(nl80211.MulticastGroupReg); err != nil {
+		return err
+	}
+	return c.loadReg()
+}
+
+// loadReg reads the phy channels and the domain of each phy.
+func (c *Client) loadReg() error {
+	phys, err := c.Phys()
+	if err != nil {
+		return err
+	}
+	global, err := c.GetReg(-1)
+	if err != nil {
+		return err
+	}
+	regs := map[int]*RegDomain{}
+	regPhys := map[int]*Phy{}
+	for _, p := range phys {
+		regPhys[p.PHY] = p
+		regs[p.PHY] = global
+		if r, err := c.GetReg(p.PHY); err == nil {
+			regs[p.PHY] = r
+		}
+		log.Println("REG: ", p.Name, regs[p.PHY].Alpha2, len(regs[p.PHY].Rules))
+	}
+	c.m.Lock()
+	c.reg = global
+	c.regs = regs
+	c.regPhys = regPhys
+	c.m.Unlock()
+	return nil
+}
+
+// onRegChange reloads the domain, if WatchReg was called.
+func (c *Client) onRegChange(e *RegChange) {
+	c.m.Lock()
+	watching := c.reg != nil
+	c.m.Unlock()
+	if !watching {
+		return
+	}
+	log.Println("REG: change", e.Alpha2, e.Initiator, e.Type)
+	if err := c.loadReg(); err != nil {
+		log.Println("REG: reload failed", err)
+	}
+}
+
+// Reg returns the domain of the phy loaded by WatchReg, or nil.
+func (c *Client) Reg(phy int) *RegDomain {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if r := c.regs[phy]; r != nil {
+		return r
+	}
+	return c.reg
+}
+
+// ChannelInfo returns the restrictions for the channel on the phy, from
+// the phy channel flags and the regulatory rule. Without WatchReg all
+// channels are allowed.
+func (c *Client) ChannelInfo(phy, freq int) ChannelInfo {
+	p, r := c.regPhy(phy)
+	return channelInfo(p, r, freq)
+}
+
+// regPhy returns the phy and its domain - the global domain if the phy
+// is not self managed.
+func (c *Client) regPhy(phy int) (*Phy, *RegDomain) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	r := c.regs[phy]
+	if r == nil {
+		r = c.reg
+	}
+	return c.regPhys[phy], r
+}
+
+func channelInfo(p *Phy, r *RegDomain, freq int) ChannelInfo {
+	ch := ChannelInfo{Freq: freq, Allowed: true}
+	if p != nil {
+		pc := p.Channel(freq)
+		if pc == nil || pc.Disabled {
+			ch.Allowed = false
+			return ch
+		}
+		ch.NoIR = pc.NoIR
+		ch.DFS = pc.Radar
+		ch.MaxPower = pc.MaxPower
+	}
+	if r != nil {
+		rule := r.Rule(freq)
+		if rule == nil {
+			ch.Allowed = false
+			return ch
+		}
+		if rule.Flags&nl80211.RrfNoIr != 0 {
+			ch.NoIR = true
+		}
+		if rule.Flags&nl80211.RrfDfs != 0 {
+			ch.DFS = true
+		}
+		if rule.MaxEIRP > 0 && (ch.MaxPower == 0 || rule.MaxEIRP < ch.MaxPower) {
+			ch.MaxPower = rule.MaxEIRP
+		}
+	}
+	return ch
+}
+
+// Channels returns the channels of the phy loaded by WatchReg, with the
+// restrictions of ChannelInfo.
+func (c *Client) Channels(phy int) []ChannelInfo {
+	p, r := c.regPhy(phy)
+	if p == nil {
+		return nil
+	}
+	res := []ChannelInfo{}
+	for _, b := range p.Bands {
+		for _, pc := range b.Channels {
+			res = append(res, channelInfo(p, r, pc.Freq))
+		}
+	}
+	return res
+}
+
+// CheckFreq returns an error if frames can't be sent on the channel.
+func (c *Client) CheckFreq(phy, freq int) error {
+	ch := c.ChannelInfo(phy, freq)
+	switch {
+	case !ch.Allowed:
+		return fmt.Errorf("%w: %d", errFreqNotAllowed, freq)
+	case ch.NoIR:
+		return fmt.Errorf("%w: %d", errFreqNoIR, freq)
+	case ch.DFS:
+		return fmt.Errorf("%w: %d", errFreqDFS, freq)
+	}
+	return nil
+}
+
+// AdjustFreq returns freq if frames can be sent on it, else the closest
+// channel in the same band that can be used, else any usable channel.
+func (c *Client) AdjustFreq(phy, freq int) (int, error) {
+	if c.CheckFreq(phy, freq) == nil {
+		return freq, nil
+	}
+	best, other := 0, 0
+	for _, ch := range c.Channels(phy) {
+		if !ch.CanTransmit() {
+			continue
+		}
+		if band(ch.Freq) != band(freq) {
+			if other == 0 {
+				other = ch.Freq
+			}
+			continue
+		}
+		if best == 0 || abs(ch.Freq-freq) < abs(best-freq) {
+			best = ch.Freq
+		}
+	}
+	if best == 0 {
+		best = other
+	}
+	if best == 0 {
+		return 0, errNoChannel
+	}
+	log.Println("REG: using", best, "instead of", freq)
+	return best, nil
+}
+
+// band returns the band of the frequency - 2, 5 or 6 GHz.
+func band(freq int) int {
+	switch {
+	case freq < 3000:
+		return 2
+	case freq < 5950:
+		return 5
+	}
+	return 6
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,179 @@
+package wifi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+)
+
+var regFamily = genetlink.Family{
+	ID:      0x1c,
+	Version: 1,
+	Name:    nl80211.GenlName,
+	Groups:  []genetlink.MulticastGroup{{ID: 6, Name: nl80211.MulticastGroupReg}},
+}
+
+func regRule(t *testing.T, idx uint16, start, end, eirp int, flags uint32) netlink.Attribute {
+	return netlink.Attribute{Type: idx, Data: nested(t,
+		netlink.Attribute{Type: nl80211.AttrRegRuleFlags, Data: u32(int(flags))},
+		netlink.Attribute{Type: nl80211.AttrFreqRangeStart, Data: u32(start * 1000)},
+		netlink.Attribute{Type: nl80211.AttrFreqRangeEnd, Data: u32(end * 1000)},
+		netlink.Attribute{Type: nl80211.AttrFreqRangeMaxBw, Data: u32(40000)},
+		netlink.Attribute{Type: nl80211.AttrPowerRuleMaxEirp, Data: u32(eirp)})}
+}
+
+// regMsg is a reply to CmdGetReg. The 2.4GHz rule in "XX" ends below
+// channel 6.
+func regMsg(t *testing.T, alpha2 string) genetlink.Message {
+	end24 := 2483
+	if alpha2 == "XX" {
+		end24 = 2432
+	}
+	return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdGetReg, Version: 1},
+		Data: nested(t,
+			netlink.Attribute{Type: nl80211.AttrRegAlpha2, Data: []byte(alpha2 + "\x00")},
+			netlink.Attribute{Type: nl80211.AttrDfsRegion, Data: []byte{nl80211.DfsEtsi}},
+			netlink.Attribute{Type: nl80211.AttrRegRules, Data: nested(t,
+				regRule(t, 1, 2402, end24, 2000, 0),
+				regRule(t, 2, 5170, 5250, 2300, nl80211.RrfAutoBw),
+				regRule(t, 3, 5250, 5330, 2000, nl80211.RrfDfs))})}
+}
+
+// newFakeReg returns a Client using a fake kernel with a 2.4 and 5GHz phy
+// in the regulatory domain.
+func newFakeReg(t *testing.T, alpha2 string) (*Client, *fakeNL80211) {
+	c, f := newFakeNL80211(t, regFamily)
+	msgs := wiphyDump(t, 1)
+	for i := range msgs {
+		msgs[i].Header.Version = 1
+	}
+	f.reply(nl80211.CmdGetWiphy, msgs...)
+	f.reply(nl80211.CmdGetReg, regMsg(t, alpha2))
+	return c, f
+}
+
+func TestParseReg(t *testing.T) {
+	r, err := parseReg(regMsg(t, "DE").Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Alpha2 != "DE" || r.DFSRegion != nl80211.DfsEtsi || len(r.Rules) != 3 {
+		t.Fatal("Unexpected domain", r)
+	}
+	if rule := r.Rule(2437); rule == nil || rule.MaxEIRP != 2000 || rule.Start != 2402000 {
+		t.Error("Unexpected rule", rule)
+	}
+	// 5250 is the edge of 2 rules - ch 52 (5260) is in the DFS rule.
+	if rule := r.Rule(5260); rule == nil || rule.Flags&nl80211.RrfDfs == 0 {
+		t.Error("Unexpected rule", rule)
+	}
+	if r.Rule(5500) != nil {
+		t.Error("Channel outside the domain")
+	}
+}
+
+func TestChannelInfo(t *testing.T) {
+	phys, err := parsePhyDump(wiphyDump(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := phys[0]
+	r, _ := parseReg(regMsg(t, "DE").Data)
+	for _, tc := range []struct {
+		freq     int
+		want     ChannelInfo
+		transmit bool
+	}{
+		{freq: 2437, want: ChannelInfo{Freq: 2437, Allowed: true, MaxPower: 2000}, transmit: true},
+		{freq: 2467, want: ChannelInfo{Freq: 2467, Allowed: true, NoIR: true, MaxPower: 2000}},
+		{freq: 2484, want: ChannelInfo{Freq: 2484}},
+		{freq: 5180, want: ChannelInfo{Freq: 5180, Allowed: true, MaxPower: 2300}, transmit: true},
+		{freq: 5260, want: ChannelInfo{Freq: 5260, Allowed: true, DFS: true, MaxPower: 2000}},
+		{freq: 5500, want: ChannelInfo{Freq: 5500}},
+	} {
+		ch := channelInfo(p, r, tc.freq)
+		if ch != tc.want || ch.CanTransmit() != tc.transmit {
+			t.Error("Unexpected channel", ch, tc.want)
+		}
+	}
+	// Nothing known - the kernel decides.
+	if ch := channelInfo(nil, nil, 5500); !ch.CanTransmit() {
+		t.Error("Unexpected channel", ch)
+	}
+}
+
+// Phys without their own domain use the global one.
+func TestChannelsGlobal(t *testing.T) {
+	phys, err := parsePhyDump(wiphyDump(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := parseReg(regMsg(t, "DE").Data)
+	c := &Client{reg: r, regPhys: map[int]*Phy{1: phys[0]}}
+	chs := c.Channels(1)
+	for _, ch := range chs {
+		if ch != c.ChannelInfo(1, ch.Freq) {
+			t.Error("Unexpected channel", ch, c.ChannelInfo(1, ch.Freq))
+		}
+		if ch.Freq == 2467 && !ch.NoIR {
+			t.Error("Global domain not used", ch)
+		}
+	}
+	if len(chs) != 6 {
+		t.Error("Unexpected channels", chs)
+	}
+}
+
+func TestWatchReg(t *testing.T) {
+	c, f := newFakeReg(t, "DE")
+	ifi := &Interface{Index: 3, PHY: 1}
+
+	if err := c.CheckFreq(1, 2484); err != nil {
+		t.Error("Channels allowed before WatchReg", err)
+	}
+	if err := c.WatchReg(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Reg(1).Alpha2 != "DE" || len(c.Channels(1)) != 6 {
+		t.Fatal("Domain not loaded", c.Reg(1), c.Channels(1))
+	}
+	if err := c.CheckFreq(1, 2467); !errors.Is(err, errFreqNoIR) {
+		t.Error("Expecting NoIR", err)
+	}
+	if err := c.CheckFreq(1, 5260); !errors.Is(err, errFreqDFS) {
+		t.Error("Expecting DFS", err)
+	}
+	if _, err := c.TxFrame(ifi, []byte{0}, 2484, 10); !errors.Is(err, errFreqNotAllowed) {
+		t.Error("Frame sent on disabled channel", err)
+	}
+	if _, err := c.RemainOnChannel(ifi, 2484, 10); !errors.Is(err, errFreqNotAllowed) {
+		t.Error("ROC on disabled channel", err)
+	}
+	if freq, err := c.AdjustFreq(1, 2437); err != nil || freq != 2437 {
+		t.Error("Unexpected channel", freq, err)
+	}
+
+	// Channel 6 is not in the new domain.
+	f.reply(nl80211.CmdGetReg, regMsg(t, "XX"))
+	f.inject(eventNL(t, 0, nl80211.CmdRegChange,
+		netlink.Attribute{Type: nl80211.AttrRegAlpha2, Data: []byte("XX\x00")}))
+	for i := 0; c.Reg(1).Alpha2 != "XX"; i++ {
+		if i > 100 {
+			t.Fatal("Domain not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.CheckFreq(1, NANFreq); !errors.Is(err, errFreqNotAllowed) {
+		t.Error("Expecting channel 6 not allowed", err)
+	}
+	if freq, err := c.AdjustFreq(1, 2437); err != nil || freq != 2412 {
+		t.Error("Unexpected channel", freq, err)
+	}
+	if freq, err := c.AdjustFreq(1, 5200); err != nil || freq != 5180 {
+		t.Error("Unexpected channel", freq, err)
+	}
+}
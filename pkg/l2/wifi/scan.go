@@ -0,0 +1,300 @@
+package wifi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Native scan, for nodes without wpa_supplicant - OpenWrt and MIPS builds.
+// The scan is triggered on the interface, and the kernel sends
+// NewScanResults (or ScanAborted) on the "scan" multicast group when done.
+// The results are the kernel BSS cache, read with a GetScan dump.
+
+var (
+	errScanAborted = errors.New("scan aborted")
+	errNoGroup     = errors.New("nl80211 multicast group not found")
+)
+
+// scanTimeout is used if the context has no deadline. A full active scan
+// on 2.4 and 5GHz takes 3-5 seconds.
+const scanTimeout = 10 * time.Second
+
+// ScanRequest holds the scan options. The zero value is an active scan of
+// all channels.
+type ScanRequest struct {
+	// SSIDs to probe for, in an active scan. Results are also filtered
+	// to these SSIDs. If empty, the wildcard SSID is probed.
+	SSIDs []string
+
+	// Freqs to scan, in MHz. Results are filtered to these frequencies.
+	// If empty, all supported channels are scanned.
+	Freqs []int
+
+	// Passive scans only listen for beacons - no probe requests are sent.
+	// Required on DFS channels, and avoids revealing the node.
+	Passive bool
+
+	// Flush removes the cached BSS entries before the scan, so results
+	// only include BSSs seen in this scan.
+	Flush bool
+}
+
+// attrs returns the TriggerScan attributes for the request.
+func (r *ScanRequest) attrs(ifi *Interface) ([]netlink.Attribute, error) {
+	attrs := []netlink.Attribute{
+		{
+			Type: nl80211.AttrIfindex,
+			Data: nlenc.Uint32Bytes(uint32(ifi.Index)),
+		},
+	}
+
+	// No SSIDs attribute means passive scan.
+	if !r.Passive {
+		ssids := []netlink.Attribute{}
+		for i, s := range r.SSIDs {
+			ssids = append(ssids, netlink.Attribute{Type: uint16(i + 1), Data: []byte(s)})
+		}
+		if len(ssids) == 0 {
+			ssids = append(ssids, netlink.Attribute{Type: 1, Data: []byte{}})
+		}
+		b, err := netlink.MarshalAttributes(ssids)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrScanSsids, Data: b})
+	}
+
+	if len(r.Freqs) > 0 {
+		freqs := []netlink.Attribute{}
+		for i, f := range r.Freqs {
+			freqs = append(freqs, netlink.Attribute{Type: uint16(i + 1),
+				Data: nlenc.Uint32Bytes(uint32(f))})
+		}
+		b, err := netlink.MarshalAttributes(freqs)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrScanFrequencies, Data: b})
+	}
+
+	if r.Flush {
+		attrs = append(attrs, netlink.Attribute{Type: nl80211.AttrScanFlags,
+			Data: nlenc.Uint32Bytes(nl80211.ScanFlagFlush)})
+	}
+	return attrs, nil
+}
+
+// match returns true if the BSS matches the SSID and frequency filters.
+func (r *ScanRequest) match(b *BSS) bool {
+	if len(r.SSIDs) > 0 {
+		found := false
+		for _, s := range r.SSIDs {
+			if s == b.SSID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Freqs) > 0 {
+		for _, f := range r.Freqs {
+			if f == b.Frequency {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Scan triggers a scan on the interface, waits for it to complete and
+// returns the matching BSSs. req may be nil.
+func (c *Client) Scan(ctx context.Context, ifi *Interface, req *ScanRequest) ([]*BSS, error) {
+	if req == nil {
+		req = &ScanRequest{}
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scanTimeout)
+		defer cancel()
+	}
+
+	// Subscribe and join before the trigger, so the done event is not
+	// missed.
+	sub := c.Events.Subscribe(SubscribeOptions{
+		Kinds:   []EventKind{KindScanDone, KindScanAborted},
+		Ifindex: ifi.Index,
+	})
+	defer sub.Close()
+	if err := c.joinGroup(nl80211.MulticastGroupScan); err != nil {
+		return nil, err
+	}
+
+	attrs, err := req.attrs(ifi)
+	if err != nil {
+		return nil, err
+	}
+	b, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.s.Execute(genetlink.Message{
+		Header: genetlink.Header{
+			Command: nl80211.CmdTriggerScan,
+			Version: c.familyVersion,
+		},
+		Data: b,
+	}, c.familyID, netlink.Request|netlink.Acknowledge)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitScan(ctx, sub); err != nil {
+		return nil, err
+	}
+	return c.ScanResults(ifi, req)
+}
+
+// joinGroup joins the nl80211 multicast group with the name. Joining a
+// group again has no effect.
+func (c *Client) joinGroup(name string) error {
+	for _, g := range c.family.Groups {
+		if g.Name == name {
+			return c.s.JoinGroup(g.ID)
+		}
+	}
+	return errNoGroup
+}
+
+// waitScan waits for the scan done or aborted event.
+func waitScan(ctx context.Context, sub *Subscription) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ev, ok := <-sub.C:
+		if !ok {
+			return errSessionClosed
+		}
+		if ev.Kind() == KindScanAborted {
+			return errScanAborted
+		}
+		return nil
+	}
+}
+
+// ScanResults returns the cached BSSs of the interface that match the
+// request - without scanning. req may be nil.
+func (c *Client) ScanResults(ifi *Interface, req *ScanRequest) ([]*BSS, error) {
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{
+			Type: nl80211.AttrIfindex,
+			Data: nlenc.Uint32Bytes(uint32(ifi.Index)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := c.s.Execute(genetlink.Message{
+		Header: genetlink.Header{
+			Command: nl80211.CmdGetScan,
+			Version: c.familyVersion,
+		},
+		Data: b,
+	}, c.familyID, netlink.Request|netlink.Dump)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkMessages(msgs, nl80211.CmdNewScanResults); err != nil {
+		return nil, err
+	}
+	return parseScanResults(msgs, req)
+}
+
+// parseScanResults returns all BSSs in a GetScan dump that match req.
+func parseScanResults(msgs []genetlink.Message, req *ScanRequest) ([]*BSS, error) {
+	if req == nil {
+		req = &ScanRequest{}
+	}
+	res := []*BSS{}
+	for _, m := range msgs {
+		attrs, err := netlink.UnmarshalAttributes(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attrs {
+			if a.Type != nl80211.AttrBss {
+				continue
+			}
+			nattrs, err := netlink.UnmarshalAttributes(a.Data)
+			if err != nil {
+				return nil, err
+			}
+			bss := &BSS{}
+			if err := bss.parseAttributes(nattrs); err != nil {
+				return nil, err
+			}
+			if req.match(bss) {
+				res = append(res, bss)
+			}
+		}
+	}
+	return res, nil
+}
+
+// IE IDs used for the capability flags.
+const (
+	ieRSN    = 48
+	ieVendor = 221
+)
+
+var wpaOUI = []byte{0x00, 0x50, 0xf2, 0x01}
+
+// Flags returns the capabilities in the wpa_supplicant scan results
+// format - for example "[WPA2][ESS]".
+func (b *BSS) Flags() string {
+	var f bytes.Buffer
+	hasRSN, hasWPA := false, false
+	ies, _ := ParseIEs(b.IEs)
+	for _, ie := range ies {
+		switch ie.ID {
+		case ieRSN:
+			hasRSN = true
+		case ieVendor:
+			if bytes.HasPrefix(ie.Data, wpaOUI) {
+				hasWPA = true
+			}
+		}
+	}
+	if hasWPA {
+		f.WriteString("[WPA]")
+	}
+	if hasRSN {
+		f.WriteString("[WPA2]")
+	}
+	if !hasWPA && !hasRSN && b.Capability&capPrivacy != 0 {
+		f.WriteString("[WEP]")
+	}
+	if b.Capability&capESS != 0 {
+		f.WriteString("[ESS]")
+	}
+	if b.Capability&capIBSS != 0 {
+		f.WriteString("[IBSS]")
+	}
+	return f.String()
+}
+
+// Capability information bits, in beacons and probe responses.
+const (
+	capESS     = 1 << 0
+	capIBSS    = 1 << 1
+	capPrivacy = 1 << 4
+)
@@ -0,0 +1,110 @@
+package wifi
+
+import (
+	"net"
+	"testing"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// scanResult returns a NewScanResults message, as in a GetScan dump.
+func scanResult(t *testing.T, bssid net.HardwareAddr, ssid string, freq int, mbm int32, ies []byte) genetlink.Message {
+	ie := append([]byte{IE_SSID, byte(len(ssid))}, ssid...)
+	ie = append(ie, ies...)
+	bss, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nl80211.BssBssid, Data: bssid},
+		{Type: nl80211.BssFrequency, Data: nlenc.Uint32Bytes(uint32(freq))},
+		{Type: nl80211.BssCapability, Data: nlenc.Uint16Bytes(capESS | capPrivacy)},
+		{Type: nl80211.BssSignalMbm, Data: nlenc.Uint32Bytes(uint32(mbm))},
+		{Type: nl80211.BssSeenMsAgo, Data: nlenc.Uint32Bytes(1500)},
+		{Type: nl80211.BssInformationElements, Data: ie},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(3)},
+		{Type: nl80211.AttrBss, Data: bss},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdNewScanResults}, Data: b}
+}
+
+func TestParseScanResults(t *testing.T) {
+	rsn := []byte{ieRSN, 2, 1, 0}
+	msgs := []genetlink.Message{
+		scanResult(t, net.HardwareAddr{2, 0, 0, 0, 0, 1}, "DIRECT-ab", 2437, -4500, rsn),
+		scanResult(t, net.HardwareAddr{2, 0, 0, 0, 0, 2}, "other", 5180, -7000, nil),
+	}
+
+	res, err := parseScanResults(msgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatal("Expecting 2 results", len(res))
+	}
+	b := res[0]
+	if b.SSID != "DIRECT-ab" || b.Frequency != 2437 || b.Signal != -45 ||
+		b.LastSeen.Milliseconds() != 1500 || b.BSSID.String() != "02:00:00:00:00:01" {
+		t.Error("Unexpected BSS", b)
+	}
+	if b.Flags() != "[WPA2][ESS]" || res[1].Flags() != "[WEP][ESS]" {
+		t.Error("Unexpected flags", b.Flags(), res[1].Flags())
+	}
+
+	res, _ = parseScanResults(msgs, &ScanRequest{Freqs: []int{5180}})
+	if len(res) != 1 || res[0].SSID != "other" {
+		t.Error("Frequency filter", res)
+	}
+	res, _ = parseScanResults(msgs, &ScanRequest{SSIDs: []string{"DIRECT-ab"}, Freqs: []int{5180}})
+	if len(res) != 0 {
+		t.Error("SSID filter", res)
+	}
+}
+
+func TestScanRequestAttrs(t *testing.T) {
+	ifi := &Interface{Index: 3}
+	find := func(attrs []netlink.Attribute, typ uint16) *netlink.Attribute {
+		for i := range attrs {
+			if attrs[i].Type == typ {
+				return &attrs[i]
+			}
+		}
+		return nil
+	}
+
+	// Active, wildcard SSID
+	attrs, err := (&ScanRequest{}).attrs(ifi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := find(attrs, nl80211.AttrScanSsids)
+	if a == nil {
+		t.Fatal("Missing SSIDs")
+	}
+	ssids, _ := netlink.UnmarshalAttributes(a.Data)
+	if len(ssids) != 1 || len(ssids[0].Data) != 0 {
+		t.Error("Expecting wildcard SSID", ssids)
+	}
+	if find(attrs, nl80211.AttrScanFlags) != nil || find(attrs, nl80211.AttrScanFrequencies) != nil {
+		t.Error("Unexpected attributes", attrs)
+	}
+
+	attrs, _ = (&ScanRequest{Passive: true, Flush: true, Freqs: []int{2412, 2437}}).attrs(ifi)
+	if find(attrs, nl80211.AttrScanSsids) != nil {
+		t.Error("Passive scan with SSIDs")
+	}
+	if a := find(attrs, nl80211.AttrScanFlags); a == nil || nlenc.Uint32(a.Data) != nl80211.ScanFlagFlush {
+		t.Error("Missing flush")
+	}
+	freqs, _ := netlink.UnmarshalAttributes(find(attrs, nl80211.AttrScanFrequencies).Data)
+	if len(freqs) != 2 || nlenc.Uint32(freqs[1].Data) != 2437 {
+		t.Error("Unexpected freqs", freqs)
+	}
+}
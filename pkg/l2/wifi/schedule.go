@@ -0,0 +1,132 @@
+package wifi
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+)
+
+// Frames to a peer with a known committed schedule are sent on the peer's
+// channel, at the start of its next committed slot. Otherwise - or if the
+// DW is sooner - they wait for the DW.
+
+// SetSchedule changes the local availability, advertised in discovery
+// frames and data path negotiation.
+func (c *Nan) SetSchedule(s *nan.Schedule) {
+	c.m.Lock()
+	c.Schedule = s
+	c.m.Unlock()
+	c.DataPaths.SetAvailability(s.Availability(), s.DeviceCapability())
+}
+
+// radioSchedule returns a schedule committed on the channel the radio
+// stays on between the DWs - none if 0 - and potential on the other
+// channels. Peers send in the committed slots, so only a channel the radio
+// is on can be committed.
+func radioSchedule(committed int, potential ...int) *nan.Schedule {
+	var slots []nan.Slot
+	seen := map[int]bool{}
+	for i, f := range append([]int{committed}, potential...) {
+		ch, err := nan.FreqChannel(f)
+		if err != nil || seen[f] {
+			continue
+		}
+		seen[f] = true
+		t := uint8(nan.AvailPotential)
+		if i == 0 {
+			t = nan.AvailCommitted
+		}
+		slots = append(slots, nan.Slot{Type: t, Channel: ch, Slots: nan.AllSlots, Preference: 3})
+	}
+	s := nan.NewSchedule()
+	s.Set(slots)
+	return s
+}
+
+// SelectChannels replaces the schedule using the client ranking. The
+// committed channel is the station channel if connected - the radio stays
+// there. Otherwise it is the best 2.4GHz channel, channel 6 if not much
+// worse, and the monitor mon is tuned to it - without a monitor nothing
+// keeps the radio there and only the DW is committed. The ranked 2.4GHz
+// channel, and the best 5GHz channel if the radio doesn't have to stay on
+// the station channel, are potential.
+func (c *Nan) SelectChannels(cc ChannelChoice, mon *Interface) error {
+	if c.client == nil {
+		return errNoChannel
+	}
+	cc.Band = 2
+	cc.Prefer = NANFreq
+	freqs, err := c.client.SelectChannels(c.IFace, cc)
+	if err != nil {
+		return err
+	}
+	committed := cc.StaFreq
+	if committed == 0 && mon != nil {
+		if err := c.client.SetChannel(mon, ChannelConfig{Freq: freqs[0]}); err != nil {
+			log.Println("NAN: monitor channel not set, no committed channel", mon.Name, freqs[0], err)
+		} else {
+			committed = freqs[0]
+		}
+	}
+	potential := []int{freqs[0]}
+	if !cc.SingleChannel {
+		cc.Band = 5
+		if freqs, err := c.client.SelectChannels(c.IFace, cc); err == nil {
+			potential = append(potential, freqs[0])
+		}
+	}
+	log.Println("NAN: schedule channels", c.IFace.Name, committed, potential)
+	c.SetSchedule(radioSchedule(committed, potential...))
+	return nil
+}
+
+// UpdatePeer saves the availability of the peer, if the attributes have
+// one. Called for received SDFs and NAFs.
+func (c *Nan) UpdatePeer(src net.HardwareAddr, attrs []nan.Attribute) {
+	ps := nan.PeerSchedule(attrs)
+	if ps == nil {
+		return
+	}
+	c.m.Lock()
+	c.peerSchedules[src.String()] = ps
+	c.m.Unlock()
+}
+
+// PeerSchedule returns the last received availability of the peer, or nil.
+func (c *Nan) PeerSchedule(peer net.HardwareAddr) *nan.Schedule {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.peerSchedules[peer.String()]
+}
+
+// sendToPeer sends a SDF in the next committed slot of the peer, or in the
+// next DW.
+func (c *Nan) sendToPeer(to net.HardwareAddr, done func(TxResult), attrs ...nan.Attribute) error {
+	ps := c.PeerSchedule(to)
+	if ps == nil || to[0]&1 == 1 {
+		return c.sendSDF(to, NANFreq, done, attrs...)
+	}
+
+	now := time.Now()
+	tsf := c.Sync.TSF(now)
+	ch, start, ok := ps.Next(tsf, nan.AvailCommitted)
+	delay := time.Duration(start-tsf) * time.Microsecond
+	if !ok || delay >= c.Sync.NextDW(now).Sub(now) {
+		return c.sendSDF(to, NANFreq, done, attrs...)
+	}
+
+	if err := nan.ValidateAttributes(attrs...); err != nil {
+		return err
+	}
+	time.AfterFunc(delay, func() {
+		b := appendMgmtHeader(make([]byte, 0, 256), 0xD0, to, c.Sync.ClusterID())
+		b = nan.AppendSDFHeader(b)
+		b, _ = nan.AppendAttributes(b, attrs...)
+		if err := c.SendFrame(b, ch.Freq(), nan.SlotDuration, done); err != nil {
+			log.Println("NAN: send in peer slot", to, ch, err)
+		}
+	})
+	return nil
+}
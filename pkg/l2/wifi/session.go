@@ -0,0 +1,344 @@
+package wifi
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Problems with mdlayher netlink Conn, when used for nl80211:
+// - Execute assumes all received packets are for itself - a multicast
+// event received while waiting is treated as the reply.
+// - Receive assumes the messages are a sequence for the same request, and
+// drops the batch if it has an error - the sequence of the error is lost.
+//
+// The old workaround was a second connection for receive, with frame
+// registrations sent on it before starting the read loop. Session owns a
+// single socket instead: one goroutine reads all messages, replies and
+// errors are matched to the request by sequence and port ID, everything
+// else - including all multicast messages - is an event. Execute, JoinGroup and RegisterFrame can be called at any time,
+// from any goroutine.
+
+var (
+	errSessionClosed = errors.New("netlink session closed")
+	errTimeout       = errors.New("netlink request timeout")
+
+	// errOverrun is returned for requests pending when the socket buffer
+	// overran - their replies may be lost.
+	errOverrun = errors.New("netlink receive overrun")
+)
+
+const (
+	// executeTimeout is the default Session.Timeout. Dumps of large BSS
+	// caches take a while.
+	executeTimeout = 10 * time.Second
+
+	// maxEvents is the max number of events waiting for onEvent - newer
+	// events are dropped.
+	maxEvents = 1024
+)
+
+// Socket is the netlink socket owned by the Session. Receive returns all
+// messages in a datagram, including errors, and the multicast group it
+// was sent to - 0 for unicast. PID is the port ID of the socket, set in
+// the replies. Tests and the simulated radios in package sim use a fake
+// kernel.
+type Socket interface {
+	Send(m netlink.Message) error
+	Receive() ([]netlink.Message, uint32, error)
+	JoinGroup(group uint32) error
+	PID() uint32
+	Close() error
+}
+
+// Session multiplexes nl80211 requests and events on one socket.
+type Session struct {
+	sock   Socket
+	family uint16
+	pid    uint32
+
+	// Timeout for Execute.
+	Timeout time.Duration
+
+	// Last used sequence.
+	seq uint32
+
+	m       sync.Mutex
+	pending map[uint32]*request
+	events  []genetlink.Message
+	dropped int
+	err     error
+
+	// onEvent is called for unsolicited messages, from a separate
+	// goroutine - so handlers can call Execute.
+	onEvent func(genetlink.Message)
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// request is an Execute waiting for its replies.
+type request struct {
+	msgs []genetlink.Message
+	res  chan error
+}
+
+// newSession starts reading the socket. Messages for the family that are
+// not replies are passed to onEvent.
+func newSession(sock Socket, family uint16, onEvent func(genetlink.Message)) *Session {
+	s := &Session{
+		sock:    sock,
+		family:  family,
+		pid:     sock.PID(),
+		Timeout: executeTimeout,
+		pending: map[uint32]*request{},
+		onEvent: onEvent,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.eventLoop()
+	return s
+}
+
+// Execute sends the request and waits for the replies. It is safe to
+// call from multiple goroutines - replies are matched by sequence and
+// port ID.
+// Acknowledge is added to non-dump requests, to detect completion.
+func (s *Session) Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	r := &request{res: make(chan error, 1)}
+	if flags&netlink.Dump != netlink.Dump {
+		// Dumps complete with Done - the kernel doesn't ack them.
+		flags |= netlink.Acknowledge
+	}
+	seq := atomic.AddUint32(&s.seq, 1)
+	if seq == 0 {
+		// 0 is used by events
+		seq = atomic.AddUint32(&s.seq, 1)
+	}
+
+	s.m.Lock()
+	if s.err != nil {
+		s.m.Unlock()
+		return nil, s.err
+	}
+	s.pending[seq] = r
+	s.m.Unlock()
+
+	err = s.sock.Send(netlink.Message{
+		Header: netlink.Header{
+			Type:     netlink.HeaderType(family),
+			Flags:    flags,
+			Sequence: seq,
+			PID:      s.pid,
+		},
+		Data: b,
+	})
+	if err != nil {
+		s.remove(seq)
+		return nil, err
+	}
+
+	t := time.NewTimer(s.Timeout)
+	defer t.Stop()
+	select {
+	case err = <-r.res:
+	case <-t.C:
+		s.remove(seq)
+		return nil, errTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.msgs, nil
+}
+
+// JoinGroup subscribes to a multicast group - events are received by
+// onEvent.
+func (s *Session) JoinGroup(group uint32) error {
+	return s.sock.JoinGroup(group)
+}
+
+// Close closes the socket. Pending requests fail.
+func (s *Session) Close() error {
+	s.m.Lock()
+	if s.err == errSessionClosed {
+		s.m.Unlock()
+		return nil
+	}
+	s.err = errSessionClosed
+	s.m.Unlock()
+	return s.sock.Close()
+}
+
+func (s *Session) remove(seq uint32) {
+	s.m.Lock()
+	delete(s.pending, seq)
+	s.m.Unlock()
+}
+
+func (s *Session) readLoop() {
+	defer close(s.done)
+	for {
+		msgs, group, err := s.sock.Receive()
+		if err != nil {
+			if errors.Is(err, syscall.ENOBUFS) {
+				// The kernel dropped messages - events or replies.
+				// The socket is still usable.
+				log.Println("NL receive overrun")
+				s.failPending(errOverrun)
+				continue
+			}
+			if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+				continue
+			}
+			s.fail(err)
+			return
+		}
+		for _, m := range msgs {
+			s.handle(m, group)
+		}
+	}
+}
+
+// fail closes the session with the error, and completes all pending
+// requests.
+func (s *Session) fail(err error) {
+	s.m.Lock()
+	if s.err == nil {
+		log.Println("NL receive error", err)
+		s.err = err
+	} else {
+		err = s.err
+	}
+	s.m.Unlock()
+	s.failPending(err)
+}
+
+// failPending completes the pending requests with the error.
+func (s *Session) failPending(err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for seq, r := range s.pending {
+		r.res <- err
+		delete(s.pending, seq)
+	}
+}
+
+// handle routes a received message to the pending request with the same
+// sequence and port ID, or to the events. Multicast messages are never
+// replies - a notification caused by a request may carry its sequence.
+func (s *Session) handle(m netlink.Message, group uint32) {
+	s.m.Lock()
+	r := s.pending[m.Header.Sequence]
+	if m.Header.Sequence == 0 || r == nil || group != 0 || m.Header.PID != s.pid {
+		s.m.Unlock()
+		s.event(m, group)
+		return
+	}
+
+	var err error
+	done := false
+	switch m.Header.Type {
+	case netlink.Error:
+		// Ack has code 0
+		err = messageError(m)
+		done = true
+	case netlink.Done:
+		err = messageError(m)
+		done = true
+	default:
+		var gm genetlink.Message
+		if err = gm.UnmarshalBinary(m.Data); err != nil {
+			done = true
+			break
+		}
+		r.msgs = append(r.msgs, gm)
+	}
+	if done {
+		delete(s.pending, m.Header.Sequence)
+		r.res <- err
+	}
+	s.m.Unlock()
+}
+
+// messageError returns the error in an Error or Done message, nil for
+// an ack.
+func messageError(m netlink.Message) error {
+	if len(m.Data) < 4 {
+		return nil
+	}
+	if code := nlenc.Int32(m.Data[0:4]); code != 0 {
+		return &netlink.OpError{Op: "receive", Err: syscall.Errno(-code)}
+	}
+	return nil
+}
+
+// event queues an unsolicited message for onEvent. Unicast messages with
+// a sequence are late replies to timed out requests, or errors for
+// requests sent without waiting.
+func (s *Session) event(m netlink.Message, group uint32) {
+	if m.Header.Type == netlink.Error || m.Header.Type == netlink.Done {
+		if err := messageError(m); err != nil {
+			log.Println("NL error for", m.Header.Sequence, err)
+		}
+		return
+	}
+	if m.Header.Sequence != 0 && group == 0 || uint16(m.Header.Type) != s.family {
+		return
+	}
+	var gm genetlink.Message
+	if err := gm.UnmarshalBinary(m.Data); err != nil {
+		log.Println("NL invalid event", err)
+		return
+	}
+	s.m.Lock()
+	if len(s.events) >= maxEvents {
+		s.dropped++
+		s.m.Unlock()
+		return
+	}
+	s.events = append(s.events, gm)
+	s.m.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// eventLoop calls onEvent for the queued events, in order. The read loop
+// never blocks on a slow handler, so replies are not delayed.
+func (s *Session) eventLoop() {
+	for {
+		s.m.Lock()
+		q := s.events
+		s.events = nil
+		dropped := s.dropped
+		s.dropped = 0
+		s.m.Unlock()
+		if dropped > 0 {
+			log.Println("NL event queue full, dropped", dropped)
+		}
+		for _, m := range q {
+			if s.onEvent != nil {
+				s.onEvent(m)
+			}
+		}
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
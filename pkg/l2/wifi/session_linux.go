@@ -0,0 +1,138 @@
+//+build linux
+
+package wifi
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+var errShortMessage = errors.New("short netlink message")
+
+// rawSocket reads the netlink.Conn socket directly - Conn.Receive drops
+// the batch on error messages, and the sequence of the error with it.
+type rawSocket struct {
+	c   *netlink.Conn
+	rc  syscall.RawConn
+	pid uint32
+	b   []byte
+	oob []byte
+}
+
+// newRawSocket enables NETLINK_PKTINFO, to get the multicast group of
+// the received messages.
+func newRawSocket(c *netlink.Conn) (*rawSocket, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetOption(netlink.PacketInfo, true); err != nil {
+		return nil, err
+	}
+	s := &rawSocket{c: c, rc: rc, b: make([]byte, 64*1024),
+		oob: make([]byte, unix.CmsgSpace(4))}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		var sa unix.Sockaddr
+		sa, serr = unix.Getsockname(int(fd))
+		if nl, ok := sa.(*unix.SockaddrNetlink); ok {
+			s.pid = nl.Pid
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// PID is the port ID assigned by the kernel.
+func (s *rawSocket) PID() uint32 {
+	return s.pid
+}
+
+// Send sets the port ID. Conn.Send is safe for concurrent use.
+func (s *rawSocket) Send(m netlink.Message) error {
+	_, err := s.c.Send(m)
+	return err
+}
+
+func (s *rawSocket) JoinGroup(group uint32) error {
+	return s.c.JoinGroup(group)
+}
+
+func (s *rawSocket) Close() error {
+	return s.c.Close()
+}
+
+// Receive blocks until a datagram is received, and returns all messages
+// in it - including errors and Done. Only the read loop calls it.
+func (s *rawSocket) Receive() ([]netlink.Message, uint32, error) {
+	var n, oobn int
+	var rerr error
+	err := s.rc.Read(func(fd uintptr) bool {
+		n, oobn, _, _, rerr = unix.Recvmsg(int(fd), s.b, s.oob, 0)
+		// EAGAIN - wait for the poller
+		return rerr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if rerr != nil {
+		return nil, 0, &netlink.OpError{Op: "receive", Err: rerr}
+	}
+	msgs, err := parseMessages(s.b[:n])
+	return msgs, packetGroup(s.oob[:oobn]), err
+}
+
+// packetGroup returns the group in the NETLINK_PKTINFO control message,
+// 0 for unicast.
+func packetGroup(oob []byte) uint32 {
+	cms, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, cm := range cms {
+		if cm.Header.Level == unix.SOL_NETLINK && cm.Header.Type == unix.NETLINK_PKTINFO &&
+			len(cm.Data) >= 4 {
+			return nlenc.Uint32(cm.Data[0:4])
+		}
+	}
+	return 0
+}
+
+// parseMessages splits a datagram into messages. The data is copied.
+func parseMessages(b []byte) ([]netlink.Message, error) {
+	var msgs []netlink.Message
+	for len(b) >= 16 {
+		l := int(nlenc.Uint32(b[0:4]))
+		if l < 16 || l > len(b) {
+			return nil, errShortMessage
+		}
+		// Not using Message.UnmarshalBinary - the kernel doesn't pad the
+		// length of the last message.
+		msgs = append(msgs, netlink.Message{
+			Header: netlink.Header{
+				Length:   uint32(l),
+				Type:     netlink.HeaderType(nlenc.Uint16(b[4:6])),
+				Flags:    netlink.HeaderFlags(nlenc.Uint16(b[6:8])),
+				Sequence: nlenc.Uint32(b[8:12]),
+				PID:      nlenc.Uint32(b[12:16]),
+			},
+			Data: append([]byte{}, b[16:l]...),
+		})
+		// Messages are 4 byte aligned
+		l = (l + 3) &^ 3
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return msgs, nil
+}
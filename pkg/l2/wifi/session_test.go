@@ -0,0 +1,405 @@
+package wifi
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/genetlink/genltest"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// fakeSocket is a fake kernel for the session. Replies are sent after a
+// random delay, so replies to concurrent requests are out of order. Errors
+// of type syscall.Errno are sent as netlink errors.
+type fakeSocket struct {
+	serve genltest.Func
+
+	in     chan datagram
+	errc   chan error
+	closed chan struct{}
+	once   sync.Once
+
+	m      sync.Mutex
+	groups []uint32
+	delay  time.Duration
+}
+
+// datagram is a batch of messages, sent to the multicast group or
+// unicast if 0.
+type datagram struct {
+	msgs  []netlink.Message
+	group uint32
+}
+
+// errNoReply makes the fake kernel drop the request.
+var errNoReply = errors.New("no reply")
+
+// fakePID is the port ID of the fake socket.
+const fakePID = 4242
+
+func newFakeSocket(serve genltest.Func) *fakeSocket {
+	return &fakeSocket{serve: serve, in: make(chan datagram, 256),
+		errc: make(chan error, 1), closed: make(chan struct{})}
+}
+
+func (f *fakeSocket) Send(m netlink.Message) error {
+	var greq genetlink.Message
+	if err := greq.UnmarshalBinary(m.Data); err != nil {
+		return err
+	}
+	gmsgs, err := f.serve(greq, m)
+
+	hdr := m.Header
+	hdr.Flags = 0
+	var out []netlink.Message
+	dump := m.Header.Flags&netlink.Dump == netlink.Dump
+	if errno, ok := err.(syscall.Errno); ok {
+		hdr.Type = netlink.Error
+		out = append(out, netlink.Message{Header: hdr, Data: nlenc.Int32Bytes(-int32(errno))})
+	} else if err == errNoReply {
+		return nil
+	} else if err != nil {
+		return err
+	} else {
+		if dump {
+			hdr.Flags = netlink.Multi
+		}
+		for _, gm := range gmsgs {
+			b, _ := gm.MarshalBinary()
+			out = append(out, netlink.Message{Header: hdr, Data: b})
+		}
+		if dump {
+			hdr.Type = netlink.Done
+			out = append(out, netlink.Message{Header: hdr, Data: nlenc.Int32Bytes(0)})
+		} else if m.Header.Flags&netlink.Acknowledge != 0 {
+			hdr.Type = netlink.Error
+			out = append(out, netlink.Message{Header: hdr, Data: nlenc.Int32Bytes(0)})
+		}
+	}
+
+	f.m.Lock()
+	delay := f.delay
+	f.m.Unlock()
+	if delay == 0 {
+		f.in <- datagram{msgs: out}
+		return nil
+	}
+	go func() {
+		time.Sleep(time.Duration(rand.Int63n(int64(delay))))
+		f.in <- datagram{msgs: out}
+	}()
+	return nil
+}
+
+// Inject sends unsolicited unicast messages, like frame events.
+func (f *fakeSocket) Inject(msgs ...netlink.Message) {
+	f.in <- datagram{msgs: msgs}
+}
+
+// InjectGroup sends multicast messages.
+func (f *fakeSocket) InjectGroup(group uint32, msgs ...netlink.Message) {
+	f.in <- datagram{msgs: msgs, group: group}
+}
+
+// InjectError makes the next Receive fail.
+func (f *fakeSocket) InjectError(err error) {
+	f.errc <- err
+}
+
+func (f *fakeSocket) Receive() ([]netlink.Message, uint32, error) {
+	select {
+	case err := <-f.errc:
+		return nil, 0, err
+	case d := <-f.in:
+		return d.msgs, d.group, nil
+	case <-f.closed:
+		return nil, 0, errors.New("closed")
+	}
+}
+
+func (f *fakeSocket) JoinGroup(group uint32) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.groups = append(f.groups, group)
+	return nil
+}
+
+func (f *fakeSocket) PID() uint32 {
+	return fakePID
+}
+
+func (f *fakeSocket) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+// echo replies with the request attributes.
+func echo(greq genetlink.Message, _ netlink.Message) ([]genetlink.Message, error) {
+	switch greq.Header.Command {
+	case nl80211.CmdGetInterface:
+		return []genetlink.Message{{Header: greq.Header, Data: greq.Data},
+			{Header: greq.Header, Data: greq.Data}}, nil
+	case nl80211.CmdDelInterface:
+		return nil, syscall.ENODEV
+	}
+	return []genetlink.Message{{Header: greq.Header, Data: greq.Data}}, nil
+}
+
+func eventNL(t *testing.T, seq uint32, cmd uint8, attrs ...netlink.Attribute) netlink.Message {
+	b, _ := eventMsg(t, cmd, attrs...).MarshalBinary()
+	return netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(fakeFamily.ID),
+		Sequence: seq}, Data: b}
+}
+
+func TestSessionConcurrent(t *testing.T) {
+	sock := newFakeSocket(echo)
+	sock.delay = 5 * time.Millisecond
+	events := make(chan genetlink.Message, 100)
+	s := newSession(sock, fakeFamily.ID, func(m genetlink.Message) { events <- m })
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msgs, err := s.Execute(eventMsg(t, nl80211.CmdSetInterface,
+				netlink.Attribute{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(i))}),
+				fakeFamily.ID, netlink.Request)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if len(msgs) != 1 || nlenc.Uint32(msgs[0].Data[4:8]) != uint32(i) {
+				errs <- errors.New("wrong reply")
+			}
+		}(i)
+		// Events interleaved with the replies
+		sock.Inject(eventNL(t, 0, nl80211.CmdFrame))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for i := 0; i < 50; i++ {
+		select {
+		case <-events:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Missing events", i)
+		}
+	}
+	if len(events) != 0 {
+		t.Error("Replies delivered as events", len(events))
+	}
+}
+
+func TestSessionReplies(t *testing.T) {
+	sock := newFakeSocket(echo)
+	events := make(chan genetlink.Message, 10)
+	s := newSession(sock, fakeFamily.ID, func(m genetlink.Message) { events <- m })
+
+	// Dump - all parts until Done
+	msgs, err := s.Execute(eventMsg(t, nl80211.CmdGetInterface), fakeFamily.ID, netlink.Request|netlink.Dump)
+	if err != nil || len(msgs) != 2 {
+		t.Fatal("Unexpected dump", msgs, err)
+	}
+
+	// Error is returned to the request with the sequence
+	_, err = s.Execute(eventMsg(t, nl80211.CmdDelInterface), fakeFamily.ID, netlink.Request)
+	if !errors.Is(err, syscall.ENODEV) {
+		t.Error("Expecting ENODEV", err)
+	}
+
+	// Late replies and errors are not events
+	sock.Inject(eventNL(t, 1000, nl80211.CmdNewInterface),
+		netlink.Message{Header: netlink.Header{Type: netlink.Error, Sequence: 1001},
+			Data: nlenc.Int32Bytes(-int32(syscall.EBUSY))})
+	sock.Inject(eventNL(t, 0, nl80211.CmdFrame))
+	select {
+	case m := <-events:
+		if m.Header.Command != nl80211.CmdFrame {
+			t.Error("Unexpected event", m.Header)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No event")
+	}
+
+	s.Close()
+	if _, err := s.Execute(eventMsg(t, nl80211.CmdSetInterface), fakeFamily.ID, netlink.Request); err == nil {
+		t.Error("Execute after close")
+	}
+}
+
+// Replies must have the port ID of the socket, and are never multicast -
+// a notification caused by the request has its sequence.
+func TestSessionReplyPID(t *testing.T) {
+	seqs := make(chan uint32, 1)
+	sock := newFakeSocket(func(_ genetlink.Message, nreq netlink.Message) ([]genetlink.Message, error) {
+		if nreq.Header.PID != fakePID {
+			t.Error("Request without port ID", nreq.Header.PID)
+		}
+		seqs <- nreq.Header.Sequence
+		return nil, errNoReply
+	})
+	events := make(chan genetlink.Message, 10)
+	s := newSession(sock, fakeFamily.ID, func(m genetlink.Message) { events <- m })
+	defer s.Close()
+
+	res := make(chan error, 1)
+	go func() {
+		msgs, err := s.Execute(eventMsg(t, nl80211.CmdNewInterface), fakeFamily.ID, netlink.Request)
+		if err == nil && len(msgs) != 1 {
+			err = errors.New("wrong reply")
+		}
+		res <- err
+	}()
+	seq := <-seqs
+
+	other := eventNL(t, seq, nl80211.CmdNewInterface)
+	other.Header.PID = fakePID + 1
+	sock.Inject(other, netlink.Message{Header: netlink.Header{Type: netlink.Error,
+		Sequence: seq, PID: fakePID + 1}, Data: nlenc.Int32Bytes(0)})
+	mc := eventNL(t, seq, nl80211.CmdNewInterface)
+	mc.Header.PID = fakePID
+	sock.InjectGroup(3, mc)
+	select {
+	case m := <-events:
+		if m.Header.Command != nl80211.CmdNewInterface {
+			t.Error("Unexpected event", m.Header)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Multicast not delivered as event")
+	}
+	select {
+	case err := <-res:
+		t.Fatal("Completed by a message that is not a reply", err)
+	default:
+	}
+
+	reply := eventNL(t, seq, nl80211.CmdNewInterface)
+	reply.Header.PID = fakePID
+	sock.Inject(reply, netlink.Message{Header: netlink.Header{Type: netlink.Error,
+		Sequence: seq, PID: fakePID}, Data: nlenc.Int32Bytes(0)})
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No reply")
+	}
+	if len(events) != 0 {
+		t.Error("Reply delivered as event")
+	}
+}
+
+// Event handlers can send requests - they run outside the read loop.
+func TestSessionExecuteFromEvent(t *testing.T) {
+	sock := newFakeSocket(echo)
+	var s *Session
+	done := make(chan error, 1)
+	s = newSession(sock, fakeFamily.ID, func(m genetlink.Message) {
+		_, err := s.Execute(eventMsg(t, nl80211.CmdSetInterface), fakeFamily.ID, netlink.Request)
+		done <- err
+	})
+	defer s.Close()
+	sock.Inject(eventNL(t, 0, nl80211.CmdFrame))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Deadlock")
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	sock := newFakeSocket(func(genetlink.Message, netlink.Message) ([]genetlink.Message, error) {
+		return nil, errNoReply
+	})
+	s := newSession(sock, fakeFamily.ID, nil)
+	defer s.Close()
+	s.Timeout = 50 * time.Millisecond
+	if _, err := s.Execute(eventMsg(t, nl80211.CmdSetInterface), fakeFamily.ID, netlink.Request); err != errTimeout {
+		t.Error("Expecting timeout", err)
+	}
+	s.m.Lock()
+	n := len(s.pending)
+	s.m.Unlock()
+	if n != 0 {
+		t.Error("Pending request not removed", n)
+	}
+}
+
+// Requests pending when the socket overruns fail - their replies may be
+// lost. The session keeps working.
+func TestSessionOverrun(t *testing.T) {
+	var sock *fakeSocket
+	sock = newFakeSocket(func(greq genetlink.Message, nreq netlink.Message) ([]genetlink.Message, error) {
+		if greq.Header.Command == nl80211.CmdFrame {
+			sock.InjectError(syscall.ENOBUFS)
+			return nil, errNoReply
+		}
+		return echo(greq, nreq)
+	})
+	s := newSession(sock, fakeFamily.ID, nil)
+	defer s.Close()
+	if _, err := s.Execute(eventMsg(t, nl80211.CmdFrame), fakeFamily.ID, netlink.Request); err != errOverrun {
+		t.Error("Expecting overrun", err)
+	}
+	if _, err := s.Execute(eventMsg(t, nl80211.CmdSetInterface), fakeFamily.ID, netlink.Request); err != nil {
+		t.Error("Session failed after overrun", err)
+	}
+}
+
+// Events are dropped when the handler doesn't keep up.
+func TestSessionEventQueue(t *testing.T) {
+	block := make(chan struct{})
+	sock := newFakeSocket(echo)
+	s := newSession(sock, fakeFamily.ID, func(genetlink.Message) { <-block })
+	defer s.Close()
+	defer close(block)
+
+	ev := eventNL(t, 0, nl80211.CmdFrame)
+	for i := 0; i < maxEvents+10; i++ {
+		s.handle(ev, 0)
+	}
+	s.m.Lock()
+	n, dropped := len(s.events), s.dropped
+	s.m.Unlock()
+	if n > maxEvents || dropped == 0 {
+		t.Error("Unexpected event queue", n, dropped)
+	}
+}
+
+func TestParseMessages(t *testing.T) {
+	hdr := func(l, typ, seq int) []byte {
+		b := append(nlenc.Uint32Bytes(uint32(l)), nlenc.Uint16Bytes(uint16(typ))...)
+		b = append(b, 0, 0)
+		b = append(b, nlenc.Uint32Bytes(uint32(seq))...)
+		return append(b, 0, 0, 0, 0)
+	}
+	// Length 17, padded to 20
+	b := append(hdr(17, 0x1c, 3), 1, 0, 0, 0)
+	b = append(b, hdr(16, int(netlink.Done), 3)...)
+	msgs, err := parseMessages(b)
+	if err != nil || len(msgs) != 2 {
+		t.Fatal("Unexpected messages", msgs, err)
+	}
+	if len(msgs[0].Data) != 1 || msgs[0].Header.Sequence != 3 || msgs[1].Header.Type != netlink.Done {
+		t.Error("Unexpected messages", msgs)
+	}
+	if _, err := parseMessages(hdr(24, 0x1c, 4)); err == nil {
+		t.Error("Expecting short message")
+	}
+}
@@ -0,0 +1,433 @@
+package wifi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+)
+
+// Link stats for the peers connected to the local AP, P2P GO and mesh
+// interfaces. The kernel sends NewStation/DelStation when peers come and
+// go, but the counters are only available with GetStation - the watcher
+// polls the interfaces, and publishes a StationStats event when a peer is
+// added or removed, or its link quality changes. On mesh interfaces the
+// paths are polled too, and changes published as MeshPathChanged.
+
+const (
+	// defaultStationInterval is the poll interval if not set.
+	defaultStationInterval = 5 * time.Second
+
+	// signalDelta is the signal change that is published even if the
+	// quality doesn't change.
+	signalDelta = 5
+
+	// Thresholds for the link quality.
+	signalPoor    = -80
+	signalFair    = -70
+	failRatePoor  = 0.1
+	retryRatePoor = 0.5
+	retryRateFair = 0.2
+	inactivePoor  = 30 * time.Second
+)
+
+// LinkQuality classifies the link to a station.
+type LinkQuality int
+
+const (
+	LinkGood LinkQuality = iota
+	LinkFair
+	LinkPoor
+
+	// LinkGone is published when the station is removed.
+	LinkGone
+)
+
+func (q LinkQuality) String() string {
+	switch q {
+	case LinkGood:
+		return "good"
+	case LinkFair:
+		return "fair"
+	case LinkPoor:
+		return "poor"
+	case LinkGone:
+		return "gone"
+	}
+	return "unknown"
+}
+
+// StationStats are the link stats of a peer connected to a local AP or GO
+// interface. Published on Events by the StationWatcher.
+type StationStats struct {
+	EventHeader
+	MAC net.HardwareAddr
+
+	// Freq of the local interface, if known.
+	Freq int
+
+	// Signal of the last frame received from the peer, in dBm.
+	Signal int
+
+	// RxBitrate and TxBitrate in bits/second.
+	RxBitrate int
+	TxBitrate int
+
+	// TxPackets, TxRetries and TxFailed are the counters since the peer
+	// connected.
+	TxPackets int
+	TxRetries int
+	TxFailed  int
+
+	// RetryRate and FailRate are the ratio of retries and failures to the
+	// packets sent since the previous poll. Unchanged if nothing was sent.
+	RetryRate float64
+	FailRate  float64
+
+	Inactive  time.Duration
+	Connected time.Duration
+
+	// Mesh is set for mesh peers, with the PeerLink state. Only
+	// established peers forward frames.
+	Mesh     bool
+	PeerLink PeerLinkState
+
+	Quality LinkQuality
+}
+
+// staKey identifies a station - the same peer may be connected to
+// multiple local interfaces.
+type staKey struct {
+	ifindex int
+	mac     string
+}
+
+// StationWatcher keeps the stats of the peers connected to the AP, GO and
+// mesh interfaces added with Add.
+type StationWatcher struct {
+	c *Client
+
+	// Interval between polls, defaultStationInterval if 0.
+	Interval time.Duration
+
+	m        sync.Mutex
+	ifaces   map[int]*Interface
+	stations map[staKey]*StationStats
+	paths    map[staKey]*MeshPath
+
+	// kick triggers a poll, after Add or a new station.
+	kick chan struct{}
+}
+
+// NewStationWatcher returns a watcher for the client. Run must be called
+// to start it.
+func NewStationWatcher(c *Client) *StationWatcher {
+	return &StationWatcher{
+		c:        c,
+		ifaces:   map[int]*Interface{},
+		stations: map[staKey]*StationStats{},
+		paths:    map[staKey]*MeshPath{},
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// Add starts watching the interface. Returns false if it is not an AP,
+// P2P GO or mesh point.
+func (w *StationWatcher) Add(ifi *Interface) bool {
+	switch ifi.Type {
+	case InterfaceTypeAP, InterfaceTypeP2PGroupOwner, InterfaceTypeMeshPoint:
+	default:
+		return false
+	}
+	w.m.Lock()
+	w.ifaces[ifi.Index] = ifi
+	w.m.Unlock()
+	w.poke()
+	return true
+}
+
+// Remove stops watching the interface. StationStats with LinkGone are
+// published for its stations, and removed MeshPathChanged for its paths.
+func (w *StationWatcher) Remove(ifindex int) {
+	w.m.Lock()
+	delete(w.ifaces, ifindex)
+	var gone []*StationStats
+	for k, s := range w.stations {
+		if k.ifindex == ifindex {
+			delete(w.stations, k)
+			gone = append(gone, s)
+		}
+	}
+	var paths []*MeshPathChanged
+	for k, p := range w.paths {
+		if k.ifindex == ifindex {
+			delete(w.paths, k)
+			paths = append(paths, &MeshPathChanged{
+				EventHeader: EventHeader{Ifindex: ifindex, Time: time.Now()},
+				Path:        *p, Removed: true})
+		}
+	}
+	w.m.Unlock()
+	for _, s := range gone {
+		w.publishGone(s)
+	}
+	for _, e := range paths {
+		w.c.Events.Publish(e)
+	}
+}
+
+// Paths returns a copy of the paths on the mesh interfaces.
+func (w *StationWatcher) Paths() []*MeshPath {
+	w.m.Lock()
+	defer w.m.Unlock()
+	res := make([]*MeshPath, 0, len(w.paths))
+	for _, p := range w.paths {
+		cp := *p
+		res = append(res, &cp)
+	}
+	return res
+}
+
+// Stations returns a copy of the stats of the connected peers.
+func (w *StationWatcher) Stations() []*StationStats {
+	w.m.Lock()
+	defer w.m.Unlock()
+	res := make([]*StationStats, 0, len(w.stations))
+	for _, s := range w.stations {
+		cp := *s
+		res = append(res, &cp)
+	}
+	return res
+}
+
+func (w *StationWatcher) poke() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls the interfaces and handles the station events, until the
+// context is done.
+func (w *StationWatcher) Run(ctx context.Context) error {
+	if err := w.c.joinGroup(nl80211.MulticastGroupMlme); err != nil {
+		return err
+	}
+	sub := w.c.Events.Subscribe(SubscribeOptions{
+		Kinds: []EventKind{KindStationAdded, KindStationRemoved, KindInterfaceRemoved},
+	})
+	defer sub.Close()
+
+	interval := w.Interval
+	if interval == 0 {
+		interval = defaultStationInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	w.pollAll()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			w.pollAll()
+		case <-w.kick:
+			w.pollAll()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			w.onEvent(ev)
+		}
+	}
+}
+
+func (w *StationWatcher) onEvent(ev Event) {
+	switch e := ev.(type) {
+	case *StationAdded:
+		w.m.Lock()
+		ifi := w.ifaces[e.Ifindex]
+		w.m.Unlock()
+		if ifi != nil {
+			w.poll(ifi)
+		}
+	case *StationRemoved:
+		k := staKey{ifindex: e.Ifindex, mac: e.MAC.String()}
+		w.m.Lock()
+		s := w.stations[k]
+		delete(w.stations, k)
+		w.m.Unlock()
+		if s != nil {
+			w.publishGone(s)
+		}
+	case *InterfaceRemoved:
+		w.Remove(e.Interface.Index)
+	}
+}
+
+func (w *StationWatcher) pollAll() {
+	w.m.Lock()
+	ifaces := make([]*Interface, 0, len(w.ifaces))
+	for _, ifi := range w.ifaces {
+		ifaces = append(ifaces, ifi)
+	}
+	w.m.Unlock()
+	for _, ifi := range ifaces {
+		w.poll(ifi)
+	}
+}
+
+// poll updates the stations of the interface, and publishes the changes.
+// Stations missing from the dump are removed - the event may be lost.
+func (w *StationWatcher) poll(ifi *Interface) {
+	infos, err := w.c.StationInfo(ifi)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("STA: poll", ifi.Name, err)
+		return
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	var changed, gone []*StationStats
+
+	w.m.Lock()
+	if w.ifaces[ifi.Index] == nil {
+		// Removed while polling
+		w.m.Unlock()
+		return
+	}
+	for _, info := range infos {
+		k := staKey{ifindex: ifi.Index, mac: info.HardwareAddr.String()}
+		seen[k.mac] = true
+		prev := w.stations[k]
+		s := stationStats(prev, info)
+		s.EventHeader = EventHeader{Ifindex: ifi.Index, Wiphy: ifi.PHY, Time: now}
+		s.Freq = ifi.Frequency
+		w.stations[k] = s
+		if prev == nil || prev.Quality != s.Quality || prev.PeerLink != s.PeerLink ||
+			abs(prev.Signal-s.Signal) >= signalDelta {
+			cp := *s
+			changed = append(changed, &cp)
+		}
+	}
+	for k, s := range w.stations {
+		if k.ifindex == ifi.Index && !seen[k.mac] {
+			delete(w.stations, k)
+			gone = append(gone, s)
+		}
+	}
+	w.m.Unlock()
+
+	for _, s := range changed {
+		log.Println("STA: ", ifi.Name, s.MAC, s.Quality, s.Signal, s.RetryRate, s.FailRate)
+		w.c.Events.Publish(s)
+	}
+	for _, s := range gone {
+		w.publishGone(s)
+	}
+	if ifi.Type == InterfaceTypeMeshPoint {
+		w.pollPaths(ifi)
+	}
+}
+
+// pollPaths updates the paths of the mesh interface, and publishes the
+// new and removed paths, and next hop changes.
+func (w *StationWatcher) pollPaths(ifi *Interface) {
+	paths, err := w.c.MeshPaths(ifi)
+	if err != nil {
+		log.Println("MESH: paths", ifi.Name, err)
+		return
+	}
+	h := EventHeader{Ifindex: ifi.Index, Wiphy: ifi.PHY, Time: time.Now()}
+	seen := map[string]bool{}
+	var changed []*MeshPathChanged
+
+	w.m.Lock()
+	for _, p := range paths {
+		k := staKey{ifindex: ifi.Index, mac: p.Dest.String()}
+		seen[k.mac] = true
+		prev := w.paths[k]
+		w.paths[k] = p
+		if prev == nil || prev.NextHop.String() != p.NextHop.String() || prev.Active() != p.Active() {
+			changed = append(changed, &MeshPathChanged{EventHeader: h, Path: *p})
+		}
+	}
+	for k, p := range w.paths {
+		if k.ifindex == ifi.Index && !seen[k.mac] {
+			delete(w.paths, k)
+			changed = append(changed, &MeshPathChanged{EventHeader: h, Path: *p, Removed: true})
+		}
+	}
+	w.m.Unlock()
+
+	for _, e := range changed {
+		log.Println("MESH: path", ifi.Name, e.Path.Dest, e.Path.NextHop, e.Path.Metric, e.Removed)
+		w.c.Events.Publish(e)
+	}
+}
+
+func (w *StationWatcher) publishGone(s *StationStats) {
+	cp := *s
+	cp.Quality = LinkGone
+	cp.Time = time.Now()
+	log.Println("STA: removed", cp.Ifindex, cp.MAC)
+	w.c.Events.Publish(&cp)
+}
+
+// stationStats computes the stats from the station info, and the rates
+// from the change since the previous poll.
+func stationStats(prev *StationStats, info *StationInfo) *StationStats {
+	s := &StationStats{
+		MAC:       info.HardwareAddr,
+		Signal:    info.Signal,
+		RxBitrate: info.ReceiveBitrate,
+		TxBitrate: info.TransmitBitrate,
+		TxPackets: info.TransmittedPackets,
+		TxRetries: info.TransmitRetries,
+		TxFailed:  info.TransmitFailed,
+		Inactive:  info.Inactive,
+		Connected: info.Connected,
+		Mesh:      info.Mesh,
+		PeerLink:  info.PeerLink,
+	}
+	sent, retries, failed := s.TxPackets, s.TxRetries, s.TxFailed
+	if prev != nil {
+		s.RetryRate, s.FailRate = prev.RetryRate, prev.FailRate
+		// Counters restart if the peer reconnected between polls.
+		if s.TxPackets >= prev.TxPackets && s.TxRetries >= prev.TxRetries &&
+			s.TxFailed >= prev.TxFailed {
+			sent -= prev.TxPackets
+			retries -= prev.TxRetries
+			failed -= prev.TxFailed
+		}
+	}
+	if attempts := sent + failed; attempts > 0 {
+		s.RetryRate = float64(retries) / float64(attempts)
+		s.FailRate = float64(failed) / float64(attempts)
+	}
+	s.Quality = s.classify()
+	return s
+}
+
+// classify returns the link quality from the signal, rates and activity.
+// A signal of 0 is not reported by the driver. Mesh peers that are not
+// established are poor - they can't be used.
+func (s *StationStats) classify() LinkQuality {
+	switch {
+	case s.Mesh && s.PeerLink != PeerLinkEstab,
+		s.Signal != 0 && s.Signal < signalPoor,
+		s.FailRate > failRatePoor,
+		s.RetryRate > retryRatePoor,
+		s.Inactive > inactivePoor:
+		return LinkPoor
+	case s.Signal != 0 && s.Signal < signalFair,
+		s.RetryRate > retryRateFair:
+		return LinkFair
+	}
+	return LinkGood
+}
@@ -0,0 +1,125 @@
+package wifi
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+)
+
+var (
+	staA = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	staB = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+)
+
+// staMsg is a station dump entry.
+func staMsg(t *testing.T, mac net.HardwareAddr, signal, tx, retries, failed int) genetlink.Message {
+	return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdNewStation, Version: 1},
+		Data: nested(t,
+			netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(3)},
+			netlink.Attribute{Type: nl80211.AttrMac, Data: mac},
+			netlink.Attribute{Type: nl80211.AttrStaInfo, Data: nested(t,
+				netlink.Attribute{Type: nl80211.StaInfoSignal, Data: []byte{byte(int8(signal))}},
+				netlink.Attribute{Type: nl80211.StaInfoInactiveTime, Data: u32(100)},
+				netlink.Attribute{Type: nl80211.StaInfoTxPackets, Data: u32(tx)},
+				netlink.Attribute{Type: nl80211.StaInfoTxRetries, Data: u32(retries)},
+				netlink.Attribute{Type: nl80211.StaInfoTxFailed, Data: u32(failed)})})}
+}
+
+func TestStationStats(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		prev *StationStats
+		info StationInfo
+		want LinkQuality
+	}{
+		{name: "good", info: StationInfo{Signal: -50, TransmittedPackets: 100, TransmitRetries: 10}, want: LinkGood},
+		{name: "no signal", info: StationInfo{}, want: LinkGood},
+		{name: "weak", info: StationInfo{Signal: -75}, want: LinkFair},
+		{name: "very weak", info: StationInfo{Signal: -85}, want: LinkPoor},
+		{name: "retries", info: StationInfo{Signal: -50, TransmittedPackets: 100, TransmitRetries: 30}, want: LinkFair},
+		{name: "inactive", info: StationInfo{Signal: -50, Inactive: time.Minute}, want: LinkPoor},
+		// Only the packets since the previous poll count
+		{name: "failures", prev: &StationStats{TxPackets: 1000},
+			info: StationInfo{Signal: -50, TransmittedPackets: 1010, TransmitFailed: 5}, want: LinkPoor},
+		// Nothing sent since - keep the previous rates
+		{name: "idle", prev: &StationStats{TxPackets: 10, RetryRate: 0.3},
+			info: StationInfo{Signal: -50, TransmittedPackets: 10}, want: LinkFair},
+		// Reconnected - counters restarted
+		{name: "restart", prev: &StationStats{TxPackets: 1000, TxRetries: 900},
+			info: StationInfo{Signal: -50, TransmittedPackets: 10}, want: LinkGood},
+	} {
+		if s := stationStats(tc.prev, &tc.info); s.Quality != tc.want {
+			t.Error(tc.name, "unexpected quality", s.Quality, s.RetryRate, s.FailRate)
+		}
+	}
+}
+
+func TestStationWatcher(t *testing.T) {
+	c, f := newFakeNL80211(t, mlmeFamily)
+	f.reply(nl80211.CmdGetStation, staMsg(t, staA, -50, 100, 0, 0))
+
+	sub := c.Events.Subscribe(SubscribeOptions{Kinds: []EventKind{KindStationStats}})
+	next := func() *StationStats {
+		select {
+		case ev := <-sub.C:
+			return ev.(*StationStats)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for station stats")
+		}
+		return nil
+	}
+
+	w := NewStationWatcher(c)
+	w.Interval = time.Hour
+	if w.Add(&Interface{Index: 4, Type: InterfaceTypeStation}) {
+		t.Error("Station interface watched")
+	}
+	if !w.Add(&Interface{Index: 3, PHY: 1, Type: InterfaceTypeAP, Frequency: 2437}) {
+		t.Fatal("AP interface not watched")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	if s := next(); s.MAC.String() != staA.String() || s.Quality != LinkGood ||
+		s.Signal != -50 || s.Freq != 2437 || s.Ifindex != 3 {
+		t.Fatal("Unexpected stats", s)
+	}
+
+	// A new station triggers a poll - the first one is now weak.
+	f.reply(nl80211.CmdGetStation, staMsg(t, staA, -85, 200, 0, 0), staMsg(t, staB, -60, 10, 0, 0))
+	f.inject(eventNL(t, 0, nl80211.CmdNewStation,
+		netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(3)},
+		netlink.Attribute{Type: nl80211.AttrMac, Data: staB}))
+	got := map[string]LinkQuality{}
+	for i := 0; i < 2; i++ {
+		s := next()
+		got[s.MAC.String()] = s.Quality
+	}
+	if got[staA.String()] != LinkPoor || got[staB.String()] != LinkGood {
+		t.Fatal("Unexpected stats", got)
+	}
+	if len(w.Stations()) != 2 {
+		t.Error("Unexpected stations", w.Stations())
+	}
+
+	f.inject(eventNL(t, 0, nl80211.CmdDelStation,
+		netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(3)},
+		netlink.Attribute{Type: nl80211.AttrMac, Data: staA}))
+	if s := next(); s.MAC.String() != staA.String() || s.Quality != LinkGone {
+		t.Fatal("Unexpected stats", s)
+	}
+
+	w.Remove(3)
+	if s := next(); s.MAC.String() != staB.String() || s.Quality != LinkGone {
+		t.Fatal("Unexpected stats", s)
+	}
+	if len(w.Stations()) != 0 {
+		t.Error("Unexpected stations", w.Stations())
+	}
+}
@@ -0,0 +1,256 @@
+package wifi
+
+import (
+	"sort"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Channel load, for picking the GO/AP and NAN data channels. The driver
+// survey has the time the radio found each channel busy - usually filled
+// by scans, or continuously for the current channel. The frames seen on
+// the monitor are not counted - the monitor only receives the NAN frames
+// that pass its BPF, and only on the channel it is tuned to.
+
+const (
+	// loadUnknown is used for channels without survey - better
+	// than a busy channel, worse than a measured idle one.
+	loadUnknown = 0.3
+
+	// preferMargin is how much more loaded the preferred channel can be
+	// and still be selected.
+	preferMargin = 0.1
+)
+
+// SurveyInfo is the survey of a channel, from CmdGetSurvey. The times are
+// cumulative, since the driver started or the last scan.
+type SurveyInfo struct {
+	Freq int
+
+	// Noise floor in dBm, 0 if not reported.
+	Noise int
+
+	// InUse is set for the current channel of the interface.
+	InUse bool
+
+	// Active is the time the radio was on the channel. Busy is the time
+	// the channel was sensed busy, including Rx and Tx.
+	Active  time.Duration
+	Busy    time.Duration
+	ExtBusy time.Duration
+	Rx      time.Duration
+	Tx      time.Duration
+	Scan    time.Duration
+}
+
+// ChannelQuality is the load of a channel, for the ranking.
+type ChannelQuality struct {
+	Freq  int
+	Noise int
+
+	// Busy is the busy time ratio since the previous survey, 0-1. -1 if
+	// there is no survey for the channel.
+	Busy float64
+
+	// Load is the busy ratio, or loadUnknown - lower is better.
+	Load float64
+}
+
+// ChannelChoice restricts the channels returned by SelectChannels.
+type ChannelChoice struct {
+	// Band is 2 for 2.4GHz, 5 for 5GHz - 0 for any.
+	Band int
+
+	// StaFreq is the channel of the connected station, 0 if none.
+	StaFreq int
+
+	// SingleChannel is set if the radio can't use a channel different
+	// from the station - only StaFreq can be used.
+	SingleChannel bool
+
+	// Prefer is moved first if its load is within preferMargin of the
+	// best channel - for example the NAN channel, to avoid switching.
+	Prefer int
+}
+
+// Survey returns the survey data for the channels of the interface.
+func (c *Client) Survey(ifi *Interface) ([]*SurveyInfo, error) {
+	msgs, err := c.execute(nl80211.CmdGetSurvey, []netlink.Attribute{
+		{Type: nl80211.AttrIfindex, Data: nlenc.Uint32Bytes(uint32(ifi.Index))},
+	}, netlink.Request|netlink.Dump)
+	if err != nil {
+		return nil, err
+	}
+	res := []*SurveyInfo{}
+	for _, m := range msgs {
+		attrs, err := netlink.UnmarshalAttributes(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attrs {
+			if a.Type != nl80211.AttrSurveyInfo {
+				continue
+			}
+			s, err := parseSurvey(a.Data)
+			if err != nil {
+				return nil, err
+			}
+			if s.Freq != 0 {
+				res = append(res, s)
+			}
+		}
+	}
+	return res, nil
+}
+
+func parseSurvey(b []byte) (*SurveyInfo, error) {
+	attrs, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		return nil, err
+	}
+	s := &SurveyInfo{}
+	ms := func(d []byte) time.Duration {
+		if len(d) != 8 {
+			return 0
+		}
+		return time.Duration(nlenc.Uint64(d)) * time.Millisecond
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case nl80211.SurveyInfoFrequency:
+			s.Freq = int(nlenc.Uint32(a.Data))
+		case nl80211.SurveyInfoNoise:
+			if len(a.Data) > 0 {
+				s.Noise = int(int8(a.Data[0]))
+			}
+		case nl80211.SurveyInfoInUse:
+			s.InUse = true
+		case nl80211.SurveyInfoTime:
+			s.Active = ms(a.Data)
+		case nl80211.SurveyInfoTimeBusy:
+			s.Busy = ms(a.Data)
+		case nl80211.SurveyInfoTimeExtBusy:
+			s.ExtBusy = ms(a.Data)
+		case nl80211.SurveyInfoTimeRx:
+			s.Rx = ms(a.Data)
+		case nl80211.SurveyInfoTimeTx:
+			s.Tx = ms(a.Data)
+		case nl80211.SurveyInfoTimeScan:
+			s.Scan = ms(a.Data)
+		}
+	}
+	return s, nil
+}
+
+// RankChannels returns the channels of the interface phy that can be used
+// for sending, least loaded first. The busy ratio is computed from the
+// change since the previous ranking, if the radio was on the channel.
+func (c *Client) RankChannels(ifi *Interface) ([]ChannelQuality, error) {
+	survey, err := c.Survey(ifi)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	if c.surveys == nil {
+		c.surveys = map[int]map[int]*SurveyInfo{}
+	}
+	prev := c.surveys[ifi.Index]
+	cur := map[int]*SurveyInfo{}
+	for _, s := range survey {
+		cur[s.Freq] = s
+	}
+	c.surveys[ifi.Index] = cur
+	c.m.Unlock()
+
+	freqs := map[int]bool{}
+	for _, ch := range c.Channels(ifi.PHY) {
+		freqs[ch.Freq] = true
+	}
+	if len(freqs) == 0 {
+		// No regulatory data - use the survey channels.
+		for f := range cur {
+			freqs[f] = true
+		}
+	}
+
+	res := []ChannelQuality{}
+	for f := range freqs {
+		if c.CheckFreq(ifi.PHY, f) != nil {
+			continue
+		}
+		res = append(res, channelQuality(f, cur[f], prev[f]))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Load != res[j].Load {
+			return res[i].Load < res[j].Load
+		}
+		return res[i].Freq < res[j].Freq
+	})
+	return res, nil
+}
+
+// channelQuality computes the load from the survey - the delta from the
+// previous one if the radio was on the channel since.
+func channelQuality(freq int, cur, prev *SurveyInfo) ChannelQuality {
+	q := ChannelQuality{Freq: freq, Busy: -1, Load: loadUnknown}
+	if cur != nil {
+		q.Noise = cur.Noise
+		active, busy := cur.Active, cur.Busy
+		if prev != nil && cur.Active > prev.Active && cur.Busy >= prev.Busy {
+			active, busy = cur.Active-prev.Active, cur.Busy-prev.Busy
+		}
+		if active > 0 {
+			q.Busy = float64(busy) / float64(active)
+		}
+	}
+	if q.Busy >= 0 {
+		q.Load = q.Busy
+	}
+	return q
+}
+
+// SelectChannels returns the channels for a GO, AP or NAN data path, best
+// first. With SingleChannel only the station channel is returned.
+func (c *Client) SelectChannels(ifi *Interface, cc ChannelChoice) ([]int, error) {
+	if cc.SingleChannel && cc.StaFreq != 0 {
+		if err := c.CheckFreq(ifi.PHY, cc.StaFreq); err != nil {
+			return nil, err
+		}
+		return []int{cc.StaFreq}, nil
+	}
+	ranked, err := c.RankChannels(ifi)
+	if err != nil {
+		return nil, err
+	}
+	var res []int
+	var best, prefer *ChannelQuality
+	for i := range ranked {
+		q := &ranked[i]
+		if cc.Band != 0 && band(q.Freq) != cc.Band {
+			continue
+		}
+		if best == nil {
+			best = q
+		}
+		if q.Freq == cc.Prefer {
+			prefer = q
+		}
+		res = append(res, q.Freq)
+	}
+	if prefer != nil && prefer != best && prefer.Load-best.Load <= preferMargin {
+		for i, f := range res {
+			if f == prefer.Freq {
+				copy(res[1:i+1], res[:i])
+				res[0] = f
+				break
+			}
+		}
+	}
+	if len(res) == 0 {
+		return nil, errNoChannel
+	}
+	return res, nil
+}
@@ -0,0 +1,145 @@
+package wifi
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/nan"
+	"github.com/costinm/dmesh-l2/pkg/l2/nl80211"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// surveyMsg is a survey dump entry, with the times in ms.
+func surveyMsg(t *testing.T, freq, noise, active, busy int) genetlink.Message {
+	return genetlink.Message{Header: genetlink.Header{Command: nl80211.CmdNewSurveyResults, Version: 1},
+		Data: nested(t,
+			netlink.Attribute{Type: nl80211.AttrIfindex, Data: u32(3)},
+			netlink.Attribute{Type: nl80211.AttrSurveyInfo, Data: nested(t,
+				netlink.Attribute{Type: nl80211.SurveyInfoFrequency, Data: u32(freq)},
+				netlink.Attribute{Type: nl80211.SurveyInfoNoise, Data: []byte{byte(int8(noise))}},
+				netlink.Attribute{Type: nl80211.SurveyInfoTime, Data: nlenc.Uint64Bytes(uint64(active))},
+				netlink.Attribute{Type: nl80211.SurveyInfoTimeBusy, Data: nlenc.Uint64Bytes(uint64(busy))})})}
+}
+
+func TestParseSurvey(t *testing.T) {
+	s, err := parseSurvey(nested(t,
+		netlink.Attribute{Type: nl80211.SurveyInfoFrequency, Data: u32(2437)},
+		netlink.Attribute{Type: nl80211.SurveyInfoNoise, Data: []byte{0xa1}},
+		netlink.Attribute{Type: nl80211.SurveyInfoInUse, Data: []byte{}},
+		netlink.Attribute{Type: nl80211.SurveyInfoTime, Data: nlenc.Uint64Bytes(1000)},
+		netlink.Attribute{Type: nl80211.SurveyInfoTimeBusy, Data: nlenc.Uint64Bytes(250)},
+		netlink.Attribute{Type: nl80211.SurveyInfoTimeRx, Data: nlenc.Uint64Bytes(100)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Freq != 2437 || s.Noise != -95 || !s.InUse || s.Active != time.Second ||
+		s.Busy != 250*time.Millisecond || s.Rx != 100*time.Millisecond {
+		t.Error("Unexpected survey", s)
+	}
+}
+
+func TestChannelQuality(t *testing.T) {
+	prev := &SurveyInfo{Active: time.Second, Busy: 900 * time.Millisecond}
+	cur := &SurveyInfo{Active: 2 * time.Second, Busy: time.Second}
+	// Delta since the previous survey
+	if q := channelQuality(2412, cur, prev); q.Busy != 0.1 || q.Load != 0.1 {
+		t.Error("Unexpected quality", q)
+	}
+	// Radio not on the channel since - cumulative
+	if q := channelQuality(2412, cur, cur); q.Busy != 0.5 {
+		t.Error("Unexpected quality", q)
+	}
+	if q := channelQuality(2412, nil, nil); q.Busy != -1 || q.Load != loadUnknown {
+		t.Error("Unexpected quality", q)
+	}
+}
+
+func TestSelectChannels(t *testing.T) {
+	c, f := newFakeReg(t, "DE")
+	f.reply(nl80211.CmdGetSurvey,
+		surveyMsg(t, 2412, -95, 1000, 100),
+		surveyMsg(t, 2437, -92, 1000, 150),
+		surveyMsg(t, 2467, -92, 1000, 0), // NoIR
+		surveyMsg(t, 5180, -90, 1000, 500),
+	)
+	if err := c.WatchReg(); err != nil {
+		t.Fatal(err)
+	}
+	ifi := &Interface{Index: 3, PHY: 1}
+
+	ranked, err := c.RankChannels(ifi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranked) != 3 || ranked[0].Freq != 2412 || ranked[2].Freq != 5180 || ranked[0].Noise != -95 {
+		t.Fatal("Unexpected ranking", ranked)
+	}
+
+	// Channel 6 is not much busier than 1
+	freqs, err := c.SelectChannels(ifi, ChannelChoice{Band: 2, Prefer: NANFreq})
+	if err != nil || len(freqs) != 2 || freqs[0] != 2437 || freqs[1] != 2412 {
+		t.Error("Unexpected channels", freqs, err)
+	}
+
+	if freqs, err := c.SelectChannels(ifi, ChannelChoice{Band: 5}); err != nil || len(freqs) != 1 || freqs[0] != 5180 {
+		t.Error("Unexpected channels", freqs, err)
+	}
+	if freqs, err := c.SelectChannels(ifi, ChannelChoice{StaFreq: 2467, SingleChannel: true}); err == nil {
+		t.Error("Expecting station channel not usable", freqs)
+	}
+	if freqs, err := c.SelectChannels(ifi, ChannelChoice{StaFreq: 5180, SingleChannel: true}); err != nil || freqs[0] != 5180 {
+		t.Error("Unexpected channels", freqs, err)
+	}
+}
+
+// The NAN committed channel is the station channel, or the channel the
+// monitor is tuned to.
+func TestNanSelectChannels(t *testing.T) {
+	c, f := newFakeReg(t, "DE")
+	f.reply(nl80211.CmdGetSurvey,
+		surveyMsg(t, 2412, -95, 1000, 100),
+		surveyMsg(t, 2437, -92, 1000, 150),
+		surveyMsg(t, 5180, -90, 1000, 500),
+	)
+	f.reply(nl80211.CmdSetWiphy)
+	if err := c.WatchReg(); err != nil {
+		t.Fatal(err)
+	}
+	n := NewNan(c, &Interface{Index: 3, PHY: 1, Name: "wlan0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 3}})
+	defer n.Close()
+	mon := &Interface{Index: 9, PHY: 1, Name: "dmeshmon"}
+
+	if err := n.SelectChannels(ChannelChoice{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, sl := range n.Schedule.Slots {
+		if sl.Type == nan.AvailCommitted {
+			t.Error("Committed without monitor", sl)
+		}
+	}
+
+	if err := n.SelectChannels(ChannelChoice{}, mon); err != nil {
+		t.Fatal(err)
+	}
+	set := f.requests(nl80211.CmdSetWiphy)
+	if len(set) != 1 || nlenc.Uint32(set[0][nl80211.AttrWiphyFreq]) != 2437 {
+		t.Fatal("Monitor not tuned", set)
+	}
+	if sl := n.Schedule.Slots; len(sl) != 2 || sl[0].Type != nan.AvailCommitted || sl[0].Channel.Number != 6 ||
+		sl[1].Channel.Number != 36 {
+		t.Error("Expecting committed on the monitor channel", sl)
+	}
+
+	if err := n.SelectChannels(ChannelChoice{StaFreq: 2412}, mon); err != nil {
+		t.Fatal(err)
+	}
+	if sl := n.Schedule.Slots; len(sl) != 3 || sl[0].Type != nan.AvailCommitted || sl[0].Channel.Number != 1 {
+		t.Error("Expecting committed on the station channel", sl)
+	}
+	if len(f.requests(nl80211.CmdSetWiphy)) != 1 {
+		t.Error("Monitor tuned with a station")
+	}
+}
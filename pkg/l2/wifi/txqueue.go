@@ -0,0 +1,319 @@
+package wifi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/costinm/dmesh-l2/pkg/l2/capture"
+)
+
+// Frames sent with CmdFrame are queued per interface, and sent in order
+// without waiting for the previous TX status. The kernel returns a cookie
+// for each frame, and the TX status event has the same cookie and the ACK
+// flag.
+
+var (
+	// errTxQueueFull is returned when the interface TX queue is full.
+	errTxQueueFull = errors.New("nan TX queue full")
+
+	// errNoCookie is returned if the CmdFrame reply has no cookie.
+	errNoCookie = errors.New("nan frame reply without cookie")
+
+	// errClosed is returned when sending on a closed Nan.
+	errClosed = errors.New("nan closed")
+
+	// errShortFrame is returned for frames without a 802.11 header.
+	errShortFrame = errors.New("frame shorter than the 802.11 header")
+)
+
+const (
+	txQueueSize = 32
+
+	// txStatusTimeout is the max time to wait for the TX status. It
+	// typically takes <2ms, or 50-300ms when connected on a different band.
+	txStatusTimeout = time.Second
+)
+
+// TxStatus is the completion status of a frame.
+type TxStatus int
+
+const (
+	// TxAcked means the peer acknowledged the frame.
+	TxAcked TxStatus = iota
+
+	// TxSent means a multicast frame was sent - no ACK expected.
+	TxSent
+
+	// TxNoAck means the frame was sent but the peer didn't ACK.
+	TxNoAck
+
+	// TxTimeout means no TX status was received.
+	TxTimeout
+
+	// TxDropped means the frame was not sent - queue full or send error.
+	TxDropped
+)
+
+func (s TxStatus) String() string {
+	switch s {
+	case TxAcked:
+		return "acked"
+	case TxSent:
+		return "sent"
+	case TxNoAck:
+		return "noack"
+	case TxTimeout:
+		return "timeout"
+	case TxDropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// TxResult is passed to the completion callback of a frame.
+type TxResult struct {
+	Status TxStatus
+	Cookie uint64
+
+	// Latency from sending the frame to the TX status.
+	Latency time.Duration
+
+	Err error
+}
+
+// TxStats holds the send stats for a peer.
+type TxStats struct {
+	Sent, Acked, NoAck, Timeout, Dropped int
+
+	// Last and max latency of TX status.
+	Latency, MaxLatency time.Duration
+}
+
+type txFrame struct {
+	frame  []byte
+	sent   time.Time
+	freq   int
+	dwell  int
+	params *TxParams
+	done   func(TxResult)
+}
+
+type txEvent struct {
+	cookie uint64
+	acked  bool
+
+	// noStatus is set for frames sent without ACK status.
+	noStatus bool
+}
+
+// paramsDriver is implemented by drivers supporting per frame TX params -
+// the Injector.
+type paramsDriver interface {
+	TxFrameParams(ifi *Interface, frame []byte, freq, dwell int, p TxParams) (uint64, error)
+}
+
+// SendFrame queues a raw frame, starting with 802.11 type/subtype. The
+// source address and sequence number are set, on a copy of the frame.
+// done is called when the frame completes - may be nil.
+func (c *Nan) SendFrame(frame []byte, freq, dwelltime int, done func(TxResult)) error {
+	return c.sendFrame(frame, freq, dwelltime, nil, done)
+}
+
+// SendFrameParams queues a frame with the radiotap TX params - rate,
+// power, no-ack and retries. Only used if the frame is injected on the
+// monitor, see Injector.
+func (c *Nan) SendFrameParams(frame []byte, freq, dwelltime int, p TxParams, done func(TxResult)) error {
+	return c.sendFrame(frame, freq, dwelltime, &p, done)
+}
+
+func (c *Nan) sendFrame(frame []byte, freq, dwelltime int, p *TxParams, done func(TxResult)) error {
+	if len(frame) < 24 {
+		if done != nil {
+			done(TxResult{Status: TxDropped, Err: errShortFrame})
+		}
+		return errShortFrame
+	}
+	f := &txFrame{
+		frame:  append([]byte{}, frame...),
+		freq:   freq,
+		dwell:  dwelltime,
+		params: p,
+		done:   done,
+	}
+	copy(f.frame[10:], c.IFace.HardwareAddr)
+	c.m.Lock()
+	c.seq++
+	binary.LittleEndian.PutUint16(f.frame[22:], c.seq<<4)
+	c.m.Unlock()
+	select {
+	case <-c.done:
+		c.complete(f, TxResult{Status: TxDropped, Err: errClosed})
+		return errClosed
+	case c.txq <- f:
+		return nil
+	default:
+		c.complete(f, TxResult{Status: TxDropped, Err: errTxQueueFull})
+		return errTxQueueFull
+	}
+}
+
+// TxStats returns a copy of the per peer stats.
+func (c *Nan) TxStats() map[string]TxStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	res := map[string]TxStats{}
+	for k, v := range c.txStats {
+		res[k] = *v
+	}
+	return res
+}
+
+// OnTxStatus is called by the driver with the TX status of a frame.
+func (c *Nan) OnTxStatus(cookie uint64, acked bool) {
+	select {
+	case c.txEvents <- txEvent{cookie: cookie, acked: acked}:
+	default:
+		log.Println("TX: status dropped", c.IFace.Name, cookie)
+	}
+}
+
+// OnTxSent is called by the driver for a frame sent without ACK status -
+// injected frames. The frame completes as sent.
+func (c *Nan) OnTxSent(cookie uint64) {
+	select {
+	case c.txEvents <- txEvent{cookie: cookie, noStatus: true}:
+	default:
+		log.Println("TX: status dropped", c.IFace.Name, cookie)
+	}
+}
+
+// txLoop sends the queued frames without waiting for the TX status - the
+// DW frames must all go out in the 16 TU window. Statuses are matched to
+// the frames in flight by cookie, up to txQueueSize frames are in flight.
+func (c *Nan) txLoop() {
+	pending := map[uint64]*txFrame{}
+	timer := time.NewTimer(txStatusTimeout)
+	timer.Stop()
+	for {
+		txq := c.txq
+		if len(pending) >= txQueueSize {
+			txq = nil
+		}
+		select {
+		case f := <-txq:
+			c.txSend(f, pending)
+		case ev := <-c.txEvents:
+			// Events for frames that timed out are ignored.
+			f := pending[ev.cookie]
+			if f == nil {
+				continue
+			}
+			delete(pending, ev.cookie)
+			res := TxResult{Cookie: ev.cookie, Latency: time.Since(f.sent)}
+			if ev.acked {
+				res.Status = TxAcked
+			} else if ev.noStatus || f.frame[4]&1 == 1 {
+				res.Status = TxSent
+			} else {
+				res.Status = TxNoAck
+			}
+			c.complete(f, res)
+		case <-timer.C:
+			now := time.Now()
+			for cookie, f := range pending {
+				if now.Sub(f.sent) >= txStatusTimeout {
+					delete(pending, cookie)
+					c.complete(f, TxResult{Status: TxTimeout, Cookie: cookie})
+				}
+			}
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+
+		// The timer fires when the oldest frame in flight times out.
+		timer.Stop()
+		var oldest time.Time
+		for _, f := range pending {
+			if oldest.IsZero() || f.sent.Before(oldest) {
+				oldest = f.sent
+			}
+		}
+		if !oldest.IsZero() {
+			timer.Reset(time.Until(oldest.Add(txStatusTimeout)))
+		}
+	}
+}
+
+// txSend sends a frame, and adds it to the frames waiting for TX status.
+func (c *Nan) txSend(f *txFrame, pending map[uint64]*txFrame) {
+	f.sent = time.Now()
+	var cookie uint64
+	var err error
+	if pd, ok := c.drv.(paramsDriver); ok && f.params != nil {
+		cookie, err = pd.TxFrameParams(c.IFace, f.frame, f.freq, f.dwell, *f.params)
+	} else {
+		cookie, err = c.drv.TxFrame(c.IFace, f.frame, f.freq, f.dwell)
+	}
+	if err != nil {
+		log.Println("TX: send error", c.IFace.Name, err)
+		c.complete(f, TxResult{Status: TxDropped, Err: err})
+		return
+	}
+	pending[cookie] = f
+}
+
+// complete updates the peer stats and calls the completion callback.
+func (c *Nan) complete(f *txFrame, res TxResult) {
+	to := net.HardwareAddr(f.frame[4:10]).String()
+
+	c.m.Lock()
+	st := c.txStats[to]
+	if st == nil {
+		st = &TxStats{}
+		c.txStats[to] = st
+	}
+	switch res.Status {
+	case TxAcked, TxSent:
+		st.Acked++
+	case TxNoAck:
+		st.NoAck++
+	case TxTimeout:
+		st.Timeout++
+	case TxDropped:
+		st.Dropped++
+		c.SendErrors++
+	}
+	if res.Status != TxDropped {
+		st.Sent++
+	}
+	if res.Latency > 0 {
+		st.Latency = res.Latency
+		if res.Latency > st.MaxLatency {
+			st.MaxLatency = res.Latency
+		}
+	}
+	c.m.Unlock()
+
+	if res.Status != TxAcked && res.Status != TxSent {
+		log.Println("TX: ", c.IFace.Name, to, res.Status, res.Latency)
+	}
+	if c.Recorder.Enabled() {
+		ts := f.sent
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		comment := fmt.Sprintf("status=%v cookie=%d latency=%v", res.Status, res.Cookie, res.Latency)
+		if res.Err != nil {
+			comment += " err=" + res.Err.Error()
+		}
+		c.Recorder.Record(c.IFace.Name, capture.Out, f.freq, 0, f.frame, ts, comment)
+	}
+	if f.done != nil {
+		f.done(res)
+	}
+}
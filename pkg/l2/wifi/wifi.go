@@ -166,6 +166,11 @@ type StationInfo struct {
 
 	// The number of times a beacon loss was detected.
 	BeaconLoss int
+
+	// PeerLink is the peer link state, for mesh peers. Mesh is set if
+	// the state was reported.
+	PeerLink PeerLinkState
+	Mesh     bool
 }
 
 // A BSS is an 802.11 basic service set.  It contains information about a wireless
@@ -190,6 +195,16 @@ type BSS struct {
 
 	// The status of the client within the BSS.
 	Status BSSStatus
+
+	// Signal strength of the last beacon or probe response, in dBm.
+	Signal int
+
+	// Capability information field - ESS, IBSS, privacy.
+	Capability uint16
+
+	// IEs are the raw information elements from the last beacon or probe
+	// response.
+	IEs []byte
 }
 
 // A BSSStatus indicates the current status of client within a BSS.
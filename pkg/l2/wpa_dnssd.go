@@ -175,7 +175,7 @@ func parseDns(dnsData []byte) map[string]string {
 			break
 		}
 		slen := int(dnsData[off])
-		if slen == 0 || (int(off+slen) > int(len(dnsData))) {
+		if slen == 0 || (int(off+1+slen) > int(len(dnsData))) {
 			break
 		}
 		off++
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/costinm/dmesh-l2/pkg/l2/wifi"
 	mesh "github.com/costinm/dmesh-l2/pkg/l2api"
 
 	//"github.com/costinm/dmesh/dm/mesh"
@@ -420,10 +421,21 @@ func (c *WifiInterface) APStart() {
 		log.Println("Error P2P_SET postfix", err, res)
 		return
 	}
-	res, err = c.SendCommandP2P("P2P_GROUP_ADD persistent freq=2437")
-	if err == nil {
+	freqs, err := c.wpa.l2.apFreqs(c.Interface)
+	if err != nil {
+		log.Println("AP: not started", c.Interface, err)
 		return
 	}
+	for i, freq := range freqs {
+		if i >= apFreqTries {
+			break
+		}
+		res, err = c.SendCommandP2P("P2P_GROUP_ADD persistent freq=" + strconv.Itoa(freq))
+		if err == nil {
+			return
+		}
+		log.Println("AP: P2P_GROUP_ADD failed", freq, err, res)
+	}
 	res, err = c.SendCommandP2P("P2P_GROUP_ADD persistent")
 	if err != nil {
 		res, err = c.SendCommandP2P("P2P_GROUP_ADD")
@@ -435,6 +447,76 @@ func (c *WifiInterface) APStart() {
 
 }
 
+var (
+	errNoConcurrentAP = errors.New("P2P GO not supported while connected")
+	errNoFreq         = errors.New("no frequency allowed for AP")
+)
+
+// apFreqTries is the number of ranked channels tried before letting
+// wpa_supplicant pick.
+const apFreqTries = 3
+
+// apFreqs returns the frequencies for the P2P group on the interface, best
+// first. The least loaded 2.4GHz channel is used - channel 6 if not much
+// worse, same as NAN - or the station channel if the radio can't use 2
+// channels. Without phy capabilities channel 6 is used.
+func (l2 *L2) apFreqs(name string) ([]int, error) {
+	if l2 == nil {
+		return []int{2437}, nil
+	}
+	var ifi *wifi.Interface
+	for _, i := range l2.actWifi {
+		if i.Name == name {
+			ifi = i
+		}
+	}
+	if ifi == nil {
+		return []int{2437}, nil
+	}
+	p := l2.phy(ifi.PHY)
+	if p == nil {
+		return []int{2437}, nil
+	}
+
+	cc := l2.channelChoice(ifi, false)
+	if cc.StaFreq != 0 {
+		if _, ok := p.Concurrent(wifi.InterfaceTypeStation, wifi.InterfaceTypeP2PGroupOwner); !ok {
+			return nil, errNoConcurrentAP
+		}
+	}
+	if l2.netLinkWifi != nil {
+		cc.Band = 2
+		cc.Prefer = wifi.NANFreq
+		freqs, err := l2.netLinkWifi.SelectChannels(ifi, cc)
+		if err == nil || cc.SingleChannel {
+			return freqs, err
+		}
+		log.Println("AP: channel ranking failed", ifi.Name, err)
+		// The regulatory domain, if loaded, has the power limits and
+		// country rules - the phy only the channel flags.
+		if l2.netLinkWifi.Reg(ifi.PHY) != nil {
+			f, err := l2.netLinkWifi.AdjustFreq(ifi.PHY, wifi.NANFreq)
+			return []int{f}, err
+		}
+	} else if cc.SingleChannel {
+		return []int{cc.StaFreq}, nil
+	}
+
+	if p.CanTransmit(2437) {
+		return []int{2437}, nil
+	}
+	freqs := p.Frequencies()
+	for _, f := range freqs {
+		if f < 3000 {
+			return []int{f}, nil
+		}
+	}
+	if len(freqs) > 0 {
+		return freqs[:1], nil
+	}
+	return nil, errNoFreq
+}
+
 func (c *WifiInterface) Status() map[string]string {
 	s, err := c.SendCommand("STATUS")
 	if err != nil {
@@ -97,6 +97,52 @@ type MeshDevice struct {
 
 	// Only on supplicant, not on android. Will change when the DNS-SD data changes.
 	ServiceUpdateInd int `json:"sui,omitempty"`
+
+	// Link to the device, if it is connected to our AP, GO or mesh.
+	Link *LinkStats `json:"link,omitempty"`
+
+	// Mesh is the 802.11s path to the device, if it is a mesh node.
+	Mesh *MeshRoute `json:"mesh,omitempty"`
+}
+
+// MeshRoute is the path to a node of the 802.11s mesh, sent on
+// "/wifi/mesh/path" messages.
+type MeshRoute struct {
+	// Iface is the local mesh interface.
+	Iface string `json:"iface,omitempty"`
+
+	// Via is the next hop - the same as the device MAC for a peer.
+	Via string `json:"via,omitempty"`
+
+	// Metric is the airtime metric of the path - lower is better.
+	Metric int `json:"metric,omitempty"`
+}
+
+// LinkStats are the stats of a device connected to our AP, GO or mesh,
+// sent on "/wifi/sta" messages when the link quality changes.
+type LinkStats struct {
+	// Iface is the local interface the device is connected to.
+	Iface string `json:"iface,omitempty"`
+
+	// Signal of the last frame from the device, in dBm.
+	Signal int `json:"sig,omitempty"`
+
+	// Bitrates in kbps.
+	RxRate int `json:"rx,omitempty"`
+	TxRate int `json:"tx,omitempty"`
+
+	// Ratio of retries and failures to sent packets, since the last poll.
+	Retries  float64 `json:"retry,omitempty"`
+	Failures float64 `json:"fail,omitempty"`
+
+	// Inactive time in ms.
+	Inactive int64 `json:"idle,omitempty"`
+
+	// Quality is good, fair or poor.
+	Quality string `json:"q,omitempty"`
+
+	// PeerLink is the peering state, for mesh peers.
+	PeerLink string `json:"plink,omitempty"`
 }
 
 func (md *MeshDevice) String() string { return fmt.Sprintf("%s/%d", md.SSID, md.Level) }